@@ -0,0 +1,69 @@
+package main
+
+import "fmt"
+
+// pseudonym returns the stable pseudonym of a table, column or schema
+// name: its kind and 12 hex digits of the name's keyed hash. The same name
+// gets the same pseudonym wherever it appears, so a column shared by
+// tables, or a foreign key and the column it references, still match.
+func pseudonym(kind, name string, key hashKey) string {
+	return fmt.Sprintf("%s_%012x", kind, uint64(key.sum(name))>>16)
+}
+
+// anonymizeSchema returns the schema with the names of the dataset, its
+// tables and schemas and their columns replaced by pseudonyms, keeping
+// only what describes the shape of the data: types, encodings, keys,
+// nullability and sizes. Example values, enum labels, fill values,
+// profiles and statistics, filters and query SQL, and the source's
+// connection details are left out.
+func anonymizeSchema(schema SchemaDetails, key hashKey) SchemaDetails {
+	anon := SchemaDetails{
+		DatasetMetadata: DatasetMetadata{
+			DatasetName: pseudonym("dataset", schema.DatasetMetadata.DatasetName, key),
+			SourceType:  schema.DatasetMetadata.SourceType,
+		},
+		Tables: []TableMetadata{},
+	}
+	name := func(kind string, s *string) *string {
+		if s == nil {
+			return nil
+		}
+		p := pseudonym(kind, *s, key)
+		return &p
+	}
+	for _, table := range schema.Tables {
+		t := TableMetadata{
+			TableName:     pseudonym("table", table.TableName, key),
+			Kind:          table.Kind,
+			EstimatedRows: table.EstimatedRows,
+			ExactRows:     table.ExactRows,
+			SizeBytes:     table.SizeBytes,
+			Fields:        []FieldMetadata{},
+		}
+		if table.SourceTable != "" {
+			t.SourceTable = pseudonym("table", table.SourceTable, key)
+		}
+		if table.Schema != "" && table.Schema != defaultSchema {
+			t.Schema = pseudonym("schema", table.Schema, key)
+		}
+		for _, field := range table.Fields {
+			t.Fields = append(t.Fields, FieldMetadata{
+				FieldName:           pseudonym("column", field.FieldName, key),
+				DataType:            field.DataType,
+				IsPrimaryKey:        field.IsPrimaryKey,
+				IsForeignKey:        field.IsForeignKey,
+				IsNullable:          field.IsNullable,
+				ReferencedTable:     name("table", field.ReferencedTable),
+				ReferencedField:     name("column", field.ReferencedField),
+				TransformedFeatures: []string{},
+				Encoding:            field.Encoding,
+				IsPII:               field.IsPII,
+				Precision:           field.Precision,
+				Scale:               field.Scale,
+				ElementType:         field.ElementType,
+			})
+		}
+		anon.Tables = append(anon.Tables, t)
+	}
+	return anon
+}
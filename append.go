@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// appendColumn describes a column added to an exported table by the
+// append-column command.
+type appendColumn struct {
+	Name string
+	// Values and Mask are .npy files, Mask empty for a column without
+	// nulls.
+	Values string
+	Mask   string
+	// Transform is recorded in the column's transformed_features.
+	Transform string
+	// Replace allows replacing a column the table already has.
+	Replace bool
+}
+
+// runAppendColumn implements the `append-column` command:
+//
+//	append-column [-name <column>] [-mask <mask.npy>] [-transform <name>] [-replace] <table.npz> <values.npy>
+func runAppendColumn(args []string) {
+	fs := flag.NewFlagSet("append-column", flag.ExitOnError)
+	var column appendColumn
+	fs.StringVar(&column.Name, "name", "", "name of the column (default: the name of the .npy file)")
+	fs.StringVar(&column.Mask, "mask", "", ".npy file of the column's boolean null mask, true for nulls")
+	fs.StringVar(&column.Transform, "transform", "", "name of the transform that computed the column, recorded in its transformed_features")
+	fs.BoolVar(&column.Replace, "replace", false, "replace the column if the table already has it")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatalf("usage: append-column [flags] <table.npz> <values.npy>")
+	}
+	column.Values = fs.Arg(1)
+	if column.Name == "" {
+		column.Name = trimExt(filepath.Base(column.Values))
+	}
+	field, err := appendNpzColumn(fs.Arg(0), column)
+	if err != nil {
+		log.Fatalf("failed to append column %s: %v", column.Name, err)
+	}
+	log.Printf("Appended the %s column %s to %s", field.DataType, field.FieldName, fs.Arg(0))
+}
+
+// appendNpzColumn adds a column to the NPZ archive of an exported table,
+// copying its other arrays without decompressing them, and records it in
+// the archive's embedded metadata and in the export's metadata next to the
+// archive. It returns the column's metadata.
+func appendNpzColumn(path string, column appendColumn) (FieldMetadata, error) {
+	// Double underscores mark the companion arrays of columns.
+	if column.Name == "" || strings.Contains(column.Name, "__") {
+		return FieldMetadata{}, fmt.Errorf("invalid column name %q", column.Name)
+	}
+	r, err := npz.Open(path)
+	if err != nil {
+		return FieldMetadata{}, err
+	}
+	rows, hasRows := npzRowCount(r)
+	exists := slices.Contains(npzColumnNames(r), column.Name)
+	r.Close()
+	if exists && !column.Replace {
+		return FieldMetadata{}, fmt.Errorf("%s already has a column %s, use -replace to replace it", path, column.Name)
+	}
+
+	hdr, err := readNpyHeader(column.Values)
+	if err != nil {
+		return FieldMetadata{}, err
+	}
+	dataType, ok := npyDataType(hdr.Descr.Type)
+	if !ok {
+		return FieldMetadata{}, fmt.Errorf("unsupported dtype %q of %s", hdr.Descr.Type, column.Values)
+	}
+	if len(hdr.Descr.Shape) != 1 || hdr.Descr.Fortran {
+		return FieldMetadata{}, fmt.Errorf("%s has shape %v, expected one dimension", column.Values, hdr.Descr.Shape)
+	}
+	if hasRows && hdr.Descr.Shape[0] != rows {
+		return FieldMetadata{}, fmt.Errorf("%s has %d values, the table has %d rows", column.Values, hdr.Descr.Shape[0], rows)
+	}
+	arrays := map[string]string{column.Name: column.Values}
+	if column.Mask != "" {
+		mask, err := readNpyHeader(column.Mask)
+		if err != nil {
+			return FieldMetadata{}, err
+		}
+		if mask.Descr.Type != "|b1" || len(mask.Descr.Shape) != 1 || mask.Descr.Shape[0] != hdr.Descr.Shape[0] {
+			return FieldMetadata{}, fmt.Errorf("%s is a %s array of shape %v, expected |b1 of shape %v", column.Mask, mask.Descr.Type, mask.Descr.Shape, hdr.Descr.Shape)
+		}
+		arrays[column.Name+maskSuffix] = column.Mask
+	}
+
+	field := FieldMetadata{FieldName: column.Name, DataType: dataType, IsNullable: column.Mask != ""}
+	if column.Transform != "" {
+		field.TransformedFeatures = []string{column.Transform}
+	}
+	stored, err := storedNpz(path)
+	if err != nil {
+		return FieldMetadata{}, err
+	}
+	tmp := path + ".append"
+	if err := writeNpyFiles(tmp, arrays, stored); err != nil {
+		return FieldMetadata{}, err
+	}
+	defer os.Remove(tmp)
+	if err := replaceArrays(path, tmp, []FieldMetadata{field}); err != nil {
+		return FieldMetadata{}, err
+	}
+
+	if err := appendToMetadata(path, field); err != nil {
+		return field, fmt.Errorf("updating the metadata: %w", err)
+	}
+	return field, nil
+}
+
+// appendToMetadata records a column appended to the archive at path in the
+// metadata of the export the archive is in, single or split. Archives
+// without one are left as they are.
+func appendToMetadata(path string, field FieldMetadata) error {
+	dir := filepath.Dir(path)
+	table := trimExt(filepath.Base(path))
+	layout := metadataSingle
+	if _, err := os.Stat(filepath.Join(dir, metadataPath(metadataSingle))); os.IsNotExist(err) {
+		layout = metadataSplit
+		if _, err := os.Stat(filepath.Join(dir, metadataPath(metadataSplit))); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	metadata, err := readMetadata(filepath.Join(dir, metadataPath(layout)))
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(metadata.Tables, func(t TableMetadata) bool { return t.TableName == table })
+	if i < 0 {
+		return fmt.Errorf("the metadata has no table %s", table)
+	}
+	metadata.Tables[i].Fields = patchedFields(metadata.Tables[i].Fields, []FieldMetadata{field})
+	// Appending moves the arrays of an uncompressed archive.
+	if metadata.Tables[i].Arrays, err = npzLayout(path); err != nil {
+		return err
+	}
+	if metadata.Header != nil {
+		if metadata.Header.SchemaHash, err = schemaHash(metadata.Tables); err != nil {
+			return err
+		}
+	}
+	_, err = writeMetadata(dir, layout, metadata)
+	return err
+}
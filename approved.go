@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// loadApprovedSchema reads the metadata of an earlier export, given as its
+// metadata.json or, for the split layout, its metadata/index.json, and
+// returns its tables by name.
+func loadApprovedSchema(path string) (map[string]TableMetadata, error) {
+	schema, err := readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]TableMetadata, len(schema.Tables))
+	for _, table := range schema.Tables {
+		tables[table.TableName] = table
+	}
+	return tables, nil
+}
+
+// readMetadata reads the metadata of an export from its metadata.json or,
+// for the split layout, from its metadata/index.json and the table files it
+// lists.
+func readMetadata(path string) (SchemaDetails, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return SchemaDetails{}, err
+	}
+	var schema SchemaDetails
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return SchemaDetails{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if schema.Tables != nil {
+		return schema, nil
+	}
+
+	var index MetadataIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return SchemaDetails{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	schema.Header, schema.DatasetMetadata = index.Header, index.DatasetMetadata
+	// Index paths are relative to the output directory.
+	outDir := filepath.Dir(filepath.Dir(path))
+	for _, entry := range index.Tables {
+		tb, err := os.ReadFile(filepath.Join(outDir, entry.Path))
+		if err != nil {
+			return SchemaDetails{}, err
+		}
+		var table TableMetadata
+		if err := json.Unmarshal(tb, &table); err != nil {
+			return SchemaDetails{}, fmt.Errorf("parsing %s: %w", entry.Path, err)
+		}
+		schema.Tables = append(schema.Tables, table)
+	}
+	return schema, nil
+}
+
+// checkApprovedSchema keeps only the columns of the live tables that the
+// approved schema has and checks that the columns the export writes, after
+// the column transforms, still match it: the same tables and columns, data
+// types, decimal sizes and element types, and no column that became
+// nullable. It returns every mismatch.
+func checkApprovedSchema(live []TableMetadata, approved map[string]TableMetadata, cfg ExportConfig, rates map[string]float64, dims map[string]*dimension, key hashKey) ([]TableMetadata, error) {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, table := range live {
+		seen[table.TableName] = true
+		a, ok := approved[table.TableName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("table %s is not in the approved schema", table.TableName))
+			continue
+		}
+		approvedFields := make(map[string]FieldMetadata, len(a.Fields))
+		for _, field := range a.Fields {
+			approvedFields[field.FieldName] = field
+		}
+
+		var fields []FieldMetadata
+		for _, field := range table.Fields {
+			if _, ok := approvedFields[field.FieldName]; ok {
+				fields = append(fields, field)
+			}
+		}
+		live[i].Fields = fields
+
+		// Transforms add and retype columns, so compare what is written.
+		data := &TableData{TableName: table.TableName, Columns: slices.Clone(fields)}
+		if _, err := newRowTransforms(data, cfg.transforms(table.TableName), cfg.Currency.Base, rates, dims, key, cfg.FreezeVocabulary); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := cfg.nullFilter(data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		columns := make(map[string]FieldMetadata, len(data.Columns))
+		for _, col := range data.Columns {
+			columns[col.FieldName] = col
+			if _, ok := approvedFields[col.FieldName]; !ok {
+				errs = append(errs, fmt.Errorf("column %s.%s is not in the approved schema", table.TableName, col.FieldName))
+			}
+		}
+		for _, want := range a.Fields {
+			got, ok := columns[want.FieldName]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Errorf("column %s.%s no longer exists", table.TableName, want.FieldName))
+			case got.DataType != want.DataType || got.ElementType != want.ElementType:
+				errs = append(errs, fmt.Errorf("column %s.%s is %s, approved as %s", table.TableName, want.FieldName, typeName(got), typeName(want)))
+			case got.Precision != want.Precision || got.Scale != want.Scale:
+				errs = append(errs, fmt.Errorf("column %s.%s is decimal(%d,%d), approved as decimal(%d,%d)",
+					table.TableName, want.FieldName, got.Precision, got.Scale, want.Precision, want.Scale))
+			case got.IsNullable && !want.IsNullable:
+				errs = append(errs, fmt.Errorf("column %s.%s became nullable", table.TableName, want.FieldName))
+			}
+		}
+	}
+	var missing []string
+	for name := range approved {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	slices.Sort(missing)
+	for _, name := range missing {
+		errs = append(errs, fmt.Errorf("approved table %s is not selected or no longer exists", name))
+	}
+	return live, errors.Join(errs...)
+}
+
+// typeName describes a column's data type, with the element type of arrays.
+func typeName(field FieldMetadata) string {
+	if field.ElementType != "" {
+		return field.DataType + "<" + field.ElementType + ">"
+	}
+	return field.DataType
+}
+
+// useApprovedEncodings gives the columns the encodings of the approved
+// schema, so dictionary encoding isn't decided anew.
+func useApprovedEncodings(columns []FieldMetadata, approved []FieldMetadata) {
+	for i, col := range columns {
+		for _, field := range approved {
+			if field.FieldName == col.FieldName && col.Encoding == "" && field.Encoding != EncodingSharedDictionary {
+				columns[i].Encoding = field.Encoding
+			}
+		}
+	}
+}
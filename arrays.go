@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+
+	"github.com/lib/pq"
+	"github.com/sbinet/npyio/npz"
+)
+
+// parseArray parses a one-dimensional PostgreSQL array in its text form
+// into its elements, typed after elementType, with nil for null elements.
+func parseArray(src interface{}, elementType string) ([]interface{}, error) {
+	switch elementType {
+	case DataTypeInt:
+		return scanArray[sql.NullInt64](src)
+	case DataTypeFloat:
+		return scanArray[sql.NullFloat64](src)
+	case DataTypeBool:
+		return scanArray[sql.NullBool](src)
+	default:
+		return scanArray[sql.NullString](src)
+	}
+}
+
+func scanArray[T driver.Valuer](src interface{}) ([]interface{}, error) {
+	var elements []T
+	if err := pq.Array(&elements).Scan(src); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(elements))
+	for i, e := range elements {
+		values[i], _ = e.Value()
+	}
+	return values, nil
+}
+
+// arrayElementKind returns the columnBuffer kind of the values array of a
+// ragged column.
+func arrayElementKind(elementType string) byte {
+	switch elementType {
+	case DataTypeInt:
+		return kindInt64
+	case DataTypeFloat:
+		return kindFloat64
+	case DataTypeBool:
+		return kindBool
+	}
+	return kindString
+}
+
+// appendRagged appends the elements of an array value, or the bytes of a
+// binary value, to the values buffer of a ragged column and its end to the
+// offsets buffer. Nulls, both whole arrays and elements, can't be stored:
+// a null array is empty and null elements are zero values.
+func appendRagged(values, offsets *columnBuffer, value interface{}) {
+	if values.kind == kindUint8 {
+		b, _ := binaryValue(value)
+		values.appendBytes(b)
+		offsets.appendInt64(int64(values.count))
+		return
+	}
+	elements, _ := value.([]interface{})
+	for _, e := range elements {
+		switch values.kind {
+		case kindInt64:
+			v, _ := e.(int64)
+			values.appendInt64(v)
+		case kindFloat64:
+			v, _ := e.(float64)
+			values.appendFloat64(v)
+		case kindBool:
+			v, _ := e.(bool)
+			values.appendBool(v)
+		default:
+			var s string
+			if e != nil {
+				s = fmt.Sprintf("%v", e)
+			}
+			values.appendString(s)
+		}
+	}
+	offsets.appendInt64(int64(values.count))
+}
+
+// readRaggedColumn reads a ragged column as one []interface{} per row, or
+// returns ok false if name has no offsets array.
+func readRaggedColumn(r *npz.Reader, name string) (rows []interface{}, ok bool, err error) {
+	offsets, err := readNpzColumn(r, name+offsetsSuffix)
+	if err != nil {
+		return nil, false, nil
+	}
+	column, err := readNpzColumn(r, name)
+	if err != nil {
+		return nil, true, err
+	}
+	ends, _ := offsets.([]int64)
+	values := reflect.ValueOf(column)
+	for i := 1; i < len(ends); i++ {
+		if ends[i-1] > ends[i] || ends[i] > int64(values.Len()) {
+			return nil, true, fmt.Errorf("invalid offsets of %s", name)
+		}
+		elements := make([]interface{}, 0, ends[i]-ends[i-1])
+		for j := ends[i-1]; j < ends[i]; j++ {
+			elements = append(elements, values.Index(int(j)).Interface())
+		}
+		rows = append(rows, elements)
+	}
+	return rows, true, nil
+}
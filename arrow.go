@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// arrowBatchRows and arrowBatchBytes bound the rows buffered per record
+	// batch before it is written out.
+	arrowBatchRows  = 1 << 16
+	arrowBatchBytes = 64 << 20
+
+	arrowMagic = "ARROW1"
+	// arrowMetadataV5 is the IPC metadata version written.
+	arrowMetadataV5 = 4
+)
+
+// Arrow IPC message header types.
+const (
+	arrowSchemaMessage     = 1
+	arrowDictionaryMessage = 2
+	arrowRecordBatch       = 3
+)
+
+// Arrow type union members.
+const (
+	arrowTypeInt             = 2
+	arrowTypeFloatingPoint   = 3
+	arrowTypeBinary          = 4
+	arrowTypeUtf8            = 5
+	arrowTypeBool            = 6
+	arrowTypeDecimal         = 7
+	arrowTypeDate            = 8
+	arrowTypeTime            = 9
+	arrowTypeTimestamp       = 10
+	arrowTypeFixedSizeBinary = 15
+)
+
+// arrowDecimalMaxPrecision is the largest precision a Decimal256 holds;
+// decimals beyond it are written as doubles.
+const arrowDecimalMaxPrecision = 76
+
+// arrowWriter writes a table as an Arrow IPC file (Feather v2) from batches
+// of rows. Rows are buffered per column and written as record batches, so
+// memory is bounded by the batch size. Dictionary encoded columns use Arrow
+// dictionaries, extended with delta dictionary batches as new values
+// appear.
+type arrowWriter struct {
+	path      string
+	tableName string
+	f         io.WriteCloser
+	w         *bufio.Writer
+	// stream is set to write the IPC streaming format, without the file's
+	// magic and footer, to a pipe.
+	stream  bool
+	offset  int64
+	columns []*arrowColumn
+	schema  fbTable
+
+	dictionaries []arrowBlock
+	batches      []arrowBlock
+	rows         int
+	stats        *chunkStatsBuilder
+}
+
+// arrowBlock locates a message in the file, for the footer.
+type arrowBlock struct {
+	offset         int64
+	metadataLength int32
+	bodyLength     int64
+}
+
+// arrowColumn buffers the values of one column for the current record
+// batch.
+type arrowColumn struct {
+	field    FieldMetadata
+	id       int64
+	typeID   uint8
+	typ      fbTable
+	width    int
+	nullable bool
+
+	validity []byte
+	nulls    int
+	n        int
+	// values holds fixed-width values, the bits of booleans or the bytes
+	// of strings, which end at the entries of offsets.
+	values  []byte
+	offsets []byte
+	dict    *dictionaryBuilder
+	// written is the number of dictionary values already written.
+	written int
+	// invalid counts the values that could not be converted to the
+	// column's type and were written as nulls.
+	invalid int
+}
+
+// newArrowWriter creates the Arrow IPC file of a table at path and writes
+// its schema. The columns' data types and encodings must be final.
+func newArrowWriter(path, tableName string, columns []FieldMetadata) (*arrowWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &arrowWriter{path: path, tableName: tableName, f: f}
+	return w, w.start(columns)
+}
+
+// newArrowStreamWriter writes a table to f as an Arrow IPC stream,
+// starting with its schema.
+func newArrowStreamWriter(f io.WriteCloser, tableName string, columns []FieldMetadata) (*arrowWriter, error) {
+	w := &arrowWriter{tableName: tableName, f: f, stream: true}
+	return w, w.start(columns)
+}
+
+// start writes the schema, after the file's magic.
+func (w *arrowWriter) start(columns []FieldMetadata) error {
+	w.w = bufio.NewWriter(w.f)
+	w.stats = newChunkStatsBuilder(columns)
+	var fields fbTables
+	for i, field := range columns {
+		c := newArrowColumn(field, int64(i))
+		w.columns = append(w.columns, c)
+		fields = append(fields, c.schemaField())
+	}
+	w.schema = fbTable{0: fbInt16(0), 1: fields}
+
+	if !w.stream {
+		magic := append([]byte(arrowMagic), 0, 0)
+		if err := w.write(magic); err != nil {
+			w.discard()
+			return err
+		}
+	}
+	if _, err := w.writeMessage(arrowSchemaMessage, w.schema, nil); err != nil {
+		w.discard()
+		return err
+	}
+	return nil
+}
+
+func newArrowColumn(field FieldMetadata, id int64) *arrowColumn {
+	c := &arrowColumn{field: field, id: id, nullable: field.IsNullable}
+	isDecimal := field.DataType == DataTypeFloat && field.Precision > 0 && field.Precision <= arrowDecimalMaxPrecision
+	switch {
+	case field.Encoding == EncodingHash, field.DataType == DataTypeInt:
+		c.typeID, c.typ, c.width = arrowTypeInt, fbTable{0: fbInt32(64), 1: fbBool(true)}, 8
+	case isDecimal:
+		bitWidth := 128
+		if field.Precision > 38 {
+			bitWidth = 256
+		}
+		c.typeID, c.width = arrowTypeDecimal, bitWidth/8
+		c.typ = fbTable{0: fbInt32(int32(field.Precision)), 1: fbInt32(int32(field.Scale)), 2: fbInt32(int32(bitWidth))}
+	case field.DataType == DataTypeFloat:
+		c.typeID, c.typ, c.width = arrowTypeFloatingPoint, fbTable{0: fbInt16(2)}, 8
+	case field.DataType == DataTypeBool:
+		c.typeID, c.typ = arrowTypeBool, fbTable{}
+	case field.DataType == DataTypeTime:
+		// Microseconds in UTC.
+		c.typeID, c.typ, c.width = arrowTypeTimestamp, fbTable{0: fbInt16(2), 1: fbString("UTC")}, 8
+	case field.DataType == DataTypeTimeOfDay:
+		// 64-bit microseconds since midnight.
+		c.typeID, c.typ, c.width = arrowTypeTime, fbTable{0: fbInt16(2), 1: fbInt32(64)}, 8
+	case field.DataType == DataTypeDate:
+		// Days since the epoch.
+		c.typeID, c.typ, c.width = arrowTypeDate, fbTable{0: fbInt16(0)}, 4
+	case field.DataType == DataTypeUUID:
+		c.typeID, c.typ, c.width = arrowTypeFixedSizeBinary, fbTable{0: fbInt32(16)}, 16
+	case field.DataType == DataTypeBytes:
+		c.typeID, c.typ = arrowTypeBinary, fbTable{}
+	default:
+		c.typeID, c.typ = arrowTypeUtf8, fbTable{}
+		if field.Encoding == EncodingDictionary && field.DataType == DataTypeString {
+			c.dict = newDictionaryBuilder(field.EnumValues...)
+			c.width = 4
+		}
+	}
+	return c
+}
+
+// schemaField describes the column in the schema.
+func (c *arrowColumn) schemaField() fbTable {
+	field := fbTable{
+		0: fbString(c.field.FieldName),
+		1: fbBool(c.nullable),
+		2: fbUint8(c.typeID),
+		3: c.typ,
+		5: fbTables{},
+	}
+	if c.dict != nil {
+		field[4] = fbTable{
+			0: fbInt64(c.id),
+			1: fbTable{0: fbInt32(32), 1: fbBool(true)},
+		}
+	}
+	if c.typeID == arrowTypeFixedSizeBinary {
+		field[6] = arrowKeyValues(map[string][]byte{
+			"ARROW:extension:name":     []byte("arrow.uuid"),
+			"ARROW:extension:metadata": nil,
+		})
+	}
+	if c.field.DataType == DataTypeJSON || c.field.DataType == DataTypeArray {
+		field[6] = arrowKeyValues(map[string][]byte{
+			"ARROW:extension:name":     []byte("arrow.json"),
+			"ARROW:extension:metadata": nil,
+		})
+	}
+	return field
+}
+
+// arrowKeyValues encodes custom metadata, sorted by key.
+func arrowKeyValues(entries map[string][]byte) fbTables {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make(fbTables, len(keys))
+	for i, k := range keys {
+		kvs[i] = fbTable{0: fbString(k), 1: fbString(entries[k])}
+	}
+	return kvs
+}
+
+func (w *arrowWriter) write(p []byte) error {
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return err
+}
+
+// writeMessage writes an encapsulated IPC message: the continuation
+// marker, the metadata length, the padded metadata and the body.
+func (w *arrowWriter) writeMessage(headerType uint8, header fbTable, body []byte) (arrowBlock, error) {
+	block := arrowBlock{offset: w.offset, bodyLength: int64(len(body))}
+	metadata := fbFinish(fbTable{
+		0: fbInt16(arrowMetadataV5),
+		1: fbUint8(headerType),
+		2: header,
+		3: fbInt64(int64(len(body))),
+	})
+	for (8+len(metadata))%8 != 0 {
+		metadata = append(metadata, 0)
+	}
+	block.metadataLength = int32(8 + len(metadata))
+
+	prefix := binary.LittleEndian.AppendUint32(nil, 0xFFFFFFFF)
+	prefix = binary.LittleEndian.AppendUint32(prefix, uint32(len(metadata)))
+	for _, p := range [][]byte{prefix, metadata, body} {
+		if err := w.write(p); err != nil {
+			return block, err
+		}
+	}
+	return block, nil
+}
+
+// writeRows buffers a batch of rows, writing out record batches as they
+// fill until ctx is canceled.
+func (w *arrowWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	for _, row := range rows {
+		for _, c := range w.columns {
+			c.append(row[c.field.FieldName])
+		}
+		w.stats.add(row)
+		w.rows++
+		if w.rows >= arrowBatchRows || w.rows%1024 == 0 && w.bufferedBytes() >= arrowBatchBytes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := w.flushBatch(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *arrowWriter) bufferedBytes() int {
+	n := 0
+	for _, c := range w.columns {
+		n += len(c.values) + len(c.offsets) + len(c.validity)
+	}
+	return n
+}
+
+// append converts a value to the column's type and buffers it. Nulls in
+// non-nullable columns are written as zero values, as the NPZ writer does.
+func (c *arrowColumn) append(value interface{}) {
+	valid := value != nil && c.appendValue(value)
+	if value != nil && !valid {
+		c.invalid++
+	}
+	if !valid {
+		c.appendZero()
+		if c.nullable {
+			c.nulls++
+		}
+	}
+
+	if c.n%8 == 0 {
+		c.validity = append(c.validity, 0)
+	}
+	if valid || !c.nullable {
+		c.validity[c.n/8] |= 1 << (c.n % 8)
+	}
+	c.n++
+}
+
+// appendValue buffers a non-null value and reports whether it could be
+// converted.
+func (c *arrowColumn) appendValue(value interface{}) bool {
+	switch c.typeID {
+	case arrowTypeInt:
+		var v int64
+		switch value := value.(type) {
+		case int64:
+			v = value
+		case int:
+			v = int64(value)
+		case float64:
+			v = int64(value)
+		default:
+			return false
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+	case arrowTypeFloatingPoint:
+		f, ok := moneyAmount(value)
+		if !ok {
+			return false
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(f))
+	case arrowTypeDecimal:
+		unscaled, ok := decimalValue(value, c.field.Scale)
+		if !ok {
+			return false
+		}
+		b, ok := twosComplement(unscaled, c.width)
+		if !ok {
+			return false
+		}
+		slices.Reverse(b)
+		c.values = append(c.values, b...)
+	case arrowTypeBool:
+		v, ok := value.(bool)
+		if !ok {
+			return false
+		}
+		c.appendBit(v)
+	case arrowTypeTimestamp:
+		t, ok := timeValue(value)
+		if !ok {
+			return false
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, uint64(t.UnixMicro()))
+	case arrowTypeTime:
+		d, ok := timeOfDayValue(value)
+		if !ok {
+			return false
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, uint64(d.Microseconds()))
+	case arrowTypeDate:
+		t, ok := timeValue(value)
+		if !ok {
+			return false
+		}
+		days := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+		c.values = binary.LittleEndian.AppendUint32(c.values, uint32(int32(days)))
+	case arrowTypeFixedSizeBinary:
+		u, ok := uuidBytes(value)
+		if !ok {
+			return false
+		}
+		c.values = append(c.values, u[:]...)
+	default:
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case time.Time:
+			s = v.Format(time.RFC3339)
+		default:
+			if c.field.DataType == DataTypeJSON || c.field.DataType == DataTypeArray {
+				s, _ = jsonText(v)
+			} else {
+				s = fmt.Sprintf("%v", v)
+			}
+		}
+		c.appendString(s)
+	}
+	return true
+}
+
+func (c *arrowColumn) appendZero() {
+	switch {
+	case c.typeID == arrowTypeBool:
+		c.appendBit(false)
+	case (c.typeID == arrowTypeUtf8 || c.typeID == arrowTypeBinary) && c.dict == nil:
+		c.appendString("")
+	case c.dict != nil:
+		c.values = binary.LittleEndian.AppendUint32(c.values, 0)
+	default:
+		c.values = append(c.values, make([]byte, c.width)...)
+	}
+}
+
+func (c *arrowColumn) appendBit(v bool) {
+	if c.n%8 == 0 {
+		c.values = append(c.values, 0)
+	}
+	if v {
+		c.values[c.n/8] |= 1 << (c.n % 8)
+	}
+}
+
+func (c *arrowColumn) appendString(s string) {
+	if c.dict != nil {
+		c.values = binary.LittleEndian.AppendUint32(c.values, uint32(c.dict.code(s)))
+		return
+	}
+	if len(c.offsets) == 0 {
+		c.offsets = binary.LittleEndian.AppendUint32(c.offsets, 0)
+	}
+	c.values = append(c.values, s...)
+	c.offsets = binary.LittleEndian.AppendUint32(c.offsets, uint32(len(c.values)))
+}
+
+// arrowBody collects the buffers of a record batch, each padded to 8
+// bytes.
+type arrowBody struct {
+	data    []byte
+	nodes   []byte
+	buffers []byte
+}
+
+func (b *arrowBody) node(length, nulls int) {
+	b.nodes = binary.LittleEndian.AppendUint64(b.nodes, uint64(length))
+	b.nodes = binary.LittleEndian.AppendUint64(b.nodes, uint64(nulls))
+}
+
+func (b *arrowBody) buffer(p []byte) {
+	b.buffers = binary.LittleEndian.AppendUint64(b.buffers, uint64(len(b.data)))
+	b.buffers = binary.LittleEndian.AppendUint64(b.buffers, uint64(len(p)))
+	b.data = append(b.data, p...)
+	for len(b.data)%8 != 0 {
+		b.data = append(b.data, 0)
+	}
+}
+
+// recordBatch returns the RecordBatch header of the body.
+func (b *arrowBody) recordBatch(length int) fbTable {
+	return fbTable{
+		0: fbInt64(int64(length)),
+		1: fbStructs{align: 8, n: len(b.nodes) / 16, data: b.nodes},
+		2: fbStructs{align: 8, n: len(b.buffers) / 16, data: b.buffers},
+	}
+}
+
+// flushBatch writes the dictionary values added since the last batch and
+// the buffered rows as a record batch.
+func (w *arrowWriter) flushBatch() error {
+	for _, c := range w.columns {
+		if c.dict == nil || (c.written == len(c.dict.values) && len(w.batches) > 0) {
+			continue
+		}
+		var body arrowBody
+		values := c.dict.values[c.written:]
+		offsets := binary.LittleEndian.AppendUint32(nil, 0)
+		var data []byte
+		for _, v := range values {
+			data = append(data, v...)
+			offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+		}
+		body.node(len(values), 0)
+		body.buffer(nil)
+		body.buffer(offsets)
+		body.buffer(data)
+		block, err := w.writeMessage(arrowDictionaryMessage, fbTable{
+			0: fbInt64(c.id),
+			1: body.recordBatch(len(values)),
+			// Every dictionary is written before the first record batch;
+			// later ones only add values.
+			2: fbBool(len(w.batches) > 0),
+		}, body.data)
+		if err != nil {
+			return err
+		}
+		w.dictionaries = append(w.dictionaries, block)
+		c.written = len(c.dict.values)
+	}
+
+	var body arrowBody
+	for _, c := range w.columns {
+		body.node(c.n, c.nulls)
+		if c.nulls > 0 {
+			body.buffer(c.validity)
+		} else {
+			body.buffer(nil)
+		}
+		if (c.typeID == arrowTypeUtf8 || c.typeID == arrowTypeBinary) && c.dict == nil {
+			if len(c.offsets) == 0 {
+				c.offsets = binary.LittleEndian.AppendUint32(c.offsets, 0)
+			}
+			body.buffer(c.offsets)
+		}
+		body.buffer(c.values)
+	}
+	block, err := w.writeMessage(arrowRecordBatch, body.recordBatch(w.rows), body.data)
+	if err != nil {
+		return err
+	}
+	w.batches = append(w.batches, block)
+	w.stats.flush()
+
+	for _, c := range w.columns {
+		if c.invalid > 0 {
+			log.Printf("column %s.%s: %d values could not be converted to the Arrow type and were written as null",
+				w.tableName, c.field.FieldName, c.invalid)
+		}
+		c.validity, c.values, c.offsets = c.validity[:0], c.values[:0], c.offsets[:0]
+		c.n, c.nulls, c.invalid = 0, 0, 0
+	}
+	w.rows = 0
+	return nil
+}
+
+// chunkStats returns the statistics of the record batches written.
+func (w *arrowWriter) chunkStats() []ChunkStats {
+	return w.stats.chunks
+}
+
+// close writes the last record batch and the footer. The entries of files
+// are stored as the footer's custom metadata; streams have no footer, so
+// they are dropped. Arrow files need no temporary files, so it returns 0
+// temporary bytes.
+func (w *arrowWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	// A file without record batches would lack its dictionaries, so an
+	// empty table gets one empty batch.
+	if w.rows > 0 || len(w.batches) == 0 {
+		if err := w.flushBatch(); err != nil {
+			w.discard()
+			return 0, err
+		}
+	}
+
+	// The end-of-stream marker precedes the footer.
+	tail := binary.LittleEndian.AppendUint32(nil, 0xFFFFFFFF)
+	tail = binary.LittleEndian.AppendUint32(tail, 0)
+	if !w.stream {
+		footer := fbTable{
+			0: fbInt16(arrowMetadataV5),
+			1: w.schema,
+			2: arrowBlocks(w.dictionaries),
+			3: arrowBlocks(w.batches),
+		}
+		if len(files) > 0 {
+			footer[4] = arrowKeyValues(files)
+		}
+		b := fbFinish(footer)
+		tail = append(tail, b...)
+		tail = binary.LittleEndian.AppendUint32(tail, uint32(len(b)))
+		tail = append(tail, arrowMagic...)
+	}
+	if err := w.write(tail); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.w.Flush(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		w.discard()
+		return 0, err
+	}
+
+	if !w.stream {
+		log.Printf("Table %q saved successfully to %s", w.tableName, w.path)
+	}
+	return 0, nil
+}
+
+// arrowBlocks encodes the Block structs of the footer.
+func arrowBlocks(blocks []arrowBlock) fbStructs {
+	var data []byte
+	for _, b := range blocks {
+		data = binary.LittleEndian.AppendUint64(data, uint64(b.offset))
+		data = binary.LittleEndian.AppendUint32(data, uint32(b.metadataLength))
+		data = binary.LittleEndian.AppendUint32(data, 0)
+		data = binary.LittleEndian.AppendUint64(data, uint64(b.bodyLength))
+	}
+	return fbStructs{align: 8, n: len(blocks), data: data}
+}
+
+// discard removes the partially written file of a table that failed to
+// export.
+func (w *arrowWriter) discard() {
+	w.f.Close()
+	if !w.stream {
+		os.Remove(w.path)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	// The values of rows besides the basic types gob knows.
+	gob.Register(time.Time{})
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+}
+
+// cachedSource replays the batches of a table read by an earlier run with
+// -cache-dir instead of reading the table again, and caches the batches of
+// the tables it reads. Tables are cached by what decides their rows: the
+// source, the table or query and its columns, filter, sample, row order
+// and watermark range, the parameters and the snapshot. Without a snapshot
+// or a closed watermark range nothing in the key changes with the data, so
+// such tables are read again once their cache is older than ttl.
+type cachedSource struct {
+	exportSource
+	dir string
+	ttl time.Duration
+	// source identifies the database, snapshot the snapshot of
+	// -snapshot, if any.
+	source   string
+	snapshot string
+}
+
+// newCachedSource caches the tables read from src in dir, for ttl unless
+// read from a snapshot or up to a watermark.
+func newCachedSource(src exportSource, dir string, ttl time.Duration, cfg ExportConfig, snapshot *SnapshotInfo) (*cachedSource, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &cachedSource{exportSource: src, dir: dir, ttl: ttl, source: cfg.Connection.Source + " " + cfg.Connection.sourceDSN()}
+	if snapshot != nil {
+		s.snapshot = snapshot.LSN
+	}
+	return s, nil
+}
+
+// cachePath returns the file the batches of a table are cached in.
+func (s *cachedSource) cachePath(table TableMetadata, cfg ExportConfig) string {
+	var columns []string
+	for _, field := range table.Fields {
+		columns = append(columns, field.FieldName+" "+field.DataType)
+	}
+	b, _ := json.Marshal(struct {
+		Source, Snapshot                 string
+		Table, SourceTable, Schema, Kind string
+		Query, Where                     string
+		Columns                          []string
+		Sample                           *SampleInfo
+		RowOrder                         *RowOrder
+		Watermark                        *WatermarkRange
+		Params                           map[string]string
+	}{s.source, s.snapshot, table.TableName, table.SourceTable, table.Schema, table.Kind, table.Query, table.Where, columns, table.Sample, table.RowOrder, table.Watermark, cfg.Params})
+	sum := sha256.Sum256(b)
+	return filepath.Join(s.dir, strings.ReplaceAll(table.TableName, string(filepath.Separator), "_")+"-"+hex.EncodeToString(sum[:16])+".gob")
+}
+
+// StreamTableData replays the table's cached batches, or reads them from
+// the source and caches them once the table was read completely. Tables
+// resumed from a checkpoint are read from the source.
+func (s *cachedSource) StreamTableData(ctx context.Context, table TableMetadata, cfg ExportConfig, emit func(rows []TableRow) error) error {
+	if len(table.ResumeKey) > 0 {
+		return s.exportSource.StreamTableData(ctx, table, cfg, emit)
+	}
+	path := s.cachePath(table, cfg)
+	if info, err := os.Stat(path); err == nil && s.expired(table, info.ModTime()) {
+		log.Printf("Cache of table %q is older than -cache-ttl %s, reading it again", table.TableName, s.ttl)
+	} else if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		log.Printf("Reading table %q from the cache", table.TableName)
+		return replayCache(ctx, f, emit)
+	}
+
+	f, err := os.CreateTemp(s.dir, ".cache-*")
+	if err != nil {
+		return fmt.Errorf("creating the cache file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	var cacheErr error
+	err = s.exportSource.StreamTableData(ctx, table, cfg, func(rows []TableRow) error {
+		// Rows are encoded before the export transforms them.
+		if cacheErr == nil {
+			if cacheErr = enc.Encode(rows); cacheErr != nil {
+				log.Printf("table %s: not caching its rows: %v", table.TableName, cacheErr)
+			}
+		}
+		return emit(rows)
+	})
+	if err != nil || cacheErr != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("table %s: not caching its rows: %v", table.TableName, err)
+		return nil
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("table %s: not caching its rows: %v", table.TableName, err)
+		return nil
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		log.Printf("table %s: not caching its rows: %v", table.TableName, err)
+	}
+	return nil
+}
+
+// expired reports whether the cache of a table written at modTime is too
+// old to use. The rows of a snapshot, or of a watermark range closed at
+// both ends, don't change, so their caches never expire.
+func (s *cachedSource) expired(table TableMetadata, modTime time.Time) bool {
+	if s.ttl <= 0 || s.snapshot != "" {
+		return false
+	}
+	if w := table.Watermark; w != nil && w.Through != nil {
+		return false
+	}
+	return time.Since(modTime) > s.ttl
+}
+
+// replayCache passes the batches of a cache file to emit.
+func replayCache(ctx context.Context, r io.Reader, emit func(rows []TableRow) error) error {
+	dec := gob.NewDecoder(bufio.NewReader(r))
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var rows []TableRow
+		if err := dec.Decode(&rows); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading the cache: %w", err)
+		}
+		if err := emit(rows); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheExpired(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		snapshot string
+		table    TableMetadata
+		modTime  time.Time
+		want     bool
+	}{
+		{"fresh", time.Hour, "", TableMetadata{}, time.Now(), false},
+		{"older than the ttl", time.Hour, "", TableMetadata{}, old, true},
+		{"no ttl", 0, "", TableMetadata{}, old, false},
+		{"snapshot", time.Hour, "0/16B3748", TableMetadata{}, old, false},
+		{"open watermark range", time.Hour, "", TableMetadata{Watermark: &WatermarkRange{Column: "id", After: 10}}, old, true},
+		{"closed watermark range", time.Hour, "", TableMetadata{Watermark: &WatermarkRange{Column: "id", After: 10, Through: 20}}, old, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &cachedSource{ttl: tt.ttl, snapshot: tt.snapshot}
+			if got := s.expired(tt.table, tt.modTime); got != tt.want {
+				t.Errorf("expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
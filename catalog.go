@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DataHub connection settings are read from the environment so credentials
+// never end up in metadata.json or provenance.json.
+const (
+	envDataHubURL   = "DATAHUB_GMS_URL"
+	envDataHubToken = "DATAHUB_TOKEN"
+)
+
+// dataHubProposal is a MetadataChangeProposal as accepted by the GMS
+// `/aspects?action=ingestProposal` endpoint.
+type dataHubProposal struct {
+	EntityType string        `json:"entityType"`
+	EntityURN  string        `json:"entityUrn"`
+	ChangeType string        `json:"changeType"`
+	AspectName string        `json:"aspectName"`
+	Aspect     dataHubAspect `json:"aspect"`
+}
+
+type dataHubAspect struct {
+	Value       string `json:"value"`
+	ContentType string `json:"contentType"`
+}
+
+// dataHubFieldTypes maps our data types to DataHub schema field types.
+var dataHubFieldTypes = map[string]string{
+	DataTypeString:    "com.linkedin.schema.StringType",
+	DataTypeInt:       "com.linkedin.schema.NumberType",
+	DataTypeFloat:     "com.linkedin.schema.NumberType",
+	DataTypeBool:      "com.linkedin.schema.BooleanType",
+	DataTypeTime:      "com.linkedin.schema.TimeType",
+	DataTypeDate:      "com.linkedin.schema.DateType",
+	DataTypeUUID:      "com.linkedin.schema.StringType",
+	DataTypeJSON:      "com.linkedin.schema.StringType",
+	DataTypeArray:     "com.linkedin.schema.ArrayType",
+	DataTypeBytes:     "com.linkedin.schema.BytesType",
+	DataTypeNull:      "com.linkedin.schema.NullType",
+	DataTypeTimeOfDay: "com.linkedin.schema.TimeType",
+}
+
+// datasetURN builds a DataHub dataset URN.
+func datasetURN(platform, name string) string {
+	return fmt.Sprintf("urn:li:dataset:(urn:li:dataPlatform:%s,%s,PROD)", platform, name)
+}
+
+// upstreamName returns the name of the source table of an exported table in
+// its DataHub dataset URN: database.schema.table for PostgreSQL, in the
+// schema recorded for the table, and database.table for other sources.
+func upstreamName(dbName, platform string, table TableMetadata) string {
+	if platform != "postgres" {
+		return dbName + "." + table.sourceName()
+	}
+	return dbName + "." + cmp.Or(table.Schema, defaultSchema) + "." + table.relationName()
+}
+
+// pushToDataHub publishes the schema, row counts, and lineage of each
+// exported table to a DataHub GMS instance. DataHub is the only catalog
+// supported; there is no Amundsen client.
+func pushToDataHub(gmsURL, token string, cfg ExportConfig, schema SchemaDetails, rowCounts map[string]int) error {
+	dbName := schema.DatasetMetadata.DatasetName
+	now := time.Now().UnixMilli()
+
+	platform := "postgres"
+	switch schema.DatasetMetadata.SourceDetails["database_type"] {
+	case "MongoDB":
+		platform = "mongodb"
+	case "SQLite":
+		platform = "sqlite"
+	}
+
+	for _, table := range schema.Tables {
+		urn := datasetURN("file", fmt.Sprintf("%s.%s", dbName, table.TableName))
+
+		properties := map[string]interface{}{
+			"name":        table.TableName,
+			"description": fmt.Sprintf("%s export of %s.%s", formatNames[cfg.Format], dbName, table.TableName),
+			"customProperties": map[string]string{
+				"row_count":    strconv.Itoa(rowCounts[table.TableName]),
+				"path":         cfg.outputPath(table.TableName),
+				"tool_version": ToolVersion,
+			},
+		}
+
+		var fields []map[string]interface{}
+		var primaryKeys []string
+		for _, field := range table.Fields {
+			fieldType, ok := dataHubFieldTypes[field.DataType]
+			if !ok {
+				fieldType = dataHubFieldTypes[DataTypeString]
+			}
+			fields = append(fields, map[string]interface{}{
+				"fieldPath":      field.FieldName,
+				"nativeDataType": field.DataType,
+				"nullable":       field.IsNullable,
+				"type": map[string]interface{}{
+					"type": map[string]interface{}{fieldType: map[string]interface{}{}},
+				},
+			})
+			if field.IsPrimaryKey {
+				primaryKeys = append(primaryKeys, field.FieldName)
+			}
+		}
+		schemaMetadata := map[string]interface{}{
+			"schemaName": table.TableName,
+			"platform":   "urn:li:dataPlatform:file",
+			"version":    0,
+			"hash":       "",
+			"platformSchema": map[string]interface{}{
+				"com.linkedin.schema.OtherSchema": map[string]string{"rawSchema": ""},
+			},
+			"fields":      fields,
+			"primaryKeys": primaryKeys,
+		}
+
+		type aspect struct {
+			name  string
+			value interface{}
+		}
+		aspects := []aspect{
+			{"datasetProperties", properties},
+			{"schemaMetadata", schemaMetadata},
+		}
+		// Query exports have no single source table to trace back to.
+		if table.Query == "" {
+			lineage := map[string]interface{}{
+				"upstreams": []map[string]interface{}{{
+					"dataset": datasetURN(platform, upstreamName(dbName, platform, table)),
+					"type":    "TRANSFORMED",
+					"auditStamp": map[string]interface{}{
+						"time":  now,
+						"actor": "urn:li:corpuser:datahub",
+					},
+				}},
+			}
+			aspects = append(aspects, aspect{"upstreamLineage", lineage})
+		}
+		for _, aspect := range aspects {
+			if err := ingestDataHubAspect(gmsURL, token, urn, aspect.name, aspect.value); err != nil {
+				return fmt.Errorf("pushing %s for table %s: %w", aspect.name, table.TableName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ingestDataHubAspect upserts a single aspect of a dataset entity.
+func ingestDataHubAspect(gmsURL, token, urn, aspectName string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]dataHubProposal{
+		"proposal": {
+			EntityType: "dataset",
+			EntityURN:  urn,
+			ChangeType: "UPSERT",
+			AspectName: aspectName,
+			Aspect:     dataHubAspect{Value: string(b), ContentType: "application/json"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(gmsURL, "/") + "/aspects?action=ingestProposal"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-RestLi-Protocol-Version", "2.0.0")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("datahub returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestUpstreamName(t *testing.T) {
+	tests := []struct {
+		name     string
+		platform string
+		table    TableMetadata
+		want     string
+	}{
+		{"public table", "postgres", TableMetadata{TableName: "orders", Schema: "public"}, "shop.public.orders"},
+		{"table without a recorded schema", "postgres", TableMetadata{TableName: "orders"}, "shop.public.orders"},
+		{"other schema", "postgres", TableMetadata{TableName: "sales.orders", Schema: "sales"}, "shop.sales.orders"},
+		{"hot/cold partition", "postgres", TableMetadata{TableName: "sales.orders.hot", SourceTable: "sales.orders", Schema: "sales"}, "shop.sales.orders"},
+		{"sqlite", "sqlite", TableMetadata{TableName: "orders"}, "shop.orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamName("shop", tt.platform, tt.table); got != tt.want {
+				t.Errorf("upstreamName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
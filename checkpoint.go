@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// checkpointDir holds the checkpoints of an export in its output
+// directory, one directory per table.
+const checkpointDir = ".checkpoint"
+
+// tableCheckpoint records how far the export of a table got, so that a run
+// with -resume continues it instead of starting over. The rows exported so
+// far are kept as NPZ parts, merged into the table's file once it is
+// complete.
+type tableCheckpoint struct {
+	// Fingerprint identifies the export of the table; the checkpoint of a
+	// table exported differently is discarded.
+	Fingerprint string `json:"fingerprint"`
+	// Parts are the file names of the parts, in order.
+	Parts []string `json:"parts"`
+	Rows  int      `json:"rows"`
+	// Key is the ResumeKey of the last row of the last part.
+	Key []typedValue `json:"key,omitempty"`
+	// Columns are the table's columns with their encodings decided.
+	Columns   []FieldMetadata `json:"columns"`
+	Watermark *typedValue     `json:"watermark,omitempty"`
+	// Rejected and RejectsSize are the rows and bytes written to the
+	// table's rejects file up to the last part.
+	Rejected    int   `json:"rejected,omitempty"`
+	RejectsSize int64 `json:"rejects_size,omitempty"`
+	// NullDropped is the number of rows dropped for their nulls up to the
+	// last part.
+	NullDropped int `json:"null_dropped,omitempty"`
+	// Profile is the state of the column profiles up to the last part.
+	Profile []columnProfileState `json:"profile,omitempty"`
+	// Done is set once the table's file is complete, with Note and Usage
+	// its result.
+	Done  bool       `json:"done"`
+	Note  string     `json:"note,omitempty"`
+	Usage TableUsage `json:"usage"`
+}
+
+// typedValue is a key or watermark value stored with its data type, so it
+// is read back as the value the source driver returns.
+type typedValue struct {
+	DataType string          `json:"data_type"`
+	Value    json.RawMessage `json:"value"`
+}
+
+func newTypedValue(v interface{}) (typedValue, error) {
+	dataType := DataTypeString
+	switch x := v.(type) {
+	case int64, int:
+		dataType = DataTypeInt
+	case float64:
+		dataType = DataTypeFloat
+	case bool:
+		dataType = DataTypeBool
+	case time.Time:
+		dataType = DataTypeTime
+	case []byte:
+		v = string(x)
+	case string:
+	default:
+		v = fmt.Sprintf("%v", v)
+	}
+	b, err := json.Marshal(v)
+	return typedValue{DataType: dataType, Value: b}, err
+}
+
+func (t typedValue) decode() (interface{}, error) {
+	return decodeWatermark(t.Value, t.DataType)
+}
+
+// tableCheckpointer writes the checkpoints of one table's export.
+type tableCheckpointer struct {
+	dir   string
+	table string
+	// every is the number of rows after which a part is checkpointed.
+	every int
+	spill spillConfig
+	// stored is set to store the parts' arrays uncompressed.
+	stored bool
+	// rejects is the table's quarantine, whose file is checkpointed with
+	// the parts.
+	rejects *rowQuarantine
+	// nulls is the table's null filter, whose dropped rows are recorded.
+	nulls *nullFilter
+	// profile is the table's profiler, nil without profile set.
+	profile *tableProfiler
+	cp      tableCheckpoint
+}
+
+// openCheckpoint returns the checkpointer of a table, with the checkpoint
+// an earlier attempt left if it has the same fingerprint.
+func openCheckpoint(outDir string, table TableMetadata, fingerprint string, every int, spill spillConfig) (*tableCheckpointer, error) {
+	c := &tableCheckpointer{
+		dir:   filepath.Join(outDir, checkpointDir, table.TableName),
+		table: table.TableName,
+		every: every,
+		spill: spill,
+		cp:    tableCheckpoint{Fingerprint: fingerprint},
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, "checkpoint.json"))
+	if err == nil {
+		var cp tableCheckpoint
+		if err := json.Unmarshal(b, &cp); err != nil {
+			return nil, fmt.Errorf("parsing checkpoint of table %s: %w", table.TableName, err)
+		}
+		if cp.Fingerprint == fingerprint {
+			c.cp = cp
+			return c, nil
+		}
+		log.Printf("Discarding the checkpoint of table %q, which was exported differently", table.TableName)
+	} else if os.IsNotExist(err) {
+		// Parts left without a checkpoint are for recoverParts.
+		return c, os.MkdirAll(c.dir, 0755)
+	} else {
+		return nil, err
+	}
+	if err := os.RemoveAll(c.dir); err != nil {
+		return nil, err
+	}
+	return c, os.MkdirAll(c.dir, 0755)
+}
+
+// recoverParts rebuilds the checkpoint of a table from the parts an
+// earlier run left without checkpoint.json, such as one killed between
+// closing a part and recording it. Rows are exported in the order of the
+// primary key, so for a table with a single integer key, like a BIGSERIAL
+// or identity ID, the parts hold every row up to the highest ID in them,
+// and the export continues after it. The string columns keep the
+// dictionary encodings of the parts; the others are decided by the
+// options, which must be those of the earlier run. Parts that can't be
+// recovered are removed.
+func (c *tableCheckpointer) recoverParts(table TableMetadata, columns []FieldMetadata) error {
+	parts, err := filepath.Glob(filepath.Join(c.dir, "part-*.npz"))
+	if err != nil || len(parts) == 0 {
+		return err
+	}
+	slices.Sort(parts)
+	discard := func(reason string) error {
+		log.Printf("Discarding %d parts of table %q left without a checkpoint: %s", len(parts), c.table, reason)
+		for _, part := range parts {
+			if err := os.Remove(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var key []FieldMetadata
+	for _, field := range table.Fields {
+		if field.IsPrimaryKey {
+			key = append(key, field)
+		}
+	}
+	switch {
+	case len(key) != 1 || key[0].DataType != DataTypeInt:
+		return discard("the table has no single integer primary key")
+	case table.Query != "" || table.Watermark != nil:
+		return discard("only full table exports are recovered")
+	case table.SourceTable != "":
+		return discard("the boundary of a hot/cold partition may have moved")
+	case c.rejects != nil && c.rejects.enabled:
+		return discard("the rows rejected by -quarantine are not known")
+	}
+	i := slices.IndexFunc(columns, func(f FieldMetadata) bool { return f.FieldName == key[0].FieldName })
+	if i < 0 || columns[i].Encoding == EncodingHash {
+		return discard("the primary key is not exported as is")
+	}
+
+	columns = slices.Clone(columns)
+	rows := 0
+	maxID := int64(math.MinInt64)
+	for n, part := range parts {
+		// A part is named after the parts before it.
+		if filepath.Base(part) != fmt.Sprintf("part-%05d.npz", n+1) {
+			return discard(fmt.Sprintf("%s is out of sequence", filepath.Base(part)))
+		}
+		ids, err := readPartKeys(part, key[0].FieldName)
+		if err != nil {
+			if n == len(parts)-1 {
+				// The last part may have been cut short.
+				log.Printf("Discarding the unreadable last part of table %q: %v", c.table, err)
+				os.Remove(part)
+				parts = parts[:n]
+				break
+			}
+			return discard(err.Error())
+		}
+		for _, id := range ids {
+			maxID = max(maxID, id)
+		}
+		rows += len(ids)
+		if n == 0 {
+			if err := usePartEncodings(part, columns); err != nil {
+				return discard(err.Error())
+			}
+		}
+	}
+	if rows == 0 {
+		return discard("they hold no rows")
+	}
+
+	key0, err := newTypedValue(maxID)
+	if err != nil {
+		return err
+	}
+	cp := tableCheckpoint{Fingerprint: c.cp.Fingerprint, Rows: rows, Key: []typedValue{key0}, Columns: columns}
+	for _, part := range parts {
+		cp.Parts = append(cp.Parts, filepath.Base(part))
+	}
+	if err := c.save(cp); err != nil {
+		return err
+	}
+	c.cp = cp
+	log.Printf("Recovered %d rows of table %q from %d parts without a checkpoint, continuing after %s %d",
+		rows, c.table, len(parts), key[0].FieldName, maxID)
+	return nil
+}
+
+// readPartKeys reads the integer key column of a part.
+func readPartKeys(path, name string) ([]int64, error) {
+	r, err := npz.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	column, err := readNpzColumn(r, name)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from %s: %w", name, filepath.Base(path), err)
+	}
+	ids, ok := column.([]int64)
+	if !ok {
+		return nil, fmt.Errorf("%s of %s is %T, expected int64", name, filepath.Base(path), column)
+	}
+	return ids, nil
+}
+
+// usePartEncodings sets the encoding of the string columns without one to
+// dictionary where a part has their categories and raw elsewhere.
+func usePartEncodings(path string, columns []FieldMetadata) error {
+	r, err := npz.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for i, col := range columns {
+		if col.Encoding != "" || col.DataType != DataTypeString {
+			continue
+		}
+		columns[i].Encoding = EncodingRaw
+		if npzDtype(r, col.FieldName+categoriesSuffix) != "" {
+			columns[i].Encoding = EncodingDictionary
+		}
+	}
+	return nil
+}
+
+// checkpointFingerprint identifies how a table is exported: its columns,
+// filters and watermark range, its column transforms, the encoding and
+// compression options and the hash key.
+func checkpointFingerprint(table TableMetadata, opts exportOptions, key hashKey) string {
+	b, _ := json.Marshal(struct {
+		Table         TableMetadata
+		Transforms    ColumnTransforms
+		DictEncoding  string
+		ArrayEncoding string
+		Binary        string
+		Compression   string
+		Decimals      string
+		Quarantine    bool
+		NullPolicy    NullPolicy
+		HashKey       [2]uint64
+	}{table, opts.Export.transforms(table.TableName), opts.DictEncoding, opts.ArrayEncoding, opts.BinaryEncoding, opts.Export.NPZCompression, opts.Export.DecimalEncoding, opts.Export.Quarantine, opts.Export.NullPolicy, [2]uint64{key.k0, key.k1}})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// resumed reports whether rows of the table were checkpointed.
+func (c *tableCheckpointer) resumed() bool {
+	return len(c.cp.Parts) > 0
+}
+
+// resumeKey returns the key to continue the export after.
+func (c *tableCheckpointer) resumeKey() ([]interface{}, error) {
+	key := make([]interface{}, len(c.cp.Key))
+	for i, v := range c.cp.Key {
+		var err error
+		if key[i], err = v.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// watermark returns the highest watermark value of the rows checkpointed.
+func (c *tableCheckpointer) watermark() (interface{}, error) {
+	if c.cp.Watermark == nil {
+		return nil, nil
+	}
+	return c.cp.Watermark.decode()
+}
+
+// newPart returns the writer of the table's next part.
+func (c *tableCheckpointer) newPart(columns []FieldMetadata) tableWriter {
+	w := newNpzWriter(c.dir, c.table, columns, c.spill)
+	w.path = filepath.Join(c.dir, fmt.Sprintf("part-%05d.npz", len(c.cp.Parts)+1))
+	w.part = true
+	w.stored = c.stored
+	return w
+}
+
+// due reports whether rows, the number exported, call for a checkpoint:
+// every c.every rows, and while the export is paused, so the rows read
+// before a pause are kept if the export is stopped during it.
+func (c *tableCheckpointer) due(rows int) bool {
+	return rows-c.cp.Rows >= c.every || rows > c.cp.Rows && exportPause.Paused()
+}
+
+// checkpoint closes the current part, records it with the rows exported,
+// the key after its last row and the highest watermark value, and returns
+// the number of temporary bytes the part used. A part interrupted by
+// canceling ctx is discarded, leaving the previous checkpoint in place.
+func (c *tableCheckpointer) checkpoint(ctx context.Context, w tableWriter, rows int, key []interface{}, columns []FieldMetadata, watermark interface{}) (int64, error) {
+	n, err := w.close(ctx, nil)
+	if err != nil {
+		return n, err
+	}
+	cp := c.cp
+	cp.Parts = append(slices.Clip(cp.Parts), filepath.Base(w.(*npzWriter).path))
+	cp.Rows = rows
+	cp.Columns = columns
+	if c.rejects != nil {
+		cp.Rejected, cp.RejectsSize = c.rejects.rows, c.rejects.size
+	}
+	if c.nulls != nil {
+		cp.NullDropped = c.nulls.dropped
+	}
+	if c.profile != nil {
+		if cp.Profile, err = c.profile.state(); err != nil {
+			return n, err
+		}
+	}
+	cp.Key = nil
+	for _, v := range key {
+		t, err := newTypedValue(v)
+		if err != nil {
+			return n, err
+		}
+		cp.Key = append(cp.Key, t)
+	}
+	if watermark != nil {
+		t, err := newTypedValue(watermark)
+		if err != nil {
+			return n, err
+		}
+		cp.Watermark = &t
+	}
+	if err := c.save(cp); err != nil {
+		return n, err
+	}
+	c.cp = cp
+	log.Printf("Checkpointed table %q at %d rows", c.table, rows)
+	return n, nil
+}
+
+// assemble writes the table's file at path from the checkpointed parts and
+// last, its final part.
+func (c *tableCheckpointer) assemble(ctx context.Context, path string, last tableWriter) error {
+	var parts []string
+	for _, part := range c.cp.Parts {
+		parts = append(parts, filepath.Join(c.dir, part))
+	}
+	parts = append(parts, last.(*npzWriter).path)
+	if len(parts) == 1 {
+		return os.Rename(parts[0], path)
+	}
+	_, err := mergeNpz(ctx, path, parts)
+	return err
+}
+
+// result returns the result of a table an earlier attempt completed, if
+// its file is still there. Otherwise a completed table starts over.
+func (c *tableCheckpointer) result(path string) (tableResult, bool) {
+	if !c.cp.Done {
+		return tableResult{}, false
+	}
+	if _, err := os.Stat(path); err == nil {
+		if watermark, err := c.watermark(); err == nil {
+			return tableResult{columns: c.cp.Columns, note: c.cp.Note, written: true, usage: c.cp.Usage, watermark: watermark}, true
+		}
+	}
+	c.cp = tableCheckpoint{Fingerprint: c.cp.Fingerprint}
+	return tableResult{}, false
+}
+
+// done records the result of the completed table and removes its parts.
+func (c *tableCheckpointer) done(r tableResult) error {
+	cp := tableCheckpoint{
+		Fingerprint: c.cp.Fingerprint,
+		Columns:     r.columns,
+		Done:        true,
+		Note:        r.note,
+		Usage:       r.usage,
+	}
+	if r.watermark != nil {
+		t, err := newTypedValue(r.watermark)
+		if err != nil {
+			return err
+		}
+		cp.Watermark = &t
+	}
+	if err := c.save(cp); err != nil {
+		return err
+	}
+	for _, part := range c.cp.Parts {
+		os.Remove(filepath.Join(c.dir, part))
+	}
+	c.cp = cp
+	return nil
+}
+
+// save writes the checkpoint, replacing the previous one only once it is
+// complete.
+func (c *tableCheckpointer) save(cp tableCheckpoint) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, "checkpoint.json")
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
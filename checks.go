@@ -0,0 +1,255 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// maxCheckExamples is the number of violating rows a check result lists.
+const maxCheckExamples = 10
+
+// Comparison operators of checks.
+var checkOps = []string{"<", "<=", "=", "!=", ">=", ">"}
+
+// CheckConfig is an invariant between two exported tables, verified after
+// the export: every row of Table whose Key matches the RefKey of a row of
+// RefTable must have a Column value that compares to that row's RefColumn
+// value with Op, such as user_sessions.started_at >= users.created_at on
+// user_sessions.user_id = users.id.
+type CheckConfig struct {
+	// Name identifies the check in the run report; it defaults to the
+	// comparison.
+	Name   string `yaml:"name" toml:"name"`
+	Table  string `yaml:"table" toml:"table"`
+	Column string `yaml:"column" toml:"column"`
+	// Op is <, <=, =, !=, >= or >.
+	Op        string `yaml:"op" toml:"op"`
+	RefTable  string `yaml:"ref_table" toml:"ref_table"`
+	RefColumn string `yaml:"ref_column" toml:"ref_column"`
+	// Key is Table's column matching RefKey, RefTable's column whose
+	// values must be unique.
+	Key    string `yaml:"key" toml:"key"`
+	RefKey string `yaml:"ref_key" toml:"ref_key"`
+}
+
+// validate checks that a check names its tables, columns and operator.
+func (c CheckConfig) validate() error {
+	if c.Table == "" || c.Column == "" || c.RefTable == "" || c.RefColumn == "" || c.Key == "" || c.RefKey == "" {
+		return fmt.Errorf("checks need a table, column, ref_table, ref_column, key and ref_key")
+	}
+	for _, op := range checkOps {
+		if c.Op == op {
+			return nil
+		}
+	}
+	return fmt.Errorf("check %s: unknown op %q, expected one of %s", c.name(), c.Op, strings.Join(checkOps, " "))
+}
+
+// name returns the check's name, or its comparison.
+func (c CheckConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return fmt.Sprintf("%s.%s %s %s.%s", c.Table, c.Column, c.Op, c.RefTable, c.RefColumn)
+}
+
+// CheckResult is the outcome of a check in the run report.
+type CheckResult struct {
+	Name string `json:"name"`
+	// Rows is the number of rows compared: rows with a matching reference
+	// row and neither value null.
+	Rows       int `json:"rows"`
+	Violations int `json:"violations"`
+	// Unmatched is the number of rows whose key matched no reference row.
+	Unmatched int              `json:"unmatched,omitempty"`
+	Examples  []CheckViolation `json:"examples,omitempty"`
+	// Error is why the check could not run.
+	Error string `json:"error,omitempty"`
+}
+
+// CheckViolation is a row that fails a check.
+type CheckViolation struct {
+	Row      int         `json:"row"`
+	Key      interface{} `json:"key"`
+	Value    interface{} `json:"value"`
+	RefValue interface{} `json:"ref_value"`
+}
+
+// runChecks verifies the checks of cfg against the tables written by the
+// run, logging the ones that fail. Checks of tables that were not written
+// report an error rather than run.
+func runChecks(cfg ExportConfig, written map[string]*TableMetadata) []CheckResult {
+	results := make([]CheckResult, len(cfg.Checks))
+	for i, c := range cfg.Checks {
+		results[i] = CheckResult{Name: c.name()}
+		for _, table := range []string{c.Table, c.RefTable} {
+			if written[table] == nil && results[i].Error == "" {
+				results[i].Error = fmt.Sprintf("table %s was not exported", table)
+			}
+		}
+		if results[i].Error == "" {
+			if err := runCheck(cfg, c, written[c.Table], written[c.RefTable], &results[i]); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		switch r := results[i]; {
+		case r.Error != "":
+			log.Printf("Check %q could not run: %s", r.Name, r.Error)
+		case r.Violations > 0:
+			log.Printf("Check %q failed for %d of %d rows", r.Name, r.Violations, r.Rows)
+		}
+	}
+	return results
+}
+
+// runCheck streams the rows of a check's table past an index of its
+// reference table's keys.
+func runCheck(cfg ExportConfig, c CheckConfig, table, refTable *TableMetadata, result *CheckResult) error {
+	refKeys, refValues, err := readCheckColumns(cfg, refTable, c.RefKey, c.RefColumn)
+	if err != nil {
+		return err
+	}
+	refs := make(map[string]interface{}, len(refKeys))
+	for i, k := range refKeys {
+		if k == nil {
+			continue
+		}
+		key := fmt.Sprint(k)
+		if _, ok := refs[key]; ok {
+			return fmt.Errorf("%s.%s has the value %v more than once", c.RefTable, c.RefKey, k)
+		}
+		refs[key] = refValues[i]
+	}
+	refKeys, refValues = nil, nil
+
+	keys, values, err := readCheckColumns(cfg, table, c.Key, c.Column)
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if k == nil {
+			continue
+		}
+		ref, ok := refs[fmt.Sprint(k)]
+		if !ok {
+			result.Unmatched++
+			continue
+		}
+		if values[i] == nil || ref == nil {
+			continue
+		}
+		order, ok := compareCheckValues(values[i], ref)
+		if !ok {
+			return fmt.Errorf("%s.%s value %v (%T) and %s.%s value %v (%T) don't compare",
+				c.Table, c.Column, values[i], values[i], c.RefTable, c.RefColumn, ref, ref)
+		}
+		result.Rows++
+		if checkHolds(c.Op, order) {
+			continue
+		}
+		result.Violations++
+		if len(result.Examples) < maxCheckExamples {
+			result.Examples = append(result.Examples, CheckViolation{
+				Row: i, Key: rejectedValue(k), Value: rejectedValue(values[i]), RefValue: rejectedValue(ref),
+			})
+		}
+	}
+	return nil
+}
+
+// readCheckColumns reads the key and value columns of an exported table,
+// with nulls as nil.
+func readCheckColumns(cfg ExportConfig, table *TableMetadata, key, column string) (keys, values []interface{}, err error) {
+	r, err := npz.Open(cfg.outputPath(table.TableName))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	fields := make(map[string]FieldMetadata, len(table.Fields))
+	for _, f := range table.Fields {
+		fields[f.FieldName] = f
+	}
+	var columns [2][]interface{}
+	for i, name := range []string{key, column} {
+		field, ok := fields[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("table %s has no column %s", table.TableName, name)
+		}
+		if columns[i], err = readCheckColumn(r, cfg.OutDir, field); err != nil {
+			return nil, nil, fmt.Errorf("reading %s.%s: %w", table.TableName, name, err)
+		}
+	}
+	return columns[0], columns[1], nil
+}
+
+// readCheckColumn reads a column of an NPZ archive in dir like convert
+// does.
+func readCheckColumn(r *npz.Reader, dir string, field FieldMetadata) ([]interface{}, error) {
+	column, err := readDecodedColumn(r, dir, field.FieldName)
+	if err != nil {
+		return nil, err
+	}
+	if field.Encoding == EncodingDecimalScaled {
+		if column, err = readScaledDecimals(r, field, column); err != nil {
+			return nil, err
+		}
+	}
+	rv := reflect.ValueOf(column)
+	var mask []bool
+	if m, err := readNpzColumn(r, field.FieldName+maskSuffix); err == nil {
+		if mask, _ = m.([]bool); len(mask) != rv.Len() {
+			return nil, fmt.Errorf("null mask has %d values, expected %d", len(mask), rv.Len())
+		}
+	}
+	values := make([]interface{}, rv.Len())
+	for i := range values {
+		if mask != nil && mask[i] {
+			continue
+		}
+		values[i] = npzValue(field, rv.Index(i).Interface())
+	}
+	return values, nil
+}
+
+// compareCheckValues compares two values of a check: times with times,
+// and numbers, including numeric text such as decimals, with numbers.
+// Other text compares as text.
+func compareCheckValues(a, b interface{}) (int, bool) {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ta.Compare(tb), ok
+	}
+	if fa, ok := moneyAmount(a); ok {
+		if fb, ok := moneyAmount(b); ok {
+			return cmp.Compare(fa, fb), true
+		}
+	}
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	return strings.Compare(sa, sb), okA && okB
+}
+
+// checkHolds reports whether a comparison result satisfies op.
+func checkHolds(op string, order int) bool {
+	switch op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case ">=":
+		return order >= 0
+	default:
+		return order > 0
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+)
+
+// ChunkStats describes a chunk of a table's file, a Parquet row group or a
+// record batch of a Feather file, with the range of values of its key and
+// timestamp columns, so loaders filtering on those columns can skip the
+// chunks that hold no matching rows.
+type ChunkStats struct {
+	// FirstRow is the index in the table of the chunk's first row.
+	FirstRow int64 `json:"first_row"`
+	Rows     int64 `json:"rows"`
+	// Columns maps the primary key, timestamp and date columns to the
+	// range of their values in the chunk.
+	Columns map[string]ColumnRange `json:"columns,omitempty"`
+}
+
+// ColumnRange is the range of the values of a column in a chunk. Min and
+// Max are nil when the chunk has only nulls in the column; timestamps are
+// in RFC 3339 format and dates in YYYY-MM-DD format.
+type ColumnRange struct {
+	Min   interface{} `json:"min"`
+	Max   interface{} `json:"max"`
+	Nulls int64       `json:"null_count"`
+}
+
+// chunkStatsBuilder collects the ChunkStats of a file's chunks as its rows
+// are written.
+type chunkStatsBuilder struct {
+	fields []FieldMetadata
+	ranges []ColumnRange
+	rows   int64
+	chunks []ChunkStats
+}
+
+// newChunkStatsBuilder returns the builder of the chunk statistics of the
+// primary key, timestamp and date columns among columns. Hashed columns
+// are left out, since the range of their hashes says nothing about the
+// values.
+func newChunkStatsBuilder(columns []FieldMetadata) *chunkStatsBuilder {
+	b := &chunkStatsBuilder{}
+	for _, field := range columns {
+		if field.Encoding == EncodingHash {
+			continue
+		}
+		if field.IsPrimaryKey || field.DataType == DataTypeTime || field.DataType == DataTypeDate {
+			b.fields = append(b.fields, field)
+		}
+	}
+	b.ranges = make([]ColumnRange, len(b.fields))
+	return b
+}
+
+// add widens the ranges of the current chunk with a row.
+func (b *chunkStatsBuilder) add(row TableRow) {
+	b.rows++
+	for i, field := range b.fields {
+		r := &b.ranges[i]
+		v, ok := rangeValue(field, row[field.FieldName])
+		if !ok {
+			r.Nulls++
+			continue
+		}
+		if r.Min == nil || laterWatermark(v, r.Min) {
+			r.Min = v
+		}
+		if r.Max == nil || laterWatermark(r.Max, v) {
+			r.Max = v
+		}
+	}
+}
+
+// flush ends the current chunk.
+func (b *chunkStatsBuilder) flush() {
+	if b.rows == 0 {
+		return
+	}
+	chunk := ChunkStats{Rows: b.rows}
+	if n := len(b.chunks); n > 0 {
+		chunk.FirstRow = b.chunks[n-1].FirstRow + b.chunks[n-1].Rows
+	}
+	if len(b.fields) > 0 {
+		chunk.Columns = make(map[string]ColumnRange, len(b.fields))
+	}
+	for i, field := range b.fields {
+		r := b.ranges[i]
+		if field.DataType == DataTypeDate {
+			if t, ok := r.Min.(time.Time); ok {
+				r.Min = t.Format(time.DateOnly)
+				r.Max = r.Max.(time.Time).Format(time.DateOnly)
+			}
+		}
+		chunk.Columns[field.FieldName] = r
+		b.ranges[i] = ColumnRange{}
+	}
+	b.chunks = append(b.chunks, chunk)
+	b.rows = 0
+}
+
+// rangeValue returns a value of a column in the form its range is kept
+// in, and false for nulls and values that are not comparable.
+func rangeValue(field FieldMetadata, value interface{}) (interface{}, bool) {
+	if field.DataType == DataTypeTime || field.DataType == DataTypeDate {
+		t, ok := timeValue(value)
+		return t.UTC(), ok
+	}
+	switch v := value.(type) {
+	case int64, float64, string:
+		return v, true
+	case int:
+		return int64(v), true
+	case []byte:
+		return string(v), true
+	}
+	return nil, false
+}
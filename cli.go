@@ -0,0 +1,462 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// exportOptions holds the command-line settings of an export run.
+type exportOptions struct {
+	Export ExportConfig
+	// ConfigPath is the -config file the export is defined by, if any.
+	ConfigPath       string
+	DictEncoding     string
+	ArrayEncoding    string
+	BinaryEncoding   string
+	MetadataLayout   string
+	MetadataExamples int
+	EmptyTables      string
+	EmbedMetadata    bool
+	EmitNotebook     bool
+	EmitLoader       bool
+	FeatureSpec      string
+	SchemaOnly       bool
+	SchemaStats      bool
+	ReuseMetadata    string
+	// PatchColumns are the columns per table that -patch-columns patches
+	// into an existing export.
+	PatchColumns map[string][]string
+	// Incremental is the state file of incremental exports.
+	Incremental string
+	// CheckpointRows is the number of rows after which a table's export
+	// is checkpointed, 0 for none.
+	CheckpointRows   int
+	Resume           bool
+	Snapshot         bool
+	FastCopy         bool
+	PauseAPIAddr     string
+	TempDir          string
+	SpillThresholdMB int64
+	MemoryBudgetMB   int64
+	// MinFreeDiskMB is the free space the output and temporary
+	// directories must keep, 0 to not check it; OnLowDisk is what the
+	// export does when they run low.
+	MinFreeDiskMB int64
+	OnLowDisk     string
+	Concurrency   int
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	// ProgressInterval is how often a progress snapshot is recorded, 0 for
+	// never.
+	ProgressInterval time.Duration
+	// CacheDir caches the rows read from the source, so a rerun reads the
+	// same tables from the cache; empty to not cache them.
+	CacheDir string
+	// CacheTTL is how long the cached rows of a table read without a
+	// snapshot or a watermark range are used, 0 for as long as they exist.
+	CacheTTL time.Duration
+	// FollowFKs adds the tables the selected tables reference to the
+	// export, up to FKDepth levels of references, 0 for all of them.
+	FollowFKs bool
+	FKDepth   int
+	// Anonymize replaces the names of the -schema-only metadata with
+	// pseudonyms and leaves out the values it would show.
+	Anonymize bool
+}
+
+// parseExportFlags parses the export command line.
+func parseExportFlags(args []string) (exportOptions, error) {
+	var opts exportOptions
+	var configPath, source, dsn, dbName, tables, schemas, outDir, format, delimiter, compression, decimals, nullPolicy, sinkExec, upload, outputs, hashColumns, patchColumns, parquetCodec string
+	var batchSize, rowGroupRows, pageSize, maxProcs, nice, ioLevel, columnGroupSize, limit int
+	var ioClass, sampleMethod, healthBaseline, vocabulary, scaling string
+	var sample float64
+	var profileBudget time.Duration
+	var batchTimeout time.Duration
+	var fillDefaults, quarantine, exactCounts, profile, includeViews, denormalize, reproducible, health, freezeVocabulary bool
+	params := make(map[string]string)
+
+	defaults := defaultExportConfig()
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "", "YAML or TOML export definition; other flags override its values")
+	fs.StringVar(&source, "source", sourcePostgres, "database backend: postgres, mongodb or sqlite")
+	fs.StringVar(&dsn, "dsn", defaultDSN, "PostgreSQL connection string, MongoDB URI or SQLite database file")
+	fs.StringVar(&dbName, "db", defaults.Connection.DBName, "database name recorded as the dataset name")
+	fs.StringVar(&tables, "tables", strings.Join(defaults.tableNames(), ","), "comma-separated list of tables or collections to export")
+	fs.StringVar(&schemas, "schemas", "", "comma-separated list of PostgreSQL schemas whose tables can be exported (default public); tables outside public are named schema.table")
+	fs.BoolVar(&includeViews, "include-views", false, "let -tables list PostgreSQL views and materialized views, exported like tables")
+	fs.StringVar(&outDir, "out", defaults.OutDir, "output directory for exported files and metadata")
+	fs.StringVar(&format, "format", defaults.Format, "output file format: npz, parquet, feather or csv")
+	fs.StringVar(&delimiter, "csv-delimiter", defaults.CSVDelimiter, `field delimiter of csv files, \t for tabs`)
+	fs.StringVar(&compression, "npz-compression", npzCompressionDeflate, "compression of npz arrays: deflate, or none to store them aligned for memory mapping")
+	fs.StringVar(&decimals, "decimal-encoding", decimalsFloat, "decimal columns in npz files: float, string for exact text, or scaled for integers times 10^scale")
+	fs.BoolVar(&fillDefaults, "fill-defaults", false, "store nulls of npz columns as their constant SQL DEFAULT instead of 0 or \"\", recording it as the column's fill_value")
+	fs.IntVar(&columnGroupSize, "column-group-size", 0, "split tables with more columns than this, besides their primary key, into column group files of at most this many columns (0 disables)")
+	fs.Float64Var(&sample, "sample", 0, "export this fraction of every table's rows, e.g. 0.01 for 1%, with TABLESAMPLE on PostgreSQL and random() on SQLite (0 exports every row)")
+	fs.StringVar(&sampleMethod, "sample-method", sampleBernoulli, "TABLESAMPLE method of -sample on PostgreSQL: bernoulli samples rows, system whole pages, reading less of the table")
+	fs.IntVar(&limit, "limit", 0, "export at most this many rows of every table and query, after sampling (0 for all)")
+	fs.BoolVar(&exactCounts, "exact-counts", false, "count the rows of every table for the metadata's exact_rows, next to the planner's estimated_rows")
+	fs.BoolVar(&profile, "profile", false, "profile every exported column (count, nulls, approximate distinct count, min/max, mean/stddev) into the metadata and stats.json")
+	fs.DurationVar(&profileBudget, "profile-budget", 0, "time -profile may spend over the run, shared among the tables; tables past their share are profiled from a sample of their rows (0 for no limit)")
+	fs.BoolVar(&reproducible, "reproducible", false, "order query results on their columns and record the SHA-256 of every exported array, so runs over the same data write identical files")
+	fs.StringVar(&vocabulary, "vocabulary", "", "vocabulary.json of an earlier export whose codes label encoded columns keep, new values getting the next codes")
+	fs.BoolVar(&freezeVocabulary, "freeze-vocabulary", false, "export values missing from the -vocabulary of label encoded columns as nulls, as at inference time")
+	fs.StringVar(&scaling, "scaling", "", "scaling.json of an earlier export whose parameters scaled columns are scaled with, instead of fitting them to the data")
+	fs.BoolVar(&health, "health", false, "gate the run on the export's health: exit with code 3 when tables are skipped, checks fail or rows are rejected, with the verdict in run_report.json")
+	fs.StringVar(&healthBaseline, "health-baseline", "", "earlier export directory whose row counts and column distributions -health compares the export to; implies -health")
+	fs.BoolVar(&quarantine, "quarantine", false, "leave rows with values that fail to convert out of the export, writing them to rejects/<table>.jsonl with the errors")
+	fs.StringVar(&nullPolicy, "null-policy", nullMask, "nulls of every column: mask, sentinel=<value>, nan (float columns), drop_row or error")
+	fs.StringVar(&outputs, "outputs", "", "comma-separated format=dir list of further outputs written from the same rows, e.g. parquet=analytics")
+	fs.StringVar(&sinkExec, "sink-exec", "", "shell command started per table to read it as an Arrow IPC stream on stdin instead of writing files (feather only); NPZ_TABLE holds the table name")
+	fs.StringVar(&upload, "upload", "", "s3://bucket/prefix to upload the export's files to once written, with credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	fs.IntVar(&rowGroupRows, "parquet-row-group-rows", 0, "maximum rows per row group of parquet files (0 for the default of 1048576)")
+	fs.IntVar(&pageSize, "parquet-page-size", 0, "approximate bytes of values per data page of parquet files (0 for the default of 1 MB)")
+	fs.StringVar(&parquetCodec, "parquet-codec", "", "compression of the pages of parquet files: snappy (the default), zstd, gzip or none")
+	fs.IntVar(&batchSize, "batch-size", defaults.BatchSize, "rows fetched per query")
+	fs.DurationVar(&batchTimeout, "batch-timeout", 0, "time a batch may take to read before it is considered stalled and retried (0 for the default of 5m)")
+	fs.StringVar(&hashColumns, "hash-columns", "", "comma-separated table.column list of ID columns to replace with keyed 64-bit hashes")
+	fs.Func("param", "value of a named query parameter as name=value (repeatable)", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected name=value")
+		}
+		params[name] = value
+		return nil
+	})
+	fs.StringVar(&opts.DictEncoding, "dict-encoding", dictionaryAuto, "dictionary encoding of string columns: auto, always or never")
+	fs.StringVar(&opts.ArrayEncoding, "array-encoding", arraysJSON, "PostgreSQL array columns: json strings, or ragged values and offsets arrays (npz only)")
+	fs.StringVar(&opts.BinaryEncoding, "binary-encoding", binaryRagged, "binary columns in npz files: ragged uint8 values and offsets arrays, or base64 strings")
+	fs.StringVar(&opts.MetadataLayout, "metadata-layout", metadataSingle, "metadata layout: single (metadata.json) or split (per-table files plus index)")
+	fs.IntVar(&opts.MetadataExamples, "examples", 0, "number of example values per non-PII column to store in metadata")
+	fs.StringVar(&opts.EmptyTables, "empty-tables", emptyTablesWrite, "tables without rows or columns: write empty arrays or skip")
+	fs.BoolVar(&opts.EmbedMetadata, "embed-metadata", false, "store __metadata__.json inside each table's NPZ")
+	fs.BoolVar(&opts.SchemaOnly, "schema-only", false, "write the metadata without reading or exporting any rows")
+	fs.BoolVar(&opts.SchemaStats, "schema-stats", false, "with -schema-only, add column statistics from PostgreSQL's pg_stats")
+	fs.BoolVar(&opts.Anonymize, "anonymize", false, "with -schema-only, replace the names of tables and columns with stable pseudonyms (keyed by NPZ_HASH_KEY) and leave out examples, statistics and SQL, for sharing the schema with vendors")
+	fs.StringVar(&opts.ReuseMetadata, "reuse-metadata", "", "metadata.json (or metadata/index.json) of an approved earlier export; fail if the live schema no longer matches it")
+	fs.StringVar(&patchColumns, "patch-columns", "", "comma-separated table.column list of columns to re-export into the existing npz files in the output directory, matching rows on the primary key")
+	fs.StringVar(&opts.Incremental, "incremental", "", "state file of incremental exports; tables with a watermark column only export rows past the watermark it records")
+	fs.BoolVar(&opts.Snapshot, "snapshot", false, "read every table from one consistent PostgreSQL snapshot, recording its LSN in the metadata")
+	fs.BoolVar(&opts.FastCopy, "fast-copy", false, "read PostgreSQL tables with one streamed COPY ... TO STDOUT each instead of batch queries")
+	fs.BoolVar(&denormalize, "denormalize", false, "join the tables each table references with foreign keys onto its rows, with columns prefixed by the foreign key column")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "cache the rows read from the source in this directory, and read tables cached by an earlier run from it instead of the database")
+	fs.DurationVar(&opts.CacheTTL, "cache-ttl", 24*time.Hour, "with -cache-dir, read tables cached without -snapshot or an -incremental watermark range again once their cache is older than this (0 to never)")
+	fs.BoolVar(&opts.FollowFKs, "follow-fks", false, "also export the tables the selected tables reference with foreign keys, and the tables those reference")
+	fs.IntVar(&opts.FKDepth, "fk-depth", 0, "with -follow-fks, follow at most this many levels of foreign keys (0 for all)")
+	fs.IntVar(&opts.CheckpointRows, "checkpoint-rows", 0, "checkpoint each table's export every N rows, so an interrupted export can be resumed (npz only, 0 disables)")
+	fs.BoolVar(&opts.Resume, "resume", false, "resume the interrupted export in the output directory from its checkpoints")
+	fs.StringVar(&opts.FeatureSpec, "feature-spec", "", "YAML or TOML file listing the table.column features a model uses; other columns are not exported")
+	fs.BoolVar(&opts.EmitNotebook, "emit-notebook", false, "write an explore.ipynb starter notebook next to the exported files")
+	fs.BoolVar(&opts.EmitLoader, "emit-loader", false, "write a Python loader and pytest tests checking the exported NPZ files")
+	fs.StringVar(&opts.PauseAPIAddr, "pause-api", "", "address for the pause/resume HTTP API, e.g. localhost:8090")
+	fs.StringVar(&opts.TempDir, "temp-dir", os.TempDir(), "directory for temporary spill files")
+	fs.Int64Var(&opts.SpillThresholdMB, "spill-threshold-mb", 256, "buffered MB per table before column buffers spill to disk (0 disables spilling)")
+	fs.Int64Var(&opts.MemoryBudgetMB, "memory-budget-mb", 256, "MB of fetched rows per table held in memory while waiting to be written")
+	fs.Int64Var(&opts.MinFreeDiskMB, "min-free-disk-mb", 1024, "MB of free space the output and temporary directories must keep (0 disables the checks); an export estimated not to fit only logs a warning")
+	fs.StringVar(&opts.OnLowDisk, "on-low-disk", lowDiskFail, "when free space drops below -min-free-disk-mb: pause until space is freed, or fail, keeping the checkpoints for -resume")
+	fs.IntVar(&opts.Concurrency, "concurrency", 1, "number of tables exported concurrently")
+	fs.IntVar(&maxProcs, "max-procs", 0, "GOMAXPROCS, the CPUs running the exporter at once (0 for all)")
+	fs.IntVar(&nice, "nice", 0, "scheduling niceness of the exporter, up to 19 for the lowest CPU priority")
+	fs.StringVar(&ioClass, "io-class", "", "Linux I/O scheduling class of the exporter: best_effort, with -io-level, or idle")
+	fs.IntVar(&ioLevel, "io-level", 0, "I/O priority within the best_effort class, from 0 (highest) to 7 (lowest)")
+	fs.IntVar(&opts.MaxAttempts, "max-attempts", 3, "times a failing table is tried before it is skipped")
+	fs.DurationVar(&opts.RetryDelay, "retry-delay", 5*time.Second, "delay before retrying a failed table, multiplied by the attempt number")
+	fs.DurationVar(&opts.ProgressInterval, "progress-interval", time.Minute, "how often to append a progress snapshot to progress.jsonl in the output directory (0 disables)")
+	fs.Parse(args)
+
+	opts.Export = defaults
+	if configPath != "" {
+		cfg, err := loadExportConfig(configPath)
+		if err != nil {
+			return opts, err
+		}
+		opts.Export = cfg
+		opts.ConfigPath = configPath
+	}
+
+	extraOutputs, err := parseOutputs(outputs)
+	if err != nil {
+		return opts, err
+	}
+
+	// Flags given explicitly take precedence over the config file.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "source":
+			opts.Export.Connection.Source = source
+		case "dsn":
+			opts.Export.Connection.DSN = dsn
+		case "db":
+			opts.Export.Connection.DBName = dbName
+		case "tables":
+			opts.Export.Tables = nil
+			for _, t := range strings.Split(tables, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					opts.Export.Tables = append(opts.Export.Tables, TableConfig{Name: t})
+				}
+			}
+		case "out":
+			opts.Export.OutDir = outDir
+		case "batch-size":
+			opts.Export.BatchSize = batchSize
+		case "batch-timeout":
+			opts.Export.BatchTimeout = ""
+			if batchTimeout > 0 {
+				opts.Export.BatchTimeout = batchTimeout.String()
+			}
+		case "format":
+			opts.Export.Format = format
+		case "csv-delimiter":
+			opts.Export.CSVDelimiter = delimiter
+		case "npz-compression":
+			opts.Export.NPZCompression = compression
+		case "decimal-encoding":
+			opts.Export.DecimalEncoding = decimals
+		case "fill-defaults":
+			opts.Export.FillDefaults = fillDefaults
+		case "schemas":
+			opts.Export.Schemas = nil
+			for _, s := range strings.Split(schemas, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					opts.Export.Schemas = append(opts.Export.Schemas, s)
+				}
+			}
+		case "include-views":
+			opts.Export.IncludeViews = includeViews
+		case "column-group-size":
+			opts.Export.ColumnGroupSize = columnGroupSize
+		case "sample":
+			opts.Export.TableSample.Fraction = sample
+		case "sample-method":
+			opts.Export.TableSample.Method = sampleMethod
+		case "limit":
+			opts.Export.TableSample.Limit = limit
+		case "exact-counts":
+			opts.Export.ExactCounts = exactCounts
+		case "reproducible":
+			opts.Export.Reproducible = reproducible
+		case "profile-budget":
+			opts.Export.ProfileBudget = ""
+			if profileBudget > 0 {
+				opts.Export.ProfileBudget = profileBudget.String()
+			}
+		case "profile":
+			opts.Export.Profile = profile
+		case "quarantine":
+			opts.Export.Quarantine = quarantine
+		case "vocabulary":
+			opts.Export.Vocabulary = vocabulary
+		case "freeze-vocabulary":
+			opts.Export.FreezeVocabulary = freezeVocabulary
+		case "scaling":
+			opts.Export.Scaling = scaling
+		case "health":
+			if !health {
+				opts.Export.Health = nil
+			} else if opts.Export.Health == nil {
+				opts.Export.Health = &HealthConfig{}
+			}
+		case "health-baseline":
+			if opts.Export.Health == nil {
+				opts.Export.Health = &HealthConfig{}
+			}
+			opts.Export.Health.Baseline = healthBaseline
+		case "null-policy":
+			opts.Export.NullPolicy = parseNullPolicy(nullPolicy)
+		case "sink-exec":
+			opts.Export.Sink.Exec = sinkExec
+		case "upload":
+			if opts.Export.Sink.Upload == nil {
+				opts.Export.Sink.Upload = &UploadConfig{}
+			}
+			opts.Export.Sink.Upload.URL = upload
+		case "outputs":
+			opts.Export.Outputs = extraOutputs
+		case "parquet-row-group-rows":
+			opts.Export.Parquet.RowGroupRows = rowGroupRows
+		case "parquet-page-size":
+			opts.Export.Parquet.PageSize = pageSize
+		case "parquet-codec":
+			opts.Export.Parquet.Codec = parquetCodec
+		case "concurrency":
+			opts.Export.Resources.Concurrency = opts.Concurrency
+		case "max-procs":
+			opts.Export.Resources.MaxProcs = maxProcs
+		case "nice":
+			opts.Export.Resources.Nice = nice
+		case "io-class":
+			opts.Export.Resources.IOClass = ioClass
+		case "io-level":
+			opts.Export.Resources.IOLevel = ioLevel
+		}
+	})
+	if opts.Export.Resources.Concurrency > 0 {
+		opts.Concurrency = opts.Export.Resources.Concurrency
+	}
+	// -denormalize applies to the tables, however they were selected.
+	if denormalize {
+		for i := range opts.Export.Tables {
+			opts.Export.Tables[i].Denormalize = true
+		}
+	}
+	if hashColumns != "" {
+		if err := opts.Export.addHashColumns(strings.Split(hashColumns, ",")); err != nil {
+			return opts, err
+		}
+	}
+	opts.Export.resolveParams(params)
+	if err := opts.Export.validate(); err != nil {
+		return opts, err
+	}
+
+	switch opts.DictEncoding {
+	case dictionaryAuto, dictionaryAlways, dictionaryNever:
+	default:
+		return opts, fmt.Errorf("invalid -dict-encoding %q, expected auto, always or never", opts.DictEncoding)
+	}
+	switch opts.ArrayEncoding {
+	case arraysJSON:
+	case arraysRagged:
+		if opts.Export.Format != formatNPZ {
+			return opts, fmt.Errorf("-array-encoding %s is only supported with the %s format", arraysRagged, formatNPZ)
+		}
+	default:
+		return opts, fmt.Errorf("invalid -array-encoding %q, expected json or ragged", opts.ArrayEncoding)
+	}
+	switch opts.BinaryEncoding {
+	case binaryRagged:
+	case binaryBase64:
+		if opts.Export.Format != formatNPZ {
+			return opts, fmt.Errorf("-binary-encoding %s is only supported with the %s format, the others store binary columns as they are", binaryBase64, formatNPZ)
+		}
+	default:
+		return opts, fmt.Errorf("invalid -binary-encoding %q, expected ragged or base64", opts.BinaryEncoding)
+	}
+	switch opts.MetadataLayout {
+	case metadataSingle, metadataSplit:
+	default:
+		return opts, fmt.Errorf("invalid -metadata-layout %q, expected single or split", opts.MetadataLayout)
+	}
+	switch opts.EmptyTables {
+	case emptyTablesWrite, emptyTablesSkip:
+	default:
+		return opts, fmt.Errorf("invalid -empty-tables %q, expected write or skip", opts.EmptyTables)
+	}
+	if opts.EmitLoader && opts.Export.Format != formatNPZ {
+		return opts, fmt.Errorf("-emit-loader is only supported with the %s format", formatNPZ)
+	}
+	if opts.SchemaStats && !opts.SchemaOnly {
+		return opts, fmt.Errorf("-schema-stats requires -schema-only")
+	}
+	if opts.Anonymize && !opts.SchemaOnly {
+		return opts, fmt.Errorf("-anonymize requires -schema-only")
+	}
+	if opts.SchemaOnly && opts.ReuseMetadata != "" {
+		return opts, fmt.Errorf("-reuse-metadata exports data and can't be used with -schema-only")
+	}
+	if patchColumns != "" {
+		columns, err := parsePatchColumns(strings.Split(patchColumns, ","))
+		if err != nil {
+			return opts, err
+		}
+		for table := range columns {
+			if _, ok := opts.Export.table(table); !ok {
+				return opts, fmt.Errorf("patch column table %s is not a selected table", table)
+			}
+		}
+		if opts.Export.Format != formatNPZ {
+			return opts, fmt.Errorf("-patch-columns is only supported with the %s format", formatNPZ)
+		}
+		if opts.SchemaOnly {
+			return opts, fmt.Errorf("-patch-columns exports data and can't be used with -schema-only")
+		}
+		opts.PatchColumns = columns
+	}
+	if opts.CheckpointRows < 0 {
+		return opts, fmt.Errorf("invalid -checkpoint-rows %d", opts.CheckpointRows)
+	}
+	if opts.CheckpointRows > 0 && opts.Export.Format != formatNPZ {
+		return opts, fmt.Errorf("-checkpoint-rows needs the %s format", formatNPZ)
+	}
+	if opts.Export.ColumnGroupSize > 0 && (opts.CheckpointRows > 0 || opts.PatchColumns != nil) {
+		return opts, fmt.Errorf("column_group_size can't be used with -checkpoint-rows or -patch-columns")
+	}
+	if len(opts.Export.Outputs) > 0 && (opts.CheckpointRows > 0 || opts.PatchColumns != nil) {
+		return opts, fmt.Errorf("outputs can't be used with -checkpoint-rows or -patch-columns")
+	}
+	for _, name := range append(opts.Export.tableNames(), opts.Export.queryNames()...) {
+		if len(opts.Export.columnGroups(name)) > 0 && (opts.CheckpointRows > 0 || opts.PatchColumns != nil) {
+			return opts, fmt.Errorf("%s: column_groups can't be used with -checkpoint-rows or -patch-columns", name)
+		}
+		if opts.Export.split(name) != nil && (opts.CheckpointRows > 0 || opts.PatchColumns != nil) {
+			return opts, fmt.Errorf("%s: split can't be used with -checkpoint-rows or -patch-columns", name)
+		}
+		if len(opts.Export.transforms(name).SharedDictionary) > 0 && opts.CheckpointRows > 0 {
+			return opts, fmt.Errorf("%s: shared_dictionary can't be used with -checkpoint-rows", name)
+		}
+	}
+	if opts.FKDepth < 0 {
+		return opts, fmt.Errorf("invalid -fk-depth %d", opts.FKDepth)
+	}
+	if opts.FKDepth > 0 && !opts.FollowFKs {
+		return opts, fmt.Errorf("-fk-depth needs -follow-fks")
+	}
+	if opts.Resume && opts.CheckpointRows == 0 {
+		return opts, fmt.Errorf("-resume needs -checkpoint-rows")
+	}
+	if opts.Incremental != "" {
+		watermarks := false
+		for _, t := range opts.Export.Tables {
+			watermarks = watermarks || t.Watermark != ""
+		}
+		if !watermarks {
+			return opts, fmt.Errorf("-incremental needs a watermark column on at least one table")
+		}
+		if opts.SchemaOnly || opts.PatchColumns != nil {
+			return opts, fmt.Errorf("-incremental can't be used with -schema-only or -patch-columns")
+		}
+	}
+	if opts.EmbedMetadata && opts.Export.Format == formatCSV {
+		return opts, fmt.Errorf("-embed-metadata is not supported with the %s format", formatCSV)
+	}
+	if opts.EmbedMetadata && opts.Export.Sink.Exec != "" {
+		return opts, fmt.Errorf("-embed-metadata is not supported with an exec sink")
+	}
+	if opts.SpillThresholdMB < 0 {
+		return opts, fmt.Errorf("invalid -spill-threshold-mb %d, expected a non-negative number", opts.SpillThresholdMB)
+	}
+	if opts.MemoryBudgetMB <= 0 {
+		return opts, fmt.Errorf("invalid -memory-budget-mb %d, expected a positive number", opts.MemoryBudgetMB)
+	}
+	if opts.MinFreeDiskMB < 0 {
+		return opts, fmt.Errorf("invalid -min-free-disk-mb %d, expected a non-negative number", opts.MinFreeDiskMB)
+	}
+	switch opts.OnLowDisk {
+	case lowDiskPause, lowDiskFail:
+	default:
+		return opts, fmt.Errorf("invalid -on-low-disk %q, expected pause or fail", opts.OnLowDisk)
+	}
+	if opts.Concurrency < 1 {
+		return opts, fmt.Errorf("invalid -concurrency %d, expected a positive number", opts.Concurrency)
+	}
+	if opts.MaxAttempts < 1 {
+		return opts, fmt.Errorf("invalid -max-attempts %d, expected a positive number", opts.MaxAttempts)
+	}
+	if opts.CacheTTL < 0 {
+		return opts, fmt.Errorf("invalid -cache-ttl %s, expected a non-negative duration", opts.CacheTTL)
+	}
+	if opts.RetryDelay < 0 {
+		return opts, fmt.Errorf("invalid -retry-delay %s, expected a non-negative duration", opts.RetryDelay)
+	}
+	if opts.ProgressInterval < 0 {
+		return opts, fmt.Errorf("invalid -progress-interval %s, expected a non-negative duration", opts.ProgressInterval)
+	}
+	if opts.MetadataExamples < 0 {
+		return opts, fmt.Errorf("invalid -examples %d, expected a non-negative number", opts.MetadataExamples)
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// otherColumnGroup is the column group of the columns a table's
+// column_groups don't name.
+const otherColumnGroup = "other"
+
+// ColumnGroup marks a table entry of the metadata as one of the files a
+// table is split into, either by its column_groups or because it is wider
+// than column_group_size. Every group has the table's rows in the same
+// order, and its primary key columns if it has any, so the groups join
+// back into the table.
+type ColumnGroup struct {
+	// Table is the name of the split table.
+	Table string `json:"table"`
+	// Name is the group's name in the table's column_groups, or groupN
+	// for the groups of column_group_size.
+	Name string `json:"name"`
+	// Index numbers the groups from 1 to Count, in column order.
+	Index int `json:"index"`
+	Count int `json:"count"`
+	// Key are the primary key columns every group has.
+	Key []string `json:"key,omitempty"`
+}
+
+// ColumnGroupConfig is a named group of a table's columns, such as its
+// identity, behavioral or billing features.
+type ColumnGroupConfig struct {
+	Name    string   `yaml:"name" toml:"name"`
+	Columns []string `yaml:"columns" toml:"columns"`
+}
+
+// validateColumnGroups checks the column_groups of a table or query.
+func validateColumnGroups(groups []ColumnGroupConfig) error {
+	seen := make(map[string]string)
+	names := make(map[string]bool)
+	for _, g := range groups {
+		if g.Name == "" || strings.ContainsAny(g.Name, "./\\") || g.Name == otherColumnGroup {
+			return fmt.Errorf("invalid column group name %q", g.Name)
+		}
+		if names[g.Name] {
+			return fmt.Errorf("column group %s is listed twice", g.Name)
+		}
+		names[g.Name] = true
+		if len(g.Columns) == 0 {
+			return fmt.Errorf("column group %s has no columns", g.Name)
+		}
+		for _, column := range g.Columns {
+			if other, ok := seen[column]; ok {
+				return fmt.Errorf("column %s is in column groups %s and %s", column, other, g.Name)
+			}
+			seen[column] = g.Name
+		}
+	}
+	return nil
+}
+
+// plannedGroup is a column group of a table and its columns.
+type plannedGroup struct {
+	name    string
+	columns []FieldMetadata
+}
+
+// columnGroupName returns the name a column group of table is exported
+// as.
+func columnGroupName(table, group string) string {
+	return table + "." + group
+}
+
+// planColumnGroups splits the columns of a table into the groups named by
+// its column_groups, followed by a group of the columns they leave out,
+// or else into groups of at most size columns besides its primary key
+// columns. Every group starts with the primary key columns. It returns nil
+// for tables without column_groups no wider than size.
+func planColumnGroups(columns []FieldMetadata, size int, named []ColumnGroupConfig) ([]plannedGroup, error) {
+	var key, others []FieldMetadata
+	for _, field := range columns {
+		if field.IsPrimaryKey {
+			key = append(key, field)
+		} else {
+			others = append(others, field)
+		}
+	}
+	if len(named) > 0 {
+		var groups []plannedGroup
+		for _, g := range named {
+			group := plannedGroup{name: g.Name, columns: append([]FieldMetadata{}, key...)}
+			for _, column := range g.Columns {
+				i := slices.IndexFunc(columns, func(f FieldMetadata) bool { return f.FieldName == column })
+				if i < 0 {
+					return nil, fmt.Errorf("column group %s: no column %s", g.Name, column)
+				}
+				if !columns[i].IsPrimaryKey {
+					group.columns = append(group.columns, columns[i])
+				}
+			}
+			groups = append(groups, group)
+		}
+		rest := plannedGroup{name: otherColumnGroup, columns: append([]FieldMetadata{}, key...)}
+		for _, field := range others {
+			if !slices.ContainsFunc(named, func(g ColumnGroupConfig) bool { return slices.Contains(g.Columns, field.FieldName) }) {
+				rest.columns = append(rest.columns, field)
+			}
+		}
+		if len(rest.columns) > len(key) {
+			groups = append(groups, rest)
+		}
+		return groups, nil
+	}
+	if size <= 0 || len(others) <= size {
+		return nil, nil
+	}
+	var groups []plannedGroup
+	for start := 0; start < len(others); start += size {
+		group := append([]FieldMetadata{}, key...)
+		groups = append(groups, plannedGroup{
+			name:    fmt.Sprintf("group%d", len(groups)+1),
+			columns: append(group, others[start:min(start+size, len(others))]...),
+		})
+	}
+	return groups, nil
+}
+
+// columnGroupWriter writes the column groups of a table, each to a file of
+// its own, from the same batches of rows.
+type columnGroupWriter struct {
+	writers []tableWriter
+}
+
+// newColumnGroupWriter creates the writers of the groups of a table. Each
+// group spills on its share of the spill threshold.
+func newColumnGroupWriter(ctx context.Context, cfg ExportConfig, tableName string, groups []plannedGroup, spill spillConfig) (*columnGroupWriter, error) {
+	w := &columnGroupWriter{}
+	spill.Threshold /= int64(len(groups))
+	for _, group := range groups {
+		gw, err := newTableWriter(ctx, cfg, columnGroupName(tableName, group.name), group.columns, spill)
+		if err != nil {
+			w.discard()
+			return nil, err
+		}
+		w.writers = append(w.writers, gw)
+	}
+	return w, nil
+}
+
+func (w *columnGroupWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	for _, gw := range w.writers {
+		if err := gw.writeRows(ctx, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *columnGroupWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	var temp int64
+	for i, gw := range w.writers {
+		n, err := gw.close(ctx, files)
+		temp += n
+		if err != nil {
+			for _, rest := range w.writers[i+1:] {
+				rest.discard()
+			}
+			return temp, err
+		}
+	}
+	return temp, nil
+}
+
+func (w *columnGroupWriter) discard() {
+	for _, gw := range w.writers {
+		gw.discard()
+	}
+}
+
+// expandColumnGroups replaces the entries of the tables written in column
+// groups, given the columns of their groups, with an entry per group, and
+// moves their rows and written entries to the groups.
+func expandColumnGroups(cfg ExportConfig, tables []TableMetadata, grouped map[string][]plannedGroup, rows map[string]int, written map[string]*TableMetadata) ([]TableMetadata, error) {
+	var expanded []TableMetadata
+	for _, table := range tables {
+		groups, ok := grouped[table.TableName]
+		if !ok {
+			expanded = append(expanded, table)
+			continue
+		}
+		var key []string
+		for _, field := range groups[0].columns {
+			if field.IsPrimaryKey {
+				key = append(key, field.FieldName)
+			}
+		}
+		for i, planned := range groups {
+			group := table
+			group.TableName = columnGroupName(table.TableName, planned.name)
+			group.SourceTable = table.TableName
+			group.ColumnGroup = &ColumnGroup{Table: table.TableName, Name: planned.name, Index: i + 1, Count: len(groups), Key: key}
+			// The groups have the table's rows, but not its size.
+			group.Chunks, group.SizeBytes = nil, nil
+			// The fields are the table's, with their final metadata.
+			group.Fields = nil
+			for _, column := range planned.columns {
+				for _, field := range table.Fields {
+					if field.FieldName == column.FieldName {
+						group.Fields = append(group.Fields, field)
+					}
+				}
+			}
+			if cfg.NPZCompression == npzCompressionNone {
+				layout, err := npzLayout(cfg.outputPath(group.TableName))
+				if err != nil {
+					return nil, fmt.Errorf("reading the array layout of table %s: %w", group.TableName, err)
+				}
+				group.Arrays = layout
+			}
+			rows[group.TableName] = rows[table.TableName]
+			expanded = append(expanded, group)
+		}
+		delete(rows, table.TableName)
+		delete(written, table.TableName)
+	}
+	// The entries of the other tables moved with the slice.
+	for i := range expanded {
+		if written[expanded[i].TableName] != nil || expanded[i].ColumnGroup != nil {
+			written[expanded[i].TableName] = &expanded[i]
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,991 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ExportConfig is the declarative definition of an export job: where to
+// read from, which tables, columns and queries to export, and where to
+// write them. It is loaded from a YAML or TOML file with -config;
+// command-line flags override the values from the file.
+type ExportConfig struct {
+	Connection ConnectionConfig `yaml:"connection" toml:"connection"`
+	Tables     []TableConfig    `yaml:"tables" toml:"tables"`
+	Queries    []QueryConfig    `yaml:"queries" toml:"queries"`
+	// Views are helper views created for the run, which queries can
+	// select from.
+	Views []ViewConfig `yaml:"views" toml:"views"`
+	// Schemas are the PostgreSQL schemas whose tables can be exported,
+	// public by default. Tables outside public are named schema.table, and
+	// a table named so is found without listing its schema here.
+	Schemas []string `yaml:"schemas" toml:"schemas"`
+	// IncludeViews lets tables list the PostgreSQL database's own views and
+	// materialized views, exported like tables.
+	IncludeViews bool `yaml:"include_views" toml:"include_views"`
+	// Params holds default values of the named parameters of queries and
+	// table filters.
+	Params    map[string]string `yaml:"params" toml:"params"`
+	OutDir    string            `yaml:"out_dir" toml:"out_dir"`
+	BatchSize int               `yaml:"batch_size" toml:"batch_size"`
+	// BatchTimeout is a duration such as 15m that a batch may take to
+	// read before it is considered stalled and retried, 5m by default.
+	// With -fast-copy it bounds the wait for each batch of the COPY.
+	BatchTimeout string `yaml:"batch_timeout" toml:"batch_timeout"`
+	// Format is the file format tables are written in: npz (the default),
+	// parquet, feather or csv.
+	Format string `yaml:"format" toml:"format"`
+	// CSVDelimiter separates the fields of csv files: a single character,
+	// or \t for tab-separated files.
+	CSVDelimiter string `yaml:"csv_delimiter" toml:"csv_delimiter"`
+	// NPZCompression is deflate (the default), or none to store the arrays
+	// of npz files uncompressed and aligned.
+	NPZCompression string `yaml:"npz_compression" toml:"npz_compression"`
+	// DecimalEncoding is how decimal columns are stored in npz files:
+	// float (the default), string for exact text, or scaled for unscaled
+	// integers.
+	DecimalEncoding string `yaml:"decimal_encoding" toml:"decimal_encoding"`
+	// FillDefaults stores the nulls of npz columns whose SQL DEFAULT is a
+	// constant as that constant rather than a zero value.
+	FillDefaults bool `yaml:"fill_defaults" toml:"fill_defaults"`
+	// ColumnGroupSize splits the tables with more columns than this,
+	// besides their primary key, into column groups of at most this many
+	// columns, each written to a file of its own. 0 writes every table to
+	// a single file.
+	ColumnGroupSize int `yaml:"column_group_size" toml:"column_group_size"`
+	// ExactCounts counts the rows of every table in the metadata, next to
+	// the planner's estimate.
+	ExactCounts bool `yaml:"exact_counts" toml:"exact_counts"`
+	// Profile computes a profile of every exported column, stored in the
+	// metadata and in stats.json.
+	Profile bool `yaml:"profile" toml:"profile"`
+	// ProfileBudget is a duration such as 10m that profiling may take over
+	// the whole run, shared among the tables. Tables profiled past their
+	// share are profiled from a sample of their rows.
+	ProfileBudget string `yaml:"profile_budget" toml:"profile_budget"`
+	// Reproducible orders query results on their columns too, and records
+	// the SHA-256 of every exported array, so that two runs over the same
+	// data write the same bytes.
+	Reproducible bool `yaml:"reproducible" toml:"reproducible"`
+	// Vocabulary is the vocabulary.json of an earlier export, whose codes
+	// label encoded columns keep.
+	Vocabulary string `yaml:"vocabulary" toml:"vocabulary"`
+	// FreezeVocabulary exports the values missing from the vocabulary of
+	// a label encoded column as nulls instead of giving them new codes.
+	FreezeVocabulary bool `yaml:"freeze_vocabulary" toml:"freeze_vocabulary"`
+	// Scaling is the scaling.json of an earlier export, whose parameters
+	// scaled columns are scaled with instead of fitting them.
+	Scaling string `yaml:"scaling" toml:"scaling"`
+	// Quarantine leaves the rows with values that fail to convert to their
+	// column's type out of the export, writing them to rejects/<table>.jsonl,
+	// instead of storing nulls or zero values in their place.
+	Quarantine bool `yaml:"quarantine" toml:"quarantine"`
+	// NullPolicy is how the nulls of every column are exported, unless
+	// the column's table or query sets a policy of its own.
+	NullPolicy NullPolicy `yaml:"null_policy" toml:"null_policy"`
+	// Parquet tunes the row groups and pages of parquet files.
+	Parquet ParquetConfig `yaml:"parquet" toml:"parquet"`
+	// Sink streams the tables to a command instead of writing files, or
+	// uploads the files written to object storage.
+	Sink SinkConfig `yaml:"sink" toml:"sink"`
+	// Outputs write the tables again in other formats to other
+	// directories, from the same rows.
+	Outputs []OutputConfig `yaml:"outputs" toml:"outputs"`
+	// Currency configures the normalization of money columns.
+	Currency CurrencyConfig `yaml:"currency" toml:"currency"`
+	// Dimensions are the small tables that joins enrich tables with.
+	Dimensions []DimensionConfig `yaml:"dimensions" toml:"dimensions"`
+	// SampleSize is the number of documents sampled to infer the schema
+	// of a MongoDB collection.
+	SampleSize int `yaml:"schema_sample_size" toml:"schema_sample_size"`
+	// TableLimits are the default limits of every table and query, which
+	// their own limits override.
+	TableLimits TableLimits `yaml:"table_limits" toml:"table_limits"`
+	// TableSample is the default sample of every table, and the default
+	// limit of every table and query, which their own sample overrides.
+	TableSample SampleConfig `yaml:"table_sample" toml:"table_sample"`
+	// NameMatching is how table names are matched against the source's:
+	// exact (the default) or case_insensitive.
+	NameMatching string `yaml:"name_matching" toml:"name_matching"`
+	// Checks are invariants between tables verified after the export.
+	Checks []CheckConfig `yaml:"checks" toml:"checks"`
+	// Health gates the run's exit code on the quality of the export.
+	Health *HealthConfig `yaml:"health" toml:"health"`
+	// Resources limit the CPU and disk priority and the parallelism of
+	// the run.
+	Resources ResourceConfig `yaml:"resources" toml:"resources"`
+}
+
+// ParquetConfig sets the size of the row groups and data pages of parquet
+// files and how their pages are compressed. Zero values keep the defaults:
+// row groups of up to a million rows and 64 MB, pages of about 1 MB, and
+// Snappy compression.
+type ParquetConfig struct {
+	RowGroupRows int `yaml:"row_group_rows" toml:"row_group_rows"`
+	PageSize     int `yaml:"page_size" toml:"page_size"`
+	// Codec compresses the pages of every column: snappy, zstd, gzip or
+	// none. ZstdLevel is the zstd level, 1 to 22, 3 by default.
+	Codec     string `yaml:"codec" toml:"codec"`
+	ZstdLevel int    `yaml:"zstd_level" toml:"zstd_level"`
+}
+
+// ParquetColumnConfig overrides how one column of a parquet file is
+// encoded and compressed. Encoding is auto (the default), plain,
+// dictionary or delta; auto picks a dictionary for strings with few
+// distinct values and delta for integers and timestamps when that is
+// smaller, from the values of each row group. Codec and ZstdLevel
+// override those of ParquetConfig.
+type ParquetColumnConfig struct {
+	Encoding  string `yaml:"encoding" toml:"encoding"`
+	Codec     string `yaml:"codec" toml:"codec"`
+	ZstdLevel int    `yaml:"zstd_level" toml:"zstd_level"`
+}
+
+// ConnectionConfig holds the database connection settings. DSN takes
+// precedence over the individual fields.
+type ConnectionConfig struct {
+	// Source is the database backend: postgres (the default), mongodb or
+	// sqlite. For sqlite, DSN is the path of the database file.
+	Source   string `yaml:"source" toml:"source"`
+	DSN      string `yaml:"dsn" toml:"dsn"`
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	// DBName is the database to connect to; it is also recorded as the
+	// dataset name in the metadata.
+	DBName  string `yaml:"dbname" toml:"dbname"`
+	SSLMode string `yaml:"sslmode" toml:"sslmode"`
+}
+
+// TableConfig selects a table and, optionally, the columns to export from
+// it in the given order. An empty Columns list exports every column.
+type TableConfig struct {
+	Name    string   `yaml:"name" toml:"name"`
+	Columns []string `yaml:"columns" toml:"columns"`
+	// IncludeColumns is another name for Columns.
+	IncludeColumns []string `yaml:"include_columns" toml:"include_columns"`
+	// ExcludeColumns are never exported, such as password hashes or large
+	// blobs.
+	ExcludeColumns []string `yaml:"exclude_columns" toml:"exclude_columns"`
+	// Where is a SQL condition restricting the exported rows. Like query
+	// SQL it may contain :name parameters, which are bound.
+	Where string `yaml:"where" toml:"where"`
+	// Priority orders the run: tables with a higher priority are exported
+	// first. The default is 0.
+	Priority int `yaml:"priority" toml:"priority"`
+	// Watermark is a column that only grows, such as updated_at or an
+	// increasing id. With -incremental only rows past the highest value
+	// exported by the previous run are exported.
+	Watermark string       `yaml:"watermark" toml:"watermark"`
+	Limits    TableLimits  `yaml:"limits" toml:"limits"`
+	Sample    SampleConfig `yaml:"sample" toml:"sample"`
+	// SortBy sorts the rows of each row group of a parquet file on the
+	// listed columns, each optionally followed by asc or desc.
+	SortBy []string `yaml:"sort_by" toml:"sort_by"`
+	// ParquetColumns set the encoding and compression of columns of a
+	// parquet file, by column.
+	ParquetColumns map[string]ParquetColumnConfig `yaml:"parquet_columns" toml:"parquet_columns"`
+	// HotCold exports the table as a hot partition of recent rows and a
+	// cold partition of the older ones.
+	HotCold *HotColdConfig `yaml:"hot_cold" toml:"hot_cold"`
+	// ColumnGroups writes the table as a file per named group of its
+	// columns, and one of the columns the groups leave out.
+	ColumnGroups []ColumnGroupConfig `yaml:"column_groups" toml:"column_groups"`
+	// Denormalize joins the tables the table references with foreign keys
+	// onto its rows, and with DenormalizeDepth above 1 the tables those
+	// reference, and so on.
+	Denormalize      bool `yaml:"denormalize" toml:"denormalize"`
+	DenormalizeDepth int  `yaml:"denormalize_depth" toml:"denormalize_depth"`
+	// Split writes the table's rows to train, val and test files.
+	Split            *SplitConfig `yaml:"split" toml:"split"`
+	ColumnTransforms `yaml:",inline"`
+}
+
+// QueryConfig is a named query whose result is exported like a table.
+// The SQL may contain :name parameters, which are bound as statement
+// parameters rather than interpolated into the query text.
+type QueryConfig struct {
+	Name             string                         `yaml:"name" toml:"name"`
+	SQL              string                         `yaml:"sql" toml:"sql"`
+	Priority         int                            `yaml:"priority" toml:"priority"`
+	Limits           TableLimits                    `yaml:"limits" toml:"limits"`
+	Sample           SampleConfig                   `yaml:"sample" toml:"sample"`
+	SortBy           []string                       `yaml:"sort_by" toml:"sort_by"`
+	ParquetColumns   map[string]ParquetColumnConfig `yaml:"parquet_columns" toml:"parquet_columns"`
+	ColumnGroups     []ColumnGroupConfig            `yaml:"column_groups" toml:"column_groups"`
+	Split            *SplitConfig                   `yaml:"split" toml:"split"`
+	ColumnTransforms `yaml:",inline"`
+}
+
+// ColumnTransforms are the per-column conversions applied to a table or
+// query result during export.
+type ColumnTransforms struct {
+	// Parse converts text columns to numbers or dates.
+	Parse map[string]ParseConfig `yaml:"parse" toml:"parse"`
+	// Money adds amounts converted to the base currency.
+	Money []MoneyConfig `yaml:"money" toml:"money"`
+	// HashColumns are replaced by keyed 64-bit hashes.
+	HashColumns []string `yaml:"hash_columns" toml:"hash_columns"`
+	// FlattenJSON adds a column per listed top-level key of JSON columns.
+	FlattenJSON map[string][]string `yaml:"flatten_json" toml:"flatten_json"`
+	// OneHot adds a bool column per listed value of categorical columns,
+	// or per label of enum columns given no values.
+	OneHot map[string][]string `yaml:"one_hot" toml:"one_hot"`
+	// ExpandDatetime adds a column per listed feature of timestamp and
+	// date columns, such as year or day_of_week, or per feature given none.
+	ExpandDatetime map[string][]string `yaml:"expand_datetime" toml:"expand_datetime"`
+	// LabelEncode replaces the values of categorical columns with int64
+	// codes, recording their vocabulary.
+	LabelEncode []string `yaml:"label_encode" toml:"label_encode"`
+	// Scale min-max scales (min_max) or standardizes (z_score) numeric
+	// columns, recording the fitted parameters.
+	Scale map[string]string `yaml:"scale" toml:"scale"`
+	// SharedDictionary stores string columns as int32 codes into the named
+	// dictionary, written once to the dictionaries directory and shared by
+	// every column naming it, in the npz format.
+	SharedDictionary map[string]string `yaml:"shared_dictionary" toml:"shared_dictionary"`
+	// Dictionary turns the dictionary encoding of string columns on or
+	// off, or leaves it to the export's -dict-encoding with auto.
+	Dictionary map[string]string `yaml:"dictionary" toml:"dictionary"`
+	// Joins add the columns of dimensions.
+	Joins []JoinConfig `yaml:"joins" toml:"joins"`
+	// NullPolicy overrides the export's null policy for the named columns.
+	NullPolicy map[string]NullPolicy `yaml:"null_policy" toml:"null_policy"`
+}
+
+// defaultExportConfig returns the configuration used when neither a config
+// file nor flags say otherwise.
+func defaultExportConfig() ExportConfig {
+	return ExportConfig{
+		Connection:   ConnectionConfig{DBName: "centrum_db_dev"},
+		Tables:       []TableConfig{{Name: "users"}, {Name: "user_sessions"}, {Name: "tools"}},
+		OutDir:       "data",
+		BatchSize:    BATCHSIZE,
+		Format:       formatNPZ,
+		CSVDelimiter: ",",
+		SampleSize:   1000,
+	}
+}
+
+// loadExportConfig reads an export definition from a .toml file or, for
+// any other extension, a YAML file. Unset values keep their defaults and
+// unknown keys are rejected.
+func loadExportConfig(path string) (ExportConfig, error) {
+	cfg := defaultExportConfig()
+	// The file defines the complete selection of tables and queries.
+	cfg.Tables = nil
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.Decode(string(b), &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return cfg, fmt.Errorf("parsing config %s: unknown key %q", path, undecoded[0].String())
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// validate checks the configuration for missing or inconsistent values.
+func (c ExportConfig) validate() error {
+	if len(c.Tables) == 0 && len(c.Queries) == 0 {
+		return fmt.Errorf("no tables selected")
+	}
+	dims := make(map[string]bool)
+	for _, d := range c.Dimensions {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		if dims[d.Name] {
+			return fmt.Errorf("dimension %s defined more than once", d.Name)
+		}
+		dims[d.Name] = true
+	}
+	if err := c.NullPolicy.validate(); err != nil {
+		return fmt.Errorf("null_policy: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, name := range append(c.tableNames(), c.queryNames()...) {
+		if err := c.limits(name).validate(); err != nil {
+			return fmt.Errorf("limits of %s: %w", name, err)
+		}
+		sample := c.sample(name)
+		if err := sample.validate(); err != nil {
+			return fmt.Errorf("sample of %s: %w", name, err)
+		}
+		if sample.Fraction > 0 && c.Connection.Source == sourceMongoDB {
+			return fmt.Errorf("sample of %s: sampling is not supported for the %s source, only limit", name, c.Connection.Source)
+		}
+		if sample.Fraction > 0 && c.Reproducible && c.Connection.Source == sourceSQLite {
+			return fmt.Errorf("sample of %s: the random() samples of the %s source aren't reproducible", name, c.Connection.Source)
+		}
+		transforms := c.transforms(name)
+		for col, p := range transforms.Parse {
+			if _, err := newTextParser(p); err != nil {
+				return fmt.Errorf("parsing %s.%s: %w", name, col, err)
+			}
+		}
+		for _, m := range transforms.Money {
+			if m.Amount == "" || (m.Currency == "") == (m.Code == "") {
+				return fmt.Errorf("money columns of %s need an amount and either a currency column or a code", name)
+			}
+		}
+		for col, keys := range transforms.FlattenJSON {
+			if len(keys) == 0 || slices.Contains(keys, "") {
+				return fmt.Errorf("flatten_json of %s.%s needs a list of keys", name, col)
+			}
+		}
+		for col, values := range transforms.OneHot {
+			if slices.Contains(values, "") {
+				return fmt.Errorf("one_hot of %s.%s lists an empty value", name, col)
+			}
+			if len(values) > maxOneHotValues {
+				return fmt.Errorf("one_hot of %s.%s has %d values, more than the %d allowed", name, col, len(values), maxOneHotValues)
+			}
+		}
+		for col, features := range transforms.ExpandDatetime {
+			for _, f := range features {
+				if !slices.Contains(datetimeFeatures, f) {
+					return fmt.Errorf("expand_datetime of %s.%s: unknown feature %q, expected one of %s", name, col, f, strings.Join(datetimeFeatures, ", "))
+				}
+			}
+		}
+		for _, col := range transforms.LabelEncode {
+			if slices.Contains(transforms.HashColumns, col) {
+				return fmt.Errorf("column %s.%s can't be both label encoded and hashed", name, col)
+			}
+		}
+		for col, method := range transforms.Scale {
+			if method != scaleMinMax && method != scaleZScore {
+				return fmt.Errorf("scale of %s.%s: unknown method %q, expected %s or %s", name, col, method, scaleMinMax, scaleZScore)
+			}
+			if slices.Contains(transforms.HashColumns, col) || slices.Contains(transforms.LabelEncode, col) {
+				return fmt.Errorf("column %s.%s can't be both scaled and hashed or label encoded", name, col)
+			}
+		}
+		for col, dict := range transforms.SharedDictionary {
+			if c.Format != formatNPZ || len(c.Outputs) > 0 {
+				return fmt.Errorf("shared_dictionary of %s.%s: shared dictionaries are written in the %s format only, without outputs", name, col, formatNPZ)
+			}
+			if dict == "" || strings.ContainsAny(dict, `/\`) || strings.HasPrefix(dict, ".") {
+				return fmt.Errorf("shared_dictionary of %s.%s: %q is not a valid dictionary name", name, col, dict)
+			}
+			if slices.Contains(transforms.HashColumns, col) || slices.Contains(transforms.LabelEncode, col) {
+				return fmt.Errorf("column %s.%s can't be both in a shared dictionary and hashed or label encoded", name, col)
+			}
+		}
+		for col, setting := range transforms.Dictionary {
+			if setting != dictionaryOn && setting != dictionaryOff && setting != dictionaryAuto {
+				return fmt.Errorf("dictionary of %s.%s: invalid setting %q, expected on, off or auto", name, col, setting)
+			}
+			if setting == dictionaryOn && (slices.Contains(transforms.HashColumns, col) || slices.Contains(transforms.LabelEncode, col)) {
+				return fmt.Errorf("column %s.%s can't be both dictionary encoded and hashed or label encoded", name, col)
+			}
+			if _, ok := transforms.SharedDictionary[col]; ok {
+				return fmt.Errorf("column %s.%s can't set its dictionary and be in a shared dictionary", name, col)
+			}
+		}
+		for col, p := range transforms.NullPolicy {
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("null_policy of %s.%s: %w", name, col, err)
+			}
+		}
+		for _, j := range transforms.Joins {
+			if j.Dimension == "" || j.On == "" {
+				return fmt.Errorf("joins of %s need a dimension and an on column", name)
+			}
+			if !dims[j.Dimension] {
+				return fmt.Errorf("%s joins unknown dimension %q", name, j.Dimension)
+			}
+		}
+	}
+	if c.FreezeVocabulary && c.Vocabulary == "" {
+		return fmt.Errorf("freeze_vocabulary needs a vocabulary")
+	}
+	if c.normalizesMoney() && (c.Currency.Base == "" || c.Currency.RatesFile == "") {
+		return fmt.Errorf("money normalization needs currency.base and currency.rates_file")
+	}
+	views := make(map[string]bool)
+	for _, v := range c.Views {
+		if v.Name == "" || v.SQL == "" {
+			return fmt.Errorf("views need a name and sql")
+		}
+		if views[v.Name] {
+			return fmt.Errorf("view %s defined more than once", v.Name)
+		}
+		views[v.Name] = true
+		// CREATE VIEW takes no parameters.
+		if _, names := bindNamedParams(v.SQL); len(names) > 0 {
+			return fmt.Errorf("view %s: views can't use parameters", v.Name)
+		}
+	}
+	if len(c.Views) > 0 && c.Connection.Source == sourceMongoDB {
+		return fmt.Errorf("views are not supported for the %s source", c.Connection.Source)
+	}
+	for _, q := range c.Queries {
+		if q.Name == "" || q.SQL == "" {
+			return fmt.Errorf("queries need a name and sql")
+		}
+		if seen[q.Name] {
+			return fmt.Errorf("query %s defined more than once", q.Name)
+		}
+		seen[q.Name] = true
+		_, names := bindNamedParams(q.SQL)
+		if _, err := c.queryArgs(names); err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+		if q.Sample.Fraction > 0 {
+			return fmt.Errorf("query %s: query results can't be sampled, only limited", q.Name)
+		}
+	}
+	for _, t := range c.Tables {
+		if t.Name == "" {
+			return fmt.Errorf("table without a name")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("table %s selected more than once", t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.Columns) > 0 && len(t.IncludeColumns) > 0 {
+			return fmt.Errorf("table %s: columns and include_columns are the same setting, give only one", t.Name)
+		}
+		for _, col := range append(t.includedColumns(), t.ExcludeColumns...) {
+			if col == "" {
+				return fmt.Errorf("empty column name for table %s", t.Name)
+			}
+		}
+		for _, col := range t.ExcludeColumns {
+			if slices.Contains(t.includedColumns(), col) {
+				return fmt.Errorf("table %s: column %s is both included and excluded", t.Name, col)
+			}
+		}
+		if t.Watermark != "" && c.Connection.Source == sourceMongoDB {
+			return fmt.Errorf("table %s: watermarks are not supported for the %s source", t.Name, c.Connection.Source)
+		}
+		if t.HotCold != nil {
+			if err := t.HotCold.validate(); err != nil {
+				return fmt.Errorf("table %s: %w", t.Name, err)
+			}
+			if t.Watermark != "" {
+				return fmt.Errorf("table %s: hot_cold and watermark can't be combined", t.Name)
+			}
+			if c.Connection.Source == sourceMongoDB {
+				return fmt.Errorf("table %s: hot_cold is not supported for the %s source", t.Name, c.Connection.Source)
+			}
+		}
+		if t.Where != "" {
+			if c.Connection.Source == sourceMongoDB {
+				return fmt.Errorf("table %s: where filters are not supported for the %s source", t.Name, c.Connection.Source)
+			}
+			_, names := bindNamedParams(t.Where)
+			if _, err := c.queryArgs(names); err != nil {
+				return fmt.Errorf("table %s: %w", t.Name, err)
+			}
+		}
+	}
+	if c.OutDir == "" {
+		return fmt.Errorf("no output directory")
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("invalid batch size %d, expected a positive number", c.BatchSize)
+	}
+	switch c.Format {
+	case formatNPZ, formatParquet, formatFeather:
+	case formatCSV:
+		if _, err := parseDelimiter(c.CSVDelimiter); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q, expected %s, %s, %s or %s", c.Format, formatNPZ, formatParquet, formatFeather, formatCSV)
+	}
+	switch c.NPZCompression {
+	case "", npzCompressionDeflate:
+	case npzCompressionNone:
+		if c.Format != formatNPZ {
+			return fmt.Errorf("npz_compression %s needs the %s format", npzCompressionNone, formatNPZ)
+		}
+	default:
+		return fmt.Errorf("unknown npz_compression %q, expected %s or %s", c.NPZCompression, npzCompressionDeflate, npzCompressionNone)
+	}
+	switch c.DecimalEncoding {
+	case "", decimalsFloat:
+	case decimalsString, decimalsScaled:
+		if c.Format != formatNPZ {
+			return fmt.Errorf("decimal_encoding %s needs the %s format, the others store decimals exactly", c.DecimalEncoding, formatNPZ)
+		}
+	default:
+		return fmt.Errorf("unknown decimal_encoding %q, expected %s, %s or %s", c.DecimalEncoding, decimalsFloat, decimalsString, decimalsScaled)
+	}
+	if c.ExactCounts && c.Connection.Source == sourceMongoDB {
+		return fmt.Errorf("exact_counts is not supported for the %s source", c.Connection.Source)
+	}
+	if err := c.validateOutputs(); err != nil {
+		return err
+	}
+	if c.ColumnGroupSize < 0 {
+		return fmt.Errorf("invalid column_group_size %d, expected a positive number", c.ColumnGroupSize)
+	}
+	if c.ColumnGroupSize > 0 && c.Sink.Exec != "" {
+		return fmt.Errorf("column_group_size writes several files per table and can't be used with an exec sink")
+	}
+	if c.FillDefaults && c.Format != formatNPZ {
+		return fmt.Errorf("fill_defaults needs the %s format, the others store nulls", formatNPZ)
+	}
+	if c.Parquet.RowGroupRows < 0 || c.Parquet.PageSize < 0 {
+		return fmt.Errorf("invalid parquet row_group_rows %d or page_size %d, expected positive numbers", c.Parquet.RowGroupRows, c.Parquet.PageSize)
+	}
+	if _, err := parseParquetCodec(c.Parquet.Codec, c.Parquet.ZstdLevel); err != nil {
+		return err
+	}
+	for _, name := range append(c.tableNames(), c.queryNames()...) {
+		if len(c.parquetColumns(name)) > 0 && c.Format != formatParquet {
+			return fmt.Errorf("%s: parquet_columns needs the %s format", name, formatParquet)
+		}
+		if _, err := c.parquetOptions(name); err != nil {
+			return err
+		}
+		if len(c.sortBy(name)) > 0 && c.Format != formatParquet {
+			return fmt.Errorf("%s: sort_by needs the %s format", name, formatParquet)
+		}
+	}
+	for _, t := range c.Tables {
+		if t.DenormalizeDepth < 0 {
+			return fmt.Errorf("%s: invalid denormalize_depth %d, expected a positive number", t.Name, t.DenormalizeDepth)
+		}
+		if t.DenormalizeDepth > 0 && !t.Denormalize {
+			return fmt.Errorf("%s: denormalize_depth needs denormalize", t.Name)
+		}
+		if t.Denormalize && c.Connection.Source == sourceMongoDB {
+			return fmt.Errorf("%s: denormalize is not supported for the %s source, which has no foreign keys", t.Name, c.Connection.Source)
+		}
+	}
+	for _, name := range append(c.tableNames(), c.queryNames()...) {
+		split := c.split(name)
+		if split == nil {
+			continue
+		}
+		if err := split.validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if c.Sink.Exec != "" {
+			return fmt.Errorf("%s: split writes several files per table and can't be used with an exec sink", name)
+		}
+		if len(c.columnGroups(name)) > 0 {
+			return fmt.Errorf("%s: split can't be combined with column_groups", name)
+		}
+		if t, ok := c.table(name); ok && t.HotCold != nil {
+			return fmt.Errorf("%s: split can't be combined with hot_cold", name)
+		}
+	}
+	for _, name := range append(c.tableNames(), c.queryNames()...) {
+		groups := c.columnGroups(name)
+		if len(groups) == 0 {
+			continue
+		}
+		if c.Sink.Exec != "" {
+			return fmt.Errorf("%s: column_groups writes several files per table and can't be used with an exec sink", name)
+		}
+		if err := validateColumnGroups(groups); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for _, check := range c.Checks {
+		if err := check.validate(); err != nil {
+			return err
+		}
+		for _, table := range []string{check.Table, check.RefTable} {
+			if !seen[table] {
+				return fmt.Errorf("check %s: %s is not an exported table or query", check.name(), table)
+			}
+		}
+		if c.Format != formatNPZ {
+			return fmt.Errorf("check %s: checks need the %s format", check.name(), formatNPZ)
+		}
+	}
+	if c.Health != nil {
+		if err := c.Health.validate(c.OutDir); err != nil {
+			return err
+		}
+	}
+	if c.Sink.Exec != "" && c.Format != formatFeather {
+		return fmt.Errorf("sink exec streams Arrow IPC and needs the %s format", formatFeather)
+	}
+	if c.Sink.Upload != nil {
+		if c.Sink.Exec != "" {
+			return fmt.Errorf("sink upload uploads the files written and can't be used with an exec sink")
+		}
+		if err := c.Sink.Upload.validate(); err != nil {
+			return err
+		}
+	}
+	if c.BatchTimeout != "" {
+		if d, err := time.ParseDuration(c.BatchTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid batch_timeout %q, expected a positive duration", c.BatchTimeout)
+		}
+	}
+	if c.ProfileBudget != "" {
+		if d, err := time.ParseDuration(c.ProfileBudget); err != nil || d <= 0 {
+			return fmt.Errorf("invalid profile_budget %q, expected a positive duration", c.ProfileBudget)
+		}
+		if !c.Profile {
+			return fmt.Errorf("profile_budget needs profile")
+		}
+	}
+	switch c.NameMatching {
+	case "", nameMatchingExact, nameMatchingCaseInsensitive:
+	default:
+		return fmt.Errorf("unknown name_matching %q, expected %s or %s", c.NameMatching, nameMatchingExact, nameMatchingCaseInsensitive)
+	}
+	if c.IncludeViews && c.Connection.Source != sourcePostgres && c.Connection.Source != "" {
+		return fmt.Errorf("include_views is not supported for the %s source", c.Connection.Source)
+	}
+	if len(c.Schemas) > 0 && c.Connection.Source != sourcePostgres && c.Connection.Source != "" {
+		return fmt.Errorf("schemas are not supported for the %s source", c.Connection.Source)
+	}
+	if err := c.Resources.validate(); err != nil {
+		return err
+	}
+	switch c.Connection.Source {
+	case sourcePostgres, "":
+	case sourceSQLite:
+		if c.Connection.DSN == "" {
+			return fmt.Errorf("the %s source needs the database file as dsn", c.Connection.Source)
+		}
+	case sourceMongoDB:
+		if len(c.Queries) > 0 {
+			return fmt.Errorf("queries are not supported for the %s source", c.Connection.Source)
+		}
+		if c.SampleSize <= 0 {
+			return fmt.Errorf("invalid schema sample size %d, expected a positive number", c.SampleSize)
+		}
+	default:
+		return fmt.Errorf("unknown source %q, expected %s, %s or %s", c.Connection.Source, sourcePostgres, sourceMongoDB, sourceSQLite)
+	}
+	return nil
+}
+
+// batchTimeout returns how long a batch may take to read before it is
+// considered stalled.
+func (c ExportConfig) batchTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.BatchTimeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultBatchTimeout
+}
+
+// outputPath returns the path of the file a table is written to.
+func (c ExportConfig) outputPath(table string) string {
+	return filepath.Join(c.OutDir, table+"."+c.Format)
+}
+
+// priorities returns the priorities of the tables and queries by name.
+func (c ExportConfig) priorities() map[string]int {
+	priorities := make(map[string]int)
+	for _, t := range c.Tables {
+		priorities[t.Name] = t.Priority
+		if t.HotCold != nil {
+			priorities[partitionName(t.Name, partitionHot)] = t.Priority
+			priorities[partitionName(t.Name, partitionCold)] = t.Priority
+		}
+	}
+	for _, q := range c.Queries {
+		priorities[q.Name] = q.Priority
+	}
+	return priorities
+}
+
+// includedColumns returns the columns to export, in order, or nil for all.
+func (t TableConfig) includedColumns() []string {
+	if len(t.IncludeColumns) > 0 {
+		return t.IncludeColumns
+	}
+	return t.Columns
+}
+
+// tableNames returns the names of the selected tables.
+func (c ExportConfig) tableNames() []string {
+	names := make([]string, len(c.Tables))
+	for i, t := range c.Tables {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// listedSchemas returns the PostgreSQL schemas whose tables are listed:
+// the configured schemas, or public, and those of the selected tables
+// named schema.table.
+func (c ExportConfig) listedSchemas() []string {
+	schemas := slices.Clone(c.Schemas)
+	if len(schemas) == 0 {
+		schemas = []string{defaultSchema}
+	}
+	for _, name := range c.tableNames() {
+		if schema, _, ok := strings.Cut(name, "."); ok && !slices.Contains(schemas, schema) {
+			schemas = append(schemas, schema)
+		}
+	}
+	return schemas
+}
+
+// queryNames returns the names of the configured queries.
+func (c ExportConfig) queryNames() []string {
+	names := make([]string, len(c.Queries))
+	for i, q := range c.Queries {
+		names[i] = q.Name
+	}
+	return names
+}
+
+// table returns the configuration of the named table.
+func (c ExportConfig) table(name string) (TableConfig, bool) {
+	for _, t := range c.Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	// The partitions of a hot/cold table share its config.
+	for _, t := range c.Tables {
+		if t.HotCold != nil && (name == partitionName(t.Name, partitionHot) || name == partitionName(t.Name, partitionCold)) {
+			return t, true
+		}
+	}
+	return TableConfig{}, false
+}
+
+// transforms returns the column transforms of the named table or query.
+func (c ExportConfig) transforms(name string) ColumnTransforms {
+	if t, ok := c.table(name); ok {
+		return t.ColumnTransforms
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return q.ColumnTransforms
+		}
+	}
+	return ColumnTransforms{}
+}
+
+// sortBy returns the sort_by columns of the named table or query.
+func (c ExportConfig) sortBy(name string) []string {
+	if t, ok := c.table(name); ok {
+		return t.SortBy
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return q.SortBy
+		}
+	}
+	return nil
+}
+
+// split returns the split of the named table or query, nil for tables
+// written whole.
+func (c ExportConfig) split(name string) *SplitConfig {
+	if t, ok := c.table(name); ok {
+		return t.Split
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return q.Split
+		}
+	}
+	return nil
+}
+
+// columnGroups returns the column_groups of the named table or query.
+func (c ExportConfig) columnGroups(name string) []ColumnGroupConfig {
+	if t, ok := c.table(name); ok {
+		return t.ColumnGroups
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return q.ColumnGroups
+		}
+	}
+	return nil
+}
+
+// parquetOptions returns the layout of the parquet file of the named table
+// or query.
+func (c ExportConfig) parquetOptions(name string) (parquetOptions, error) {
+	sortBy, err := parseSortBy(c.sortBy(name))
+	if err != nil {
+		return parquetOptions{}, fmt.Errorf("%s: %w", name, err)
+	}
+	opts := parquetOptions{rowGroupRows: c.Parquet.RowGroupRows, pageBytes: c.Parquet.PageSize, sortBy: sortBy}
+	if opts.codec, err = parseParquetCodec(c.Parquet.Codec, c.Parquet.ZstdLevel); err != nil {
+		return parquetOptions{}, err
+	}
+	for column, cc := range c.parquetColumns(name) {
+		encoding := cmp.Or(cc.Encoding, parquetEncodingAuto)
+		if !slices.Contains(parquetEncodings, encoding) {
+			return parquetOptions{}, fmt.Errorf("%s: invalid parquet encoding %q of column %s, expected one of %s", name, cc.Encoding, column, strings.Join(parquetEncodings, ", "))
+		}
+		codec := opts.codec
+		if cc.Codec != "" || cc.ZstdLevel != 0 {
+			// The export's zstd level only carries over to columns that
+			// keep its codec.
+			level := cc.ZstdLevel
+			if cc.Codec == "" || cc.Codec == c.Parquet.Codec {
+				level = cmp.Or(level, c.Parquet.ZstdLevel)
+			}
+			if codec, err = parseParquetCodec(cmp.Or(cc.Codec, c.Parquet.Codec), level); err != nil {
+				return parquetOptions{}, fmt.Errorf("%s: column %s: %w", name, column, err)
+			}
+		}
+		if opts.columns == nil {
+			opts.columns = make(map[string]parquetColumnOptions)
+		}
+		opts.columns[column] = parquetColumnOptions{encoding: encoding, codec: codec}
+	}
+	return opts, nil
+}
+
+// parquetColumns returns the parquet settings of the columns of the named
+// table or query.
+func (c ExportConfig) parquetColumns(name string) map[string]ParquetColumnConfig {
+	if t, ok := c.table(name); ok {
+		return t.ParquetColumns
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return q.ParquetColumns
+		}
+	}
+	return nil
+}
+
+// parseSortBy parses sort_by entries such as "created_at" or "id desc".
+func parseSortBy(entries []string) ([]sortColumn, error) {
+	var columns []sortColumn
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid sort_by entry %q, expected a column optionally followed by asc or desc", entry)
+		}
+		col := sortColumn{name: fields[0]}
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "asc":
+			case "desc":
+				col.descending = true
+			default:
+				return nil, fmt.Errorf("invalid sort_by entry %q, expected a column optionally followed by asc or desc", entry)
+			}
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// limits returns the limits of the named table or query.
+func (c ExportConfig) limits(name string) TableLimits {
+	if t, ok := c.table(name); ok {
+		return c.TableLimits.override(t.Limits)
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return c.TableLimits.override(q.Limits)
+		}
+	}
+	return c.TableLimits
+}
+
+// sample returns the sample of the named table or query.
+func (c ExportConfig) sample(name string) SampleConfig {
+	if t, ok := c.table(name); ok {
+		return c.TableSample.override(t.Sample)
+	}
+	for _, q := range c.Queries {
+		if q.Name == name {
+			return c.TableSample.override(q.Sample)
+		}
+	}
+	return c.TableSample
+}
+
+// hashesColumns reports whether any table or query hashes columns.
+func (c ExportConfig) hashesColumns() bool {
+	for _, name := range append(c.tableNames(), c.queryNames()...) {
+		if len(c.transforms(name).HashColumns) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizesMoney reports whether any table or query normalizes money.
+func (c ExportConfig) normalizesMoney() bool {
+	for _, name := range append(c.tableNames(), c.queryNames()...) {
+		if len(c.transforms(name).Money) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dataSourceName returns the connection string for lib/pq. Without an
+// explicit DSN it is assembled from the individual fields, and without
+// either defaultDSN is used.
+func (c ConnectionConfig) dataSourceName() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+	if c.Host == "" && c.Port == 0 && c.User == "" && c.Password == "" && c.SSLMode == "" {
+		return defaultDSN
+	}
+
+	params := map[string]string{
+		"host":     c.Host,
+		"user":     c.User,
+		"password": c.Password,
+		"dbname":   c.DBName,
+		"sslmode":  c.SSLMode,
+	}
+	if c.Port != 0 {
+		params["port"] = fmt.Sprint(c.Port)
+	}
+
+	var parts []string
+	for key, value := range params {
+		if value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", key, quoteDSNValue(value)))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// quoteDSNValue quotes a key=value connection string value if needed.
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\n\r\f\v'\\") {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// runConvert implements the `convert` command:
+//
+//	convert [-from npz] [-to parquet] [-out dir] <export dir>
+func runConvert(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	from := fs.String("from", formatNPZ, "format of the existing export: npz")
+	to := fs.String("to", formatParquet, "format to convert to: parquet, feather or csv")
+	outDir := fs.String("out", "", "directory for the converted files (default: the export directory)")
+	delimiter := fs.String("csv-delimiter", ",", `field delimiter of csv files, \t for tabs`)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("usage: convert [flags] <export dir>")
+	}
+	if *from != formatNPZ {
+		log.Fatalf("invalid -from %q, only %s exports can be converted", *from, formatNPZ)
+	}
+	switch *to {
+	case formatParquet, formatFeather:
+	case formatCSV:
+		if _, err := parseDelimiter(*delimiter); err != nil {
+			log.Fatalf("invalid -csv-delimiter: %v", err)
+		}
+	default:
+		log.Fatalf("invalid -to %q, expected %s, %s or %s", *to, formatParquet, formatFeather, formatCSV)
+	}
+	dir := fs.Arg(0)
+	cfg := ExportConfig{OutDir: *outDir, Format: *to, CSVDelimiter: *delimiter}
+	if cfg.OutDir == "" {
+		cfg.OutDir = dir
+	}
+	if err := os.MkdirAll(cfg.OutDir, 0755); err != nil {
+		log.Fatalf("failed to create output directory: %v", err)
+	}
+
+	n, err := convertExport(dir, cfg)
+	if err != nil {
+		log.Fatalf("failed to convert %s: %v", dir, err)
+	}
+	log.Printf("Converted %d tables from %s to %s", n, *from, *to)
+}
+
+// convertExport rewrites every NPZ archive in dir in cfg.Format to
+// cfg.OutDir and returns the number of tables converted. Column types come
+// from the metadata written with the export.
+func convertExport(dir string, cfg ExportConfig) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.npz"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(files)
+
+	for _, path := range files {
+		table := trimExt(filepath.Base(path))
+		if err := convertTable(path, table, cfg); err != nil {
+			return 0, fmt.Errorf("converting table %s: %w", table, err)
+		}
+	}
+	return len(files), nil
+}
+
+// convertTable reads a table's NPZ archive and writes its columns with the
+// writer of cfg.Format. An embedded __metadata__.json is carried over where
+// the format can hold it.
+func convertTable(path, table string, cfg ExportConfig) error {
+	r, err := npz.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	meta, _, err := findTableMetadata(r, path, table)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return fmt.Errorf("no metadata found for table %s", table)
+	}
+
+	columns := make([]reflect.Value, len(meta.Fields))
+	masks := make([][]bool, len(meta.Fields))
+	rows := 0
+	for i, field := range meta.Fields {
+		column, err := readDecodedColumn(r, filepath.Dir(path), field.FieldName)
+		if err != nil {
+			return fmt.Errorf("reading column %s: %w", field.FieldName, err)
+		}
+		if field.Encoding == EncodingDecimalScaled {
+			if column, err = readScaledDecimals(r, field, column); err != nil {
+				return fmt.Errorf("reading column %s: %w", field.FieldName, err)
+			}
+		}
+		if field.Encoding == EncodingSharedDictionary {
+			// The values are decoded, and written with the format's own
+			// dictionary encoding.
+			meta.Fields[i].Encoding = EncodingDictionary
+			meta.Fields[i].Dictionary = ""
+		}
+		columns[i] = reflect.ValueOf(column)
+		if i > 0 && columns[i].Len() != rows {
+			return fmt.Errorf("column %s has %d values, expected %d", field.FieldName, columns[i].Len(), rows)
+		}
+		rows = columns[i].Len()
+
+		if mask, err := readNpzColumn(r, field.FieldName+maskSuffix); err == nil {
+			masks[i], _ = mask.([]bool)
+			if len(masks[i]) != rows {
+				return fmt.Errorf("null mask of column %s has %d values, expected %d", field.FieldName, len(masks[i]), rows)
+			}
+		}
+	}
+
+	files := make(map[string][]byte)
+	for _, key := range r.Keys() {
+		if key != embeddedMetadataName || cfg.Format == formatCSV {
+			continue
+		}
+		rc, err := r.Open(key)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		files[key] = b
+	}
+
+	ctx := context.Background()
+	writer, err := newTableWriter(ctx, cfg, table, meta.Fields, spillConfig{})
+	if err != nil {
+		return err
+	}
+	for start := 0; start < rows; start += BATCHSIZE {
+		batch := make([]TableRow, min(BATCHSIZE, rows-start))
+		for i := range batch {
+			row := make(TableRow, len(meta.Fields))
+			for j, field := range meta.Fields {
+				if masks[j] != nil && masks[j][start+i] {
+					row[field.FieldName] = nil
+				} else {
+					row[field.FieldName] = npzValue(field, columns[j].Index(start+i).Interface())
+				}
+			}
+			batch[i] = row
+		}
+		if err := writer.writeRows(ctx, batch); err != nil {
+			writer.discard()
+			return err
+		}
+	}
+	_, err = writer.close(ctx, files)
+	return err
+}
+
+// readScaledDecimals returns the values of a decimal_scaled column as
+// decimal text, given the column's own array of unscaled values or of
+// their high halves.
+func readScaledDecimals(r *npz.Reader, field FieldMetadata, column interface{}) ([]string, error) {
+	unscaled, _ := column.([]int64)
+	var low []int64
+	if field.Precision > parquetDecimalMaxInt64 {
+		v, err := readNpzColumn(r, field.FieldName+lowSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if low, _ = v.([]int64); len(low) != len(unscaled) {
+			return nil, fmt.Errorf("%s has %d values, expected %d", field.FieldName+lowSuffix, len(low), len(unscaled))
+		}
+	}
+	values := make([]string, len(unscaled))
+	for i, v := range unscaled {
+		if low != nil {
+			values[i] = formatDecimal(joinInt128(v, low[i]), field.Scale)
+		} else {
+			values[i] = formatDecimal(big.NewInt(v), field.Scale)
+		}
+	}
+	return values, nil
+}
+
+// npzValue turns the placeholders the NPZ writer stores for missing
+// timestamps, dates, UUIDs, JSON, JSON encoded arrays and nulls back into
+// nil, for columns without a null mask, and binary values back into bytes.
+// Other missing values were written as zero values and cannot be told
+// apart from them.
+func npzValue(field FieldMetadata, v interface{}) interface{} {
+	if field.DataType == DataTypeBytes {
+		return archivedBinary(v)
+	}
+	if t, ok := v.(time.Time); ok && t.IsZero() {
+		// NaT.
+		return nil
+	}
+	if d, ok := v.(time.Duration); ok && d == natValue {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch field.DataType {
+	case DataTypeTime, DataTypeUUID, DataTypeJSON, DataTypeArray, DataTypeNull:
+		if s == "null" {
+			return nil
+		}
+	case DataTypeDate:
+		if s == "" {
+			return nil
+		}
+	}
+	return s
+}
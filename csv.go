@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// csvWriter writes a table as a delimited text file with a header row of
+// the column names. Fields are quoted as RFC 4180 requires and nulls are
+// written as empty fields.
+type csvWriter struct {
+	path      string
+	tableName string
+	f         *os.File
+	buf       *bufio.Writer
+	w         *csv.Writer
+	columns   []FieldMetadata
+	record    []string
+}
+
+// newCSVWriter creates the delimited file of a table at path and writes
+// its header row.
+func newCSVWriter(path, tableName string, columns []FieldMetadata, delimiter rune) (*csvWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	w := &csvWriter{
+		path:      path,
+		tableName: tableName,
+		f:         f,
+		buf:       buf,
+		w:         csv.NewWriter(buf),
+		columns:   columns,
+		record:    make([]string, len(columns)),
+	}
+	w.w.Comma = delimiter
+
+	for i, col := range columns {
+		w.record[i] = col.FieldName
+	}
+	if err := w.w.Write(w.record); err != nil {
+		w.discard()
+		return nil, err
+	}
+	return w, nil
+}
+
+// writeRows writes a batch of rows.
+func (w *csvWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	for _, row := range rows {
+		for i, col := range w.columns {
+			w.record[i] = csvField(col, row[col.FieldName])
+		}
+		if err := w.w.Write(w.record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvField formats a value as text: timestamps in RFC 3339, dates as
+// YYYY-MM-DD, floats in their shortest exact form and binary values in
+// base64.
+func csvField(col FieldMetadata, value interface{}) string {
+	if b, ok := value.([]byte); ok && col.DataType == DataTypeBytes {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case time.Duration:
+		return formatTimeOfDay(v)
+	case time.Time:
+		if col.DataType == DataTypeTimeOfDay {
+			d, _ := timeOfDayValue(v)
+			return formatTimeOfDay(d)
+		}
+		if col.DataType == DataTypeDate {
+			return v.Format(time.DateOnly)
+		}
+		return v.Format(time.RFC3339Nano)
+	default:
+		if col.DataType == DataTypeJSON || col.DataType == DataTypeArray {
+			s, _ := jsonText(v)
+			return s
+		}
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// close flushes the file. A delimited file has no room for extra metadata,
+// so files must be empty; -embed-metadata is rejected with the csv format.
+func (w *csvWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.path)
+		return 0, err
+	}
+
+	log.Printf("Table %q saved successfully to %s", w.tableName, w.path)
+	return 0, nil
+}
+
+// discard removes the partially written file of a table that failed to
+// export.
+func (w *csvWriter) discard() {
+	w.f.Close()
+	os.Remove(w.path)
+}
+
+// parseDelimiter returns the field delimiter given as a single character
+// or as \t or tab for tab-separated output.
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` || s == "tab" {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q, expected a single character other than a quote or newline", s)
+	}
+	return r, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// datasetReadmeName is the README written to the output directory, which
+// describes the export to the people loading it.
+const datasetReadmeName = "README.md"
+
+// saveDatasetReadme writes README.md to the output directory: the exported
+// tables with their rows, columns and files, how to load them in Python,
+// and a summary of the provenance. metadataPath is relative to the output
+// directory, and notebook is set when explore.ipynb was written.
+func saveDatasetReadme(cfg ExportConfig, metadataPath string, metadata SchemaDetails, prov Provenance, notebook bool) error {
+	var rows map[string]int
+	if metadata.Header != nil {
+		rows = metadata.Header.Rows
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", metadata.DatasetMetadata.DatasetName)
+	fmt.Fprintf(&b, "%s export written by the exporter (version %s) on %s.\n", formatNames[cfg.Format], prov.ToolVersion, prov.GeneratedAt.Format(time.RFC3339))
+	if cfg.Sink.Exec != "" {
+		b.WriteString("The table files were handed to the exec sink rather than kept in this directory.\n")
+	}
+	for _, out := range cfg.Outputs {
+		fmt.Fprintf(&b, "The same tables were also written as %s files to `%s`.\n", formatNames[out.Format], out.OutDir)
+	}
+
+	b.WriteString("\n## Tables\n\n")
+	b.WriteString("| Table | Rows | Columns | File | Note |\n")
+	b.WriteString("| --- | ---: | ---: | --- | --- |\n")
+	var exported []string
+	for _, table := range metadata.Tables {
+		file, count := "", ""
+		if !strings.HasPrefix(table.Note, "skipped") && !strings.HasPrefix(table.Note, "failed") {
+			exported = append(exported, table.TableName)
+			file = "`" + filepath.Base(cfg.outputPath(table.TableName)) + "`"
+		}
+		if n, ok := rows[table.TableName]; ok {
+			count = fmt.Sprint(n)
+		}
+		note := table.Note
+		if g := table.ColumnGroup; g != nil {
+			note = strings.TrimPrefix(fmt.Sprintf("%s; column group `%s` of `%s`", note, g.Name, g.Table), "; ")
+		}
+		if s := table.Sample; s != nil {
+			note = strings.TrimPrefix(note+"; "+s.describe(), "; ")
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %d | %s | %s |\n", table.TableName, count, len(table.Fields), file, markdownCellText(note))
+	}
+	fmt.Fprintf(&b, "\nThe columns of every table, with their types, encodings and keys, are described in `%s`.\n", filepath.ToSlash(metadataPath))
+
+	b.WriteString("\n## Loading in Python\n\n")
+	b.WriteString("```python\n")
+	b.WriteString("import json\n\n")
+	switch cfg.Format {
+	case formatNPZ:
+		b.WriteString("import numpy as np\n")
+	default:
+		b.WriteString("import pandas as pd\n")
+	}
+	fmt.Fprintf(&b, "\nwith open(%s) as f:\n    metadata = json.load(f)\n", pyString(filepath.ToSlash(metadataPath)))
+	if len(exported) > 0 {
+		name := exported[0]
+		file := pyString(filepath.Base(cfg.outputPath(name)))
+		b.WriteString("\n")
+		switch cfg.Format {
+		case formatNPZ:
+			fmt.Fprintf(&b, "with np.load(%s) as npz:\n    columns = {key: npz[key] for key in npz.files}\n", file)
+		case formatParquet:
+			fmt.Fprintf(&b, "df = pd.read_parquet(%s)\n", file)
+		case formatFeather:
+			fmt.Fprintf(&b, "df = pd.read_feather(%s)\n", file)
+		case formatCSV:
+			fmt.Fprintf(&b, "df = pd.read_csv(%s, sep=%s)\n", file, pyString(csvSep(cfg.CSVDelimiter)))
+		}
+	}
+	b.WriteString("```\n")
+	if cfg.Format == formatNPZ {
+		b.WriteString("\nEach column is an array of its own. Arrays named `<column>__mask` mark the\n" +
+			"nulls of a column, `<column>__categories` are the values of a dictionary\n" +
+			"encoded column, whose array holds their indices, and `<column>__offsets`\n" +
+			"split the values of array and binary columns into rows. A column with a\n" +
+			"`<column>__dictionary` array holds the indices of the values in\n" +
+			"`dictionaries/<name>.npy`, the dictionary it names, with -1 for nulls.\n")
+	}
+	if notebook {
+		fmt.Fprintf(&b, "\n`%s` loads every table into pandas and plots its columns.\n", notebookName)
+	}
+
+	b.WriteString("\n## Provenance\n\n")
+	fmt.Fprintf(&b, "- Source: `%s`\n", prov.SourceDSN)
+	if prov.Snapshot != nil {
+		fmt.Fprintf(&b, "- Snapshot: LSN `%s`, taken %s\n", prov.Snapshot.LSN, prov.Snapshot.TakenAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "- Schema hash: `%s`\n", prov.SchemaHash)
+	if prov.ConfigCommit != "" {
+		fmt.Fprintf(&b, "- Config commit: `%s`\n", prov.ConfigCommit)
+	}
+	var transformed []string
+	for column := range prov.Transforms {
+		transformed = append(transformed, column)
+	}
+	slices.Sort(transformed)
+	for _, column := range transformed {
+		fmt.Fprintf(&b, "- Transformed column `%s`: %s\n", column, strings.Join(prov.Transforms[column], ", "))
+	}
+	b.WriteString("\nThe queries each table was read with are recorded in `provenance.json`.\n")
+
+	return saveFile(filepath.Join(cfg.OutDir, datasetReadmeName), []byte(b.String()))
+}
+
+// markdownCellText escapes text for a cell of a markdown table.
+func markdownCellText(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
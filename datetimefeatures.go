@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Features a timestamp or date column can be expanded into, computed in
+// UTC. The day of the week counts from Monday, 0, as in Python.
+var datetimeFeatures = []string{"year", "month", "day", "day_of_week", "hour", "is_weekend", "epoch"}
+
+// datetimeExpander adds a column <column>__<feature> for each configured
+// feature of timestamp and date columns. Nulls and values that aren't
+// times give null features.
+type datetimeExpander struct {
+	table    string
+	columns  []string
+	features map[string][]string
+	// invalid counts the values per column that are not times.
+	invalid map[string]int
+}
+
+// newDatetimeExpander adds the feature columns, all of them for columns
+// listed without features.
+func newDatetimeExpander(table *TableData, expand map[string][]string) (*datetimeExpander, error) {
+	e := &datetimeExpander{table: table.TableName, features: make(map[string][]string), invalid: make(map[string]int)}
+	for column := range expand {
+		e.columns = append(e.columns, column)
+	}
+	sort.Strings(e.columns)
+
+	for _, column := range e.columns {
+		idx := slices.IndexFunc(table.Columns, func(f FieldMetadata) bool { return f.FieldName == column })
+		if idx < 0 {
+			return nil, fmt.Errorf("table %s has no column %q to expand", table.TableName, column)
+		}
+		if t := table.Columns[idx].DataType; t != DataTypeTime && t != DataTypeDate {
+			return nil, fmt.Errorf("column %s.%s is %s, only timestamp and date columns can be expanded", table.TableName, column, t)
+		}
+		features := expand[column]
+		if len(features) == 0 {
+			features = datetimeFeatures
+		}
+		e.features[column] = features
+		for _, feature := range features {
+			output := column + "__" + feature
+			if slices.ContainsFunc(table.Columns, func(f FieldMetadata) bool { return f.FieldName == output }) {
+				return nil, fmt.Errorf("table %s already has a column %q", table.TableName, output)
+			}
+			dataType := DataTypeInt
+			if feature == "is_weekend" {
+				dataType = DataTypeBool
+			}
+			table.Columns = append(table.Columns, FieldMetadata{
+				FieldName:           output,
+				DataType:            dataType,
+				IsNullable:          true,
+				TransformedFeatures: []string{"datetime_" + feature},
+			})
+		}
+	}
+	return e, nil
+}
+
+// apply adds the feature columns to a batch.
+func (e *datetimeExpander) apply(rows []TableRow) {
+	for _, row := range rows {
+		for _, column := range e.columns {
+			value := row[column]
+			t, ok := timeValue(value)
+			if !ok && value != nil {
+				e.invalid[column]++
+			}
+			for _, feature := range e.features[column] {
+				var v interface{}
+				if ok {
+					v = datetimeFeature(t.UTC(), feature)
+				}
+				row[column+"__"+feature] = v
+			}
+		}
+	}
+}
+
+// datetimeFeature returns a feature of a UTC time.
+func datetimeFeature(t time.Time, feature string) interface{} {
+	switch feature {
+	case "year":
+		return int64(t.Year())
+	case "month":
+		return int64(t.Month())
+	case "day":
+		return int64(t.Day())
+	case "day_of_week":
+		return int64(t.Weekday()+6) % 7
+	case "hour":
+		return int64(t.Hour())
+	case "is_weekend":
+		return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	default:
+		return t.Unix()
+	}
+}
+
+// finish logs the columns that held values other than times.
+func (e *datetimeExpander) finish(columns []FieldMetadata) {
+	for _, column := range e.columns {
+		if n := e.invalid[column]; n > 0 {
+			log.Printf("column %s.%s: %d values are not times, their features are null", e.table, column, n)
+		}
+	}
+}
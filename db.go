@@ -1,13 +1,31 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 const BATCHSIZE = 10000
 
+const (
+	// defaultBatchTimeout bounds a single batch query unless batch_timeout
+	// says otherwise; a query running longer is considered stalled.
+	defaultBatchTimeout = 5 * time.Minute
+	// batchRetries is how many times a stalled batch is retried before the
+	// table fails.
+	batchRetries = 2
+)
+
+// retryBackoff is multiplied by the attempt number between retries.
+var retryBackoff = 10 * time.Second
+
 type FieldMetadata struct {
 	FieldName           string   `json:"field_name"`
 	DataType            string   `json:"data_type"`
@@ -17,11 +35,86 @@ type FieldMetadata struct {
 	ReferencedTable     *string  `json:"referenced_table_or_collection"`
 	ReferencedField     *string  `json:"referenced_field"`
 	TransformedFeatures []string `json:"transformed_features"`
+	Encoding            string   `json:"encoding,omitempty"`
+	IsPII               bool     `json:"pii,omitempty"`
+	ExampleValues       []string `json:"example_values,omitempty"`
+	// Precision and Scale are set for decimal columns with a declared
+	// precision, such as numeric(12,2).
+	Precision int `json:"precision,omitempty"`
+	Scale     int `json:"scale,omitempty"`
+	// ElementType is the data type of the elements of array columns.
+	ElementType string `json:"element_type,omitempty"`
+	// EnumValues are the labels of an enum column's type, in their declared
+	// order, which are its categories when dictionary encoded.
+	EnumValues []string `json:"enum_values,omitempty"`
+	// Vocabulary maps the values of a label encoded column to their codes.
+	Vocabulary map[string]int64 `json:"vocabulary,omitempty"`
+	// Scaling is how a scaled column was scaled, with its parameters.
+	Scaling *ColumnScaling `json:"scaling,omitempty"`
+	// Dictionary names the shared dictionary of a shared_dictionary
+	// encoded column.
+	Dictionary string `json:"dictionary,omitempty"`
+	// Stats are set by -schema-stats.
+	Stats *ColumnStats `json:"stats,omitempty"`
+	// Profile is computed from the exported values with profile set.
+	Profile *ColumnProfile `json:"profile,omitempty"`
+	// FillValue is what nulls are stored as in npz files with
+	// -fill-defaults, the column's constant SQL DEFAULT, or in every format
+	// with a sentinel null policy.
+	FillValue interface{} `json:"fill_value,omitempty"`
 }
 
 type TableMetadata struct {
 	TableName string          `json:"table_or_collection_name"`
 	Fields    []FieldMetadata `json:"fields"`
+	Note      string          `json:"note,omitempty"`
+	// Query is the SQL of a configured query export, empty for tables.
+	Query string `json:"query,omitempty"`
+	// Where is the configured row filter of a table.
+	Where string `json:"where,omitempty"`
+	// SourceTable is the table a partition of a hot/cold table is read
+	// from, empty for other tables.
+	SourceTable string `json:"source_table,omitempty"`
+	// Kind is view or materialized_view for the views exported with
+	// include_views, empty for tables.
+	Kind string `json:"kind,omitempty"`
+	// Schema is the PostgreSQL schema of a table. Tables outside public
+	// are named schema.table.
+	Schema string `json:"schema,omitempty"`
+	// ColumnGroup is set on the column groups of a table split with
+	// column_groups or column_group_size.
+	ColumnGroup *ColumnGroup `json:"column_group,omitempty"`
+	// Split is set on the train, val and test splits of a table.
+	Split *SplitInfo `json:"split,omitempty"`
+	// Sample is set on the tables exported as a sample or limited.
+	Sample *SampleInfo `json:"sample,omitempty"`
+	// RowOrder is the order the rows were exported in.
+	RowOrder *RowOrder `json:"row_order,omitempty"`
+	// Checksums are the SHA-256 of the arrays of an NPZ file, or of the
+	// file in the other formats, recorded with reproducible.
+	Checksums map[string]string `json:"sha256,omitempty"`
+	// OmittedColumns are the columns of the source table that the include
+	// or exclude lists of the config leave out.
+	OmittedColumns []string `json:"omitted_columns,omitempty"`
+	// Watermark is the range of an -incremental export.
+	Watermark *WatermarkRange `json:"watermark,omitempty"`
+	// ResumeKey is the key of the last row a checkpoint recorded, or for
+	// query exports their offset, which the export continues after.
+	ResumeKey []interface{} `json:"-"`
+	// EstimatedRows is the planner's row estimate and SizeBytes the size of
+	// the table on disk, for PostgreSQL tables. ExactRows is the number of
+	// rows the export reads, counted with exact_counts.
+	EstimatedRows *int64 `json:"estimated_rows,omitempty"`
+	ExactRows     *int64 `json:"exact_rows,omitempty"`
+	SizeBytes     *int64 `json:"size_bytes,omitempty"`
+	// ColumnBytes estimates the size of the exported columns of all rows
+	// of a PostgreSQL table, for the free disk space check.
+	ColumnBytes *int64 `json:"-"`
+	// Arrays locate the arrays of an npz file stored uncompressed.
+	Arrays []ArrayLayout `json:"arrays,omitempty"`
+	// Chunks describe the row groups or record batches of a Parquet or
+	// Feather file, with the range of its key and timestamp columns.
+	Chunks []ChunkStats `json:"chunks,omitempty"`
 }
 
 // Define a row as a map where keys are field names and values are the row’s data.
@@ -36,11 +129,15 @@ type TableData struct {
 
 // Optionally, define a helper to convert raw values using the metadata.
 // This function can be extended to handle different data types appropriately.
-func convertValue(rawValue interface{}, _ string) interface{} {
+// Arrays are parsed from their text form into []interface{}.
+func convertValue(rawValue interface{}, meta FieldMetadata) (interface{}, error) {
 	// For example, if the expected data type is "int" but the rawValue is []byte,
-	// you can convert it accordingly. For now, we return the raw value.
+	// you can convert it accordingly. For now, only arrays are converted.
 	// You can add cases for "string", "float", "bool", etc.
-	return rawValue
+	if meta.DataType == DataTypeArray && rawValue != nil {
+		return parseArray(rawValue, meta.ElementType)
+	}
+	return rawValue, nil
 }
 
 const (
@@ -52,7 +149,12 @@ const (
 	DataTypeTime   = "timestamp"
 	DataTypeDate   = "date"
 	DataTypeUUID   = "uuid"
+	DataTypeJSON   = "json"
+	DataTypeArray  = "array"
+	DataTypeBytes  = "bytes"
 	DataTypeNull   = "null"
+	// DataTypeTimeOfDay is a time of day without a date, in UTC.
+	DataTypeTimeOfDay = "time"
 )
 
 // mapDataType converts PostgreSQL types to our standardized types.
@@ -66,141 +168,400 @@ func mapDataType(pgType string) string {
 		return DataTypeFloat
 	case "boolean":
 		return DataTypeBool
-	case "timestamp without time zone", "timestamp with time zone",
-		"time without time zone", "time with time zone":
+	case "timestamp without time zone", "timestamp with time zone":
 		return DataTypeTime
+	case "time without time zone", "time with time zone":
+		return DataTypeTimeOfDay
 	case "date":
 		return DataTypeDate
 	case "uuid":
 		return DataTypeUUID
+	case "json", "jsonb":
+		return DataTypeJSON
+	case "ARRAY":
+		return DataTypeArray
+	case "bytea":
+		return DataTypeBytes
 	default:
 		// Fallback to string if unknown; alternatively, return pgType.
 		return DataTypeString
 	}
 }
 
-func FetchTableData(db *sql.DB, table TableMetadata) (*TableData, error) {
+// selectQuery builds the SELECT statement used to export a table, without
+// the pagination clause appended per batch. Query results are ordered on
+// their columns when their row order says so.
+func selectQuery(table TableMetadata) string {
+	// Build a slice of column names from the metadata.
+	var filterColumns []string
+	for _, field := range table.Fields {
+		filterColumns = append(filterColumns, quoteIdent(field.FieldName))
+	}
+	columnsStr := strings.Join(filterColumns, ", ")
+	if table.Query != "" {
+		query := fmt.Sprintf("SELECT %s FROM (%s) AS q", columnsStr, table.Query)
+		if o := table.RowOrder; o != nil && o.Guarantee == rowOrderColumns {
+			var order []string
+			for _, column := range o.Columns {
+				order = append(order, quoteIdent(column))
+			}
+			query += " ORDER BY " + strings.Join(order, ", ")
+		}
+		return query
+	}
+	if table.Where != "" {
+		return fmt.Sprintf("SELECT %s FROM %s WHERE %s", columnsStr, table.sourceIdent(), table.Where)
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", columnsStr, table.sourceIdent())
+}
+
+// sourceName returns the name of the source table a table is read from.
+func (t TableMetadata) sourceName() string {
+	if t.SourceTable != "" {
+		return t.SourceTable
+	}
+	return t.TableName
+}
+
+// relationName returns the name of the source table within its schema.
+func (t TableMetadata) relationName() string {
+	if t.Schema == "" || t.Schema == defaultSchema {
+		return t.sourceName()
+	}
+	return strings.TrimPrefix(t.sourceName(), t.Schema+".")
+}
+
+// sourceIdent returns the quoted name of the source table, qualified with
+// its schema if it has one.
+func (t TableMetadata) sourceIdent() string {
+	if t.Schema == "" {
+		return quoteIdent(t.sourceName())
+	}
+	return quoteIdent(t.Schema) + "." + quoteIdent(t.relationName())
+}
+
+// offsetPaged reports whether a table is paginated with OFFSET: query
+// exports and views, which have neither a key nor a row identifier.
+func (t TableMetadata) offsetPaged() bool {
+	return t.Query != "" || t.Kind == relationView
+}
+
+// StreamTableData reads all rows of a table in batches of cfg.BatchSize and
+// passes each batch to emit as soon as it is read, stopping at the first
+// error emit returns. It paginates on the primary key, or for tables
+// without one on fallback, so each batch is a range scan of the key's
+// index, of SQLite's rowid or of PostgreSQL's ctid regardless of how far
+// into the table it is. ctid batches are ranges of heap blocks, see
+// blockPager. Query exports and views have no key and are paginated with
+// OFFSET. With a snapshot every batch reads from that exported snapshot,
+// until a pause releases it.
+func StreamTableData(ctx context.Context, db *sql.DB, snapshot *pgSnapshot, table TableMetadata, cfg ExportConfig, fallback rowIdentity, emit func(rows []TableRow) error) error {
 	offset := 0
-	tableData := &TableData{
-		TableName: table.TableName,
-		Columns:   table.Fields,
-		Rows:      []TableRow{},
+
+	// Without columns there is nothing to select, and the query would be invalid.
+	if len(table.Fields) == 0 {
+		return nil
 	}
 
-	// Build a slice of column names from the metadata.
-	var filterColumns []string
+	// Prepare a mapping of column names to their corresponding metadata for conversion.
+	metaMap := make(map[string]FieldMetadata)
 	for _, field := range table.Fields {
-		filterColumns = append(filterColumns, field.FieldName)
+		metaMap[field.FieldName] = field
+	}
+
+	hb := startHeartbeat(table.TableName)
+	defer hb.Stop()
+
+	// Named parameters of query exports and table filters are bound,
+	// never interpolated.
+	query, names := bindNamedParams(selectQuery(table))
+	args, err := cfg.queryArgs(names)
+	if err != nil {
+		return fmt.Errorf("%s: %w", table.TableName, err)
 	}
+	if w := table.Watermark; w != nil && w.After != nil {
+		args = append(args, w.After)
+	}
+	baseQuery := query
 
+	key := tablePageKey(table, fallback)
+	if table.Kind == relationView {
+		// Views are filtered and ordered like tables.
+		baseQuery = key.query(table, 0, false)
+	}
+	var lastKey []interface{}
+	if table.ResumeKey != nil {
+		if table.offsetPaged() {
+			offset = int(table.ResumeKey[0].(int64))
+		} else {
+			lastKey = table.ResumeKey
+		}
+	}
+	var pager *blockPager
+	if key.blocks {
+		if pager, err = newBlockPager(ctx, db, table, cfg.BatchSize); err != nil {
+			return err
+		}
+		if lastKey == nil {
+			lastKey = []interface{}{tidText(0)}
+		} else if err := pager.resume(lastKey[0]); err != nil {
+			return fmt.Errorf("%s: %w", table.TableName, err)
+		}
+	}
 	for {
-		columnsStr := strings.Join(filterColumns, ", ")
-		query := fmt.Sprintf("SELECT %s FROM %s LIMIT %d OFFSET %d", columnsStr, table.TableName, BATCHSIZE, offset)
-		rows, err := db.Query(query)
+		if pager != nil && pager.done() {
+			break
+		}
+		if err := exportPause.wait(ctx, table.TableName, offset); err != nil {
+			return err
+		}
+		hb.setOffset(offset)
+
+		query, queryArgs := "", append(slices.Clip(args), lastKey...)
+		if table.offsetPaged() {
+			query = fmt.Sprintf("%s LIMIT %d OFFSET %d", baseQuery, cfg.BatchSize, offset)
+		} else {
+			query = key.query(table, cfg.BatchSize, lastKey != nil)
+		}
+		if pager != nil {
+			queryArgs = append(queryArgs, pager.end())
+		}
+
+		started := time.Now()
+		batch, err := fetchBatchWithRetry(ctx, db, snapshot, table, query, queryArgs, metaMap, cfg.batchTimeout())
 		if err != nil {
+			return err
+		}
+		if !table.offsetPaged() {
+			lastKey = key.takeKey(batch)
+		}
+		if pager != nil {
+			// The next range starts after this one, whichever rows it held.
+			lastKey = []interface{}{pager.end()}
+			pager.advance(len(batch))
+		}
+		hb.addBatch(len(batch), time.Since(started))
+		if len(batch) > 0 {
+			resumeKey := lastKey
+			if table.offsetPaged() {
+				resumeKey = []interface{}{int64(offset + len(batch))}
+			}
+			batch[len(batch)-1][resumeKeyColumn] = resumeKey
+			if err := emit(batch); err != nil {
+				return err
+			}
+		}
+
+		// A short batch is the last one, but ranges of blocks hold any
+		// number of rows.
+		if pager == nil && len(batch) < cfg.BatchSize {
+			break
+		}
+		offset += len(batch)
+	}
+
+	return nil
+}
+
+// fetchBatchWithRetry runs a batch query under timeout, retrying up to
+// batchRetries times when the query stalls. Other errors, and ctx being
+// canceled, fail immediately.
+func fetchBatchWithRetry(ctx context.Context, db *sql.DB, snapshot *pgSnapshot, table TableMetadata, query string, args []interface{}, metaMap map[string]FieldMetadata, timeout time.Duration) ([]TableRow, error) {
+	for attempt := 1; ; attempt++ {
+		batchCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		batch, err := fetchBatch(batchCtx, db, snapshot, query, args, metaMap)
+		stalled := ctx.Err() == nil && batchCtx.Err() == context.DeadlineExceeded
+		cancel()
+
+		if err == nil {
+			return batch, nil
+		}
+		if !stalled {
 			return nil, err
 		}
 
-		// Get column names from the query result.
-		cols, err := rows.Columns()
-		if err != nil {
-			rows.Close()
+		diag := stallDiagnostics(db, table.sourceIdent())
+		if attempt > batchRetries {
+			return nil, fmt.Errorf("batch query stalled %d times (timeout %s), giving up: %q: %s", attempt, timeout, query, diag)
+		}
+		log.Printf("batch query for table %s stalled after %s (attempt %d/%d), retrying: %s",
+			table.TableName, time.Since(start).Round(time.Second), attempt, batchRetries+1, diag)
+		if err := sleepContext(ctx, time.Duration(attempt)*retryBackoff); err != nil {
 			return nil, err
 		}
+	}
+}
 
-		// Prepare a mapping of column names to their corresponding metadata for conversion.
-		metaMap := make(map[string]FieldMetadata)
-		for _, field := range table.Fields {
-			metaMap[field.FieldName] = field
+// fetchBatch runs a single batch query, in a transaction of its own reading
+// from the snapshot if one is held, and converts its rows.
+func fetchBatch(ctx context.Context, db *sql.DB, snapshot *pgSnapshot, query string, args []interface{}, metaMap map[string]FieldMetadata) ([]TableRow, error) {
+	var tx *sql.Tx
+	err := snapshot.use(func(id string) (err error) {
+		if id != "" {
+			tx, err = beginSnapshotTx(ctx, db, id)
 		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var q dbQuerier = db
+	if tx != nil {
+		defer tx.Rollback()
+		q = tx
+	}
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		batchCount := 0
-		for rows.Next() {
-			// Create a slice to hold column values.
-			values := make([]interface{}, len(cols))
-			valuePtrs := make([]interface{}, len(cols))
-			for i := range values {
-				valuePtrs[i] = &values[i]
-			}
+	// Get column names from the query result.
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
 
-			if err := rows.Scan(valuePtrs...); err != nil {
-				rows.Close()
-				return nil, err
-			}
+	var batch []TableRow
+	for rows.Next() {
+		// Create a slice to hold column values.
+		values := make([]interface{}, len(cols))
+		valuePtrs := make([]interface{}, len(cols))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, err
+		}
 
-			// Create a row map and use metadata for type conversion if needed.
-			rowMap := make(TableRow)
-			for i, colName := range cols {
-				if meta, ok := metaMap[colName]; ok {
-					rowMap[colName] = convertValue(values[i], meta.DataType)
-				} else {
-					rowMap[colName] = values[i]
+		// Create a row map and use metadata for type conversion if needed.
+		rowMap := make(TableRow)
+		for i, colName := range cols {
+			if meta, ok := metaMap[colName]; ok {
+				v, err := convertValue(values[i], meta)
+				if err != nil {
+					return nil, fmt.Errorf("converting column %s: %w", colName, err)
 				}
+				rowMap[colName] = v
+			} else {
+				rowMap[colName] = values[i]
 			}
-
-			tableData.Rows = append(tableData.Rows, rowMap)
-			batchCount++
 		}
-		rows.Close()
 
-		// If no rows were returned in this batch, exit the loop.
-		if batchCount == 0 {
-			break
-		}
-		offset += BATCHSIZE
+		batch = append(batch, rowMap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return tableData, nil
+	return batch, nil
 }
 
 type DatasetMetadata struct {
 	DatasetName   string                 `json:"dataset_name"`
 	SourceType    string                 `json:"source_type"`
 	SourceDetails map[string]interface{} `json:"source_details"`
+	// Snapshot is the snapshot every table was read from with -snapshot.
+	Snapshot *SnapshotInfo `json:"snapshot,omitempty"`
 }
 
 type SchemaDetails struct {
+	// Header describes the export that wrote the metadata.
+	Header          *MetadataHeader `json:"header,omitempty"`
 	DatasetMetadata DatasetMetadata `json:"dataset_metadata"`
 	Tables          []TableMetadata `json:"schema"`
 }
 
-// connectToDB connects to the PostgreSQL database.
-func connectToDB() (*sql.DB, error) {
-	dsn := "user=postgres dbname=centrum_db_dev password=postgres host=localhost sslmode=disable"
-	db, err := sql.Open("postgres", dsn)
+// defaultDSN is the connection string used when no connection is configured.
+const defaultDSN = "user=postgres dbname=centrum_db_dev password=postgres host=localhost sslmode=disable"
+
+// connectToDB connects to the PostgreSQL database, creating the views on
+// every connection.
+func connectToDB(ctx context.Context, dsn string, views []ViewConfig) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
 	if err != nil {
 		return nil, err
 	}
+	// Count the bytes exchanged with the server for the run report.
+	connector.Dialer(countingDialer{})
+	db := sql.OpenDB(viewConnector{Connector: connector, views: views})
 	// Verify the connection.
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, nil
 }
 
-// fetchMetadata fetches the schema details (tables, columns, primary keys, and foreign keys).
-func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetails, error) {
-	var schema SchemaDetails
-
-	// Query to get all user tables in the public schema.
-	tablesQuery := `
-		SELECT table_name
-		FROM information_schema.tables
-		WHERE table_schema = 'public'
-		  AND table_type = 'BASE TABLE'
-	`
-	rows, err := db.Query(tablesQuery)
+// fetchEnumLabels returns the labels of every enum type in their declared
+// order, by schema-qualified type name.
+func fetchEnumLabels(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, t.typname, e.enumlabel
+		FROM pg_enum e
+		JOIN pg_type t ON t.oid = e.enumtypid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		ORDER BY n.nspname, t.typname, e.enumsortorder
+	`)
 	if err != nil {
-		return schema, fmt.Errorf("querying tables: %w", err)
+		return nil, fmt.Errorf("querying enum types: %w", err)
 	}
 	defer rows.Close()
-
+	enums := make(map[string][]string)
 	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return schema, fmt.Errorf("scanning table name: %w", err)
+		var schema, name, label string
+		if err := rows.Scan(&schema, &name, &label); err != nil {
+			return nil, fmt.Errorf("scanning enum label: %w", err)
 		}
+		enums[schema+"."+name] = append(enums[schema+"."+name], label)
+	}
+	return enums, rows.Err()
+}
+
+// matviewColumnsQuery selects the columns of a materialized view, which
+// information_schema.columns leaves out, from the system catalogs, named
+// the way information_schema.columns names them.
+const matviewColumnsQuery = `
+	SELECT a.attname,
+	       CASE WHEN t.typelem <> 0 AND t.typlen = -1 THEN 'ARRAY'
+	            WHEN tn.nspname = 'pg_catalog' THEN format_type(a.atttypid, NULL)
+	            ELSE 'USER-DEFINED' END,
+	       tn.nspname, t.typname,
+	       CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END,
+	       information_schema._pg_numeric_precision(a.atttypid, a.atttypmod),
+	       information_schema._pg_numeric_scale(a.atttypid, a.atttypmod),
+	       NULL::text
+	FROM pg_attribute a
+	JOIN pg_class c ON c.oid = a.attrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_type t ON t.oid = a.atttypid
+	JOIN pg_namespace tn ON tn.oid = t.typnamespace
+	WHERE n.nspname = $2
+	  AND c.relname = $1
+	  AND a.attnum > 0
+	  AND NOT a.attisdropped
+	ORDER BY a.attnum
+`
+
+// fetchMetadata fetches the schema details (tables, columns, primary keys, and foreign keys)
+// of the tables selected in cfg, restricted to their configured columns.
+func fetchMetadata(ctx context.Context, db *sql.DB, cfg ExportConfig) (SchemaDetails, error) {
+	var schema SchemaDetails
+	tableNames := cfg.tableNames()
 
+	existing, err := listRelations(ctx, db, cfg.listedSchemas(), cfg.IncludeViews)
+	if err != nil {
+		return schema, err
+	}
+	enums, err := fetchEnumLabels(ctx, db)
+	if err != nil {
+		return schema, err
+	}
+
+	for _, rel := range existing {
+		tableName := rel.tableName()
 		tableNotAskedFor := true
 		for _, t := range tableNames {
 			if t == tableName {
@@ -214,33 +575,53 @@ func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetail
 		}
 
 		// Create a new TableMetadata for the current table.
-		tableMeta := TableMetadata{TableName: tableName}
+		tableMeta := TableMetadata{TableName: tableName, Kind: rel.kind, Schema: rel.schema}
 
 		// Query column details for the current table.
 		columnsQuery := `
-			SELECT column_name, data_type, is_nullable
+			SELECT column_name, data_type, udt_schema, udt_name, is_nullable, numeric_precision, numeric_scale, column_default
 			FROM information_schema.columns
-			WHERE table_schema = 'public'
+			WHERE table_schema = $2
 			  AND table_name = $1
 			ORDER BY ordinal_position
 		`
-		colRows, err := db.Query(columnsQuery, tableName)
+		if rel.kind == relationMaterializedView {
+			columnsQuery = matviewColumnsQuery
+		}
+		colRows, err := db.QueryContext(ctx, columnsQuery, rel.name, rel.schema)
 		if err != nil {
 			return schema, fmt.Errorf("querying columns for table %s: %w", tableName, err)
 		}
 		var fields []FieldMetadata
 		for colRows.Next() {
-			var colName, dataType, isNullableStr string
-			if err := colRows.Scan(&colName, &dataType, &isNullableStr); err != nil {
+			var colName, dataType, udtSchema, udtName, isNullableStr string
+			var precision, scale sql.NullInt64
+			var defaultValue sql.NullString
+			if err := colRows.Scan(&colName, &dataType, &udtSchema, &udtName, &isNullableStr, &precision, &scale, &defaultValue); err != nil {
 				colRows.Close()
 				return schema, fmt.Errorf("scanning column for table %s: %w", tableName, err)
 			}
+			isDecimal := dataType == "numeric" || dataType == "decimal"
 			dataType = mapDataType(dataType)
 			isNullable := (isNullableStr == "YES")
 			field := FieldMetadata{
 				FieldName:  colName,
 				DataType:   dataType,
 				IsNullable: isNullable,
+				IsPII:      isLikelyPII(colName),
+			}
+			if isDecimal && precision.Valid {
+				field.Precision = int(precision.Int64)
+				field.Scale = int(scale.Int64)
+			}
+			if dataType == DataTypeArray {
+				// Array types are named after their element type, e.g. _int4.
+				field.ElementType = mapColumnType(strings.ToUpper(strings.TrimPrefix(udtName, "_")))
+			}
+			// Enum columns are USER-DEFINED, read as their labels.
+			field.EnumValues = enums[udtSchema+"."+udtName]
+			if cfg.FillDefaults && defaultValue.Valid {
+				field.FillValue, _ = constantDefault(field, defaultValue.String)
 			}
 			fields = append(fields, field)
 		}
@@ -252,10 +633,12 @@ func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetail
 			FROM information_schema.table_constraints tc
 			JOIN information_schema.key_column_usage kcu 
 			  ON tc.constraint_name = kcu.constraint_name
+			 AND tc.constraint_schema = kcu.constraint_schema
 			WHERE tc.constraint_type = 'PRIMARY KEY'
+			  AND tc.table_schema = $2
 			  AND tc.table_name = $1
 		`
-		pkRows, err := db.Query(pkQuery, tableName)
+		pkRows, err := db.QueryContext(ctx, pkQuery, rel.name, rel.schema)
 		if err != nil {
 			return schema, fmt.Errorf("querying primary keys for table %s: %w", tableName, err)
 		}
@@ -280,17 +663,21 @@ func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetail
 		// Query foreign key details for the table.
 		fkQuery := `
 			SELECT kcu.column_name, 
+			       ccu.table_schema AS foreign_schema,
 			       ccu.table_name AS foreign_table, 
 			       ccu.column_name AS foreign_column
 			FROM information_schema.table_constraints tc
 			JOIN information_schema.key_column_usage kcu 
 			  ON tc.constraint_name = kcu.constraint_name
+			 AND tc.constraint_schema = kcu.constraint_schema
 			JOIN information_schema.constraint_column_usage ccu 
 			  ON ccu.constraint_name = tc.constraint_name
+			 AND ccu.constraint_schema = tc.constraint_schema
 			WHERE tc.constraint_type = 'FOREIGN KEY'
+			  AND tc.table_schema = $2
 			  AND tc.table_name = $1
 		`
-		fkRows, err := db.Query(fkQuery, tableName)
+		fkRows, err := db.QueryContext(ctx, fkQuery, rel.name, rel.schema)
 		if err != nil {
 			return schema, fmt.Errorf("querying foreign keys for table %s: %w", tableName, err)
 		}
@@ -299,15 +686,15 @@ func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetail
 			foreignColumn string
 		})
 		for fkRows.Next() {
-			var colName, foreignTable, foreignColumn string
-			if err := fkRows.Scan(&colName, &foreignTable, &foreignColumn); err != nil {
+			var colName, foreignSchema, foreignTable, foreignColumn string
+			if err := fkRows.Scan(&colName, &foreignSchema, &foreignTable, &foreignColumn); err != nil {
 				fkRows.Close()
 				return schema, fmt.Errorf("scanning foreign key for table %s: %w", tableName, err)
 			}
 			fkMap[colName] = struct {
 				foreignTable  string
 				foreignColumn string
-			}{foreignTable: foreignTable, foreignColumn: foreignColumn}
+			}{foreignTable: qualifiedName(foreignSchema, foreignTable), foreignColumn: foreignColumn}
 		}
 		fkRows.Close()
 
@@ -320,15 +707,127 @@ func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetail
 			}
 		}
 
+		// Keep only the configured columns, in the configured order.
+		tableCfg, _ := cfg.table(tableName)
+		tableCfg.Name = tableName
+		fields, omitted, err := selectColumns(tableCfg, fields)
+		if err != nil {
+			return schema, err
+		}
+
 		tableMeta.Fields = fields
+		tableMeta.OmittedColumns = omitted
+		tableMeta.Where = tableCfg.Where
+		if err := fetchTableSize(ctx, db, cfg, &tableMeta); err != nil {
+			return schema, err
+		}
+		schema.Tables = append(schema.Tables, tableMeta)
+	}
+
+	dropUnselectedForeignKeys(schema.Tables, tableNames)
+
+	for _, q := range cfg.Queries {
+		tableMeta, err := fetchQueryMetadata(ctx, db, cfg, q, mapColumnType)
+		if err != nil {
+			return schema, err
+		}
 		schema.Tables = append(schema.Tables, tableMeta)
 	}
 
+	schema.DatasetMetadata = DatasetMetadata{
+		DatasetName: cfg.Connection.DBName,
+		SourceType:  "Relational Database",
+		SourceDetails: map[string]interface{}{
+			"database_type":         "PostgreSQL",
+			"tables_or_collections": tableNames,
+		},
+	}
+
+	return schema, nil
+}
+
+// Kinds of the views exported with include_views.
+const (
+	relationView             = "view"
+	relationMaterializedView = "materialized_view"
+)
+
+// defaultSchema is the PostgreSQL schema whose tables are named without
+// their schema.
+const defaultSchema = "public"
+
+// relation is a table, or with include_views a view, of a listed schema.
+type relation struct {
+	schema string
+	name   string
+	// kind is empty for tables.
+	kind string
+}
+
+// tableName returns the name a relation is exported as.
+func (r relation) tableName() string {
+	return qualifiedName(r.schema, r.name)
+}
+
+// qualifiedName returns the name of a PostgreSQL table as exported: its
+// own name in public, schema.table in the other schemas.
+func qualifiedName(schema, name string) string {
+	if schema == defaultSchema {
+		return name
+	}
+	return schema + "." + name
+}
+
+// listRelations returns the user tables in the schemas, and with
+// includeViews their views and materialized views too.
+func listRelations(ctx context.Context, db *sql.DB, schemas []string, includeViews bool) ([]relation, error) {
+	// Materialized views are missing from information_schema.
+	rows, err := db.QueryContext(ctx, `
+		SELECT table_schema, table_name, CASE table_type WHEN 'VIEW' THEN 'view' ELSE '' END
+		FROM information_schema.tables
+		WHERE table_schema = ANY($2)
+		  AND (table_type = 'BASE TABLE' OR ($1 AND table_type = 'VIEW'))
+		UNION ALL
+		SELECT schemaname, matviewname, 'materialized_view'
+		FROM pg_matviews
+		WHERE $1 AND schemaname = ANY($2)
+	`, includeViews, pq.Array(schemas))
+	if err != nil {
+		return nil, fmt.Errorf("querying tables: %w", err)
+	}
+	defer rows.Close()
+	var relations []relation
+	for rows.Next() {
+		var r relation
+		if err := rows.Scan(&r.schema, &r.name, &r.kind); err != nil {
+			return nil, fmt.Errorf("scanning table name: %w", err)
+		}
+		relations = append(relations, r)
+	}
 	if err := rows.Err(); err != nil {
-		return schema, fmt.Errorf("processing tables: %w", err)
+		return nil, fmt.Errorf("processing tables: %w", err)
+	}
+	return relations, nil
+}
+
+// listTables returns the names of the user tables in the schemas, and with
+// includeViews those of their views and materialized views.
+func listTables(ctx context.Context, db *sql.DB, schemas []string, includeViews bool) ([]string, error) {
+	relations, err := listRelations(ctx, db, schemas, includeViews)
+	if err != nil {
+		return nil, err
 	}
+	names := make([]string, len(relations))
+	for i, r := range relations {
+		names[i] = r.tableName()
+	}
+	return names, nil
+}
 
-	for tableIdx, table := range schema.Tables {
+// dropUnselectedForeignKeys clears the foreign key details of fields
+// referencing tables that are not part of the export.
+func dropUnselectedForeignKeys(tables []TableMetadata, tableNames []string) {
+	for tableIdx, table := range tables {
 		for fieldIdx, field := range table.Fields {
 			if field.IsForeignKey && field.ReferencedTable != nil {
 				found := false
@@ -342,22 +841,11 @@ func fetchMetadata(db *sql.DB, dbName string, tableNames []string) (SchemaDetail
 
 				// If not found, update the field metadata.
 				if !found {
-					schema.Tables[tableIdx].Fields[fieldIdx].ReferencedTable = nil
-					schema.Tables[tableIdx].Fields[fieldIdx].IsForeignKey = false
-					schema.Tables[tableIdx].Fields[fieldIdx].ReferencedField = nil
+					tables[tableIdx].Fields[fieldIdx].ReferencedTable = nil
+					tables[tableIdx].Fields[fieldIdx].IsForeignKey = false
+					tables[tableIdx].Fields[fieldIdx].ReferencedField = nil
 				}
 			}
 		}
 	}
-
-	schema.DatasetMetadata = DatasetMetadata{
-		DatasetName: dbName,
-		SourceType:  "Relational Database",
-		SourceDetails: map[string]interface{}{
-			"database_type":         "PostgreSQL",
-			"tables_or_collections": tableNames,
-		},
-	}
-
-	return schema, nil
 }
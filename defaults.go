@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// constantDefault returns the value to fill a column's nulls with, given
+// its DEFAULT expression, when the expression is a constant of the
+// column's type such as 0, 'none' or '1970-01-01'::date. Expressions such
+// as nextval(...) or now() have no fill value. Times and dates are kept as
+// text in the metadata.
+func constantDefault(field FieldMetadata, expr string) (interface{}, bool) {
+	literal, quoted, ok := parseDefaultLiteral(expr)
+	if !ok {
+		return nil, false
+	}
+	if !quoted && strings.EqualFold(literal, "null") {
+		return nil, false
+	}
+	switch field.DataType {
+	case DataTypeInt:
+		v, err := strconv.ParseInt(literal, 10, 64)
+		return v, err == nil
+	case DataTypeFloat:
+		v, err := strconv.ParseFloat(literal, 64)
+		return v, err == nil
+	case DataTypeBool:
+		switch strings.ToLower(literal) {
+		case "true", "t", "1":
+			return true, true
+		case "false", "f", "0":
+			return false, true
+		}
+	case DataTypeString:
+		return literal, true
+	case DataTypeDate:
+		if t, err := time.Parse(time.DateOnly, literal); err == nil && quoted {
+			return t.Format(time.DateOnly), true
+		}
+	case DataTypeTime:
+		if t, ok := timeValue(literal); ok && quoted {
+			return t.UTC().Format(time.RFC3339Nano), true
+		}
+	}
+	return nil, false
+}
+
+// parseDefaultLiteral extracts the literal of a constant DEFAULT
+// expression, as PostgreSQL's information_schema and SQLite's table_info
+// report it: optionally parenthesized, and for PostgreSQL followed by
+// casts. quoted is set for string literals, whose quotes are removed.
+func parseDefaultLiteral(expr string) (literal string, quoted, ok bool) {
+	expr = strings.TrimSpace(expr)
+	for len(expr) >= 2 && expr[0] == '(' && expr[len(expr)-1] == ')' {
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+	if strings.HasPrefix(expr, "'") {
+		var b strings.Builder
+		i := 1
+		for ; i < len(expr); i++ {
+			if expr[i] == '\'' {
+				if i+1 < len(expr) && expr[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			b.WriteByte(expr[i])
+		}
+		if i >= len(expr) {
+			return "", false, false
+		}
+		rest := expr[i+1:]
+		if rest != "" && !strings.HasPrefix(rest, "::") {
+			return "", false, false
+		}
+		return b.String(), true, true
+	}
+	literal, _, _ = strings.Cut(expr, "::")
+	literal = strings.TrimSpace(literal)
+	for len(literal) >= 2 && literal[0] == '(' && literal[len(literal)-1] == ')' {
+		literal = strings.TrimSpace(literal[1 : len(literal)-1])
+	}
+	// Anything else than a number or keyword is an expression.
+	for _, c := range literal {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '.' || c == '-' || c == '+') {
+			return "", false, false
+		}
+	}
+	switch strings.ToLower(literal) {
+	case "", "current_timestamp", "current_date", "current_time", "localtimestamp", "localtime":
+		return "", false, false
+	}
+	return literal, false, true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// denormalizes reports whether a table is exported with the tables it
+// references joined onto it.
+func (c ExportConfig) denormalizes() bool {
+	return slices.ContainsFunc(c.Tables, func(t TableConfig) bool { return t.Denormalize })
+}
+
+// joinPrefix returns the prefix of the columns joined through a foreign
+// key column: user_ for user_id, owner_ for owner.
+func joinPrefix(column string) string {
+	return strings.TrimSuffix(column, "_id") + "_"
+}
+
+// denormalize adds a dimension for every table the denormalized tables of
+// cfg reference with single-column foreign keys, and a join of it on each
+// foreign key, prefixing the joined columns with the name of the foreign
+// key column. Up to denormalize_depth levels, the tables the joined tables
+// reference are joined on the joined foreign key columns in turn, with
+// both prefixes. It returns the added dimensions.
+func denormalize(cfg *ExportConfig, fks []foreignKey) ([]DimensionConfig, error) {
+	var added []DimensionConfig
+	// dimensionOf returns the dimension of a referenced table and column.
+	dimensionOf := func(table, key string) (string, error) {
+		for _, d := range added {
+			if d.Table == table && d.Key == key {
+				return d.Name, nil
+			}
+		}
+		// A table referenced on other columns too has a dimension per key.
+		name := table
+		if slices.ContainsFunc(added, func(d DimensionConfig) bool { return d.Name == name }) {
+			name = table + "." + key
+		}
+		if slices.ContainsFunc(cfg.Dimensions, func(d DimensionConfig) bool { return d.Name == name }) {
+			return "", fmt.Errorf("dimension %s is configured, and also the table a foreign key references", name)
+		}
+		added = append(added, DimensionConfig{Name: name, Key: key, Connection: cfg.Connection, Table: table})
+		return name, nil
+	}
+
+	// A level is the tables joined so far, with the prefix of their
+	// columns, and the key their columns were joined on.
+	type joined struct {
+		table, prefix, key string
+	}
+	for i := range cfg.Tables {
+		t := &cfg.Tables[i]
+		if !t.Denormalize {
+			continue
+		}
+		depth := max(t.DenormalizeDepth, 1)
+		level := []joined{{table: t.Name}}
+		for n := 0; n < depth && len(level) > 0; n++ {
+			var next []joined
+			for _, from := range level {
+				for _, fk := range fks {
+					if fk.Table != from.table || len(fk.Columns) != 1 {
+						continue
+					}
+					column := fk.Columns[0]
+					// The key a table was joined on is not among its
+					// joined columns, and the table's own columns must be
+					// exported.
+					if column == from.key || (from.prefix == "" && !t.exports(column)) {
+						continue
+					}
+					name, err := dimensionOf(fk.RefTable, fk.RefColumns[0])
+					if err != nil {
+						return nil, err
+					}
+					prefix := from.prefix + joinPrefix(column)
+					t.Joins = append(t.Joins, JoinConfig{Dimension: name, On: from.prefix + column, Prefix: prefix})
+					next = append(next, joined{table: fk.RefTable, prefix: prefix, key: fk.RefColumns[0]})
+				}
+			}
+			level = next
+		}
+	}
+	cfg.Dimensions = append(cfg.Dimensions, added...)
+	return added, nil
+}
+
+// exports reports whether the table's column selection exports a column.
+func (t TableConfig) exports(column string) bool {
+	if columns := t.includedColumns(); len(columns) > 0 && !slices.Contains(columns, column) {
+		return false
+	}
+	return !slices.Contains(t.ExcludeColumns, column)
+}
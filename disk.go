@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// diskCheckInterval is how often the free space of the export's
+// filesystems is checked while it runs.
+const diskCheckInterval = 5 * time.Second
+
+const (
+	// What the export does when free disk space drops below the minimum,
+	// selected with -on-low-disk: pause until space is freed, or stop and
+	// fail, keeping the checkpoints for -resume.
+	lowDiskPause = "pause"
+	lowDiskFail  = "fail"
+)
+
+// lowDiskError reports a directory with less free space than the minimum.
+type lowDiskError struct {
+	dir        string
+	free, need uint64
+}
+
+func (e *lowDiskError) Error() string {
+	return fmt.Sprintf("%s has %d MB free, needs %d MB", e.dir, e.free>>20, e.need>>20)
+}
+
+// checkDiskSpace returns a lowDiskError for the first directory whose
+// filesystem has less than need bytes free. Filesystems whose free space
+// can't be read pass.
+func checkDiskSpace(dirs []string, need uint64) error {
+	for _, dir := range dirs {
+		free, ok, err := freeDiskBytes(dir)
+		if err != nil {
+			return fmt.Errorf("reading free space of %s: %w", dir, err)
+		}
+		if ok && free < need {
+			return &lowDiskError{dir: dir, free: free, need: need}
+		}
+	}
+	return nil
+}
+
+// estimatedExportBytes estimates the uncompressed size of the tables'
+// files from their ColumnBytes, scaled to the rows they read: the rows
+// exact_counts counted through their filter, their sample's fraction and
+// their limit. Partitions, splits and column groups of a table share its
+// rows and are counted once. It also returns whether any table has an
+// estimate.
+func estimatedExportBytes(tables []TableMetadata) (uint64, bool) {
+	sources := make(map[string]float64)
+	for _, table := range tables {
+		if table.ColumnBytes == nil {
+			continue
+		}
+		bytes := float64(max(*table.ColumnBytes, 0))
+		rows := -1.0
+		if table.EstimatedRows != nil && *table.EstimatedRows > 0 {
+			rows = float64(*table.EstimatedRows)
+		}
+		if table.ExactRows != nil && rows > 0 {
+			bytes *= float64(*table.ExactRows) / rows
+			rows = float64(*table.ExactRows)
+		}
+		if s := table.Sample; s != nil {
+			if s.Method != "" {
+				bytes *= s.Fraction
+				rows *= s.Fraction
+			}
+			if s.Limit > 0 && rows > float64(s.Limit) {
+				bytes *= float64(s.Limit) / rows
+			}
+		}
+		source := cmp.Or(table.SourceTable, table.TableName)
+		sources[source] = max(sources[source], bytes)
+	}
+	var total float64
+	for _, bytes := range sources {
+		total += bytes
+	}
+	return uint64(total), len(sources) > 0
+}
+
+// diskMonitor checks the free space of the export's directories while it
+// runs, and pauses the export or cancels it when one runs low.
+type diskMonitor struct {
+	dirs    []string
+	minFree uint64
+	onLow   string
+	cancel  context.CancelCauseFunc
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// pauseByDiskMonitor marks the pauses the disk monitor starts, the only
+// ones it resumes once space is freed.
+const pauseByDiskMonitor = "disk monitor"
+
+// startDiskMonitor starts checking that dirs keep minFree bytes free,
+// calling cancel with a lowDiskError to fail the export. It returns nil
+// with minFree 0.
+func startDiskMonitor(dirs []string, minFree uint64, onLow string, cancel context.CancelCauseFunc) *diskMonitor {
+	if minFree == 0 {
+		return nil
+	}
+	m := &diskMonitor{dirs: dirs, minFree: minFree, onLow: onLow, cancel: cancel, stop: make(chan struct{})}
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+func (m *diskMonitor) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// check compares the free space with the minimum.
+func (m *diskMonitor) check() {
+	err := checkDiskSpace(m.dirs, m.minFree)
+	var lowDisk *lowDiskError
+	if err != nil && !errors.As(err, &lowDisk) {
+		log.Printf("failed to check disk space: %v", err)
+		return
+	}
+	switch {
+	case err == nil:
+		// Pauses an operator started, or took over, are left to them.
+		if exportPause.ResumeBy(pauseByDiskMonitor) {
+			log.Printf("Disk space freed, resuming the export")
+		}
+	case m.onLow == lowDiskPause:
+		// Also after an operator resumed the export without freeing space.
+		if exportPause.PauseBy(pauseByDiskMonitor) {
+			log.Printf("Low disk space: %v; pausing the export until space is freed", err)
+		}
+	case m.onLow == lowDiskFail:
+		log.Printf("Low disk space: %v; stopping the export", err)
+		m.cancel(err)
+	}
+}
+
+// Stop stops checking.
+func (m *diskMonitor) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	m.wg.Wait()
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestEstimatedExportBytes(t *testing.T) {
+	n := func(v int64) *int64 { return &v }
+	table := TableMetadata{TableName: "t", EstimatedRows: n(1000), ColumnBytes: n(100000)}
+
+	tests := []struct {
+		name   string
+		tables func() []TableMetadata
+		want   uint64
+		known  bool
+	}{
+		{"no estimate", func() []TableMetadata {
+			return []TableMetadata{{TableName: "q"}}
+		}, 0, false},
+		{"whole table", func() []TableMetadata {
+			return []TableMetadata{table}
+		}, 100000, true},
+		{"counted through the filter", func() []TableMetadata {
+			t := table
+			t.ExactRows = n(250)
+			return []TableMetadata{t}
+		}, 25000, true},
+		{"sampled", func() []TableMetadata {
+			t := table
+			t.Sample = &SampleInfo{Method: sampleBernoulli, Fraction: 0.1}
+			return []TableMetadata{t}
+		}, 10000, true},
+		{"sampled and limited", func() []TableMetadata {
+			t := table
+			t.Sample = &SampleInfo{Method: sampleBernoulli, Fraction: 0.5, Limit: 50}
+			return []TableMetadata{t}
+		}, 5000, true},
+		{"limit above the rows", func() []TableMetadata {
+			t := table
+			t.Sample = &SampleInfo{Limit: 5000}
+			return []TableMetadata{t}
+		}, 100000, true},
+		{"hot and cold partitions", func() []TableMetadata {
+			hot, cold := table, table
+			hot.TableName, hot.SourceTable = "t__hot", "t"
+			cold.TableName, cold.SourceTable = "t__cold", "t"
+			hot.EstimatedRows, cold.EstimatedRows = nil, nil
+			return []TableMetadata{hot, cold}
+		}, 100000, true},
+		{"two tables", func() []TableMetadata {
+			other := table
+			other.TableName = "u"
+			return []TableMetadata{table, other}
+		}, 200000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, known := estimatedExportBytes(tt.tables())
+			if got != tt.want || known != tt.known {
+				t.Errorf("estimatedExportBytes = %d, %v, want %d, %v", got, known, tt.want, tt.known)
+			}
+		})
+	}
+}
+
+func TestDiskMonitorResumesOwnPauses(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok, err := freeDiskBytes(dir); err != nil || !ok {
+		t.Skipf("free space of %s unknown: %v", dir, err)
+	}
+	defer exportPause.Resume()
+	m := &diskMonitor{dirs: []string{dir}, onLow: lowDiskPause}
+	low, freed := func() { m.minFree = 1 << 62 }, func() { m.minFree = 1 }
+
+	low()
+	m.check()
+	if !exportPause.Paused() {
+		t.Fatal("low disk space didn't pause the export")
+	}
+	freed()
+	m.check()
+	if exportPause.Paused() {
+		t.Fatal("freed disk space didn't resume the export")
+	}
+
+	// An operator's pause stays, whether it came first or after.
+	exportPause.Pause()
+	low()
+	m.check()
+	freed()
+	m.check()
+	if !exportPause.Paused() {
+		t.Fatal("the monitor resumed an operator's pause")
+	}
+	exportPause.Resume()
+
+	low()
+	m.check()
+	exportPause.Pause()
+	freed()
+	m.check()
+	if !exportPause.Paused() {
+		t.Fatal("the monitor resumed a pause an operator took over")
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+const (
+	// driftBins is the number of quantile bins used for numeric PSI.
+	driftBins = 10
+	// driftEpsilon replaces empty bin proportions so PSI stays finite.
+	driftEpsilon = 1e-4
+)
+
+// ColumnDrift holds the drift metrics of a single column between two exports.
+type ColumnDrift struct {
+	Table  string   `json:"table"`
+	Column string   `json:"column"`
+	Kind   string   `json:"kind"`
+	PSI    float64  `json:"psi"`
+	KS     *float64 `json:"ks,omitempty"`
+	Alert  bool     `json:"alert"`
+}
+
+// DriftReport is the result of comparing a baseline export with a current one.
+type DriftReport struct {
+	Baseline     string        `json:"baseline"`
+	Current      string        `json:"current"`
+	PSIThreshold float64       `json:"psi_threshold"`
+	KSThreshold  float64       `json:"ks_threshold"`
+	Columns      []ColumnDrift `json:"columns"`
+	Alerts       int           `json:"alerts"`
+}
+
+// runDrift implements the `drift` command:
+//
+//	drift [-psi 0.2] [-ks 0.1] [-report drift_report.json] <baseline dir> <current dir>
+func runDrift(args []string) {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	psiThreshold := fs.Float64("psi", 0.2, "alert when a column's PSI exceeds this value")
+	ksThreshold := fs.Float64("ks", 0.1, "alert when a numeric column's KS statistic exceeds this value")
+	reportPath := fs.String("report", "drift_report.json", "where to write the drift report")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatalf("usage: drift [flags] <baseline dir> <current dir>")
+	}
+
+	report, err := compareExports(fs.Arg(0), fs.Arg(1), *psiThreshold, *ksThreshold)
+	if err != nil {
+		log.Fatalf("failed to compare exports: %v", err)
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to marshal drift report: %v", err)
+	}
+	if err := saveFile(*reportPath, b); err != nil {
+		log.Fatalf("failed to save drift report: %v", err)
+	}
+
+	for _, col := range report.Columns {
+		if col.Alert {
+			log.Printf("ALERT: drift in %s.%s (psi=%.4f)", col.Table, col.Column, col.PSI)
+		}
+	}
+	log.Printf("Compared %d columns, %d alerts, report saved to %s", len(report.Columns), report.Alerts, *reportPath)
+
+	if report.Alerts > 0 {
+		os.Exit(1)
+	}
+}
+
+// compareExports computes drift metrics for every column present in both
+// export directories.
+func compareExports(baselineDir, currentDir string, psiThreshold, ksThreshold float64) (*DriftReport, error) {
+	report := &DriftReport{
+		Baseline:     baselineDir,
+		Current:      currentDir,
+		PSIThreshold: psiThreshold,
+		KSThreshold:  ksThreshold,
+		Columns:      []ColumnDrift{},
+	}
+
+	files, err := filepath.Glob(filepath.Join(baselineDir, "*.npz"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	for _, baselineFile := range files {
+		currentFile := filepath.Join(currentDir, filepath.Base(baselineFile))
+		if _, err := os.Stat(currentFile); err != nil {
+			log.Printf("skipping %s: not present in %s", filepath.Base(baselineFile), currentDir)
+			continue
+		}
+
+		table := trimExt(filepath.Base(baselineFile))
+		cols, err := compareTables(table, baselineFile, currentFile)
+		if err != nil {
+			return nil, fmt.Errorf("comparing table %s: %w", table, err)
+		}
+
+		for _, col := range cols {
+			col.Alert = col.PSI > psiThreshold || (col.KS != nil && *col.KS > ksThreshold)
+			if col.Alert {
+				report.Alerts++
+			}
+			report.Columns = append(report.Columns, col)
+		}
+	}
+
+	return report, nil
+}
+
+// compareTables computes drift for the columns shared by two NPZ files.
+func compareTables(table, baselineFile, currentFile string) ([]ColumnDrift, error) {
+	baseline, err := npz.Open(baselineFile)
+	if err != nil {
+		return nil, err
+	}
+	defer baseline.Close()
+
+	current, err := npz.Open(currentFile)
+	if err != nil {
+		return nil, err
+	}
+	defer current.Close()
+
+	currentNames := make(map[string]bool)
+	for _, name := range npzColumnNames(current) {
+		currentNames[name] = true
+	}
+
+	var result []ColumnDrift
+	for _, name := range npzColumnNames(baseline) {
+		if !currentNames[name] || strings.HasSuffix(name, categoriesSuffix) || strings.HasSuffix(name, dictionarySuffix) || strings.HasSuffix(name, offsetsSuffix) || strings.HasSuffix(name, lowSuffix) || strings.HasSuffix(name, maskSuffix) {
+			continue
+		}
+
+		before, err := readPresentValues(baseline, filepath.Dir(baselineFile), name)
+		if err != nil {
+			return nil, err
+		}
+		after, err := readPresentValues(current, filepath.Dir(currentFile), name)
+		if err != nil {
+			return nil, err
+		}
+
+		drift := ColumnDrift{Table: table, Column: name}
+		beforeNum, okBefore := numericValues(before)
+		afterNum, okAfter := numericValues(after)
+		if okBefore && okAfter {
+			ks := ksStatistic(beforeNum, afterNum)
+			drift.Kind = "numeric"
+			drift.PSI = numericPSI(beforeNum, afterNum)
+			drift.KS = &ks
+		} else {
+			drift.Kind = "categorical"
+			drift.PSI = categoricalPSI(stringValues(before), stringValues(after))
+		}
+		result = append(result, drift)
+	}
+
+	return result, nil
+}
+
+// readDecodedColumn reads a column of an NPZ archive in dir, turning
+// dictionary encoded codes back into their string values so exports with
+// different dictionaries compare, and splitting ragged columns into one
+// []interface{} per row.
+func readDecodedColumn(r *npz.Reader, dir, name string) (interface{}, error) {
+	if rows, ok, err := readRaggedColumn(r, name); ok {
+		return rows, err
+	}
+	column, err := readNpzColumn(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if values, ok, err := readSharedDictionary(r, dir, name); ok {
+		if err != nil {
+			return nil, err
+		}
+		codes, _ := numericValues(column)
+		return dictionaryDecode(codes, values), nil
+	}
+	categories, err := readNpzColumn(r, name+categoriesSuffix)
+	if err != nil {
+		// Not dictionary encoded.
+		return column, nil
+	}
+	codes, _ := numericValues(column)
+	return dictionaryDecode(codes, stringValues(categories)), nil
+}
+
+// readPresentValues reads a column like readDecodedColumn, leaving out the
+// rows its null mask marks.
+func readPresentValues(r *npz.Reader, dir, name string) (interface{}, error) {
+	column, err := readDecodedColumn(r, dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if npzDtype(r, name+maskSuffix) == "" {
+		return column, nil
+	}
+	m, err := readNpzColumn(r, name+maskSuffix)
+	if err != nil {
+		return nil, err
+	}
+	mask, _ := m.([]bool)
+	rv := reflect.ValueOf(column)
+	if len(mask) != rv.Len() {
+		return nil, fmt.Errorf("null mask of %s has %d values, expected %d", name, len(mask), rv.Len())
+	}
+	present := reflect.MakeSlice(rv.Type(), 0, rv.Len())
+	for i, null := range mask {
+		if !null {
+			present = reflect.Append(present, rv.Index(i))
+		}
+	}
+	return present.Interface(), nil
+}
+
+// finiteValues returns the values that are neither NaN nor infinite, such
+// as the NaNs of the nan null policy, which have no place in an ordering.
+func finiteValues(values []float64) []float64 {
+	finite := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			finite = append(finite, v)
+		}
+	}
+	return finite
+}
+
+// numericValues converts a numeric, boolean or time slice to []float64,
+// with times as seconds since the epoch.
+func numericValues(column interface{}) ([]float64, bool) {
+	rv := reflect.ValueOf(column)
+	out := make([]float64, rv.Len())
+	for i := range out {
+		v := rv.Index(i)
+		if t, ok := v.Interface().(time.Time); ok {
+			out[i] = float64(t.Unix())
+			continue
+		}
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			out[i] = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			out[i] = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			out[i] = v.Float()
+		case reflect.Bool:
+			if v.Bool() {
+				out[i] = 1
+			}
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// stringValues formats every element of a slice as a string.
+func stringValues(column interface{}) []string {
+	rv := reflect.ValueOf(column)
+	out := make([]string, rv.Len())
+	for i := range out {
+		out[i] = fmt.Sprintf("%v", rv.Index(i).Interface())
+	}
+	return out
+}
+
+// numericPSI computes the population stability index using quantile bins
+// derived from the baseline distribution, ignoring values that aren't
+// finite.
+func numericPSI(baseline, current []float64) float64 {
+	baseline, current = finiteValues(baseline), finiteValues(current)
+	if len(baseline) == 0 || len(current) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), baseline...)
+	sort.Float64s(sorted)
+	var edges []float64
+	for i := 1; i < driftBins; i++ {
+		edge := sorted[i*len(sorted)/driftBins]
+		if len(edges) == 0 || edge > edges[len(edges)-1] {
+			edges = append(edges, edge)
+		}
+	}
+
+	return psi(binCounts(baseline, edges), binCounts(current, edges), len(baseline), len(current))
+}
+
+// binCounts counts values into the buckets delimited by edges.
+func binCounts(values, edges []float64) []int {
+	counts := make([]int, len(edges)+1)
+	for _, v := range values {
+		counts[sort.SearchFloat64s(edges, v)]++
+	}
+	return counts
+}
+
+// categoricalPSI computes the population stability index over category frequencies.
+func categoricalPSI(baseline, current []string) float64 {
+	if len(baseline) == 0 || len(current) == 0 {
+		return 0
+	}
+
+	index := make(map[string]int)
+	for _, values := range [][]string{baseline, current} {
+		for _, v := range values {
+			if _, ok := index[v]; !ok {
+				index[v] = len(index)
+			}
+		}
+	}
+
+	before := make([]int, len(index))
+	for _, v := range baseline {
+		before[index[v]]++
+	}
+	after := make([]int, len(index))
+	for _, v := range current {
+		after[index[v]]++
+	}
+
+	return psi(before, after, len(baseline), len(current))
+}
+
+func psi(before, after []int, nBefore, nAfter int) float64 {
+	var total float64
+	for i := range before {
+		b := math.Max(float64(before[i])/float64(nBefore), driftEpsilon)
+		a := math.Max(float64(after[i])/float64(nAfter), driftEpsilon)
+		total += (a - b) * math.Log(a/b)
+	}
+	return total
+}
+
+// ksStatistic computes the two-sample Kolmogorov-Smirnov statistic,
+// ignoring values that aren't finite.
+func ksStatistic(baseline, current []float64) float64 {
+	a, b := finiteValues(baseline), finiteValues(current)
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	sort.Float64s(a)
+	sort.Float64s(b)
+
+	var i, j int
+	var maxDiff float64
+	for i < len(a) && j < len(b) {
+		v := math.Min(a[i], b[j])
+		for i < len(a) && a[i] <= v {
+			i++
+		}
+		for j < len(b) && b[j] <= v {
+			j++
+		}
+		diff := math.Abs(float64(i)/float64(len(a)) - float64(j)/float64(len(b)))
+		maxDiff = math.Max(maxDiff, diff)
+	}
+	return maxDiff
+}
+
+// trimExt strips the extension from a file name.
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
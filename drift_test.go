@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKSStatistic(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	tests := []struct {
+		name              string
+		baseline, current []float64
+		want              float64
+	}{
+		{"identical", []float64{1, 2, 3, 4}, []float64{1, 2, 3, 4}, 0},
+		{"disjoint", []float64{1, 2}, []float64{3, 4}, 1},
+		{"half shifted", []float64{1, 2, 3, 4}, []float64{3, 4, 5, 6}, 0.5},
+		{"empty", nil, []float64{1}, 0},
+		{"nan in baseline", []float64{1, nan, 2, 3, 4}, []float64{1, 2, 3, 4}, 0},
+		{"nan in both", []float64{nan, 1, 2}, []float64{3, nan, 4}, 1},
+		{"infinities", []float64{1, inf, 2}, []float64{math.Inf(-1), 1, 2}, 0},
+		{"only nans", []float64{nan, nan}, []float64{1, 2}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ksStatistic(tt.baseline, tt.current); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("ksStatistic(%v, %v) = %v, want %v", tt.baseline, tt.current, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericPSI(t *testing.T) {
+	values := make([]float64, 1000)
+	shifted := make([]float64, 1000)
+	for i := range values {
+		values[i] = float64(i)
+		shifted[i] = float64(i + 500)
+	}
+	withNaNs := append([]float64{math.NaN(), math.Inf(1)}, values...)
+
+	tests := []struct {
+		name              string
+		baseline, current []float64
+		// stable is true for distributions whose PSI must stay under 0.1.
+		stable bool
+	}{
+		{"identical", values, values, true},
+		{"nans ignored", withNaNs, values, true},
+		{"shifted", values, shifted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := numericPSI(tt.baseline, tt.current)
+			if math.IsNaN(got) || math.IsInf(got, 0) {
+				t.Fatalf("numericPSI = %v, want a finite value", got)
+			}
+			if stable := got < 0.1; stable != tt.stable {
+				t.Errorf("numericPSI = %v, stable %v, want %v", got, stable, tt.stable)
+			}
+		})
+	}
+}
+
+func TestCategoricalPSI(t *testing.T) {
+	if got := categoricalPSI([]string{"a", "b", "a"}, []string{"a", "a", "b"}); got != 0 {
+		t.Errorf("categoricalPSI of the same frequencies = %v, want 0", got)
+	}
+	if got := categoricalPSI([]string{"a", "a"}, []string{"b", "b"}); got < 1 {
+		t.Errorf("categoricalPSI of disjoint categories = %v, want at least 1", got)
+	}
+}
+
+func TestPSI(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []int
+		want          float64
+	}{
+		{"same", []int{5, 5}, []int{5, 5}, 0},
+		// (0.8-0.5)ln(0.8/0.5) + (0.2-0.5)ln(0.2/0.5)
+		{"shifted", []int{5, 5}, []int{8, 2}, 0.3*math.Log(1.6) - 0.3*math.Log(0.4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := psi(tt.before, tt.after, 10, 10)
+			if math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("psi = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
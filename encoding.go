@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"math/big"
+	"strings"
+)
+
+const (
+	// Column encodings recorded in FieldMetadata.Encoding.
+	EncodingRaw        = "raw"
+	EncodingDictionary = "dictionary"
+	EncodingJSON       = "json"
+	EncodingRagged     = "ragged"
+	EncodingBase64     = "base64"
+	// Decimal columns stored exactly, as text or as unscaled integers.
+	EncodingDecimalString = "decimal_string"
+	EncodingDecimalScaled = "decimal_scaled"
+
+	// Dictionary encoding modes, selected with -dict-encoding.
+	dictionaryAuto   = "auto"
+	dictionaryAlways = "always"
+	dictionaryNever  = "never"
+
+	// Dictionary settings of single columns, in a table's dictionary.
+	dictionaryOn  = "on"
+	dictionaryOff = "off"
+
+	// dictionaryMaxRatio is the highest distinct/rows ratio for which the
+	// auto mode picks a dictionary encoding.
+	dictionaryMaxRatio = 0.1
+
+	// dictionarySampleRows is the number of leading rows the auto mode
+	// decides on, since the rows of a table are streamed.
+	dictionarySampleRows = 10000
+
+	// categoriesSuffix names the companion array holding a dictionary
+	// encoded column's categories.
+	categoriesSuffix = "__categories"
+
+	// Array encodings, selected with -array-encoding.
+	arraysJSON   = "json"
+	arraysRagged = "ragged"
+
+	// Binary encodings, selected with -binary-encoding.
+	binaryRagged = "ragged"
+	binaryBase64 = "base64"
+
+	// offsetsSuffix names the companion array holding the end offsets of
+	// a ragged column's rows in its values array, after a leading 0.
+	offsetsSuffix = "__offsets"
+
+	// maskSuffix names the boolean companion array that is true where a
+	// column is null.
+	maskSuffix = "__mask"
+
+	// Decimal encodings, selected with decimal_encoding in the config or
+	// -decimal-encoding.
+	decimalsFloat  = "float"
+	decimalsString = "string"
+	decimalsScaled = "scaled"
+
+	// lowSuffix names the companion array holding the low 64 bits of the
+	// unscaled values of a decimal_scaled column too wide for an int64;
+	// the column's own array holds the high 64 bits.
+	lowSuffix = "__low"
+
+	// scaledDecimalMaxPrecision is the largest precision the scaled
+	// encoding holds, in 128 bits; wider decimals are stored as text.
+	scaledDecimalMaxPrecision = 38
+)
+
+// companionSuffixes are the suffixes of the companion arrays of columns.
+var companionSuffixes = []string{categoriesSuffix, offsetsSuffix, maskSuffix, lowSuffix, dictionarySuffix}
+
+// companionName reports whether an array name ends like a companion
+// array, so that a column of that name would be read as one.
+func companionName(name string) bool {
+	for _, suffix := range companionSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDecimalEncoding sets the encoding of every decimal column, a float
+// column with a declared precision, whose Encoding isn't set yet: string
+// stores the exact values as text at the column's scale, scaled stores the
+// values times 10^scale as int64, or as two int64 halves beyond 18 digits.
+// The float mode leaves them floats.
+func applyDecimalEncoding(table *TableData, mode string) {
+	for i, col := range table.Columns {
+		if col.Encoding != "" || col.DataType != DataTypeFloat || col.Precision == 0 {
+			continue
+		}
+		switch {
+		case mode == decimalsScaled && col.Precision <= scaledDecimalMaxPrecision:
+			table.Columns[i].Encoding = EncodingDecimalScaled
+		case mode == decimalsScaled || mode == decimalsString:
+			table.Columns[i].Encoding = EncodingDecimalString
+		}
+	}
+}
+
+// formatDecimal formats an unscaled decimal value at the given scale.
+func formatDecimal(unscaled *big.Int, scale int) string {
+	digits := new(big.Int).Abs(unscaled).String()
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if unscaled.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// splitInt128 returns the high and low 64 bits of a value that fits in a
+// signed 128-bit integer.
+func splitInt128(v *big.Int) (hi, lo int64) {
+	mask := new(big.Int).SetUint64(math.MaxUint64)
+	lo = int64(new(big.Int).And(v, mask).Uint64())
+	hi = new(big.Int).Rsh(v, 64).Int64()
+	return hi, lo
+}
+
+// joinInt128 is the inverse of splitInt128.
+func joinInt128(hi, lo int64) *big.Int {
+	v := new(big.Int).Lsh(big.NewInt(hi), 64)
+	return v.Or(v, new(big.Int).SetUint64(uint64(lo)))
+}
+
+// applyArrayEncoding sets the encoding of every array column whose
+// Encoding isn't set yet: json stores each array as JSON text, ragged
+// stores the elements of all rows in one typed array next to their
+// offsets.
+func applyArrayEncoding(table *TableData, mode string) {
+	for i, col := range table.Columns {
+		if col.Encoding != "" || col.DataType != DataTypeArray {
+			continue
+		}
+		if mode == arraysRagged {
+			table.Columns[i].Encoding = EncodingRagged
+		} else {
+			table.Columns[i].Encoding = EncodingJSON
+		}
+	}
+}
+
+// applyBinaryEncoding sets the encoding of every binary column whose
+// Encoding isn't set yet: ragged stores the bytes of all rows in one uint8
+// array next to their offsets, like ragged arrays, base64 stores each
+// value as base64 text.
+func applyBinaryEncoding(table *TableData, mode string) {
+	for i, col := range table.Columns {
+		if col.Encoding != "" || col.DataType != DataTypeBytes {
+			continue
+		}
+		if mode == binaryBase64 {
+			table.Columns[i].Encoding = EncodingBase64
+		} else {
+			table.Columns[i].Encoding = EncodingRagged
+		}
+	}
+}
+
+// binaryValue returns the bytes of a binary column's value.
+func binaryValue(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+// archivedBinary turns a value of a binary column read back from an NPZ
+// archive, the uint8 elements of a ragged row or base64 text, into bytes.
+func archivedBinary(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		b := make([]byte, len(v))
+		for i, e := range v {
+			b[i], _ = e.(uint8)
+		}
+		return b
+	case string:
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// applyDictionaryEncoding decides the encoding of every string column of
+// the table from its cardinality: that of the column's profile when it has
+// one, and otherwise that of the table's rows, which are the first
+// dictionarySampleRows rows of an export. columns, by column, turn the
+// dictionary on or off for single columns, whatever the mode. Columns whose
+// Encoding is already set are left untouched so callers can override the
+// decision per column.
+func applyDictionaryEncoding(table *TableData, mode string, columns map[string]string) {
+	for i, col := range table.Columns {
+		if col.Encoding != "" {
+			continue
+		}
+		if col.DataType != DataTypeString {
+			table.Columns[i].Encoding = EncodingRaw
+			continue
+		}
+		colMode := mode
+		switch columns[col.FieldName] {
+		case dictionaryOn:
+			colMode = dictionaryAlways
+		case dictionaryOff:
+			colMode = dictionaryNever
+		}
+		// Enum columns have their categories already.
+		if len(col.EnumValues) > 0 && colMode != dictionaryNever {
+			table.Columns[i].Encoding = EncodingDictionary
+			continue
+		}
+
+		switch colMode {
+		case dictionaryAlways:
+			table.Columns[i].Encoding = EncodingDictionary
+		case dictionaryNever:
+			table.Columns[i].Encoding = EncodingRaw
+		default:
+			distinct, nrows := sampleCardinality(table.Rows, col.FieldName)
+			// Nulls count as a value, as they do in the sample.
+			if p := col.Profile; p != nil && p.Count+p.Nulls > 0 {
+				distinct, nrows = p.DistinctCount, p.Count+p.Nulls
+				if p.Nulls > 0 {
+					distinct++
+				}
+			}
+			if nrows > 0 && float64(distinct) <= dictionaryMaxRatio*float64(nrows) {
+				table.Columns[i].Encoding = EncodingDictionary
+			} else {
+				table.Columns[i].Encoding = EncodingRaw
+			}
+		}
+	}
+}
+
+// sampleCardinality returns the distinct values of a column in rows, null
+// included, and the number of rows.
+func sampleCardinality(rows []TableRow, column string) (int64, int64) {
+	distinct := make(map[interface{}]struct{})
+	for _, row := range rows {
+		distinct[row[column]] = struct{}{}
+	}
+	return int64(len(distinct)), int64(len(rows))
+}
+
+// dictionaryBuilder assigns int32 codes to values in order of first appearance.
+type dictionaryBuilder struct {
+	index  map[string]int32
+	values []string
+}
+
+// newDictionaryBuilder returns a builder whose first codes are those of
+// values, such as the labels of an enum type in their declared order.
+func newDictionaryBuilder(values ...string) *dictionaryBuilder {
+	d := &dictionaryBuilder{index: make(map[string]int32)}
+	for _, v := range values {
+		d.code(v)
+	}
+	return d
+}
+
+// code returns the code of v, adding it to the dictionary if needed.
+func (d *dictionaryBuilder) code(v string) int32 {
+	code, ok := d.index[v]
+	if !ok {
+		code = int32(len(d.values))
+		d.index[v] = code
+		d.values = append(d.values, v)
+	}
+	return code
+}
+
+// dictionaryDecode maps codes back to their category values.
+func dictionaryDecode(codes []float64, categories []string) []string {
+	values := make([]string, len(codes))
+	for i, code := range codes {
+		if c := int(code); c >= 0 && c < len(categories) {
+			values[i] = categories[c]
+		}
+	}
+	return values
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestApplyDictionaryEncoding(t *testing.T) {
+	// 100 rows of 5 values in the sample.
+	var rows []TableRow
+	for i := range 100 {
+		rows = append(rows, TableRow{"status": []string{"a", "b", "c", "d", "e"}[i%5]})
+	}
+	unique := &ColumnProfile{Count: 100000, DistinctCount: 90000}
+	few := &ColumnProfile{Count: 100000, Nulls: 5000, DistinctCount: 12}
+
+	tests := []struct {
+		name    string
+		mode    string
+		profile *ColumnProfile
+		setting string
+		want    string
+	}{
+		{"sample decides", dictionaryAuto, nil, "", EncodingDictionary},
+		{"profile with many values", dictionaryAuto, unique, "", EncodingRaw},
+		{"profile with few values", dictionaryAuto, few, "", EncodingDictionary},
+		{"column on", dictionaryNever, unique, dictionaryOn, EncodingDictionary},
+		{"column off", dictionaryAlways, nil, dictionaryOff, EncodingRaw},
+		{"column auto follows the mode", dictionaryNever, nil, dictionaryAuto, EncodingRaw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &TableData{
+				Columns: []FieldMetadata{{FieldName: "status", DataType: DataTypeString, Profile: tt.profile}},
+				Rows:    rows,
+			}
+			applyDictionaryEncoding(table, tt.mode, map[string]string{"status": tt.setting})
+			if got := table.Columns[0].Encoding; got != tt.want {
+				t.Errorf("encoding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
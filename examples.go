@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxExampleLength truncates long example values such as free text.
+const maxExampleLength = 64
+
+// piiMarkers are column name fragments that tag a column as PII.
+var piiMarkers = []string{
+	"email", "password", "passwd", "secret", "token", "phone", "ssn",
+	"address", "first_name", "last_name", "full_name", "birth", "ip_addr",
+	"api_key", "credit_card", "iban",
+}
+
+// isLikelyPII reports whether a column name suggests personal or secret data.
+func isLikelyPII(columnName string) bool {
+	name := strings.ToLower(columnName)
+	for _, marker := range piiMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleExampleValues adds distinct non-null example values from the
+// table's rows to each column's metadata, up to n per column, skipping
+// columns tagged as PII. It is called for every batch, so examples come
+// from the first rows that provide them.
+func sampleExampleValues(table *TableData, n int) {
+	if n == 0 {
+		return
+	}
+
+	for i, col := range table.Columns {
+		if col.IsPII || len(col.ExampleValues) == n {
+			continue
+		}
+
+		examples := col.ExampleValues
+		for _, row := range table.Rows {
+			if len(examples) == n {
+				break
+			}
+			value := row[col.FieldName]
+			if value == nil {
+				continue
+			}
+			example := formatExample(value)
+			if !slices.Contains(examples, example) {
+				examples = append(examples, example)
+			}
+		}
+		table.Columns[i].ExampleValues = examples
+	}
+}
+
+// formatExample renders a value for the data dictionary.
+func formatExample(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case time.Time:
+		s = v.Format(time.RFC3339)
+	case []byte:
+		s = string(v)
+	case []interface{}:
+		s, _ = jsonText(v)
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	if r := []rune(s); len(r) > maxExampleLength {
+		s = string(r[:maxExampleLength]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Output file formats, selected with format in the config or -format.
+const (
+	formatNPZ     = "npz"
+	formatParquet = "parquet"
+	formatFeather = "feather"
+	formatCSV     = "csv"
+)
+
+// formatNames are the display names of the output formats.
+var formatNames = map[string]string{formatNPZ: "NumPy", formatParquet: "Parquet", formatFeather: "Feather", formatCSV: "CSV"}
+
+// tableWriter writes a table's output file from batches of rows.
+type tableWriter interface {
+	// writeRows writes a batch. Writers that write out parts of the file
+	// as their buffers fill stop between them once ctx is canceled.
+	writeRows(ctx context.Context, rows []TableRow) error
+	// close finishes the file, storing the entries of files as extra
+	// metadata, and returns the number of temporary bytes used. It stops
+	// and discards the file once ctx is canceled.
+	close(ctx context.Context, files map[string][]byte) (int64, error)
+	// discard removes what was written of a table that failed to export.
+	discard()
+}
+
+// chunkedWriter is implemented by writers of formats whose files are split
+// into chunks that loaders can read one at a time.
+type chunkedWriter interface {
+	// chunkStats returns the statistics of the chunks written so far.
+	chunkStats() []ChunkStats
+}
+
+// newTableWriter creates the writer of a table's file in cfg.OutDir in the
+// configured format, and of its files in the further outputs. Only the NPZ
+// writer uses spill files, and an exec sink's command is killed if ctx is
+// canceled.
+func newTableWriter(ctx context.Context, cfg ExportConfig, tableName string, columns []FieldMetadata, spill spillConfig) (tableWriter, error) {
+	if len(cfg.Outputs) > 0 {
+		ocfg := cfg
+		ocfg.Outputs = nil
+		w, err := newTableWriter(ctx, ocfg, tableName, columns, spill)
+		if err != nil {
+			return nil, err
+		}
+		return newMultiOutputWriter(ctx, cfg, w, tableName, columns, spill)
+	}
+	path := cfg.outputPath(tableName)
+	switch cfg.Format {
+	case formatParquet:
+		opts, err := cfg.parquetOptions(tableName)
+		if err != nil {
+			return nil, err
+		}
+		return newParquetWriter(path, tableName, columns, opts)
+	case formatFeather:
+		if cfg.Sink.Exec != "" {
+			return newExecSink(ctx, cfg.Sink.Exec, tableName, columns)
+		}
+		return newArrowWriter(path, tableName, columns)
+	case formatCSV:
+		delimiter, err := parseDelimiter(cfg.CSVDelimiter)
+		if err != nil {
+			return nil, err
+		}
+		return newCSVWriter(path, tableName, columns, delimiter)
+	}
+	w := newNpzWriter(cfg.OutDir, tableName, columns, spill)
+	w.stored = cfg.NPZCompression == npzCompressionNone
+	return w, nil
+}
+
+// tableExporter exports single tables of a run. Its fields are shared by
+// every table and only read, so tables can be exported concurrently.
+type tableExporter struct {
+	opts    exportOptions
+	src     exportSource
+	dataset DatasetMetadata
+	spill   spillConfig
+	rates   map[string]float64
+	dims    map[string]*dimension
+	key     hashKey
+	// approved is the schema given with -reuse-metadata, by table.
+	approved map[string]TableMetadata
+	// profiles is the budget of profile_budget, nil without one.
+	profiles *profileBudget
+	// dictionaries are the shared dictionaries the tables add to.
+	dictionaries *sharedDictionaries
+}
+
+// tableResult is the outcome of exporting one table.
+type tableResult struct {
+	// columns is the table's final column metadata.
+	columns []FieldMetadata
+	// note is recorded in the table's metadata; written is false for
+	// skipped and failed tables.
+	note    string
+	written bool
+	usage   TableUsage
+	err     error
+	// attempts is the number of times the table was exported.
+	attempts int
+	// watermark is the highest value of the table's watermark column
+	// exported, nil without a watermark or rows.
+	watermark interface{}
+	// chunks are the statistics of the chunks of the table's file, for
+	// chunked formats.
+	chunks []ChunkStats
+	// groups are the columns of the column groups a wide table was
+	// written in, nil for tables written to a single file.
+	groups []plannedGroup
+	// splits are the splits a table was written in, nil for tables
+	// written whole.
+	splits *tableSplits
+}
+
+// exportTables exports the tables with up to concurrency tables in flight,
+// starting them in order. A table that keeps failing is skipped without
+// stopping the others; its last error is returned in its result. Once ctx
+// is canceled no more tables start, and the tables not started fail with
+// its error.
+func (e *tableExporter) exportTables(ctx context.Context, tables []TableMetadata, concurrency int) []tableResult {
+	results := make([]tableResult, len(tables))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(concurrency, len(tables)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = e.exportTableWithRetries(ctx, tables[i])
+			}
+		}()
+	}
+	for i := range tables {
+		if ctx.Err() != nil {
+			results[i] = tableResult{columns: tables[i].Fields, note: "failed: " + ctx.Err().Error(), err: ctx.Err()}
+			continue
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// exportTableWithRetries exports a table, trying again after a failure up
+// to -max-attempts times with a delay growing by -retry-delay per attempt.
+// A table that fails every attempt is skipped. Canceling ctx ends the
+// attempts.
+func (e *tableExporter) exportTableWithRetries(ctx context.Context, table TableMetadata) tableResult {
+	for attempt := 1; ; attempt++ {
+		r := e.exportTable(ctx, table)
+		r.attempts = attempt
+		if r.err == nil {
+			return r
+		}
+		if ctx.Err() != nil {
+			log.Printf("Table %q interrupted: %v", table.TableName, r.err)
+			return r
+		}
+		// Another attempt would only reach the limit, or the null, again.
+		var limitErr *limitError
+		var nullErr *nullValueError
+		if errors.As(r.err, &limitErr) || errors.As(r.err, &nullErr) {
+			log.Printf("Skipping table %q: %v", table.TableName, r.err)
+			return r
+		}
+		if attempt >= e.opts.MaxAttempts {
+			log.Printf("Skipping table %q after %d failed attempts: %v", table.TableName, attempt, r.err)
+			r.note = fmt.Sprintf("skipped after %d failed attempts: %v", attempt, r.err)
+			return r
+		}
+		delay := time.Duration(attempt) * e.opts.RetryDelay
+		log.Printf("failed to export table %q (attempt %d of %d), retrying in %s: %v", table.TableName, attempt, e.opts.MaxAttempts, delay, r.err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return r
+		}
+	}
+}
+
+// exportTable streams a table from the source through its row transforms
+// into its output file, stopping when ctx is canceled.
+func (e *tableExporter) exportTable(ctx context.Context, table TableMetadata) tableResult {
+	cfg := e.opts.Export
+	meter := startUsageMeter(table.TableName)
+	failed := func(err error) tableResult {
+		return tableResult{columns: table.Fields, note: "failed: " + err.Error(), usage: meter.finish(""), err: err}
+	}
+
+	tableData := &TableData{TableName: table.TableName, Columns: slices.Clone(table.Fields)}
+	transforms, err := newRowTransforms(tableData, cfg.transforms(table.TableName), cfg.Currency.Base, e.rates, e.dims, e.key, cfg.FreezeVocabulary)
+	if err != nil {
+		return failed(fmt.Errorf("preparing column transforms: %w", err))
+	}
+	if err := useSharedDictionaries(tableData, cfg.transforms(table.TableName).SharedDictionary); err != nil {
+		return failed(err)
+	}
+	nulls, err := cfg.nullFilter(tableData)
+	if err != nil {
+		return failed(err)
+	}
+	var profiler *tableProfiler
+	if cfg.Profile {
+		profiler = newTableProfiler(tableData.Columns)
+		e.profiles.take(profiler)
+		defer e.profiles.giveBack(profiler)
+	}
+	if approved, ok := e.approved[table.TableName]; ok {
+		useApprovedEncodings(tableData.Columns, approved.Fields)
+	}
+	rejects := newRowQuarantine(cfg.OutDir, table.TableName, cfg.Quarantine)
+	defer rejects.close()
+
+	// With -checkpoint-rows the table is written in parts, and continues
+	// after the last part an earlier attempt checkpointed.
+	var ckpt *tableCheckpointer
+	var watermark interface{}
+	if e.opts.CheckpointRows > 0 {
+		fingerprint := checkpointFingerprint(table, e.opts, e.key)
+		if ckpt, err = openCheckpoint(cfg.OutDir, table, fingerprint, e.opts.CheckpointRows, e.spill); err != nil {
+			return failed(fmt.Errorf("opening checkpoint: %w", err))
+		}
+		ckpt.stored = cfg.NPZCompression == npzCompressionNone
+		ckpt.rejects = rejects
+		ckpt.nulls = nulls
+		ckpt.profile = profiler
+		if r, ok := ckpt.result(cfg.outputPath(table.TableName)); ok {
+			log.Printf("Table %q was already exported", table.TableName)
+			return r
+		}
+		if !ckpt.resumed() {
+			if err := ckpt.recoverParts(table, tableData.Columns); err != nil {
+				return failed(fmt.Errorf("recovering checkpoint parts: %w", err))
+			}
+		}
+		if ckpt.resumed() {
+			if table.ResumeKey, err = ckpt.resumeKey(); err != nil {
+				return failed(fmt.Errorf("reading checkpoint: %w", err))
+			}
+			if watermark, err = ckpt.watermark(); err != nil {
+				return failed(fmt.Errorf("reading checkpoint: %w", err))
+			}
+			tableData.Columns = ckpt.cp.Columns
+			restoreTransforms(transforms, tableData.Columns)
+			meter.usage.Rows = ckpt.cp.Rows
+			meter.usage.RejectedRows = ckpt.cp.Rejected
+			meter.usage.NullDroppedRows = ckpt.cp.NullDropped
+			nulls.dropped = ckpt.cp.NullDropped
+			if profiler != nil {
+				// Parts checkpointed without profiles can't be profiled
+				// without reading them back.
+				if err := profiler.restore(ckpt.cp.Profile); err != nil {
+					log.Printf("Not profiling table %q: %v", table.TableName, err)
+					profiler, ckpt.profile = nil, nil
+				}
+			}
+			log.Printf("Resuming table %q after %d rows", table.TableName, ckpt.cp.Rows)
+		}
+	}
+	// The rows rejected before the checkpoint stay in the rejects file.
+	var rejectsSize int64
+	if ckpt != nil {
+		rejectsSize = ckpt.cp.RejectsSize
+	}
+	if err := rejects.open(meter.usage.RejectedRows, rejectsSize); err != nil {
+		return failed(fmt.Errorf("opening rejects file: %w", err))
+	}
+
+	// Batches are transformed and appended to the column buffers as they
+	// arrive. The writer starts once the first dictionarySampleRows rows,
+	// which decide the dictionary encodings, have been read, or right away
+	// when resuming with the encodings decided.
+	var writer tableWriter
+	var groups []plannedGroup
+	var splits *splitWriter
+	split := cfg.split(table.TableName)
+	// Hot/cold partitions are written whole.
+	var rowSplitter *splitter
+	if split != nil && table.SourceTable == "" {
+		if rowSplitter, err = tableSplitter(table, *split); err != nil {
+			return failed(err)
+		}
+	}
+	var sample []TableRow
+	decided := ckpt != nil && ckpt.resumed()
+	startWriter := func() error {
+		tableData.Rows = sample
+		applyArrayEncoding(tableData, e.opts.ArrayEncoding)
+		if cfg.Format == formatNPZ {
+			applyBinaryEncoding(tableData, e.opts.BinaryEncoding)
+		}
+		applyDecimalEncoding(tableData, cfg.DecimalEncoding)
+		applyDictionaryEncoding(tableData, e.opts.DictEncoding, cfg.transforms(table.TableName).Dictionary)
+		// Hot/cold partitions are written whole, and splits in one file
+		// each.
+		if table.SourceTable == "" && split == nil {
+			var err error
+			if groups, err = planColumnGroups(tableData.Columns, cfg.ColumnGroupSize, cfg.columnGroups(table.TableName)); err != nil {
+				return err
+			}
+		}
+		if ckpt != nil {
+			writer = ckpt.newPart(tableData.Columns)
+		} else if rowSplitter != nil {
+			w, err := newSplitWriter(ctx, cfg, table.TableName, tableData.Columns, rowSplitter, e.spill)
+			if err != nil {
+				return fmt.Errorf("creating %s files: %w", cfg.Format, err)
+			}
+			log.Printf("Splitting table %q into %d splits", table.TableName, len(w.writers))
+			splits, writer = w, w
+		} else if groups != nil {
+			w, err := newColumnGroupWriter(ctx, cfg, table.TableName, groups, e.spill)
+			if err != nil {
+				return fmt.Errorf("creating %s files: %w", cfg.Format, err)
+			}
+			log.Printf("Table %q has %d columns, writing them in %d column groups", table.TableName, len(tableData.Columns), len(groups))
+			writer = w
+		} else {
+			w, err := newTableWriter(ctx, cfg, table.TableName, tableData.Columns, e.spill)
+			if err != nil {
+				return fmt.Errorf("creating %s file: %w", cfg.Format, err)
+			}
+			writer = w
+		}
+		writer = e.dictionaries.wrap(writer, tableData.Columns)
+		rows := sample
+		sample = nil
+		return writer.writeRows(ctx, rows)
+	}
+	if scaler := scalerToFit(transforms); scaler != nil {
+		scratch, err := newRowTransforms(&TableData{TableName: table.TableName, Columns: slices.Clone(table.Fields)}, cfg.transforms(table.TableName), cfg.Currency.Base, e.rates, e.dims, e.key, cfg.FreezeVocabulary)
+		if err != nil {
+			return failed(fmt.Errorf("preparing column transforms: %w", err))
+		}
+		if err := fitScaling(ctx, e.src, table, cfg, e.opts.MemoryBudgetMB<<20, scaler, scratch, rowSplitter, tableData.Columns); err != nil {
+			return failed(fmt.Errorf("fitting the scaling: %w", err))
+		}
+	}
+	limits := cfg.limits(table.TableName)
+	limiter := newTableLimiter(limits, table.Sample)
+	err = streamTable(ctx, e.src, table, cfg, e.opts.MemoryBudgetMB<<20, func(rows []TableRow) error {
+		var resumeKey []interface{}
+		if n := len(rows); n > 0 {
+			resumeKey, _ = rows[n-1][resumeKeyColumn].([]interface{})
+			delete(rows[n-1], resumeKeyColumn)
+		}
+		rows, limitErr := limiter.admit(rows, meter)
+		if rowSplitter != nil {
+			rowSplitter.mark(rows)
+		}
+		// Before the transforms, which may hash the column.
+		if table.Watermark != nil {
+			for _, row := range rows {
+				v := row[table.Watermark.Column]
+				if v != nil && (watermark == nil || laterWatermark(watermark, v)) {
+					watermark = v
+				}
+			}
+		}
+		for _, t := range transforms {
+			t.apply(rows)
+		}
+		n := len(rows)
+		rows, err := rejects.filter(rows, tableData.Columns)
+		if err != nil {
+			return err
+		}
+		meter.usage.Rows -= n - len(rows)
+		meter.usage.RejectedRows += n - len(rows)
+		n = len(rows)
+		if rows, err = nulls.filter(rows); err != nil {
+			return err
+		}
+		meter.usage.Rows -= n - len(rows)
+		meter.usage.NullDroppedRows += n - len(rows)
+		tableData.Rows = rows
+		sampleExampleValues(tableData, e.opts.MetadataExamples)
+		if profiler != nil {
+			profiler.add(rows)
+		}
+		if writer != nil {
+			if err := writer.writeRows(ctx, rows); err != nil {
+				return err
+			}
+		} else if sample = append(sample, rows...); decided || len(sample) >= dictionarySampleRows || ckpt != nil && exportPause.Paused() {
+			// A pause decides the encodings early, to checkpoint the rows
+			// read before it.
+			if err := startWriter(); err != nil {
+				return err
+			}
+		}
+		if ckpt != nil && writer != nil && resumeKey != nil && limitErr == nil && ckpt.due(meter.usage.Rows) {
+			n, err := ckpt.checkpoint(ctx, writer, meter.usage.Rows, resumeKey, tableData.Columns, watermark)
+			meter.usage.TempBytes += n
+			if err != nil {
+				return fmt.Errorf("checkpointing: %w", err)
+			}
+			writer = ckpt.newPart(tableData.Columns)
+		}
+		return limitErr
+	})
+	tableData.Rows = nil
+	var limitErr *limitError
+	var partial string
+	if errors.Is(err, errRowLimit) {
+		log.Printf("Table %q reached its limit of %d rows", table.TableName, table.Sample.Limit)
+		err = nil
+		// The rows past the limit may be below the watermark.
+		watermark = nil
+	} else if errors.As(err, &limitErr) {
+		if limits.OnLimit == onLimitFail {
+			if writer != nil {
+				writer.discard()
+			}
+			return failed(err)
+		}
+		log.Printf("Table %q %v, keeping the %d rows read", table.TableName, err, meter.usage.Rows)
+		partial, err = "partial: "+err.Error(), nil
+		// The rows past the ones read may be below the watermark.
+		watermark = nil
+	}
+	if err != nil {
+		if writer != nil {
+			writer.discard()
+		}
+		return failed(fmt.Errorf("fetching table data: %w", err))
+	}
+	for _, t := range transforms {
+		t.finish(tableData.Columns)
+	}
+	nulls.finish(tableData.Columns)
+	if profiler != nil {
+		profiler.finish(tableData.Columns)
+	}
+	if n := meter.usage.RejectedRows; n > 0 {
+		log.Printf("Table %q: %d rows have values that failed to convert and were written to %s", table.TableName, n, rejects.path)
+	}
+	if n := meter.usage.NullDroppedRows; n > 0 {
+		log.Printf("Table %q: dropped %d rows with nulls in %s", table.TableName, n, nulls.dropColumns())
+	}
+
+	var note string
+	if len(tableData.Columns) == 0 || meter.usage.Rows == 0 {
+		note = "no rows"
+		if len(tableData.Columns) == 0 {
+			note = "no columns selected"
+		}
+		if e.opts.EmptyTables == emptyTablesSkip {
+			log.Printf("Skipping table %q: %s", table.TableName, note)
+			return tableResult{columns: table.Fields, note: "skipped: " + note, usage: meter.finish("")}
+		}
+		log.Printf("Table %q has %s, writing empty arrays", table.TableName, note)
+	}
+	if partial != "" {
+		note = partial
+	}
+	if writer == nil {
+		if err := startWriter(); err != nil {
+			if writer != nil {
+				writer.discard()
+			}
+			return failed(err)
+		}
+	}
+
+	var files map[string][]byte
+	if e.opts.EmbedMetadata {
+		if files, err = embeddedMetadataFiles(e.dataset, *tableData, meter.usage.Rows); err != nil {
+			writer.discard()
+			return failed(err)
+		}
+	}
+	n, err := writer.close(ctx, files)
+	meter.usage.TempBytes += n
+	if err != nil {
+		return failed(fmt.Errorf("writing %s file: %w", cfg.Format, err))
+	}
+	path := cfg.outputPath(table.TableName)
+	if ckpt != nil {
+		if err := ckpt.assemble(ctx, path, writer); err != nil {
+			return failed(fmt.Errorf("assembling %s from its parts: %w", path, err))
+		}
+		log.Printf("Table %q saved successfully to %s", table.TableName, path)
+	}
+	r := tableResult{
+		columns:   tableData.Columns,
+		note:      note,
+		written:   true,
+		usage:     meter.finish(path),
+		watermark: watermark,
+		groups:    groups,
+	}
+	for _, group := range groups {
+		if info, err := os.Stat(cfg.outputPath(columnGroupName(table.TableName, group.name))); err == nil {
+			r.usage.ArtifactBytes += info.Size()
+		}
+	}
+	if splits != nil {
+		r.splits = &tableSplits{cfg: *split, parts: splits.splitter.parts, rows: splits.rows}
+		for _, part := range r.splits.parts {
+			if info, err := os.Stat(cfg.outputPath(splitName(table.TableName, part.name))); err == nil {
+				r.usage.ArtifactBytes += info.Size()
+			}
+		}
+	}
+	if cw, ok := writer.(chunkedWriter); ok {
+		r.chunks = cw.chunkStats()
+	}
+	if ckpt != nil {
+		if err := ckpt.done(r); err != nil {
+			log.Printf("failed to checkpoint the completed table %q: %v", table.TableName, err)
+		}
+	}
+	return r
+}
+
+// skippedTables lists the tables that failed every attempt.
+func skippedTables(tables []TableMetadata, results []tableResult) []SkippedTable {
+	var skipped []SkippedTable
+	for i, r := range results {
+		if r.err != nil {
+			skipped = append(skipped, SkippedTable{Table: tables[i].TableName, Attempts: r.attempts, Error: r.err.Error()})
+		}
+	}
+	return skipped
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// fastCopySource is implemented by sources that can read tables with
+// COPY, selected with -fast-copy.
+type fastCopySource interface {
+	// EnableFastCopy makes later reads use COPY.
+	EnableFastCopy() error
+}
+
+// EnableFastCopy makes tables and queries stream with COPY ... TO STDOUT
+// on connections of their own instead of batch queries.
+func (s *postgresSource) EnableFastCopy() error {
+	config, err := pgconn.ParseConfig(s.dsn)
+	if err != nil {
+		return fmt.Errorf("parsing the connection string: %w", err)
+	}
+	// Count the bytes exchanged like the connections of lib/pq.
+	config.DialFunc = countingDialer{}.DialContext
+	// The session writes times in UTC and ISO format and floats exactly,
+	// as the COPY text format is parsed, and reads string literals without
+	// backslash escapes, as inlineParams writes them.
+	maps.Copy(config.RuntimeParams, map[string]string{
+		"DateStyle":                   "ISO, MDY",
+		"TimeZone":                    "UTC",
+		"extra_float_digits":          "3",
+		"standard_conforming_strings": "on",
+	})
+	s.copyConfig = config
+	return nil
+}
+
+var (
+	// errCopyPaused stops a COPY when the export is paused.
+	errCopyPaused = errors.New("copy paused")
+	// errCopyStalled stops a COPY that sent no batch within the batch
+	// timeout.
+	errCopyStalled = errors.New("copy stalled")
+)
+
+// copyTableData streams a table like StreamTableData, but reads it with a
+// single COPY ... TO STDOUT in text format, parsed as it arrives, rather
+// than scanning batch query results row by row. Tables are still ordered
+// on their page key, so a checkpointed export resumes after its last row.
+// A pause closes the COPY and its connection after the batch read, and
+// resuming starts a new COPY after the last row the same way. A COPY that
+// stalls, sending no batch within the batch timeout, is restarted like a
+// stalled batch query, up to batchRetries times in a row.
+func copyTableData(ctx context.Context, db *sql.DB, config *pgconn.Config, snapshot *pgSnapshot, table TableMetadata, cfg ExportConfig, fallback rowIdentity, emit func(rows []TableRow) error) error {
+	// Without columns there is nothing to select, and the query would be invalid.
+	if len(table.Fields) == 0 {
+		return nil
+	}
+	stalls := 0
+	for {
+		start := time.Now()
+		err := copyTableRows(ctx, config, snapshot, table, cfg, fallback, func(rows []TableRow) error {
+			if key, ok := rows[len(rows)-1][resumeKeyColumn].([]interface{}); ok {
+				table.ResumeKey = key
+			}
+			stalls, start = 0, time.Now()
+			return emit(rows)
+		})
+		if errors.Is(err, errCopyStalled) {
+			stalls++
+			diag := stallDiagnostics(db, table.sourceIdent())
+			if stalls > batchRetries {
+				return fmt.Errorf("COPY of table %s stalled %d times (timeout %s), giving up: %s", table.TableName, stalls, cfg.batchTimeout(), diag)
+			}
+			log.Printf("COPY of table %s stalled after %s (attempt %d/%d), retrying: %s",
+				table.TableName, time.Since(start).Round(time.Second), stalls, batchRetries+1, diag)
+			if err := sleepContext(ctx, time.Duration(stalls)*retryBackoff); err != nil {
+				return err
+			}
+			continue
+		}
+		if !errors.Is(err, errCopyPaused) {
+			return err
+		}
+		offset := 0
+		if table.offsetPaged() {
+			offset = int(table.ResumeKey[0].(int64))
+		}
+		if err := exportPause.wait(ctx, table.TableName, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// copyTableRows reads the rows of a table after table.ResumeKey with one
+// COPY, returning errCopyPaused once a batch was emitted while the export
+// is paused, and errCopyStalled when the next batch takes longer than the
+// batch timeout. COPY takes no parameters, so parameter values are inlined
+// as literals.
+func copyTableRows(ctx context.Context, config *pgconn.Config, snapshot *pgSnapshot, table TableMetadata, cfg ExportConfig, fallback rowIdentity, emit func(rows []TableRow) error) error {
+	hb := startHeartbeat(table.TableName)
+	defer hb.Stop()
+
+	query, names := bindNamedParams(selectQuery(table))
+	args, err := cfg.queryArgs(names)
+	if err != nil {
+		return fmt.Errorf("%s: %w", table.TableName, err)
+	}
+	if w := table.Watermark; w != nil && w.After != nil {
+		args = append(args, w.After)
+	}
+
+	// The columns of a table are followed by its page key.
+	columns := slices.Clone(table.Fields)
+	key := tablePageKey(table, fallback)
+	offset := 0
+	var lastKey []interface{}
+	if table.offsetPaged() {
+		if table.Kind == relationView {
+			query = key.query(table, 0, false)
+		}
+		if table.ResumeKey != nil {
+			offset = int(table.ResumeKey[0].(int64))
+			query += fmt.Sprintf(" OFFSET %d", offset)
+		}
+	} else {
+		lastKey = table.ResumeKey
+		query = key.query(table, 0, lastKey != nil)
+		args = append(args, lastKey...)
+		for i, field := range pageKeyFields(table) {
+			field.FieldName = fmt.Sprintf("%s%d", keyAliasPrefix, i)
+			columns = append(columns, field)
+		}
+	}
+	query, err = inlineParams(query, args)
+	if err != nil {
+		return fmt.Errorf("%s: %w", table.TableName, err)
+	}
+
+	// The COPY is canceled, and its connection closed, when a batch takes
+	// longer than the batch timeout to arrive. Emitting a batch doesn't
+	// count.
+	timeout := cfg.batchTimeout()
+	copyCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stall := time.AfterFunc(timeout, func() { cancel(errCopyStalled) })
+	defer stall.Stop()
+
+	conn, err := pgconn.ConnectConfig(copyCtx, config)
+	if err != nil {
+		if errors.Is(context.Cause(copyCtx), errCopyStalled) {
+			return errCopyStalled
+		}
+		return fmt.Errorf("connecting for COPY: %w", err)
+	}
+	defer conn.Close(context.Background())
+	exec := func(query string) error {
+		_, err := conn.Exec(copyCtx, query).ReadAll()
+		return err
+	}
+	for _, v := range cfg.Views {
+		if err := exec(v.createStatement()); err != nil {
+			return fmt.Errorf("creating view %s: %w", v.Name, err)
+		}
+	}
+	err = snapshot.use(func(id string) error {
+		if id == "" {
+			return nil
+		}
+		if err := exec("BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+			return err
+		}
+		if err := exec("SET TRANSACTION SNAPSHOT " + quoteLiteral(id)); err != nil {
+			return fmt.Errorf("importing snapshot %s: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// A batch takes the time since the previous one to arrive.
+	var batch []TableRow
+	started := time.Now()
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		took := time.Since(started)
+		if !table.offsetPaged() {
+			lastKey = key.takeKey(batch)
+		}
+		hb.addBatch(len(batch), took)
+		resumeKey := lastKey
+		if table.offsetPaged() {
+			resumeKey = []interface{}{int64(offset + len(batch))}
+		}
+		batch[len(batch)-1][resumeKeyColumn] = resumeKey
+		offset += len(batch)
+		hb.setOffset(offset)
+		rows := batch
+		batch = nil
+		if !stall.Stop() {
+			return errCopyStalled
+		}
+		err := emit(rows)
+		stall.Reset(timeout)
+		started = time.Now()
+		return err
+	}
+	w := &copyRowWriter{row: func(data []byte) error {
+		fields := splitCopyRow(data)
+		if len(fields) != len(columns) {
+			return fmt.Errorf("COPY row has %d fields, expected %d", len(fields), len(columns))
+		}
+		row := make(TableRow, len(columns))
+		for i, field := range columns {
+			v, err := decodeCopyValue(field, fields[i])
+			if err != nil {
+				return fmt.Errorf("converting column %s: %w", field.FieldName, err)
+			}
+			row[field.FieldName] = v
+		}
+		batch = append(batch, row)
+		if len(batch) < cfg.BatchSize {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if exportPause.Paused() {
+			return errCopyPaused
+		}
+		return nil
+	}}
+	_, err = conn.CopyTo(copyCtx, w, "COPY ("+query+") TO STDOUT")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(context.Cause(copyCtx), errCopyStalled) {
+		return errCopyStalled
+	}
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// copyRowWriter passes each row of the text COPY ... TO STDOUT sends to
+// row. The server sends a row per message, but a row split across writes
+// is put back together. Rows end in a newline, which fields escape.
+type copyRowWriter struct {
+	row func(data []byte) error
+	// partial is the start of a row whose end is still to come.
+	partial []byte
+}
+
+func (w *copyRowWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			break
+		}
+		line := p[:i+1]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = w.partial[:0]
+		}
+		if err := w.row(line); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// pageKeyFields returns the fields of the columns tablePageKey selects as
+// a table's key, with the row identifier of tables without a primary key
+// read as text.
+func pageKeyFields(table TableMetadata) []FieldMetadata {
+	var fields []FieldMetadata
+	for _, field := range table.Fields {
+		if field.IsPrimaryKey {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		fields = []FieldMetadata{{DataType: DataTypeString}}
+	}
+	return fields
+}
+
+// splitCopyRow splits a row of the COPY text format into its fields, with
+// nil for nulls. The fields are copies, so they outlive the message.
+func splitCopyRow(data []byte) [][]byte {
+	line := strings.TrimSuffix(string(data), "\n")
+	parts := strings.Split(line, "\t")
+	fields := make([][]byte, len(parts))
+	for i, part := range parts {
+		if part != `\N` {
+			fields[i] = unescapeCopy(part)
+		}
+	}
+	return fields
+}
+
+// unescapeCopy decodes the backslash escapes COPY TO writes in the text
+// format.
+func unescapeCopy(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			switch c = s[i]; c {
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'v':
+				c = '\v'
+			}
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// copyTimeLayouts are the formats of timestamps and times in the ISO
+// DateStyle, with time zone offsets of hours, minutes or seconds.
+var copyTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+	"2006-01-02 15:04:05.999999999",
+	"15:04:05.999999999-07",
+	"15:04:05.999999999-07:00",
+	"15:04:05.999999999",
+}
+
+// decodeCopyValue converts a field of the COPY text format to the value
+// the batch queries produce for the column, nil for a null field.
+func decodeCopyValue(field FieldMetadata, raw []byte) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	s := string(raw)
+	switch field.DataType {
+	case DataTypeInt:
+		return strconv.ParseInt(s, 10, 64)
+	case DataTypeFloat:
+		// Decimals keep their text, as the batch queries read them, for
+		// the decimal encodings to store exactly.
+		if field.Precision > 0 {
+			return raw, nil
+		}
+		// Numerics beyond the range of a float64 become infinities.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, err
+		}
+		return f, nil
+	case DataTypeBool:
+		return s == "t", nil
+	case DataTypeDate:
+		return time.Parse(time.DateOnly, s)
+	case DataTypeTime, DataTypeTimeOfDay:
+		for _, layout := range copyTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("unsupported time %q", s)
+	case DataTypeArray:
+		return parseArray(raw, field.ElementType)
+	case DataTypeBytes:
+		// bytea_output is hex by default.
+		if hexDigits, ok := strings.CutPrefix(s, `\x`); ok {
+			return hex.DecodeString(hexDigits)
+		}
+		return raw, nil
+	}
+	return s, nil
+}
+
+// inlineParams replaces the $n placeholders of a query with the values of
+// args as SQL literals, for statements such as COPY that take no
+// parameters. Strings, quoted identifiers and comments are left alone.
+func inlineParams(query string, args []interface{}) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		if end, ok := skipSQLLiteral(query, i); ok {
+			b.WriteString(query[i:end])
+			i = end
+			continue
+		}
+		c := query[i]
+		if c == '$' && (i == 0 || !isIdentByte(query[i-1])) {
+			j := i + 1
+			for j < len(query) && '0' <= query[j] && query[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				n, _ := strconv.Atoi(query[i+1 : j])
+				if n < 1 || n > len(args) {
+					return "", fmt.Errorf("no value for parameter $%d", n)
+				}
+				literal, err := sqlLiteral(args[n-1])
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(literal)
+				i = j
+				continue
+			}
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), nil
+}
+
+// sqlLiteral returns a value as an SQL literal. Strings and times are
+// untyped literals, which take the type of what they are compared with,
+// as bound parameters do.
+func sqlLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return quoteLiteral(strconv.FormatFloat(v, 'g', -1, 64)) + "::float8", nil
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case time.Time:
+		return quoteLiteral(v.Format("2006-01-02 15:04:05.999999999Z07:00")), nil
+	case []byte:
+		return quoteLiteral(string(v)), nil
+	case string:
+		return quoteLiteral(v), nil
+	}
+	return "", fmt.Errorf("unsupported parameter type %T", v)
+}
+
+// quoteLiteral quotes a string literal. Literals with backslashes are
+// written as escape strings, so they read the same whether
+// standard_conforming_strings is on or off.
+func quoteLiteral(s string) string {
+	return pq.QuoteLiteral(s)
+}
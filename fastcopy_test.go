@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestDecodeCopyValue(t *testing.T) {
+	tests := []struct {
+		field FieldMetadata
+		raw   string
+		want  interface{}
+	}{
+		{FieldMetadata{DataType: DataTypeInt}, "-42", int64(-42)},
+		{FieldMetadata{DataType: DataTypeFloat}, "0.1", 0.1},
+		{FieldMetadata{DataType: DataTypeFloat}, "1e400", math.Inf(1)},
+		// A decimal too precise for a float64 keeps every digit.
+		{FieldMetadata{DataType: DataTypeFloat, Precision: 30, Scale: 10}, "12345678901234567890.0123456789", []byte("12345678901234567890.0123456789")},
+		{FieldMetadata{DataType: DataTypeBool}, "t", true},
+		{FieldMetadata{DataType: DataTypeDate}, "2024-02-29", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{FieldMetadata{DataType: DataTypeTime}, "2024-02-29 10:30:00.5+02", time.Date(2024, 2, 29, 8, 30, 0, 5e8, time.UTC)},
+		{FieldMetadata{DataType: DataTypeBytes}, `\x00ff`, []byte{0, 0xff}},
+		{FieldMetadata{DataType: DataTypeString}, "text", "text"},
+	}
+	for _, tt := range tests {
+		got, err := decodeCopyValue(tt.field, []byte(tt.raw))
+		if err != nil {
+			t.Errorf("decodeCopyValue(%s, %q): %v", tt.field.DataType, tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeCopyValue(%s, %q) = %#v, want %#v", tt.field.DataType, tt.raw, got, tt.want)
+		}
+	}
+	if v, err := decodeCopyValue(FieldMetadata{DataType: DataTypeInt}, nil); v != nil || err != nil {
+		t.Errorf("decoding a null = %v, %v, want nil", v, err)
+	}
+}
+
+func TestInlineParams(t *testing.T) {
+	args := []interface{}{int64(7), "o'k"}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM t WHERE a = $1 AND b = $2", "SELECT * FROM t WHERE a = 7 AND b = 'o''k'"},
+		{"SELECT '$1', \"$1\" FROM t WHERE a > $1", "SELECT '$1', \"$1\" FROM t WHERE a > 7"},
+		{"SELECT 'it''s $1' WHERE a = $1", "SELECT 'it''s $1' WHERE a = 7"},
+		// A backslash escapes the quote of an escape string.
+		{`SELECT E'\' $1' WHERE a = $1`, `SELECT E'\' $1' WHERE a = 7`},
+		// In a standard string it doesn't.
+		{`SELECT '\' WHERE a = $1`, `SELECT '\' WHERE a = 7`},
+		{"SELECT $$ $1 $$, $tag$ $1 $$ $tag$ WHERE a = $1", "SELECT $$ $1 $$, $tag$ $1 $$ $tag$ WHERE a = 7"},
+		{"SELECT a -- not $1\nFROM t WHERE a = $1", "SELECT a -- not $1\nFROM t WHERE a = 7"},
+		{"SELECT a /* not /* $1 */ $2 */ FROM t WHERE a = $1", "SELECT a /* not /* $1 */ $2 */ FROM t WHERE a = 7"},
+		// Identifiers may contain dollar signs.
+		{"SELECT a$1 FROM t WHERE a = $1", "SELECT a$1 FROM t WHERE a = 7"},
+	}
+	for _, tt := range tests {
+		got, err := inlineParams(tt.query, args)
+		if err != nil || got != tt.want {
+			t.Errorf("inlineParams(%q) = %q, %v, want %q", tt.query, got, err, tt.want)
+		}
+	}
+	if _, err := inlineParams("SELECT $3", args); err == nil {
+		t.Error("inlineParams with a missing parameter succeeded")
+	}
+}
+
+func TestCopyRowWriter(t *testing.T) {
+	var rows []string
+	w := &copyRowWriter{row: func(data []byte) error {
+		rows = append(rows, string(data))
+		return nil
+	}}
+	for _, s := range []string{"1\tone\n", "2\tt", "wo\n3\tth", "ree\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"1\tone\n", "2\ttwo\n", "3\tthree\n"}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+// copyServer is a PostgreSQL server that answers COPY ... TO STDOUT with
+// its rows, once per connection, and other statements with nothing.
+type copyServer struct {
+	addr string
+	mu   sync.Mutex
+	// queries are the statements received.
+	queries []string
+	// stalls is how many connections get no answer to their COPY.
+	stalls int
+	rows   []string
+}
+
+func startCopyServer(t *testing.T, rows []string, stalls int) *copyServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &copyServer{addr: ln.Addr().String(), rows: rows, stalls: stalls}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *copyServer) serve(conn net.Conn) {
+	defer conn.Close()
+	b := pgproto3.NewBackend(conn, conn)
+	if _, err := b.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	b.Send(&pgproto3.AuthenticationOk{})
+	b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if b.Flush() != nil {
+		return
+	}
+	for {
+		msg, err := b.Receive()
+		if err != nil {
+			return
+		}
+		q, ok := msg.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		s.queries = append(s.queries, q.String)
+		stall := s.stalls > 0 && strings.HasPrefix(q.String, "COPY")
+		if stall {
+			s.stalls--
+		}
+		s.mu.Unlock()
+		if stall {
+			// Wait for the client to give up.
+			io.Copy(io.Discard, conn)
+			return
+		}
+		if strings.HasPrefix(q.String, "COPY") {
+			b.Send(&pgproto3.CopyOutResponse{ColumnFormatCodes: []uint16{0, 0}})
+			for _, row := range s.rows {
+				b.Send(&pgproto3.CopyData{Data: []byte(row)})
+			}
+			b.Send(&pgproto3.CopyDone{})
+		}
+		b.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 0")})
+		b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		if b.Flush() != nil {
+			return
+		}
+	}
+}
+
+// copyTestSource returns a source reading from s with -fast-copy.
+func copyTestSource(t *testing.T, s *copyServer) *postgresSource {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(s.addr)
+	src := &postgresSource{dsn: fmt.Sprintf("host=%s port=%s user=test dbname=test sslmode=disable", host, port)}
+	if err := src.EnableFastCopy(); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestCopyTableData(t *testing.T) {
+	s := startCopyServer(t, []string{"1\tone\n", "2\t\\N\n", "3\ttab\\there\n"}, 0)
+	src := copyTestSource(t, s)
+	table := TableMetadata{
+		TableName: "q",
+		Query:     "SELECT id, name FROM t WHERE name <> ':min_id' AND id > :min_id",
+		Fields:    []FieldMetadata{{FieldName: "id", DataType: DataTypeInt}, {FieldName: "name", DataType: DataTypeString}},
+	}
+	cfg := ExportConfig{BatchSize: 2, Params: map[string]string{"min_id": "0"}}
+	var rows []TableRow
+	var batches int
+	err := copyTableData(context.Background(), nil, src.copyConfig, nil, table, cfg, postgresRowIdentity, func(batch []TableRow) error {
+		batches++
+		rows = append(rows, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, fmt.Sprintf("%v %v", row["id"], row["name"]))
+	}
+	if want := []string{"1 one", "2 <nil>", "3 tab\there"}; !reflect.DeepEqual(got, want) || batches != 2 {
+		t.Errorf("read %q in %d batches, want %q in 2", got, batches, want)
+	}
+	if q := s.queries[len(s.queries)-1]; !strings.Contains(q, "name <> ':min_id' AND id > '0'") {
+		t.Errorf("COPY statement %q doesn't have its parameter inlined", q)
+	}
+}
+
+// A COPY that sends nothing within the batch timeout is restarted, and
+// fails the table once it stalled more than batchRetries times in a row.
+func TestCopyTableDataStalls(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = backoff })
+	db := sql.OpenDB(dsnConnector{dsn: ":memory:", drv: &sqlite3.SQLiteDriver{}})
+	defer db.Close()
+
+	table := TableMetadata{
+		TableName: "q",
+		Query:     "SELECT id FROM t",
+		Fields:    []FieldMetadata{{FieldName: "id", DataType: DataTypeInt}},
+	}
+	cfg := ExportConfig{BatchSize: 10, BatchTimeout: "100ms"}
+	tests := []struct {
+		stalls int
+		ok     bool
+	}{
+		{batchRetries, true},
+		{batchRetries + 1, false},
+	}
+	for _, tt := range tests {
+		s := startCopyServer(t, []string{"1\n", "2\n"}, tt.stalls)
+		src := copyTestSource(t, s)
+		var rows int
+		err := copyTableData(context.Background(), db, src.copyConfig, nil, table, cfg, postgresRowIdentity, func(batch []TableRow) error {
+			rows += len(batch)
+			return nil
+		})
+		if (err == nil) != tt.ok || tt.ok && rows != 2 {
+			t.Errorf("with %d stalls: read %d rows, %v", tt.stalls, rows, err)
+		}
+	}
+}
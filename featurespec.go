@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FeatureSpec lists the columns a model actually uses, as table.column
+// entries. With -feature-spec every other column is pruned from the
+// export before any data is read.
+type FeatureSpec struct {
+	Features []string `yaml:"features" toml:"features"`
+}
+
+// loadFeatureSpec reads a feature spec from a .toml file or, for any other
+// extension, a YAML file, and returns the used columns of each table.
+func loadFeatureSpec(path string) (map[string][]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading feature spec: %w", err)
+	}
+
+	var spec FeatureSpec
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.Decode(string(b), &spec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing feature spec %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("parsing feature spec %s: unknown key %q", path, undecoded[0].String())
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("parsing feature spec %s: %w", path, err)
+		}
+	}
+
+	used := make(map[string][]string)
+	for _, entry := range spec.Features {
+		table, column, ok := splitTableColumn(strings.TrimSpace(entry))
+		if !ok || table == "" || column == "" {
+			return nil, fmt.Errorf("invalid feature %q in %s, expected table.column", entry, path)
+		}
+		used[table] = append(used[table], column)
+	}
+	return used, nil
+}
+
+// pruneToFeatures keeps only the columns of the tables that the feature
+// spec uses, and drops the tables it uses none of. The amount and currency
+// columns of a used money column, the column of a used one-hot value or
+// datetime feature, and the JSON column of a used flattened key, are kept
+// since they are computed from them.
+// Transforms of pruned columns are removed from cfg. Used columns that
+// don't exist and used tables that aren't exported are logged.
+func pruneToFeatures(cfg *ExportConfig, tables []TableMetadata, used map[string][]string) []TableMetadata {
+	var kept []TableMetadata
+	exported := make(map[string]bool)
+	for _, table := range tables {
+		exported[table.TableName] = true
+		columns := used[table.TableName]
+		transforms := cfg.transforms(table.TableName)
+
+		keep := make(map[string]bool)
+		outputs := make(map[string]bool)
+		for _, name := range columns {
+			keep[name] = true
+		}
+		var money []MoneyConfig
+		for _, m := range transforms.Money {
+			output := m.outputColumn(cfg.Currency.Base)
+			if !keep[output] {
+				continue
+			}
+			money = append(money, m)
+			outputs[output] = true
+			keep[m.Amount] = true
+			if m.Currency != "" {
+				keep[m.Currency] = true
+			}
+		}
+		var oneHot map[string][]string
+		for column, values := range transforms.OneHot {
+			if len(values) == 0 {
+				for _, field := range table.Fields {
+					if field.FieldName == column {
+						values = field.EnumValues
+					}
+				}
+			}
+			for _, value := range values {
+				output := column + "__" + value
+				if !keep[output] {
+					continue
+				}
+				if oneHot == nil {
+					oneHot = make(map[string][]string)
+				}
+				oneHot[column] = append(oneHot[column], value)
+				outputs[output] = true
+				keep[column] = true
+			}
+		}
+		var expand map[string][]string
+		for column, features := range transforms.ExpandDatetime {
+			if len(features) == 0 {
+				features = datetimeFeatures
+			}
+			for _, feature := range features {
+				output := column + "__" + feature
+				if !keep[output] {
+					continue
+				}
+				if expand == nil {
+					expand = make(map[string][]string)
+				}
+				expand[column] = append(expand[column], feature)
+				outputs[output] = true
+				keep[column] = true
+			}
+		}
+		var flatten map[string][]string
+		for column, keys := range transforms.FlattenJSON {
+			for _, key := range keys {
+				output := column + "." + key
+				if !keep[output] {
+					continue
+				}
+				if flatten == nil {
+					flatten = make(map[string][]string)
+				}
+				flatten[column] = append(flatten[column], key)
+				outputs[output] = true
+				keep[column] = true
+			}
+		}
+
+		var fields []FieldMetadata
+		for _, field := range table.Fields {
+			if keep[field.FieldName] {
+				fields = append(fields, field)
+			}
+		}
+		for _, name := range columns {
+			found := outputs[name] || slices.ContainsFunc(fields, func(f FieldMetadata) bool { return f.FieldName == name })
+			if !found {
+				log.Printf("feature spec: table %s has no column %q", table.TableName, name)
+			}
+		}
+		if len(fields) == 0 {
+			log.Printf("Pruning table %q: the feature spec uses none of its columns", table.TableName)
+			continue
+		}
+		if len(fields) < len(table.Fields) {
+			log.Printf("Pruning %d of %d columns of table %q", len(table.Fields)-len(fields), len(table.Fields), table.TableName)
+		}
+
+		pruned := ColumnTransforms{Money: money, FlattenJSON: flatten, OneHot: oneHot, ExpandDatetime: expand}
+		for name, p := range transforms.Parse {
+			if keep[name] {
+				if pruned.Parse == nil {
+					pruned.Parse = make(map[string]ParseConfig)
+				}
+				pruned.Parse[name] = p
+			}
+		}
+		for _, name := range transforms.HashColumns {
+			if keep[name] {
+				pruned.HashColumns = append(pruned.HashColumns, name)
+			}
+		}
+		for _, name := range transforms.LabelEncode {
+			if keep[name] {
+				pruned.LabelEncode = append(pruned.LabelEncode, name)
+			}
+		}
+		for name, method := range transforms.Scale {
+			if keep[name] {
+				if pruned.Scale == nil {
+					pruned.Scale = make(map[string]string)
+				}
+				pruned.Scale[name] = method
+			}
+		}
+		for name, dict := range transforms.SharedDictionary {
+			if keep[name] {
+				if pruned.SharedDictionary == nil {
+					pruned.SharedDictionary = make(map[string]string)
+				}
+				pruned.SharedDictionary[name] = dict
+			}
+		}
+		cfg.setTransforms(table.TableName, pruned)
+
+		table.Fields = fields
+		kept = append(kept, table)
+	}
+
+	for table := range used {
+		if !exported[table] {
+			log.Printf("feature spec: table %s is not exported", table)
+		}
+	}
+
+	var names []string
+	for _, table := range kept {
+		names = append(names, table.TableName)
+	}
+	dropUnselectedForeignKeys(kept, names)
+	return kept
+}
+
+// setTransforms replaces the column transforms of the named table or
+// query.
+func (c *ExportConfig) setTransforms(name string, t ColumnTransforms) {
+	for i := range c.Tables {
+		if c.Tables[i].Name == name {
+			c.Tables[i].ColumnTransforms = t
+		}
+	}
+	for i := range c.Queries {
+		if c.Queries[i].Name == name {
+			c.Queries[i].ColumnTransforms = t
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Flatbuffers objects, as used for the Arrow IPC message and footer
+// metadata. A table maps field slots to values; absent slots take the
+// schema defaults.
+type (
+	fbTable  map[int]fbValue
+	fbValue  interface{}
+	fbString string
+	// fbTables is a vector of tables.
+	fbTables []fbTable
+	// fbStructs is a vector of fixed-size structs or scalars, data holding
+	// the little-endian encoding of the elements.
+	fbStructs struct {
+		align int
+		n     int
+		data  []byte
+	}
+	// fbScalar is an inline scalar field of size bytes.
+	fbScalar struct {
+		size int
+		bits uint64
+	}
+)
+
+func fbInt64(v int64) fbScalar { return fbScalar{8, uint64(v)} }
+func fbInt32(v int32) fbScalar { return fbScalar{4, uint64(uint32(v))} }
+func fbInt16(v int16) fbScalar { return fbScalar{2, uint64(uint16(v))} }
+func fbUint8(v uint8) fbScalar { return fbScalar{1, uint64(v)} }
+
+func fbBool(v bool) fbScalar {
+	if v {
+		return fbUint8(1)
+	}
+	return fbUint8(0)
+}
+
+// fbBuilder lays out flatbuffers objects front to back: every table is
+// preceded by its vtable and followed by the objects it references, so
+// all offsets point forward.
+type fbBuilder struct {
+	buf []byte
+}
+
+// fbFinish encodes root as a flatbuffer.
+func fbFinish(root fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	pos := b.table(root)
+	binary.LittleEndian.PutUint32(b.buf, uint32(pos))
+	return b.buf
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// table writes t and returns its position.
+func (b *fbBuilder) table(t fbTable) int {
+	slots := make([]int, 0, len(t))
+	for slot := range t {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	numSlots := 0
+	if len(slots) > 0 {
+		numSlots = slots[len(slots)-1] + 1
+	}
+
+	// Lay out the fields after the vtable offset, each aligned to its size.
+	offsets := make([]int, numSlots)
+	size := 4
+	for _, slot := range slots {
+		n := 4
+		if s, ok := t[slot].(fbScalar); ok {
+			n = s.size
+		}
+		size = (size + n - 1) / n * n
+		offsets[slot] = size
+		size += n
+	}
+
+	b.pad(2)
+	vtable := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*numSlots))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(size))
+	for _, off := range offsets {
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(off))
+	}
+	b.pad(8)
+	start := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[start:], uint32(start-vtable))
+
+	for _, slot := range slots {
+		at := start + offsets[slot]
+		if s, ok := t[slot].(fbScalar); ok {
+			for i := 0; i < s.size; i++ {
+				b.buf[at+i] = byte(s.bits >> (8 * i))
+			}
+			continue
+		}
+		pos := b.object(t[slot])
+		binary.LittleEndian.PutUint32(b.buf[at:], uint32(pos-at))
+	}
+	return start
+}
+
+// object writes a referenced object and returns its position.
+func (b *fbBuilder) object(v fbValue) int {
+	switch v := v.(type) {
+	case fbTable:
+		return b.table(v)
+	case fbString:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(append(b.buf, v...), 0)
+		return pos
+	case fbTables:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			at := pos + 4 + 4*i
+			elem := b.table(t)
+			binary.LittleEndian.PutUint32(b.buf[at:], uint32(elem-at))
+		}
+		return pos
+	case fbStructs:
+		// The elements, not the length prefix, must be aligned.
+		for len(b.buf)%4 != 0 || (len(b.buf)+4)%v.align != 0 {
+			b.buf = append(b.buf, 0)
+		}
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v.n))
+		b.buf = append(b.buf, v.data...)
+		return pos
+	}
+	panic("unsupported flatbuffers value")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+// foreignKey is a foreign key of a table, with the tables named as they
+// are in the export.
+type foreignKey struct {
+	Table      string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+}
+
+// foreignKeyLister is implemented by sources that can list the foreign
+// keys between their tables, for -follow-fks and denormalize.
+type foreignKeyLister interface {
+	ForeignKeys(ctx context.Context) ([]foreignKey, error)
+}
+
+// referencedTables returns the tables each table references.
+func referencedTables(fks []foreignKey) map[string][]string {
+	references := make(map[string][]string)
+	for _, fk := range fks {
+		if !slices.Contains(references[fk.Table], fk.RefTable) {
+			references[fk.Table] = append(references[fk.Table], fk.RefTable)
+		}
+	}
+	return references
+}
+
+// followForeignKeys adds the tables the selected tables reference to the
+// tables of cfg, then those the added tables reference, and so on for up
+// to depth levels of references, all of them with a depth of 0. The added
+// tables export all their columns. It returns their names in the order
+// they were added.
+func followForeignKeys(cfg *ExportConfig, references map[string][]string, depth int) []string {
+	var added []string
+	level := cfg.tableNames()
+	for n := 1; len(level) > 0 && (depth == 0 || n <= depth); n++ {
+		var next []string
+		for _, name := range level {
+			refs := slices.Clone(references[name])
+			slices.Sort(refs)
+			for _, ref := range refs {
+				if _, ok := cfg.table(ref); ok || slices.Contains(next, ref) {
+					continue
+				}
+				next = append(next, ref)
+			}
+		}
+		for _, name := range next {
+			cfg.Tables = append(cfg.Tables, TableConfig{Name: name})
+		}
+		added = append(added, next...)
+		level = next
+	}
+	return added
+}
+
+// ForeignKeys returns the foreign keys of the tables of every schema, with
+// their columns in constraint order.
+func (s *postgresSource) ForeignKeys(ctx context.Context) ([]foreignKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT sn.nspname, st.relname, rn.nspname, rt.relname,
+		       ARRAY(SELECT a.attname
+		             FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, n)
+		             JOIN pg_catalog.pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		             ORDER BY k.n),
+		       ARRAY(SELECT a.attname
+		             FROM unnest(c.confkey) WITH ORDINALITY AS k(attnum, n)
+		             JOIN pg_catalog.pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum
+		             ORDER BY k.n)
+		FROM pg_catalog.pg_constraint c
+		JOIN pg_catalog.pg_class st ON st.oid = c.conrelid
+		JOIN pg_catalog.pg_namespace sn ON sn.oid = st.relnamespace
+		JOIN pg_catalog.pg_class rt ON rt.oid = c.confrelid
+		JOIN pg_catalog.pg_namespace rn ON rn.oid = rt.relnamespace
+		WHERE c.contype = 'f'
+		ORDER BY sn.nspname, st.relname, c.conname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("querying foreign keys: %w", err)
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var schema, table, refSchema, refTable string
+		var fk foreignKey
+		if err := rows.Scan(&schema, &table, &refSchema, &refTable, (*pq.StringArray)(&fk.Columns), (*pq.StringArray)(&fk.RefColumns)); err != nil {
+			return nil, fmt.Errorf("scanning foreign key: %w", err)
+		}
+		fk.Table, fk.RefTable = qualifiedName(schema, table), qualifiedName(refSchema, refTable)
+		fks = append(fks, fk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("processing foreign keys: %w", err)
+	}
+	return fks, nil
+}
+
+// ForeignKeys returns the foreign keys of the tables. A reference without
+// columns is to the primary key of the referenced table.
+func (s *sqliteSource) ForeignKeys(ctx context.Context) ([]foreignKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.name, f.id, f."table", f."from",
+		       COALESCE(f."to", (SELECT p.name FROM pragma_table_info(f."table") p WHERE p.pk = f.seq + 1))
+		FROM sqlite_master m, pragma_foreign_key_list(m.name) f
+		WHERE m.type = 'table'
+		  AND m.name NOT LIKE 'sqlite_%'
+		ORDER BY m.name, f.id, f.seq
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("querying foreign keys: %w", err)
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	lastID := -1
+	for rows.Next() {
+		var table, refTable, column string
+		var id int
+		var refColumn sql.NullString
+		if err := rows.Scan(&table, &id, &refTable, &column, &refColumn); err != nil {
+			return nil, fmt.Errorf("scanning foreign key: %w", err)
+		}
+		// The columns of a key are rows of their own.
+		if len(fks) == 0 || fks[len(fks)-1].Table != table || id != lastID {
+			fks = append(fks, foreignKey{Table: table, RefTable: refTable})
+		}
+		lastID = id
+		fk := &fks[len(fks)-1]
+		fk.Columns = append(fk.Columns, column)
+		fk.RefColumns = append(fk.RefColumns, refColumn.String)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("processing foreign keys: %w", err)
+	}
+	return fks, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dchest/siphash"
+)
+
+const (
+	// EncodingHash marks columns replaced by keyed 64-bit SipHash-2-4
+	// values, stored as int64.
+	EncodingHash = "siphash64"
+
+	// envHashKey holds the 128-bit hashing key as 32 hex digits. Like the
+	// DataHub credentials it is read from the environment so it never ends
+	// up in metadata or provenance.
+	envHashKey = "NPZ_HASH_KEY"
+)
+
+// hashKey is a SipHash key. Values hashed with the same key can be joined
+// across tables.
+type hashKey struct {
+	k0, k1 uint64
+}
+
+// loadHashKey reads the hashing key from the environment. Without one a
+// random key is generated, so hashes only join within this run.
+func loadHashKey() (hashKey, error) {
+	b := make([]byte, 16)
+	if s := os.Getenv(envHashKey); s != "" {
+		n, err := hex.Decode(b, []byte(s))
+		if err != nil || n != 16 || len(s) != 32 {
+			return hashKey{}, fmt.Errorf("%s must be 32 hex digits", envHashKey)
+		}
+	} else if _, err := rand.Read(b); err != nil {
+		return hashKey{}, fmt.Errorf("generating hash key: %w", err)
+	}
+	return hashKey{
+		k0: binary.LittleEndian.Uint64(b[:8]),
+		k1: binary.LittleEndian.Uint64(b[8:]),
+	}, nil
+}
+
+// sum returns the hash of v's text form, so integer and string IDs with
+// the same value hash alike. Nulls hash to 0.
+func (k hashKey) sum(v interface{}) int64 {
+	if v == nil {
+		return 0
+	}
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		b = fmt.Appendf(nil, "%v", v)
+	}
+	return int64(siphash.Hash(k.k0, k.k1, b))
+}
+
+// addHashColumns adds table.column entries, as given with -hash-columns,
+// to the hashed columns of the selected tables and queries.
+func (c *ExportConfig) addHashColumns(entries []string) error {
+	for _, entry := range entries {
+		table, column, ok := splitTableColumn(strings.TrimSpace(entry))
+		if !ok || table == "" || column == "" {
+			return fmt.Errorf("invalid hash column %q, expected table.column", entry)
+		}
+		found := false
+		for i := range c.Tables {
+			if c.Tables[i].Name == table {
+				c.Tables[i].HashColumns = append(c.Tables[i].HashColumns, column)
+				found = true
+			}
+		}
+		for i := range c.Queries {
+			if c.Queries[i].Name == table {
+				c.Queries[i].HashColumns = append(c.Queries[i].HashColumns, column)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("hash column %q refers to a table that is not selected", entry)
+		}
+	}
+	return nil
+}
+
+// columnHasher replaces the values of ID columns with their hashes.
+type columnHasher struct {
+	columns []string
+	key     hashKey
+}
+
+// newColumnHasher records the hash encoding in the metadata of the named
+// columns.
+func newColumnHasher(table *TableData, columns []string, key hashKey) (*columnHasher, error) {
+	for _, name := range columns {
+		idx := -1
+		for i, col := range table.Columns {
+			if col.FieldName == name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("table %s has no column %q to hash", table.TableName, name)
+		}
+
+		col := &table.Columns[idx]
+		col.Encoding = EncodingHash
+		col.FillValue = nil
+		col.EnumValues = nil
+		col.TransformedFeatures = append(col.TransformedFeatures, EncodingHash)
+	}
+	return &columnHasher{columns: columns, key: key}, nil
+}
+
+// apply hashes the columns of a batch in place. Nulls stay null so they
+// remain distinguishable from IDs.
+func (h *columnHasher) apply(rows []TableRow) {
+	for _, name := range h.columns {
+		for _, row := range rows {
+			if row[name] != nil {
+				row[name] = h.key.sum(row[name])
+			}
+		}
+	}
+}
+
+func (h *columnHasher) finish([]FieldMetadata) {}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// exitUnhealthy is the exit code of a run whose export failed its health
+// gate, told apart from the 1 of a failed run.
+const exitUnhealthy = 3
+
+// Health verdicts.
+const (
+	healthPass = "pass"
+	healthFail = "fail"
+)
+
+// Default limits of the health gate.
+const (
+	defaultMaxRowChange = 0.5
+	defaultMaxPSI       = 0.2
+	defaultMaxKS        = 0.1
+)
+
+// HealthConfig gates an export on its quality: a run whose export breaks
+// any of the limits is unhealthy, and exits with exitUnhealthy once its
+// files are written, so a training pipeline doesn't pick it up. Count
+// limits default to 0.
+type HealthConfig struct {
+	// Baseline is the directory of an earlier, good export that the row
+	// counts and column distributions are compared to.
+	Baseline string `yaml:"baseline" toml:"baseline"`
+	// MaxRowChange is the largest relative change of a table's rows from
+	// the baseline, 0.5 by default.
+	MaxRowChange float64 `yaml:"max_row_change" toml:"max_row_change"`
+	// MaxPSI and MaxKS are the drift thresholds of columns, as with the
+	// drift command, 0.2 and 0.1 by default.
+	MaxPSI float64 `yaml:"max_psi" toml:"max_psi"`
+	MaxKS  float64 `yaml:"max_ks" toml:"max_ks"`
+	// MaxDriftedColumns is the number of columns allowed past a drift
+	// threshold.
+	MaxDriftedColumns int `yaml:"max_drifted_columns" toml:"max_drifted_columns"`
+	// MaxRejectedShare is the share of the rows read that -quarantine may
+	// reject, such as 0.001.
+	MaxRejectedShare float64 `yaml:"max_rejected_share" toml:"max_rejected_share"`
+	// MaxFailedChecks is the number of checks allowed to fail or not run.
+	MaxFailedChecks int `yaml:"max_failed_checks" toml:"max_failed_checks"`
+	// MaxSkippedTables is the number of tables allowed to fail to export.
+	MaxSkippedTables int `yaml:"max_skipped_tables" toml:"max_skipped_tables"`
+}
+
+// validate checks the limits of the gate.
+func (h HealthConfig) validate(outDir string) error {
+	if h.MaxRowChange < 0 || h.MaxPSI < 0 || h.MaxKS < 0 || h.MaxRejectedShare < 0 ||
+		h.MaxDriftedColumns < 0 || h.MaxFailedChecks < 0 || h.MaxSkippedTables < 0 {
+		return fmt.Errorf("health limits can't be negative")
+	}
+	if h.Baseline != "" && filepath.Clean(h.Baseline) == filepath.Clean(outDir) {
+		return fmt.Errorf("health baseline %s is the output directory, which the export overwrites", h.Baseline)
+	}
+	return nil
+}
+
+// HealthReport is the verdict of the health gate in the run report.
+type HealthReport struct {
+	// Status is pass or fail.
+	Status string `json:"status"`
+	// Score is the percentage of the criteria that passed.
+	Score    int               `json:"score"`
+	Reasons  []string          `json:"reasons,omitempty"`
+	Criteria []HealthCriterion `json:"criteria"`
+}
+
+// HealthCriterion is a measure of the export checked against its limit.
+type HealthCriterion struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Limit float64 `json:"limit"`
+	Pass  bool    `json:"pass"`
+}
+
+// evaluateHealth judges the export described by a run report, comparing it
+// with the baseline export when there is one. Distributions are compared
+// for the npz format only.
+func evaluateHealth(cfg ExportConfig, report RunReport) (*HealthReport, error) {
+	h := *cfg.Health
+	health := &HealthReport{Criteria: []HealthCriterion{}}
+	check := func(name string, value, limit float64, reason string) {
+		pass := value <= limit
+		health.Criteria = append(health.Criteria, HealthCriterion{Name: name, Value: value, Limit: limit, Pass: pass})
+		if !pass {
+			health.Reasons = append(health.Reasons, reason)
+		}
+	}
+
+	check("skipped_tables", float64(len(report.Skipped)), float64(h.MaxSkippedTables),
+		fmt.Sprintf("%d tables failed to export", len(report.Skipped)))
+	failed := 0
+	for _, c := range report.Checks {
+		if c.Error != "" || c.Violations > 0 {
+			failed++
+		}
+	}
+	check("failed_checks", float64(failed), float64(h.MaxFailedChecks),
+		fmt.Sprintf("%d of %d checks failed or could not run", failed, len(report.Checks)))
+	var rejected float64
+	if read := report.Totals.Rows + report.Totals.RejectedRows; read > 0 {
+		rejected = float64(report.Totals.RejectedRows) / float64(read)
+	}
+	check("rejected_share", rejected, h.MaxRejectedShare,
+		fmt.Sprintf("%d rows were rejected, %.2f%% of those read", report.Totals.RejectedRows, rejected*100))
+
+	if h.Baseline == "" {
+		health.finish()
+		return health, nil
+	}
+	maxRowChange := cmp.Or(h.MaxRowChange, defaultMaxRowChange)
+	baseline, err := baselineRows(h.Baseline)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range report.Tables {
+		before, ok := baseline[u.Table]
+		if !ok {
+			continue
+		}
+		// Rows in a table empty in the baseline count as a change of 100%.
+		change := 0.0
+		switch {
+		case before > 0:
+			change = math.Abs(float64(u.Rows-before)) / float64(before)
+		case u.Rows > 0:
+			change = 1
+		}
+		check("row_change:"+u.Table, change, maxRowChange,
+			fmt.Sprintf("table %s has %d rows, %d in the baseline", u.Table, u.Rows, before))
+	}
+
+	if cfg.Format != formatNPZ {
+		log.Printf("Not comparing column distributions with the health baseline: they are compared in the %s format only", formatNPZ)
+		health.finish()
+		return health, nil
+	}
+	drift, err := compareExports(h.Baseline, cfg.OutDir, cmp.Or(h.MaxPSI, defaultMaxPSI), cmp.Or(h.MaxKS, defaultMaxKS))
+	if err != nil {
+		return nil, fmt.Errorf("comparing with the baseline: %w", err)
+	}
+	check("drifted_columns", float64(drift.Alerts), float64(h.MaxDriftedColumns),
+		fmt.Sprintf("%d columns drifted from the baseline", drift.Alerts))
+	for _, col := range drift.Columns {
+		if col.Alert {
+			health.Reasons = append(health.Reasons, fmt.Sprintf("drift in %s.%s (psi=%.4f)", col.Table, col.Column, col.PSI))
+		}
+	}
+	health.finish()
+	return health, nil
+}
+
+// finish sets the score and status from the criteria.
+func (h *HealthReport) finish() {
+	passed := 0
+	for _, c := range h.Criteria {
+		if c.Pass {
+			passed++
+		}
+	}
+	h.Score = 100
+	if len(h.Criteria) > 0 {
+		h.Score = 100 * passed / len(h.Criteria)
+	}
+	h.Status = healthPass
+	if passed < len(h.Criteria) {
+		h.Status = healthFail
+	}
+}
+
+// baselineRows reads the rows of each table from the run report of the
+// baseline export.
+func baselineRows(dir string) (map[string]int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "run_report.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading the baseline's run report: %w", err)
+	}
+	var report RunReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		return nil, fmt.Errorf("parsing the baseline's run report: %w", err)
+	}
+	rows := make(map[string]int, len(report.Tables))
+	for _, u := range report.Tables {
+		rows[u.Table] = u.Rows
+	}
+	return rows, nil
+}
+
+// logHealth logs the verdict and its reasons.
+func logHealth(h *HealthReport) {
+	if h.Status == healthPass {
+		log.Printf("Export health: pass (score %d)", h.Score)
+		return
+	}
+	log.Printf("Export health: fail (score %d)", h.Score)
+	for _, r := range h.Reasons {
+		log.Printf("  %s", r)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatInterval is how often progress of a running table export is logged.
+const heartbeatInterval = 30 * time.Second
+
+// heartbeat periodically logs the progress of a table export so that a
+// long-running or stuck export is visible in the logs.
+type heartbeat struct {
+	table  string
+	start  time.Time
+	rows   atomic.Int64
+	offset atomic.Int64
+	// batches counts the batches read, with the total, longest and last
+	// time taken to read one in nanoseconds.
+	batches     atomic.Int64
+	batchTotal  atomic.Int64
+	batchMax    atomic.Int64
+	batchLatest atomic.Int64
+	done        chan struct{}
+}
+
+// activeHeartbeats are the heartbeats of the tables being read, which
+// progress snapshots report on.
+var activeHeartbeats sync.Map
+
+func startHeartbeat(table string) *heartbeat {
+	hb := &heartbeat{
+		table: table,
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+	activeHeartbeats.Store(hb, struct{}{})
+	go hb.run()
+	return hb
+}
+
+func (hb *heartbeat) run() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hb.done:
+			return
+		case <-ticker.C:
+			if exportPause.Paused() {
+				log.Printf("table %q paused: %d rows after %s, next batch at offset %d",
+					hb.table, hb.rows.Load(), time.Since(hb.start).Round(time.Second), hb.offset.Load())
+				continue
+			}
+			log.Printf("still exporting table %q: %d rows after %s, current batch at offset %d",
+				hb.table, hb.rows.Load(), time.Since(hb.start).Round(time.Second), hb.offset.Load())
+		}
+	}
+}
+
+// addBatch counts a batch of n rows that took d to read.
+func (hb *heartbeat) addBatch(n int, d time.Duration) {
+	hb.rows.Add(int64(n))
+	hb.batches.Add(1)
+	hb.batchTotal.Add(int64(d))
+	hb.batchLatest.Store(int64(d))
+	for {
+		max := hb.batchMax.Load()
+		if int64(d) <= max || hb.batchMax.CompareAndSwap(max, int64(d)) {
+			break
+		}
+	}
+}
+
+func (hb *heartbeat) setOffset(offset int) {
+	hb.offset.Store(int64(offset))
+}
+
+// Stop ends the heartbeat.
+func (hb *heartbeat) Stop() {
+	activeHeartbeats.Delete(hb)
+	close(hb.done)
+}
+
+// stallDiagnostics describes lock waits on a table, given its quoted name,
+// to explain why a batch query stalled. Failures to collect diagnostics are
+// reported inline.
+func stallDiagnostics(db *sql.DB, table string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT a.pid, l.mode, coalesce(a.wait_event_type, ''), coalesce(a.state, ''),
+		       array_to_string(pg_blocking_pids(a.pid), ',')
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.relation = to_regclass($1)
+		  AND NOT l.granted
+	`
+	rows, err := db.QueryContext(ctx, query, table)
+	if err != nil {
+		return fmt.Sprintf("could not collect lock diagnostics: %v", err)
+	}
+	defer rows.Close()
+
+	var waits []string
+	for rows.Next() {
+		var pid int
+		var mode, waitEvent, state, blockedBy string
+		if err := rows.Scan(&pid, &mode, &waitEvent, &state, &blockedBy); err != nil {
+			return fmt.Sprintf("could not collect lock diagnostics: %v", err)
+		}
+		waits = append(waits, fmt.Sprintf("pid %d waiting for %s (%s, %s) blocked by [%s]", pid, mode, waitEvent, state, blockedBy))
+	}
+	if len(waits) == 0 {
+		return "no ungranted locks on the table"
+	}
+	return strings.Join(waits, "; ")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WatermarkRange is the part of a table an incremental export covers: the
+// rows whose watermark column is after After, the watermark of the
+// previous run, up to Through, the highest value exported. After is nil on
+// the first run, which exports the whole table.
+type WatermarkRange struct {
+	Column  string      `json:"column"`
+	After   interface{} `json:"after,omitempty"`
+	Through interface{} `json:"through,omitempty"`
+}
+
+// incrementalState is the state file of -incremental, holding the
+// watermark reached per table.
+type incrementalState struct {
+	Tables map[string]tableWatermark `json:"tables"`
+}
+
+// tableWatermark is the highest value of a table's watermark column
+// exported so far.
+type tableWatermark struct {
+	Column string `json:"column"`
+	// DataType is the column's data type, needed to read Value back.
+	DataType  string          `json:"data_type"`
+	Value     json.RawMessage `json:"value"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// loadIncrementalState reads the state file, or returns an empty state if
+// it doesn't exist yet.
+func loadIncrementalState(path string) (incrementalState, error) {
+	state := incrementalState{Tables: make(map[string]tableWatermark)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if state.Tables == nil {
+		state.Tables = make(map[string]tableWatermark)
+	}
+	return state, nil
+}
+
+// save writes the state file, replacing it only once it is complete.
+func (s incrementalState) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// watermarkRange returns the range a table's next export starts from, for
+// its watermark column field.
+func (s incrementalState) watermarkRange(table string, field FieldMetadata) (*WatermarkRange, error) {
+	r := &WatermarkRange{Column: field.FieldName}
+	w, ok := s.Tables[table]
+	if !ok || w.Column != field.FieldName {
+		return r, nil
+	}
+	after, err := decodeWatermark(w.Value, w.DataType)
+	if err != nil {
+		return nil, fmt.Errorf("reading the watermark of table %s: %w", table, err)
+	}
+	r.After = after
+	return r, nil
+}
+
+// set records the watermark a table's export reached.
+func (s incrementalState) set(table string, field FieldMetadata, value interface{}) error {
+	if v, ok := value.([]byte); ok {
+		value = string(v)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.Tables[table] = tableWatermark{Column: field.FieldName, DataType: field.DataType, Value: b, UpdatedAt: time.Now().UTC()}
+	return nil
+}
+
+// decodeWatermark converts a stored watermark back to the value the
+// source driver returns for its data type, so it binds as one.
+func decodeWatermark(raw json.RawMessage, dataType string) (interface{}, error) {
+	switch dataType {
+	case DataTypeInt:
+		return strconv.ParseInt(string(raw), 10, 64)
+	case DataTypeFloat:
+		return strconv.ParseFloat(string(raw), 64)
+	case DataTypeBool:
+		return strconv.ParseBool(string(raw))
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if dataType == DataTypeTime || dataType == DataTypeDate {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return s, nil
+}
+
+// laterWatermark reports whether the watermark value b is after a. Values
+// of different types, which one column doesn't produce, are compared as
+// text.
+func laterWatermark(a, b interface{}) bool {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return b > a
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return b > a
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return b.After(a)
+		}
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(b, a) > 0
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%v", b), fmt.Sprintf("%v", a)) > 0
+}
+
+// incrementalRange returns the watermark range of a table's export, or nil
+// for tables without a watermark column.
+func incrementalRange(state incrementalState, cfg ExportConfig, table TableMetadata) (*WatermarkRange, error) {
+	t, ok := cfg.table(table.TableName)
+	if !ok || t.Watermark == "" {
+		return nil, nil
+	}
+	for _, field := range table.Fields {
+		if field.FieldName == t.Watermark {
+			return state.watermarkRange(table.TableName, field)
+		}
+	}
+	return nil, fmt.Errorf("watermark column %q of table %s is not exported", t.Watermark, table.TableName)
+}
+
+// watermarkField returns the field of a table's watermark column.
+func watermarkField(table TableMetadata) FieldMetadata {
+	for _, field := range table.Fields {
+		if field.FieldName == table.Watermark.Column {
+			return field
+		}
+	}
+	return FieldMetadata{FieldName: table.Watermark.Column}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// runInspect implements the `inspect` command:
+//
+//	inspect [-n 5] <file.npz>
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	samples := fs.Int("n", 5, "number of sample values printed per array")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("usage: inspect [flags] <file.npz>")
+	}
+	if err := inspectNpz(os.Stdout, fs.Arg(0), *samples); err != nil {
+		log.Fatalf("failed to inspect %s: %v", fs.Arg(0), err)
+	}
+}
+
+// inspectNpz prints the arrays of an NPZ file with their dtypes, shapes and
+// first n values, followed by the table's metadata entry.
+func inspectNpz(w io.Writer, path string, n int) error {
+	r, err := npz.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fmt.Fprintf(w, "%s\n\n", path)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ARRAY\tDTYPE\tSHAPE\tSAMPLE")
+	for _, name := range npzColumnNames(r) {
+		key := name + ".npy"
+		hdr := r.Header(key)
+		if hdr == nil {
+			key = name
+			hdr = r.Header(key)
+		}
+		if hdr == nil {
+			return fmt.Errorf("reading header of %q", name)
+		}
+
+		sample := ""
+		column, err := readNpzColumn(r, name)
+		if err != nil {
+			sample = fmt.Sprintf("<%v>", err)
+		} else {
+			sample = formatSample(column, n)
+			if values, ok, err := readSharedDictionary(r, filepath.Dir(path), name); ok && err == nil {
+				codes, _ := numericValues(column)
+				decoded := dictionaryDecode(codes[:min(n, len(codes))], values)
+				sample += " -> " + formatSample(decoded, n)
+			} else if categories, err := readNpzColumn(r, name+categoriesSuffix); err == nil {
+				codes, _ := numericValues(column)
+				decoded := dictionaryDecode(codes[:min(n, len(codes))], stringValues(categories))
+				sample += " -> " + formatSample(decoded, n)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", name, hdr.Descr.Type, hdr.Descr.Shape, sample)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	table := trimExt(filepath.Base(path))
+	meta, source, err := findTableMetadata(r, path, table)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		fmt.Fprintf(w, "\nno metadata found for table %s\n", table)
+		return nil
+	}
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nmetadata (%s):\n%s\n", source, b)
+	return nil
+}
+
+// formatSample renders the first n values of a column.
+func formatSample(column interface{}, n int) string {
+	rv := reflect.ValueOf(column)
+	var values []string
+	for i := 0; i < rv.Len() && i < n; i++ {
+		switch v := rv.Index(i).Interface().(type) {
+		case string:
+			values = append(values, fmt.Sprintf("%q", v))
+		case time.Time:
+			if v.IsZero() {
+				values = append(values, "NaT")
+			} else {
+				values = append(values, v.Format(time.RFC3339Nano))
+			}
+		default:
+			values = append(values, fmt.Sprintf("%v", v))
+		}
+	}
+	if rv.Len() > n {
+		values = append(values, "...")
+	}
+	return "[" + strings.Join(values, " ") + "]"
+}
+
+// findTableMetadata returns the metadata of the table stored in an NPZ
+// file and where it was found: the embedded __metadata__.json, or the
+// metadata.json or split metadata/<table>.json next to the file. It returns
+// nil if there is none.
+func findTableMetadata(r *npz.Reader, path, table string) (*TableMetadata, string, error) {
+	for _, key := range r.Keys() {
+		if key != embeddedMetadataName {
+			continue
+		}
+		rc, err := r.Open(key)
+		if err != nil {
+			return nil, "", err
+		}
+		defer rc.Close()
+		var embedded EmbeddedMetadata
+		if err := json.NewDecoder(rc).Decode(&embedded); err != nil {
+			return nil, "", fmt.Errorf("parsing %s: %w", embeddedMetadataName, err)
+		}
+		return &embedded.Table, embeddedMetadataName, nil
+	}
+
+	dir := filepath.Dir(path)
+	split := filepath.Join(dir, metadataDir, table+".json")
+	if b, err := os.ReadFile(split); err == nil {
+		var meta TableMetadata
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, "", fmt.Errorf("parsing %s: %w", split, err)
+		}
+		return &meta, split, nil
+	}
+
+	single := filepath.Join(dir, "metadata.json")
+	b, err := os.ReadFile(single)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var schema SchemaDetails
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, "", fmt.Errorf("parsing %s: %w", single, err)
+	}
+	for _, meta := range schema.Tables {
+		if meta.TableName == table {
+			return &meta, single, nil
+		}
+	}
+	return nil, "", nil
+}
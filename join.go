@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// DimensionConfig is a small table, read from a CSV file or another
+// database before the export, that tables are enriched with through joins.
+type DimensionConfig struct {
+	Name string `yaml:"name" toml:"name"`
+	// Key is the dimension's column the joins match on. Its values must be
+	// unique.
+	Key string `yaml:"key" toml:"key"`
+	// CSV is the path of a CSV file with a header row. Its columns are
+	// text, and empty fields are nulls.
+	CSV string `yaml:"csv" toml:"csv"`
+	// Connection is the database a Table or SQL dimension is read from.
+	Connection ConnectionConfig `yaml:"connection" toml:"connection"`
+	Table      string           `yaml:"table" toml:"table"`
+	SQL        string           `yaml:"sql" toml:"sql"`
+}
+
+// JoinConfig adds the columns of a dimension to a table, taken from the
+// dimension row whose key equals the table's On column. Rows without a
+// match get nulls.
+type JoinConfig struct {
+	Dimension string `yaml:"dimension" toml:"dimension"`
+	On        string `yaml:"on" toml:"on"`
+	// Columns are the dimension's columns to add, every column but the
+	// key by default.
+	Columns []string `yaml:"columns" toml:"columns"`
+	// Prefix is prepended to the names of the added columns.
+	Prefix string `yaml:"prefix" toml:"prefix"`
+}
+
+// validate checks a dimension's source settings.
+func (d DimensionConfig) validate() error {
+	if d.Name == "" || d.Key == "" {
+		return fmt.Errorf("dimensions need a name and key")
+	}
+	sources := 0
+	for _, s := range []string{d.CSV, d.Table, d.SQL} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("dimension %s needs exactly one of csv, table or sql", d.Name)
+	}
+	if d.CSV == "" && d.Connection == (ConnectionConfig{}) {
+		return fmt.Errorf("dimension %s needs a connection to read from", d.Name)
+	}
+	if d.SQL != "" && d.Connection.Source == sourceMongoDB {
+		return fmt.Errorf("dimension %s: queries are not supported for the %s source", d.Name, sourceMongoDB)
+	}
+	return nil
+}
+
+// dimension is a loaded dimension, with its rows by key.
+type dimension struct {
+	name string
+	// columns are the dimension's columns other than the key.
+	columns []FieldMetadata
+	rows    map[string]TableRow
+}
+
+// loadDimensions reads every configured dimension into memory.
+func loadDimensions(ctx context.Context, cfg ExportConfig) (map[string]*dimension, error) {
+	dims := make(map[string]*dimension, len(cfg.Dimensions))
+	for _, d := range cfg.Dimensions {
+		var columns []FieldMetadata
+		var rows []TableRow
+		var err error
+		if d.CSV != "" {
+			columns, rows, err = readCSVDimension(d.CSV)
+		} else {
+			columns, rows, err = readSourceDimension(ctx, d, cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading dimension %s: %w", d.Name, err)
+		}
+		dim, err := newDimension(d, columns, rows)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded dimension %q with %d rows", d.Name, len(dim.rows))
+		dims[d.Name] = dim
+	}
+	return dims, nil
+}
+
+// newDimension indexes the rows of a dimension by key.
+func newDimension(d DimensionConfig, columns []FieldMetadata, rows []TableRow) (*dimension, error) {
+	dim := &dimension{name: d.Name, rows: make(map[string]TableRow, len(rows))}
+	found := false
+	for _, field := range columns {
+		if field.FieldName == d.Key {
+			found = true
+			continue
+		}
+		dim.columns = append(dim.columns, field)
+	}
+	if !found {
+		return nil, fmt.Errorf("dimension %s has no key column %q", d.Name, d.Key)
+	}
+	for _, row := range rows {
+		k, ok := joinKey(row[d.Key])
+		if !ok {
+			continue
+		}
+		if _, dup := dim.rows[k]; dup {
+			return nil, fmt.Errorf("dimension %s has more than one row with key %s", d.Name, k)
+		}
+		dim.rows[k] = row
+	}
+	return dim, nil
+}
+
+// readCSVDimension reads a CSV file with a header row as text columns.
+func readCSVDimension(path string) ([]FieldMetadata, []TableRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the header of %s: %w", path, err)
+	}
+	columns := make([]FieldMetadata, len(header))
+	for i, name := range header {
+		columns[i] = FieldMetadata{FieldName: name, DataType: DataTypeString, IsNullable: true}
+	}
+	var rows []TableRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		row := make(TableRow, len(header))
+		for i, name := range header {
+			if record[i] != "" {
+				row[name] = record[i]
+			} else {
+				row[name] = nil
+			}
+		}
+		rows = append(rows, row)
+	}
+	return columns, rows, nil
+}
+
+// readSourceDimension reads a dimension's table or query from its own
+// connection, like an exported table.
+func readSourceDimension(ctx context.Context, d DimensionConfig, cfg ExportConfig) ([]FieldMetadata, []TableRow, error) {
+	dcfg := ExportConfig{Connection: d.Connection, Params: cfg.Params, BatchSize: cfg.BatchSize, SampleSize: cfg.SampleSize}
+	name := d.Table
+	if d.SQL != "" {
+		name = d.Name
+		dcfg.Queries = []QueryConfig{{Name: d.Name, SQL: d.SQL}}
+	} else {
+		dcfg.Tables = []TableConfig{{Name: d.Table}}
+	}
+	src, err := openSource(ctx, dcfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting: %w", err)
+	}
+	defer src.Close()
+
+	schema, err := src.FetchMetadata(ctx, dcfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching metadata: %w", err)
+	}
+	i := slices.IndexFunc(schema.Tables, func(t TableMetadata) bool { return t.TableName == name })
+	if i < 0 {
+		return nil, nil, fmt.Errorf("table %s not found", name)
+	}
+	table := schema.Tables[i]
+	var rows []TableRow
+	err = src.StreamTableData(ctx, table, dcfg, func(batch []TableRow) error {
+		for _, row := range batch {
+			delete(row, resumeKeyColumn)
+		}
+		rows = append(rows, batch...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return table.Fields, rows, nil
+}
+
+// joinKey returns the text a join matches a value on, so that a number
+// read from a database matches the same number read from a CSV file. ok
+// is false for nulls, which match nothing.
+func joinKey(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// tableJoiner adds the columns of dimensions to a table's rows with an
+// in-memory hash join on each row's key.
+type tableJoiner struct {
+	table string
+	joins []JoinConfig
+	dims  []*dimension
+	// columns are the dimension columns each join adds.
+	columns [][]string
+	// unmatched counts, per join, the rows without a dimension row.
+	unmatched []int
+}
+
+// newTableJoiner validates the joins against the table's columns and adds
+// the joined columns to them.
+func newTableJoiner(table *TableData, joins []JoinConfig, dims map[string]*dimension) (*tableJoiner, error) {
+	j := &tableJoiner{table: table.TableName, joins: joins, unmatched: make([]int, len(joins))}
+	for _, join := range joins {
+		dim, ok := dims[join.Dimension]
+		if !ok {
+			return nil, fmt.Errorf("table %s joins unknown dimension %q", table.TableName, join.Dimension)
+		}
+		if !slices.ContainsFunc(table.Columns, func(f FieldMetadata) bool { return f.FieldName == join.On }) {
+			return nil, fmt.Errorf("table %s has no column %q to join dimension %s on", table.TableName, join.On, dim.name)
+		}
+
+		fields := dim.columns
+		if len(join.Columns) > 0 {
+			fields = nil
+			for _, name := range join.Columns {
+				i := slices.IndexFunc(dim.columns, func(f FieldMetadata) bool { return f.FieldName == name })
+				if i < 0 {
+					return nil, fmt.Errorf("dimension %s has no column %q to join", dim.name, name)
+				}
+				fields = append(fields, dim.columns[i])
+			}
+		}
+		var names []string
+		for _, field := range fields {
+			output := join.Prefix + field.FieldName
+			if slices.ContainsFunc(table.Columns, func(f FieldMetadata) bool { return f.FieldName == output }) {
+				return nil, fmt.Errorf("table %s already has a column %q", table.TableName, output)
+			}
+			table.Columns = append(table.Columns, FieldMetadata{
+				FieldName:           output,
+				DataType:            field.DataType,
+				IsNullable:          true,
+				TransformedFeatures: []string{"joined_" + dim.name},
+				Precision:           field.Precision,
+				Scale:               field.Scale,
+				ElementType:         field.ElementType,
+				EnumValues:          field.EnumValues,
+			})
+			names = append(names, field.FieldName)
+		}
+		j.dims = append(j.dims, dim)
+		j.columns = append(j.columns, names)
+	}
+	return j, nil
+}
+
+// apply adds the joined columns to a batch.
+func (j *tableJoiner) apply(rows []TableRow) {
+	for i, join := range j.joins {
+		dim := j.dims[i]
+		for _, row := range rows {
+			var match TableRow
+			if k, ok := joinKey(row[join.On]); ok {
+				match = dim.rows[k]
+			}
+			if match == nil {
+				j.unmatched[i]++
+			}
+			for _, name := range j.columns[i] {
+				row[join.Prefix+name] = match[name]
+			}
+		}
+	}
+}
+
+// finish reports the rows no dimension row matched.
+func (j *tableJoiner) finish([]FieldMetadata) {
+	for i, join := range j.joins {
+		if n := j.unmatched[i]; n > 0 {
+			log.Printf("table %s: %d rows have no %s row matching %s, their joined columns are null", j.table, n, join.Dimension, join.On)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// jsonText returns the JSON text of a json column value. Drivers return
+// json and jsonb values as bytes or strings; anything else is marshaled.
+// ok is false for nil.
+func jsonText(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v), true
+		}
+		return string(b), true
+	}
+}
+
+// jsonFlattener adds a column <column>.<key> for each configured top-level
+// key of JSON object columns. String values are unquoted, other values
+// keep their JSON text, and missing keys and JSON nulls become nulls, so
+// the new columns can be parsed further like any text column.
+type jsonFlattener struct {
+	table   string
+	columns []string
+	keys    map[string][]string
+	// invalid counts the values per column that are not JSON objects.
+	invalid map[string]int
+}
+
+func newJSONFlattener(table *TableData, flatten map[string][]string) (*jsonFlattener, error) {
+	f := &jsonFlattener{table: table.TableName, keys: flatten, invalid: make(map[string]int)}
+	for column := range flatten {
+		f.columns = append(f.columns, column)
+	}
+	sort.Strings(f.columns)
+
+	for _, column := range f.columns {
+		found := false
+		for _, col := range table.Columns {
+			found = found || col.FieldName == column
+		}
+		if !found {
+			return nil, fmt.Errorf("table %s has no column %q to flatten", table.TableName, column)
+		}
+		for _, key := range flatten[column] {
+			output := column + "." + key
+			for _, col := range table.Columns {
+				if col.FieldName == output {
+					return nil, fmt.Errorf("table %s already has a column %q", table.TableName, output)
+				}
+			}
+			table.Columns = append(table.Columns, FieldMetadata{
+				FieldName:           output,
+				DataType:            DataTypeString,
+				IsNullable:          true,
+				TransformedFeatures: []string{"json_flattened"},
+			})
+		}
+	}
+	return f, nil
+}
+
+// apply adds the flattened columns to a batch.
+func (f *jsonFlattener) apply(rows []TableRow) {
+	for _, row := range rows {
+		for _, column := range f.columns {
+			var object map[string]json.RawMessage
+			if text, ok := jsonText(row[column]); ok {
+				if err := json.Unmarshal([]byte(text), &object); err != nil {
+					f.invalid[column]++
+				}
+			}
+			for _, key := range f.keys[column] {
+				row[column+"."+key] = jsonFieldValue(object[key])
+			}
+		}
+	}
+}
+
+// jsonFieldValue converts the raw JSON of an object field to a column
+// value.
+func jsonFieldValue(raw json.RawMessage) interface{} {
+	if raw == nil || string(raw) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return string(raw)
+	}
+	return compact.String()
+}
+
+// finish logs the columns that held values other than JSON objects.
+func (f *jsonFlattener) finish(columns []FieldMetadata) {
+	for _, column := range f.columns {
+		if n := f.invalid[column]; n > 0 {
+			log.Printf("column %s.%s: %d values are not JSON objects, their flattened columns are null", f.table, column, n)
+		}
+	}
+}
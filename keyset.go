@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rowIdentity is a source's implicit row identifier, used to paginate
+// tables without a primary key.
+type rowIdentity struct {
+	// column is compared and ordered on.
+	column string
+	// selectExpr selects the identifier as a value that can be bound back
+	// into the next query.
+	selectExpr string
+	// placeholder formats the bound identifier given its position.
+	placeholder string
+	// blocks pages batches by ranges of heap blocks rather than with a
+	// LIMIT, see blockPager.
+	blocks bool
+}
+
+var (
+	postgresRowIdentity = rowIdentity{column: "ctid", selectExpr: "ctid::text", placeholder: "$%d::tid", blocks: true}
+	sqliteRowIdentity   = rowIdentity{column: "rowid", selectExpr: "rowid", placeholder: "$%d"}
+)
+
+// keyAliasPrefix names the key values selected next to a table's columns.
+const keyAliasPrefix = "__key"
+
+// resumeKeyColumn holds, in the last row of every batch a table is
+// streamed in, the ResumeKey continuing after that row.
+const resumeKeyColumn = "__resume_key"
+
+// pageKey is the key a table is paginated on: its primary key, or the
+// source's row identifier for tables without one. Views are paginated with
+// OFFSET and ordered on their columns, with no key selected.
+type pageKey struct {
+	columns     []string
+	selects     []string
+	placeholder string
+	blocks      bool
+}
+
+// tablePageKey returns the pagination key of a table.
+func tablePageKey(table TableMetadata, fallback rowIdentity) pageKey {
+	var key pageKey
+	if table.Kind == relationView {
+		for _, column := range orderColumns(table) {
+			key.columns = append(key.columns, quoteIdent(column))
+		}
+		return key
+	}
+	for _, field := range table.Fields {
+		if field.IsPrimaryKey {
+			key.columns = append(key.columns, quoteIdent(field.FieldName))
+			key.selects = append(key.selects, quoteIdent(field.FieldName))
+		}
+	}
+	key.placeholder = "$%d"
+	if len(key.columns) == 0 {
+		key = pageKey{
+			columns:     []string{fallback.column},
+			selects:     []string{fallback.selectExpr},
+			placeholder: fallback.placeholder,
+			blocks:      fallback.blocks,
+		}
+	}
+	return key
+}
+
+// query builds the SELECT for one batch of up to n rows of the rows the
+// table's filter, sample and watermark select, or for all of them with n
+// 0. With after set it selects the rows following the key values bound as
+// parameters after those of the filter and the watermark, otherwise the
+// first batch. The key values are selected as __key0, __key1, ...
+//
+// Batches of a key paged by blocks select all rows after the row
+// identifier bound first and before the one bound second, with no LIMIT.
+func (k pageKey) query(table TableMetadata, n int, after bool) string {
+	var cols []string
+	for _, field := range table.Fields {
+		cols = append(cols, quoteIdent(field.FieldName))
+	}
+	for i, expr := range k.selects {
+		cols = append(cols, fmt.Sprintf("%s AS %s%d", expr, keyAliasPrefix, i))
+	}
+
+	var conditions []string
+	filter, params := bindNamedParams(table.Where)
+	bound := len(params)
+	if filter != "" {
+		conditions = append(conditions, "("+filter+")")
+	}
+	sample, condition := table.tableSample()
+	if condition != "" {
+		conditions = append(conditions, condition)
+	}
+	if w := table.Watermark; w != nil && w.After != nil {
+		bound++
+		conditions = append(conditions, fmt.Sprintf("%s > $%d", quoteIdent(w.Column), bound))
+	}
+	if after {
+		placeholders := make([]string, len(k.columns))
+		for i := range k.columns {
+			placeholders[i] = fmt.Sprintf(k.placeholder, bound+i+1)
+		}
+		if len(k.columns) == 1 {
+			conditions = append(conditions, fmt.Sprintf("%s > %s", k.columns[0], placeholders[0]))
+			if k.blocks && n > 0 {
+				conditions = append(conditions, fmt.Sprintf("%s < %s", k.columns[0], fmt.Sprintf(k.placeholder, bound+2)))
+			}
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s) > (%s)", strings.Join(k.columns, ", "), strings.Join(placeholders, ", ")))
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(cols, ", "), table.sourceIdent(), sample)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if len(k.columns) > 0 {
+		query += " ORDER BY " + strings.Join(k.columns, ", ")
+	}
+	if n > 0 && !k.blocks {
+		query += fmt.Sprintf(" LIMIT %d", n)
+	}
+	return query
+}
+
+// takeKey removes the selected key values from every row of a batch and
+// returns those of the last row, ready to be bound into the next query.
+func (k pageKey) takeKey(batch []TableRow) []interface{} {
+	var last []interface{}
+	for i, row := range batch {
+		if i == len(batch)-1 {
+			last = make([]interface{}, len(k.selects))
+		}
+		for j := range k.selects {
+			alias := fmt.Sprintf("%s%d", keyAliasPrefix, j)
+			if last != nil {
+				last[j] = row[alias]
+				// Drivers return some types, such as uuid, as text bytes,
+				// which would be bound as bytea.
+				if b, ok := last[j].([]byte); ok {
+					last[j] = string(b)
+				}
+			}
+			delete(row, alias)
+		}
+	}
+	return last
+}
+
+// blockPager pages a PostgreSQL table without a primary key by ranges of
+// its heap blocks. A range of ctids is read with a TID range scan
+// (PostgreSQL 14 and later), whereas ORDER BY ctid LIMIT n sorts all rows
+// left for every batch. Ranges are sized to hold about a batch of rows and
+// adjusted to the rows the previous range held.
+type blockPager struct {
+	// next is the block the next range starts at, blocks the number of
+	// blocks of the table when paging started: rows of the export's
+	// snapshot lie before it.
+	next, blocks int64
+	// width is the number of blocks of the next range.
+	width     int64
+	batchSize int
+}
+
+// newBlockPager sizes the ranges of a table, or materialized view, from
+// its statistics, summed over its partitions.
+func newBlockPager(ctx context.Context, db *sql.DB, table TableMetadata, batchSize int) (*blockPager, error) {
+	var blocks int64
+	var tuples, pages float64
+	err := db.QueryRowContext(ctx, `
+		SELECT coalesce(max(pg_relation_size(t.relid)), 0) / current_setting('block_size')::bigint,
+			coalesce(sum(greatest(c.reltuples, 0)), 0), coalesce(sum(greatest(c.relpages, 0)), 0)
+		FROM (SELECT $1::regclass AS relid UNION SELECT relid FROM pg_partition_tree($1::regclass)) t
+		JOIN pg_class c ON c.oid = t.relid`, table.sourceIdent()).Scan(&blocks, &tuples, &pages)
+	if err != nil {
+		return nil, fmt.Errorf("reading the size of %s: %w", table.TableName, err)
+	}
+	p := &blockPager{blocks: blocks, width: 1, batchSize: batchSize}
+	if tuples >= 1 && pages >= 1 {
+		p.width = max(1, int64(float64(batchSize)/(tuples/pages)))
+	}
+	return p, nil
+}
+
+// resume starts paging at the block of the row identifier a checkpoint
+// recorded.
+func (p *blockPager) resume(key interface{}) error {
+	s, _ := key.(string)
+	block, err := tidBlock(s)
+	if err != nil {
+		return fmt.Errorf("resuming after ctid %v: %w", key, err)
+	}
+	p.next = block
+	return nil
+}
+
+// done reports whether the ranges cover the table.
+func (p *blockPager) done() bool {
+	return p.next >= p.blocks
+}
+
+// end is the row identifier bounding the next range.
+func (p *blockPager) end() string {
+	return tidText(p.next + p.width)
+}
+
+// advance moves past a range that held n rows and resizes the next one to
+// hold about a batch, growing it at most twofold.
+func (p *blockPager) advance(n int) {
+	p.next += p.width
+	if n == 0 {
+		p.width *= 2
+		return
+	}
+	p.width = max(1, min(2*p.width, p.width*int64(p.batchSize)/int64(n)))
+}
+
+// tidText formats the row identifier before every row of a block. Tuple
+// offsets start at 1, so no row has the identifier itself.
+func tidText(block int64) string {
+	return fmt.Sprintf("(%d,0)", block)
+}
+
+// tidBlock parses the block of a row identifier formatted as text.
+func tidBlock(s string) (int64, error) {
+	block, _, ok := strings.Cut(strings.TrimPrefix(s, "("), ",")
+	if !ok || !strings.HasPrefix(s, "(") {
+		return 0, fmt.Errorf("invalid tid %q", s)
+	}
+	return strconv.ParseInt(block, 10, 64)
+}
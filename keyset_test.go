@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPageKeyQuery(t *testing.T) {
+	fields := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true},
+		{FieldName: "name", DataType: DataTypeString},
+	}
+	noKey := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt},
+		{FieldName: "name", DataType: DataTypeString},
+	}
+	composite := []FieldMetadata{
+		{FieldName: "a", DataType: DataTypeInt, IsPrimaryKey: true},
+		{FieldName: "b", DataType: DataTypeString, IsPrimaryKey: true},
+	}
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		table    TableMetadata
+		fallback rowIdentity
+		n        int
+		after    bool
+		want     string
+	}{
+		{
+			name:     "first batch",
+			table:    TableMetadata{TableName: "t", Fields: fields},
+			fallback: postgresRowIdentity,
+			n:        100,
+			want:     `SELECT "id", "name", "id" AS __key0 FROM "t" ORDER BY "id" LIMIT 100`,
+		},
+		{
+			name:     "after key",
+			table:    TableMetadata{TableName: "t", Fields: fields},
+			fallback: postgresRowIdentity,
+			n:        100,
+			after:    true,
+			want:     `SELECT "id", "name", "id" AS __key0 FROM "t" WHERE "id" > $1 ORDER BY "id" LIMIT 100`,
+		},
+		{
+			name:     "composite key",
+			table:    TableMetadata{TableName: "t", Fields: composite},
+			fallback: postgresRowIdentity,
+			n:        10,
+			after:    true,
+			want:     `SELECT "a", "b", "a" AS __key0, "b" AS __key1 FROM "t" WHERE ("a", "b") > ($1, $2) ORDER BY "a", "b" LIMIT 10`,
+		},
+		{
+			name:     "filter and watermark",
+			table:    TableMetadata{TableName: "t", Fields: fields, Where: "name = :name", Watermark: &WatermarkRange{Column: "id", After: since}},
+			fallback: postgresRowIdentity,
+			n:        10,
+			after:    true,
+			want:     `SELECT "id", "name", "id" AS __key0 FROM "t" WHERE (name = $1) AND "id" > $2 AND "id" > $3 ORDER BY "id" LIMIT 10`,
+		},
+		{
+			name:     "ctid block range",
+			table:    TableMetadata{TableName: "t", Fields: noKey},
+			fallback: postgresRowIdentity,
+			n:        100,
+			after:    true,
+			want:     `SELECT "id", "name", ctid::text AS __key0 FROM "t" WHERE ctid > $1::tid AND ctid < $2::tid ORDER BY ctid`,
+		},
+		{
+			name:     "ctid copy",
+			table:    TableMetadata{TableName: "t", Fields: noKey},
+			fallback: postgresRowIdentity,
+			after:    true,
+			want:     `SELECT "id", "name", ctid::text AS __key0 FROM "t" WHERE ctid > $1::tid ORDER BY ctid`,
+		},
+		{
+			name:     "rowid",
+			table:    TableMetadata{TableName: "t", Fields: noKey},
+			fallback: sqliteRowIdentity,
+			n:        100,
+			after:    true,
+			want:     `SELECT "id", "name", rowid AS __key0 FROM "t" WHERE rowid > $1 ORDER BY rowid LIMIT 100`,
+		},
+		{
+			name:     "view",
+			table:    TableMetadata{TableName: "v", Fields: noKey, Kind: relationView},
+			fallback: postgresRowIdentity,
+			want:     `SELECT "id", "name" FROM "v" ORDER BY "id", "name"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tablePageKey(tt.table, tt.fallback).query(tt.table, tt.n, tt.after)
+			if got != tt.want {
+				t.Errorf("query =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockPager(t *testing.T) {
+	p := &blockPager{blocks: 16, width: 2, batchSize: 100}
+	var ends []string
+	for _, n := range []int{50, 0, 400, 100} {
+		if p.done() {
+			t.Fatalf("done at block %d of %d", p.next, p.blocks)
+		}
+		ends = append(ends, p.end())
+		p.advance(n)
+	}
+	// Ranges double when short or empty, and shrink to hold about a batch.
+	want := []string{"(2,0)", "(6,0)", "(14,0)", "(16,0)"}
+	for i := range want {
+		if ends[i] != want[i] {
+			t.Errorf("range %d ends at %s, want %s", i, ends[i], want[i])
+		}
+	}
+	if !p.done() {
+		t.Errorf("not done at block %d of %d", p.next, p.blocks)
+	}
+
+	if err := p.resume("(7,12)"); err != nil {
+		t.Fatal(err)
+	}
+	if p.next != 7 {
+		t.Errorf("resumed at block %d, want 7", p.next)
+	}
+	for _, key := range []interface{}{"7,12", "(x,1)", int64(7), nil} {
+		if err := p.resume(key); err == nil {
+			t.Errorf("resume(%v) succeeded, want an error", key)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// EncodingLabel marks columns whose values were replaced by the int64
+	// codes of their vocabulary.
+	EncodingLabel = "label"
+
+	// vocabularyFile holds the vocabularies of the label encoded columns of
+	// an export, next to the metadata, as table to column to value to code.
+	vocabularyFile = "vocabulary.json"
+)
+
+// Vocabularies are the vocabularies of label encoded columns by table and
+// column, the layout of vocabularyFile.
+type Vocabularies map[string]map[string]map[string]int64
+
+// labelEncoder replaces the values of categorical columns with int64 codes,
+// numbered from 0 in the order values first appear after those of the
+// vocabulary it starts from. Nulls stay null. With a frozen vocabulary,
+// values not in it become nulls.
+type labelEncoder struct {
+	table   string
+	columns []string
+	frozen  bool
+	vocab   map[string]map[string]int64
+	next    map[string]int64
+	// unknown counts the values per column missing from a frozen
+	// vocabulary.
+	unknown map[string]int
+}
+
+// newLabelEncoder turns the columns into int columns, starting from the
+// vocabulary in their metadata, loaded with -vocabulary, or from the labels
+// of enum columns in their declared order.
+func newLabelEncoder(table *TableData, columns []string, frozen bool) (*labelEncoder, error) {
+	e := &labelEncoder{
+		table:   table.TableName,
+		columns: columns,
+		frozen:  frozen,
+		vocab:   make(map[string]map[string]int64),
+		next:    make(map[string]int64),
+		unknown: make(map[string]int),
+	}
+	for _, name := range columns {
+		idx := -1
+		for i, col := range table.Columns {
+			if col.FieldName == name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("table %s has no column %q to label encode", table.TableName, name)
+		}
+
+		col := &table.Columns[idx]
+		vocab := maps.Clone(col.Vocabulary)
+		if vocab == nil {
+			vocab = make(map[string]int64)
+			for i, label := range col.EnumValues {
+				vocab[label] = int64(i)
+			}
+		}
+		if frozen && len(vocab) == 0 {
+			return nil, fmt.Errorf("column %s.%s has no vocabulary to freeze", table.TableName, name)
+		}
+		col.DataType = DataTypeInt
+		col.Encoding = EncodingLabel
+		col.FillValue = nil
+		col.EnumValues = nil
+		col.IsNullable = col.IsNullable || frozen
+		col.TransformedFeatures = append(col.TransformedFeatures, "label_encoded")
+		// Shared with the metadata, so checkpoints record the codes given.
+		col.Vocabulary = vocab
+		e.use(name, vocab)
+	}
+	return e, nil
+}
+
+// use continues the codes of a column from a vocabulary.
+func (e *labelEncoder) use(column string, vocab map[string]int64) {
+	e.vocab[column] = vocab
+	e.next[column] = 0
+	for _, code := range vocab {
+		e.next[column] = max(e.next[column], code+1)
+	}
+}
+
+// apply replaces the values of a batch with their codes, adding the new
+// ones to the vocabulary.
+func (e *labelEncoder) apply(rows []TableRow) {
+	for _, column := range e.columns {
+		vocab := e.vocab[column]
+		for _, row := range rows {
+			value, ok := categoryText(row[column])
+			if !ok {
+				continue
+			}
+			code, known := vocab[value]
+			switch {
+			case known:
+				row[column] = code
+			case e.frozen:
+				row[column] = nil
+				e.unknown[column]++
+			default:
+				code = e.next[column]
+				vocab[value] = code
+				e.next[column]++
+				row[column] = code
+			}
+		}
+	}
+}
+
+// restore continues the vocabularies recorded in the columns of a
+// checkpoint or of the archive being patched.
+func (e *labelEncoder) restore(columns []FieldMetadata) {
+	for _, column := range e.columns {
+		for i := range columns {
+			if columns[i].FieldName == column && columns[i].Vocabulary != nil {
+				e.use(column, columns[i].Vocabulary)
+			}
+		}
+	}
+}
+
+// finish records the vocabularies in the column metadata and logs the
+// values a frozen vocabulary didn't have.
+func (e *labelEncoder) finish(columns []FieldMetadata) {
+	for _, column := range e.columns {
+		for i := range columns {
+			if columns[i].FieldName == column {
+				columns[i].Vocabulary = e.vocab[column]
+			}
+		}
+		if n := e.unknown[column]; n > 0 {
+			log.Printf("column %s.%s: %d values are not in the vocabulary and were exported as nulls", e.table, column, n)
+		}
+	}
+}
+
+// loadVocabularies reads the vocabulary file of an earlier export.
+func loadVocabularies(path string) (Vocabularies, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vocab Vocabularies
+	if err := json.Unmarshal(b, &vocab); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return vocab, nil
+}
+
+// useVocabularies sets the vocabularies the label encoded columns of the
+// tables start from.
+func useVocabularies(cfg ExportConfig, tables []TableMetadata, vocab Vocabularies) {
+	for _, table := range tables {
+		for _, column := range cfg.transforms(table.TableName).LabelEncode {
+			v, ok := vocab[table.TableName][column]
+			if !ok {
+				log.Printf("vocabulary: no vocabulary for %s.%s, starting a new one", table.TableName, column)
+				continue
+			}
+			for i := range table.Fields {
+				if table.Fields[i].FieldName == column {
+					table.Fields[i].Vocabulary = v
+				}
+			}
+		}
+	}
+}
+
+// saveVocabularies writes the vocabularies of the label encoded columns of
+// the tables to vocabularyFile in outDir, if there are any.
+func saveVocabularies(outDir string, tables []TableMetadata) error {
+	vocab := make(Vocabularies)
+	for _, table := range tables {
+		for _, field := range table.Fields {
+			if field.Encoding != EncodingLabel {
+				continue
+			}
+			if vocab[table.TableName] == nil {
+				vocab[table.TableName] = make(map[string]map[string]int64)
+			}
+			vocab[table.TableName][field.FieldName] = field.Vocabulary
+		}
+	}
+	if len(vocab) == 0 {
+		return nil
+	}
+	b, err := json.MarshalIndent(vocab, "", "  ")
+	if err != nil {
+		return err
+	}
+	return saveFile(filepath.Join(outDir, vocabularyFile), b)
+}
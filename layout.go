@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// NPZ compression, selected with npz_compression in the config or
+// -npz-compression: deflate (the default), or none to store arrays
+// uncompressed with their data aligned, so they can be memory-mapped.
+const (
+	npzCompressionDeflate = "deflate"
+	npzCompressionNone    = "none"
+)
+
+// npyAlignment is the boundary the data of arrays stored uncompressed
+// starts on, enough for any dtype and for GPU loaders.
+const npyAlignment = 64
+
+// alignmentExtraID is the zip extra field padding entries to alignment,
+// the one zipalign uses.
+const alignmentExtraID = 0xd935
+
+// ArrayLayout locates the data of an array in an NPZ archive stored
+// uncompressed, so loaders can slice the file without parsing the zip
+// entries or .npy headers.
+type ArrayLayout struct {
+	Name    string `json:"name"`
+	Dtype   string `json:"dtype"`
+	Shape   []int  `json:"shape"`
+	Strides []int  `json:"strides"`
+	// Offset is the byte offset of the array's first element in the file.
+	Offset int64 `json:"offset"`
+	Bytes  int64 `json:"nbytes"`
+	// Alignment is the largest power of two up to 4096 dividing Offset.
+	Alignment int `json:"alignment"`
+}
+
+// offsetWriter counts the bytes written to an archive's file, which once
+// the zip writer is flushed is the offset of its next entry.
+type offsetWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// writeArrayEntry writes the zip entry of an array, deflated or, with
+// stored set, uncompressed and padded so that the array's data starts on
+// an npyAlignment boundary of the file. The .npy header before the data is
+// itself padded to a multiple of 64 bytes.
+func writeArrayEntry(zw *zip.Writer, off *offsetWriter, name string, buf *columnBuffer, stored bool) error {
+	if !stored {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		return buf.writeNpy(w)
+	}
+	// The entry's size and checksum go before its data, where the entry
+	// is aligned, rather than in a data descriptor after it, which would
+	// shift the next entry. They take a first pass over the array.
+	crc := crc32.NewIEEE()
+	sum := &offsetWriter{w: crc}
+	if err := buf.writeNpy(sum); err != nil {
+		return err
+	}
+	hdr := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc.Sum32(),
+		CompressedSize64:   uint64(sum.n),
+		UncompressedSize64: uint64(sum.n),
+	}
+	if err := alignEntry(zw, off, hdr); err != nil {
+		return err
+	}
+	w, err := zw.CreateRaw(hdr)
+	if err != nil {
+		return err
+	}
+	return buf.writeNpy(w)
+}
+
+// copyArrayEntry copies the zip entry of an array without decompressing
+// it, realigned if it is stored uncompressed.
+func copyArrayEntry(zw *zip.Writer, off *offsetWriter, f *zip.File) error {
+	if f.Method != zip.Store {
+		return zw.Copy(f)
+	}
+	hdr := f.FileHeader
+	// Without a data descriptor, like writeArrayEntry.
+	hdr.Flags &^= 0x8
+	if err := alignEntry(zw, off, &hdr); err != nil {
+		return err
+	}
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	w, err := zw.CreateRaw(&hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// alignEntry sets the extra field of an entry to padding that places its
+// data, after the 30-byte local file header and the name, on an
+// npyAlignment boundary.
+func alignEntry(zw *zip.Writer, off *offsetWriter, hdr *zip.FileHeader) error {
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+	start := off.n + 30 + int64(len(hdr.Name)) + 4
+	pad := (npyAlignment - start%npyAlignment) % npyAlignment
+	extra := make([]byte, 4+pad)
+	binary.LittleEndian.PutUint16(extra, alignmentExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], uint16(pad))
+	hdr.Extra = extra
+	return nil
+}
+
+// storedArrays reports whether the arrays of an archive are stored
+// uncompressed.
+func storedArrays(files []*zip.File) bool {
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, ".npy") {
+			return f.Method == zip.Store
+		}
+	}
+	return false
+}
+
+// storedNpz reports whether the arrays of the NPZ archive at path are
+// stored uncompressed.
+func storedNpz(path string) (bool, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	return storedArrays(r.File), nil
+}
+
+// npzLayout returns the layout of the arrays of the NPZ archive at path,
+// in the archive's order, or nil if its arrays are compressed.
+func npzLayout(path string) ([]ArrayLayout, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	if !storedArrays(zr.File) {
+		return nil, nil
+	}
+	r, err := npz.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var layout []ArrayLayout
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".npy") {
+			continue
+		}
+		if f.Method != zip.Store {
+			return nil, fmt.Errorf("array %s is compressed", f.Name)
+		}
+		hdr := r.Header(f.Name)
+		if hdr == nil {
+			return nil, fmt.Errorf("reading header of %q", f.Name)
+		}
+		start, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		headerLen, err := npyHeaderLen(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading header of %q: %w", f.Name, err)
+		}
+		a := ArrayLayout{
+			Name:   strings.TrimSuffix(f.Name, ".npy"),
+			Dtype:  hdr.Descr.Type,
+			Shape:  hdr.Descr.Shape,
+			Offset: start + headerLen,
+			Bytes:  int64(f.UncompressedSize64) - headerLen,
+		}
+		// C order: the last dimension is contiguous.
+		a.Strides = make([]int, len(a.Shape))
+		stride := dtypeItemSize(a.Dtype)
+		for i := len(a.Shape) - 1; i >= 0; i-- {
+			a.Strides[i] = stride
+			stride *= a.Shape[i]
+		}
+		a.Alignment = 1
+		for a.Alignment < 4096 && a.Offset%int64(2*a.Alignment) == 0 {
+			a.Alignment *= 2
+		}
+		layout = append(layout, a)
+	}
+	return layout, nil
+}
+
+// npyHeaderLen returns the length of the .npy header of a stored entry:
+// the magic string, version and header length, then the header.
+func npyHeaderLen(f *zip.File) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	var prefix [12]byte
+	if _, err := io.ReadFull(rc, prefix[:10]); err != nil {
+		return 0, err
+	}
+	if string(prefix[:6]) != "\x93NUMPY" {
+		return 0, fmt.Errorf("not a .npy file")
+	}
+	if prefix[6] == 1 {
+		return 10 + int64(binary.LittleEndian.Uint16(prefix[8:10])), nil
+	}
+	// Versions 2 and 3 have a 4-byte header length.
+	if _, err := io.ReadFull(rc, prefix[10:]); err != nil {
+		return 0, err
+	}
+	return 12 + int64(binary.LittleEndian.Uint32(prefix[8:12])), nil
+}
+
+// dtypeItemSize returns the size in bytes of an element of a dtype such as
+// <i8, |b1, <U12 or <M8[ns].
+func dtypeItemSize(dtype string) int {
+	if len(dtype) < 3 {
+		return 0
+	}
+	kind, size := dtype[1], dtype[2:]
+	if i := strings.IndexByte(size, '['); i >= 0 {
+		size = size[:i]
+	}
+	n, _ := strconv.Atoi(size)
+	if kind == 'U' {
+		// UTF-32 code points.
+		n *= 4
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policies for a table that reaches one of its limits, selected with
+// on_limit: keep the rows read so far as a partial export, or fail the
+// table.
+const (
+	onLimitPartial = "partial"
+	onLimitFail    = "fail"
+)
+
+// TableLimits cap the export of a single table, so that one runaway table
+// can't take up the whole run. Zero values are unlimited.
+type TableLimits struct {
+	MaxRows int `yaml:"max_rows" toml:"max_rows"`
+	// MaxBytes caps the bytes read from the source, as in the run report's
+	// source_bytes.
+	MaxBytes int64 `yaml:"max_bytes" toml:"max_bytes"`
+	// MaxDuration is a duration such as 30m. It is checked as batches
+	// arrive, so a single slow batch can overrun it.
+	MaxDuration string `yaml:"max_duration" toml:"max_duration"`
+	// OnLimit is partial (the default) or fail.
+	OnLimit string `yaml:"on_limit" toml:"on_limit"`
+}
+
+// validate checks the limits' values.
+func (l TableLimits) validate() error {
+	if l.MaxRows < 0 || l.MaxBytes < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	if l.MaxDuration != "" {
+		d, err := time.ParseDuration(l.MaxDuration)
+		if err != nil {
+			return fmt.Errorf("invalid max_duration: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid max_duration %s, expected a positive duration", l.MaxDuration)
+		}
+	}
+	switch l.OnLimit {
+	case "", onLimitPartial, onLimitFail:
+	default:
+		return fmt.Errorf("invalid on_limit %q, expected %s or %s", l.OnLimit, onLimitPartial, onLimitFail)
+	}
+	return nil
+}
+
+// override returns the limits with the values set in o replacing them.
+func (l TableLimits) override(o TableLimits) TableLimits {
+	if o.MaxRows != 0 {
+		l.MaxRows = o.MaxRows
+	}
+	if o.MaxBytes != 0 {
+		l.MaxBytes = o.MaxBytes
+	}
+	if o.MaxDuration != "" {
+		l.MaxDuration = o.MaxDuration
+	}
+	if o.OnLimit != "" {
+		l.OnLimit = o.OnLimit
+	}
+	return l
+}
+
+// limitError reports the limit a table reached.
+type limitError struct {
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+// tableLimiter enforces a table's limits on the batches streamed from the
+// source, and the limit of its sample.
+type tableLimiter struct {
+	limits      TableLimits
+	maxDuration time.Duration
+	rowLimit    int
+}
+
+func newTableLimiter(limits TableLimits, sample *SampleInfo) tableLimiter {
+	// Validated with the config.
+	d, _ := time.ParseDuration(limits.MaxDuration)
+	l := tableLimiter{limits: limits, maxDuration: d}
+	if sample != nil {
+		l.rowLimit = sample.Limit
+	}
+	return l
+}
+
+// admit counts a batch into the meter, cut short at the row limits, and
+// returns the rows to export with a *limitError once a limit is reached,
+// or errRowLimit once the sample's limit is.
+func (l tableLimiter) admit(rows []TableRow, m *usageMeter) ([]TableRow, error) {
+	var err error
+	if n := l.limits.MaxRows; n > 0 && m.usage.Rows+len(rows) > n && (l.rowLimit == 0 || n < l.rowLimit) {
+		rows = rows[:n-m.usage.Rows]
+		err = &limitError{fmt.Sprintf("exceeded max_rows %d", n)}
+	} else if n := l.rowLimit; n > 0 && m.usage.Rows+len(rows) >= n {
+		rows = rows[:n-m.usage.Rows]
+		err = errRowLimit
+	}
+	m.addRows(rows)
+	switch {
+	case err != nil:
+	case l.limits.MaxBytes > 0 && m.usage.SourceBytes > l.limits.MaxBytes:
+		err = &limitError{fmt.Sprintf("exceeded max_bytes %d", l.limits.MaxBytes)}
+	case l.maxDuration > 0 && time.Since(m.start) > l.maxDuration:
+		err = &limitError{fmt.Sprintf("exceeded max_duration %s", l.limits.MaxDuration)}
+	}
+	return rows, err
+}
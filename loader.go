@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// loaderName is the Python loader written with -emit-loader.
+	loaderName = "load_dataset.py"
+
+	// loaderTestsName is the pytest file written next to the loader.
+	loaderTestsName = "test_dataset.py"
+)
+
+// npyArray describes an array of a written NPZ archive as the generated
+// tests check it.
+type npyArray struct {
+	Name  string
+	Descr string
+	Shape string
+	// SHA256 is the checksum of the array's data, in C order.
+	SHA256 string
+	// Nulls is the number of true values of a null mask, -1 for arrays
+	// that aren't masks.
+	Nulls int
+}
+
+var (
+	npyDescrRe = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyShapeRe = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+// scanNpz reads the arrays of an NPZ archive, in the archive's order.
+func scanNpz(path string) ([]npyArray, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var arrays []npyArray
+	for _, f := range r.File {
+		name, ok := strings.CutSuffix(f.Name, ".npy")
+		if !ok || strings.HasPrefix(name, "__") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		arr, err := scanNpy(name, b)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		arrays = append(arrays, arr)
+	}
+	return arrays, nil
+}
+
+// scanNpy parses the header of a .npy file and checksums its data.
+func scanNpy(name string, b []byte) (npyArray, error) {
+	if len(b) < 10 || !bytes.HasPrefix(b, []byte("\x93NUMPY")) {
+		return npyArray{}, fmt.Errorf("not a .npy file")
+	}
+	var size, start int
+	switch b[6] {
+	case 1:
+		size, start = int(binary.LittleEndian.Uint16(b[8:10])), 10
+	case 2, 3:
+		if len(b) < 12 {
+			return npyArray{}, fmt.Errorf("truncated header")
+		}
+		size, start = int(binary.LittleEndian.Uint32(b[8:12])), 12
+	default:
+		return npyArray{}, fmt.Errorf("unsupported .npy version %d", b[6])
+	}
+	if start+size > len(b) {
+		return npyArray{}, fmt.Errorf("truncated header")
+	}
+	header, data := string(b[start:start+size]), b[start+size:]
+	descr, shape := npyDescrRe.FindStringSubmatch(header), npyShapeRe.FindStringSubmatch(header)
+	if descr == nil || shape == nil {
+		return npyArray{}, fmt.Errorf("header %q has no descr or shape", header)
+	}
+	if strings.Contains(header, "'fortran_order': True") {
+		return npyArray{}, fmt.Errorf("fortran ordered arrays are not supported")
+	}
+
+	sum := sha256.Sum256(data)
+	arr := npyArray{Name: name, Descr: descr[1], Shape: pyTuple(shape[1]), SHA256: hex.EncodeToString(sum[:]), Nulls: -1}
+	if strings.HasSuffix(name, maskSuffix) && strings.HasSuffix(arr.Descr, "b1") {
+		arr.Nulls = len(data) - bytes.Count(data, []byte{0})
+	}
+	return arr, nil
+}
+
+// pyTuple normalizes the dimensions of a .npy shape into a Python tuple.
+func pyTuple(dims string) string {
+	var parts []string
+	for _, d := range strings.Split(dims, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			parts = append(parts, d)
+		}
+	}
+	if len(parts) == 1 {
+		return "(" + parts[0] + ",)"
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// saveLoader writes load_dataset.py, which loads the exported tables, and
+// test_dataset.py, pytest tests checking the shape, dtype, checksum and
+// null count of every array of the NPZ files in the output directory, and
+// that every column in the metadata has its array. metadataPath is
+// relative to the output directory.
+func saveLoader(cfg ExportConfig, metadataPath string, metadata SchemaDetails) error {
+	paths, err := filepath.Glob(filepath.Join(cfg.OutDir, "*.npz"))
+	if err != nil {
+		return err
+	}
+	slices.Sort(paths)
+	files := make(map[string][]npyArray)
+	var names []string
+	for _, path := range paths {
+		arrays, err := scanNpz(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".npz")
+		files[name] = arrays
+		names = append(names, name)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `"""Loads the tables of the %s export.
+
+Generated by the exporter (version %s) with -emit-loader, next to the
+exported files. %s checks that the files are the ones written.
+"""
+import json
+import os
+
+import numpy as np
+import pandas as pd
+
+DATA_DIR = os.path.dirname(os.path.abspath(__file__))
+METADATA_PATH = os.path.join(DATA_DIR, %s)
+
+`, metadata.DatasetMetadata.DatasetName, ToolVersion, loaderTestsName, pyString(filepath.ToSlash(metadataPath)))
+	b.WriteString("# The NPZ files of the export, without their extension.\nFILES = [\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "    %s,\n", pyString(name))
+	}
+	b.WriteString(`]
+
+
+def load_metadata():
+    """Returns the dataset metadata and the metadata of every table."""
+    with open(METADATA_PATH) as f:
+        metadata = json.load(f)
+    if "schema" in metadata:
+        return metadata["dataset_metadata"], metadata["schema"]
+    # Split layout: the index points at one file per table.
+    tables = []
+    for entry in metadata["tables"]:
+        with open(os.path.join(DATA_DIR, entry["path"])) as f:
+            tables.append(json.load(f))
+    return metadata["dataset_metadata"], tables
+
+
+def load_arrays(name):
+    """Returns every array of an NPZ file by name, companion arrays included."""
+    with np.load(os.path.join(DATA_DIR, name + ".npz")) as npz:
+        return {key: npz[key] for key in npz.files if not key.startswith("__")}
+
+
+def load_table(name):
+    """Loads an NPZ file into pandas, decoding dictionary encoded and ragged columns and nulls."""
+    arrays = load_arrays(name)
+    columns = {}
+    for key, values in arrays.items():
+        if key.endswith(("__categories", "__offsets", "__mask")):
+            continue
+        if key + "__categories" in arrays:
+            values = pd.Categorical.from_codes(values, categories=arrays[key + "__categories"])
+        if key + "__offsets" in arrays:
+            offsets = arrays[key + "__offsets"]
+            values = [values[a:b] for a, b in zip(offsets[:-1], offsets[1:])]
+        if key + "__mask" in arrays:
+            values = pd.Series(values).convert_dtypes().mask(arrays[key + "__mask"])
+        columns[key] = values
+    # Keep the column order of the metadata for the files of a table.
+    _, schema = load_metadata()
+    fields = {t["table_or_collection_name"]: t["fields"] for t in schema}
+    order = [f["field_name"] for f in fields.get(name, []) if f["field_name"] in columns]
+    order += [key for key in columns if key not in order]
+    return pd.DataFrame(columns)[order]
+`)
+	if err := saveFile(filepath.Join(cfg.OutDir, loaderName), []byte(b.String())); err != nil {
+		return err
+	}
+
+	b.Reset()
+	fmt.Fprintf(&b, `"""Checks the files of the %s export against the arrays written.
+
+Generated by the exporter (version %s) with -emit-loader. Run it from
+the output directory with:
+
+    pytest %s
+"""
+import hashlib
+
+import numpy as np
+import pytest
+
+from load_dataset import FILES, load_arrays, load_metadata
+
+# The arrays of every NPZ file, with their dtype, shape and the SHA-256 of
+# their data in C order. Null masks also have their number of nulls.
+EXPECTED = {
+`, metadata.DatasetMetadata.DatasetName, ToolVersion, loaderTestsName)
+	for _, name := range names {
+		fmt.Fprintf(&b, "    %s: {\n", pyString(name))
+		for _, arr := range files[name] {
+			fmt.Fprintf(&b, "        %s: {\"dtype\": %s, \"shape\": %s, \"sha256\": %s", pyString(arr.Name), pyString(arr.Descr), arr.Shape, pyString(arr.SHA256))
+			if arr.Nulls >= 0 {
+				fmt.Fprintf(&b, ", \"nulls\": %d", arr.Nulls)
+			}
+			b.WriteString("},\n")
+		}
+		b.WriteString("    },\n")
+	}
+	b.WriteString(`}
+
+ARRAYS = [(name, key) for name in EXPECTED for key in EXPECTED[name]]
+MASKS = [(name, key) for name, key in ARRAYS if "nulls" in EXPECTED[name][key]]
+
+
+@pytest.fixture(scope="module")
+def arrays():
+    return {name: load_arrays(name) for name in FILES}
+
+
+@pytest.mark.parametrize("name", sorted(EXPECTED))
+def test_array_names(arrays, name):
+    assert sorted(arrays[name]) == sorted(EXPECTED[name])
+
+
+@pytest.mark.parametrize("name,key", ARRAYS)
+def test_shape_and_dtype(arrays, name, key):
+    values, want = arrays[name][key], EXPECTED[name][key]
+    assert values.dtype == np.dtype(want["dtype"])
+    assert values.shape == want["shape"]
+
+
+@pytest.mark.parametrize("name,key", MASKS)
+def test_null_count(arrays, name, key):
+    assert int(np.count_nonzero(arrays[name][key])) == EXPECTED[name][key]["nulls"]
+
+
+@pytest.mark.parametrize("name,key", ARRAYS)
+def test_checksum(arrays, name, key):
+    data = np.ascontiguousarray(arrays[name][key]).tobytes()
+    assert hashlib.sha256(data).hexdigest() == EXPECTED[name][key]["sha256"]
+
+
+def test_metadata_columns(arrays):
+    """Every column of an exported table in the metadata has its array."""
+    _, schema = load_metadata()
+    for table in schema:
+        name = table["table_or_collection_name"]
+        if name in arrays:
+            for field in table["fields"]:
+                assert field["field_name"] in arrays[name], f"{name}.{field['field_name']}"
+`)
+	return saveFile(filepath.Join(cfg.OutDir, loaderTestsName), []byte(b.String()))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoader(t *testing.T) {
+	dir := t.TempDir()
+	columns := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true},
+		{FieldName: "name", DataType: DataTypeString, IsNullable: true},
+	}
+	w := newNpzWriter(dir, "users", columns, spillConfig{Dir: t.TempDir()})
+	rows := []TableRow{{"id": int64(1), "name": "a"}, {"id": int64(2), "name": nil}, {"id": int64(3), "name": "c"}}
+	if err := w.writeRows(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.close(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	arrays, err := scanNpz(filepath.Join(dir, "users.npz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]byte, 24)
+	for i := range 3 {
+		binary.LittleEndian.PutUint64(ids[i*8:], uint64(i+1))
+	}
+	sum := sha256.Sum256(ids)
+	want := map[string]npyArray{
+		"id":         {Name: "id", Descr: "<i8", Shape: "(3,)", SHA256: hex.EncodeToString(sum[:]), Nulls: -1},
+		"name__mask": {Name: "name__mask", Shape: "(3,)", Nulls: 1},
+	}
+	for _, arr := range arrays {
+		w, ok := want[arr.Name]
+		if !ok {
+			continue
+		}
+		delete(want, arr.Name)
+		if arr.Shape != w.Shape || arr.Nulls != w.Nulls || (w.SHA256 != "" && (arr.SHA256 != w.SHA256 || arr.Descr != w.Descr)) {
+			t.Errorf("array %s = %+v, want %+v", arr.Name, arr, w)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("arrays %v not found in %+v", want, arrays)
+	}
+
+	cfg := ExportConfig{OutDir: dir}
+	if err := saveLoader(cfg, "metadata.json", SchemaDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	tests, err := os.ReadFile(filepath.Join(dir, loaderTestsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(tests), `"name__mask": {"dtype": "|b1", "shape": (3,), `) || !strings.Contains(string(tests), `"nulls": 1}`) {
+		t.Errorf("%s has no null count of name:\n%s", loaderTestsName, tests)
+	}
+
+	// The generated files must at least be valid Python.
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not found")
+	}
+	for _, name := range []string{loaderName, loaderTestsName} {
+		script := "import ast, sys; ast.parse(open(sys.argv[1]).read())"
+		if out, err := exec.Command(python, "-c", script, filepath.Join(dir, name)).CombinedOutput(); err != nil {
+			t.Errorf("%s is not valid Python: %v\n%s", name, err, out)
+		}
+	}
+}
@@ -1,68 +1,742 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"os"
-
-	_ "github.com/lib/pq" // Import the PostgreSQL driver
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func saveFile(filename string, data []byte) error {
 	return os.WriteFile(filename, data, 0644)
 }
 
-func saveMetadata(metadata SchemaDetails) {
+func saveMetadata(outDir string, metadata SchemaDetails) error {
 	b, err := json.Marshal(metadata)
 	if err != nil {
-		log.Fatalf("failed to marshal metadata: %v", err)
+		return fmt.Errorf("marshaling metadata: %w", err)
+	}
+	return saveFile(filepath.Join(outDir, "metadata.json"), b)
+}
+
+// MetadataIndex is the compact top-level document written in split
+// metadata mode, pointing at one metadata file per table.
+type MetadataIndex struct {
+	Header          *MetadataHeader      `json:"header,omitempty"`
+	DatasetMetadata DatasetMetadata      `json:"dataset_metadata"`
+	Tables          []MetadataIndexEntry `json:"tables"`
+}
+
+type MetadataIndexEntry struct {
+	TableName  string `json:"table_or_collection_name"`
+	Path       string `json:"path"`
+	FieldCount int    `json:"field_count"`
+}
+
+// writeMetadata writes the metadata in the given layout and returns the
+// path of its entry point relative to outDir.
+func writeMetadata(outDir, layout string, metadata SchemaDetails) (string, error) {
+	save := saveMetadata
+	if layout == metadataSplit {
+		save = saveSplitMetadata
+	}
+	if err := save(outDir, metadata); err != nil {
+		return "", err
+	}
+	return metadataPath(layout), nil
+}
+
+// metadataPath returns the path of the metadata's entry point relative to
+// the output directory.
+func metadataPath(layout string) string {
+	if layout == metadataSplit {
+		return filepath.Join(metadataDir, "index.json")
+	}
+	return "metadata.json"
+}
+
+const (
+	// Metadata layouts, selected with -metadata-layout.
+	metadataSingle = "single"
+	metadataSplit  = "split"
+
+	metadataDir = "metadata"
+)
+
+// saveSplitMetadata writes metadata/<table>.json for every table plus a
+// metadata/index.json listing them. Index paths are relative to outDir.
+func saveSplitMetadata(outDir string, metadata SchemaDetails) error {
+	if err := os.MkdirAll(filepath.Join(outDir, metadataDir), 0755); err != nil {
+		return fmt.Errorf("creating metadata directory: %w", err)
+	}
+
+	index := MetadataIndex{Header: metadata.Header, DatasetMetadata: metadata.DatasetMetadata}
+	for _, table := range metadata.Tables {
+		b, err := json.Marshal(table)
+		if err != nil {
+			return fmt.Errorf("marshaling metadata for table %s: %w", table.TableName, err)
+		}
+
+		path := filepath.Join(metadataDir, table.TableName+".json")
+		if err := saveFile(filepath.Join(outDir, path), b); err != nil {
+			return fmt.Errorf("saving metadata for table %s: %w", table.TableName, err)
+		}
+
+		index.Tables = append(index.Tables, MetadataIndexEntry{
+			TableName:  table.TableName,
+			Path:       path,
+			FieldCount: len(table.Fields),
+		})
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata index: %w", err)
+	}
+	return saveFile(filepath.Join(outDir, metadataDir, "index.json"), b)
+}
+
+// EmbeddedMetadata is stored as __metadata__.json inside each table's NPZ
+// with -embed-metadata, so the archive is self-describing.
+type EmbeddedMetadata struct {
+	ToolVersion     string          `json:"tool_version"`
+	DatasetMetadata DatasetMetadata `json:"dataset_metadata"`
+	Table           TableMetadata   `json:"table"`
+	RowCount        int             `json:"row_count"`
+}
+
+const (
+	// Handling of tables without rows or columns, selected with
+	// -empty-tables: write empty typed arrays or skip the table with a note
+	// in the metadata.
+	emptyTablesWrite = "write"
+	emptyTablesSkip  = "skip"
+)
+
+const embeddedMetadataName = "__metadata__.json"
+
+// embeddedMetadataFiles returns the extra archive entries for a table.
+func embeddedMetadataFiles(dataset DatasetMetadata, table TableData, rowCount int) (map[string][]byte, error) {
+	b, err := json.Marshal(EmbeddedMetadata{
+		ToolVersion:     ToolVersion,
+		DatasetMetadata: dataset,
+		Table:           TableMetadata{TableName: table.TableName, Fields: table.Columns},
+		RowCount:        rowCount,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling embedded metadata for table %s: %w", table.TableName, err)
 	}
+	return map[string][]byte{embeddedMetadataName: b}, nil
+}
 
-	// TODO: add header to metadata file
+// interruptContext returns a context canceled by the first SIGINT or
+// SIGTERM, which stops the export after the batches in flight. A second
+// signal exits right away.
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Printf("Interrupted, stopping the export; interrupt again to exit immediately")
+	}()
+	return ctx
+}
 
-	err = saveFile("metadata.json", b)
+func saveProvenance(outDir string, prov Provenance) error {
+	b, err := json.MarshalIndent(prov, "", "  ")
 	if err != nil {
-		log.Fatalf("failed to save metadata: %v", err)
+		return fmt.Errorf("marshaling provenance: %w", err)
 	}
+	return saveFile(filepath.Join(outDir, "provenance.json"), b)
+}
+
+// exitFailed is the exit code of a run that failed.
+const exitFailed = 1
+
+// failf logs why a run failed and returns exitFailed, for run to return
+// once its deferred cleanup ran, where log.Fatalf would skip it.
+func failf(format string, args ...interface{}) int {
+	log.Printf(format, args...)
+	return exitFailed
 }
 
 func main() {
-	db, err := connectToDB()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "drift":
+			runDrift(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "convert":
+			runConvert(os.Args[2:])
+			return
+		case "merge":
+			runMerge(os.Args[2:])
+			return
+		case "append-column":
+			runAppendColumn(os.Args[2:])
+			return
+		case "upload":
+			runUpload(os.Args[2:])
+			return
+		}
+	}
+
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs an export with the given flags and returns the exit code,
+// after its deferred cleanup: the temporary directory is removed and the
+// source closed however the export ends.
+func run(args []string) int {
+	opts, err := parseExportFlags(args)
 	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
+		return failf("invalid arguments: %v", err)
+	}
+
+	var features map[string][]string
+	if opts.FeatureSpec != "" {
+		if features, err = loadFeatureSpec(opts.FeatureSpec); err != nil {
+			return failf("failed to load feature spec: %v", err)
+		}
+	}
+
+	cfg := opts.Export
+	if err := cfg.Resources.apply(); err != nil {
+		return failf("failed to apply the resource limits: %v", err)
+	}
+	if err := os.MkdirAll(cfg.OutDir, 0755); err != nil {
+		return failf("failed to create output directory: %v", err)
+	}
+	for _, out := range cfg.Outputs {
+		if err := os.MkdirAll(out.OutDir, 0755); err != nil {
+			return failf("failed to create output directory: %v", err)
+		}
+		log.Printf("Also writing %s files to %s", out.Format, out.OutDir)
 	}
-	defer db.Close()
 
-	selectedTables := []string{"users", "user_sessions", "tools"}
-	metadata, err := fetchMetadata(db, "centrum_db_dev", selectedTables)
+	// Spill files of this run live in their own directory, removed at exit.
+	tempDir, err := os.MkdirTemp(opts.TempDir, "npz-export-*")
 	if err != nil {
-		log.Fatalf("failed to build metadata: %v", err)
+		return failf("failed to create temporary directory: %v", err)
 	}
+	defer os.RemoveAll(tempDir)
+	spill := spillConfig{Dir: tempDir, Threshold: opts.SpillThresholdMB << 20}
 
-	saveMetadata(metadata)
+	var key hashKey
+	if cfg.hashesColumns() {
+		if key, err = loadHashKey(); err != nil {
+			return failf("failed to load hash key: %v", err)
+		}
+		if os.Getenv(envHashKey) == "" {
+			if cfg.Reproducible {
+				return failf("-reproducible needs %s to hash columns the same way every run", envHashKey)
+			}
+			log.Printf("%s not set, hashed columns only join within this run", envHashKey)
+		}
+	}
 
-	for _, table := range metadata.Tables {
+	var rates map[string]float64
+	if cfg.normalizesMoney() {
+		if rates, err = loadRates(cfg.Currency); err != nil {
+			return failf("failed to load exchange rates: %v", err)
+		}
+	}
+
+	handlePauseSignals()
+	ctx, stopExport := context.WithCancelCause(interruptContext())
+	defer stopExport(nil)
+
+	var dims map[string]*dimension
+	if len(cfg.Dimensions) > 0 {
+		if dims, err = loadDimensions(ctx, cfg); err != nil {
+			return failf("failed to load dimensions: %v", err)
+		}
+	}
+	if opts.PauseAPIAddr != "" {
+		servePauseAPI(opts.PauseAPIAddr)
+	}
+
+	src, err := openSource(ctx, cfg)
+	if err != nil {
+		return failf("failed to connect to database: %v", err)
+	}
+	defer src.Close()
+	if r, ok := src.(pauseReleaser); ok {
+		exportPause.register(r)
+	}
+
+	var snapshot *SnapshotInfo
+	if opts.Snapshot {
+		ss, ok := src.(snapshotSource)
+		if !ok {
+			return failf("-snapshot is not supported by the %s source", cfg.Connection.Source)
+		}
+		info, err := ss.BeginSnapshot(ctx)
+		if err != nil {
+			return failf("failed to begin snapshot: %v", err)
+		}
+		snapshot = &info
+		log.Printf("Exporting from the snapshot at LSN %s", info.LSN)
+	}
+
+	if opts.FastCopy {
+		fc, ok := src.(fastCopySource)
+		if !ok {
+			return failf("-fast-copy is not supported by the %s source", cfg.Connection.Source)
+		}
+		if err := fc.EnableFastCopy(); err != nil {
+			return failf("failed to enable -fast-copy: %v", err)
+		}
+	}
+
+	if lister, ok := src.(tableLister); ok {
+		existing, err := lister.ListTables(ctx)
+		if err != nil {
+			return failf("failed to list tables: %v", err)
+		}
+		renamed, err := resolveTableNames(&opts.Export, existing)
+		if err != nil {
+			return failf("failed to match table names: %v", err)
+		}
+		// Everything else refers to the tables by their names in the source.
+		for old, name := range renamed {
+			if columns, ok := opts.PatchColumns[old]; ok {
+				delete(opts.PatchColumns, old)
+				opts.PatchColumns[name] = columns
+			}
+			if columns, ok := features[old]; ok {
+				delete(features, old)
+				features[name] = columns
+			}
+		}
+		cfg = opts.Export
+	}
+
+	if opts.FollowFKs {
+		fl, ok := src.(foreignKeyLister)
+		if !ok {
+			return failf("-follow-fks is not supported by the %s source", cfg.Connection.Source)
+		}
+		fks, err := fl.ForeignKeys(ctx)
+		if err != nil {
+			return failf("failed to list foreign keys: %v", err)
+		}
+		if added := followForeignKeys(&opts.Export, referencedTables(fks), opts.FKDepth); len(added) > 0 {
+			log.Printf("Following foreign keys to tables %v", added)
+		}
+		cfg = opts.Export
+	}
+
+	if cfg.denormalizes() {
+		fl, ok := src.(foreignKeyLister)
+		if !ok {
+			return failf("denormalize is not supported by the %s source", cfg.Connection.Source)
+		}
+		fks, err := fl.ForeignKeys(ctx)
+		if err != nil {
+			return failf("failed to list foreign keys: %v", err)
+		}
+		added, err := denormalize(&opts.Export, fks)
+		if err != nil {
+			return failf("failed to denormalize: %v", err)
+		}
+		cfg = opts.Export
+		// The referenced tables are read into memory like any dimension.
+		loaded, err := loadDimensions(ctx, ExportConfig{Dimensions: added, Params: cfg.Params, BatchSize: cfg.BatchSize, SampleSize: cfg.SampleSize})
+		if err != nil {
+			return failf("failed to load dimensions: %v", err)
+		}
+		if dims == nil {
+			dims = make(map[string]*dimension)
+		}
+		maps.Copy(dims, loaded)
+	}
+
+	selectedTables := append(cfg.tableNames(), cfg.queryNames()...)
+	metadata, err := src.FetchMetadata(ctx, cfg)
+	if err != nil {
+		return failf("failed to build metadata: %v", err)
+	}
+	metadata.DatasetMetadata.Snapshot = snapshot
+	for i, table := range metadata.Tables {
+		metadata.Tables[i].Sample = cfg.sampleInfo(table)
+	}
+	if cfg.Vocabulary != "" {
+		vocab, err := loadVocabularies(cfg.Vocabulary)
+		if err != nil {
+			return failf("failed to load the vocabulary: %v", err)
+		}
+		useVocabularies(cfg, metadata.Tables, vocab)
+	}
+	if cfg.Scaling != "" {
+		scalings, err := loadScalings(cfg.Scaling)
+		if err != nil {
+			return failf("failed to load the scaling parameters: %v", err)
+		}
+		useScalings(cfg, metadata.Tables, scalings)
+	}
+	if features != nil {
+		metadata.Tables = pruneToFeatures(&opts.Export, metadata.Tables, features)
+		cfg = opts.Export
+	}
+
+	partitions, err := loadPartitions(cfg.OutDir)
+	if err != nil {
+		return failf("failed to load the partitions manifest: %v", err)
+	}
+	var hotCold *hotColdPlan
+	metadata.Tables, hotCold, err = splitHotColdTables(cfg, metadata.Tables, partitions, time.Now().UTC(), opts.PatchColumns != nil)
+	if err != nil {
+		return failf("failed to split hot/cold tables: %v", err)
+	}
+
+	var approved map[string]TableMetadata
+	if opts.ReuseMetadata != "" {
+		if approved, err = loadApprovedSchema(opts.ReuseMetadata); err != nil {
+			return failf("failed to load approved metadata: %v", err)
+		}
+		if metadata.Tables, err = checkApprovedSchema(metadata.Tables, approved, cfg, rates, dims, key); err != nil {
+			return failf("live schema no longer matches %s:\n%v", opts.ReuseMetadata, err)
+		}
+	}
+
+	// Export referenced tables before the tables pointing at them, and
+	// higher priorities first.
+	var cyclic []string
+	metadata.Tables, cyclic = sortTablesByForeignKeys(metadata.Tables, cfg.priorities())
+	if len(cyclic) > 0 {
+		log.Printf("foreign key cycle involving tables %v, exporting them in name order", cyclic)
+	}
+
+	var state incrementalState
+	if opts.Incremental != "" {
+		if state, err = loadIncrementalState(opts.Incremental); err != nil {
+			return failf("failed to load incremental state: %v", err)
+		}
+		for i, table := range metadata.Tables {
+			if metadata.Tables[i].Watermark, err = incrementalRange(state, cfg, table); err != nil {
+				return failf("failed to plan incremental export: %v", err)
+			}
+		}
+	}
+
+	for i, table := range metadata.Tables {
+		metadata.Tables[i].RowOrder = cfg.rowOrder(table)
+	}
+
+	var tables []TableMetadata
+	var indexes []int
+	for i, table := range metadata.Tables {
 		tableNotAskedFor := true
 		for _, t := range selectedTables {
-			if t == table.TableName {
+			if t == table.TableName || t == table.SourceTable {
 				tableNotAskedFor = false
 				break
 			}
 		}
 
-		if tableNotAskedFor {
+		// Kept cold partitions are only patched.
+		if tableNotAskedFor || (hotCold.kept[table.TableName] && opts.PatchColumns == nil) {
 			continue
 		}
+		tables = append(tables, table)
+		indexes = append(indexes, i)
+	}
 
-		tableData, err := FetchTableData(db, table)
+	if opts.SchemaOnly {
+		if opts.SchemaStats {
+			stats, ok := src.(schemaStatsSource)
+			if !ok {
+				return failf("-schema-stats is not supported by the %s source", cfg.Connection.Source)
+			}
+			if err := stats.FetchSchemaStats(ctx, metadata.Tables); err != nil {
+				return failf("failed to fetch schema statistics: %v", err)
+			}
+		}
+		if opts.Anonymize {
+			if key, err = loadHashKey(); err != nil {
+				return failf("failed to load hash key: %v", err)
+			}
+			if os.Getenv(envHashKey) == "" {
+				log.Printf("%s not set, the pseudonyms are only stable within this run", envHashKey)
+			}
+			metadata = anonymizeSchema(metadata, key)
+		}
+		if metadata.Header, err = buildMetadataHeader(cfg, metadata, nil, time.Now().UTC()); err != nil {
+			return failf("failed to build the metadata header: %v", err)
+		}
+		if opts.Anonymize {
+			metadata.Header.SourceHost = ""
+		}
+		path, err := writeMetadata(cfg.OutDir, opts.MetadataLayout, metadata)
 		if err != nil {
-			log.Fatalf("failed to fetch table data: %v", err)
+			return failf("failed to save metadata: %v", err)
+		}
+		log.Printf("Wrote the schema of %d tables to %s", len(metadata.Tables), filepath.Join(cfg.OutDir, path))
+		return 0
+	}
+
+	var monitor *diskMonitor
+	if opts.MinFreeDiskMB > 0 {
+		minFree := uint64(opts.MinFreeDiskMB) << 20
+		if err := checkDiskSpace([]string{cfg.OutDir, tempDir}, minFree); err != nil {
+			return failf("not enough disk space for the export: %v", err)
+		}
+		// The estimate can't tell how many rows filters and watermarks
+		// leave or how well the files compress, so it only warns. Patches
+		// rewrite a few columns of the files, not whole tables.
+		if estimate, ok := estimatedExportBytes(tables); ok && opts.PatchColumns == nil {
+			log.Printf("The exported columns take about %d MB uncompressed", estimate>>20)
+			if err := checkDiskSpace([]string{cfg.OutDir}, minFree+estimate); err != nil {
+				log.Printf("The export may not fit: %v", err)
+			}
+		}
+		monitor = startDiskMonitor([]string{cfg.OutDir, tempDir}, minFree, opts.OnLowDisk, stopExport)
+	}
+
+	if opts.PatchColumns != nil {
+		err := patchExport(ctx, opts, src, tables, spill, rates, dims, key)
+		monitor.Stop()
+		if err != nil {
+			return failf("failed to patch the export: %v", err)
+		}
+		return 0
+	}
+
+	// Checkpoints of an earlier run are only used with -resume.
+	checkpoints := filepath.Join(cfg.OutDir, checkpointDir)
+	if !opts.Resume {
+		if err := os.RemoveAll(checkpoints); err != nil {
+			return failf("failed to remove old checkpoints: %v", err)
+		}
+	}
+
+	report := RunReport{ToolVersion: ToolVersion, StartedAt: time.Now().UTC()}
+	runMeter := startUsageMeter("*")
+	var tableSource exportSource = src
+	if opts.CacheDir != "" {
+		if tableSource, err = newCachedSource(src, opts.CacheDir, opts.CacheTTL, cfg, snapshot); err != nil {
+			return failf("failed to open the cache: %v", err)
+		}
+	}
+	exporter := &tableExporter{
+		opts:         opts,
+		src:          tableSource,
+		dataset:      metadata.DatasetMetadata,
+		spill:        spill,
+		rates:        rates,
+		dims:         dims,
+		key:          key,
+		approved:     approved,
+		dictionaries: newSharedDictionaries(),
+	}
+	if cfg.ProfileBudget != "" {
+		// Validated with the config.
+		d, _ := time.ParseDuration(cfg.ProfileBudget)
+		exporter.profiles = newProfileBudget(d, len(tables))
+	}
+	progress := startProgressRecorder(filepath.Join(cfg.OutDir, progressFile), opts.ProgressInterval)
+	results := exporter.exportTables(ctx, tables, opts.Concurrency)
+	progress.Stop()
+	monitor.Stop()
+	if ctx.Err() != nil {
+		// The metadata, report and state describe complete exports only;
+		// the checkpoints are kept for -resume.
+		var lowDisk *lowDiskError
+		if errors.As(context.Cause(ctx), &lowDisk) {
+			return failf("export stopped, low disk space: %v", lowDisk)
+		}
+		return failf("export interrupted")
+	}
+
+	rowCounts := make(map[string]int)
+	written := make(map[string]*TableMetadata)
+	grouped := make(map[string][]plannedGroup)
+	split := make(map[string]tableSplits)
+	for j, r := range results {
+		i := indexes[j]
+		metadata.Tables[i].Fields = r.columns
+		metadata.Tables[i].Note = r.note
+		if r.written {
+			rowCounts[tables[j].TableName] = r.usage.Rows
+			written[tables[j].TableName] = &metadata.Tables[i]
+			// The layouts of column groups and splits are read for each of them.
+			if cfg.NPZCompression == npzCompressionNone && r.groups == nil && r.splits == nil {
+				layout, err := npzLayout(cfg.outputPath(tables[j].TableName))
+				if err != nil {
+					return failf("failed to read the array layout of table %s: %v", tables[j].TableName, err)
+				}
+				metadata.Tables[i].Arrays = layout
+			}
+			metadata.Tables[i].Chunks = r.chunks
+			if r.groups != nil {
+				grouped[tables[j].TableName] = r.groups
+			}
+			if r.splits != nil {
+				split[tables[j].TableName] = *r.splits
+			}
 		}
+		if w := metadata.Tables[i].Watermark; w != nil && r.written && r.watermark != nil {
+			w.Through = r.watermark
+			if err := state.set(tables[j].TableName, watermarkField(tables[j]), r.watermark); err != nil {
+				return failf("failed to record the watermark of table %s: %v", tables[j].TableName, err)
+			}
+		}
+		report.add(r.usage)
+	}
+	// Tables exported concurrently share the network and the clock, so the
+	// totals are measured over the whole run.
+	total := runMeter.finish("")
+	report.Totals.NetworkBytesRead = total.NetworkBytesRead
+	report.Totals.NetworkBytesWritten = total.NetworkBytesWritten
+	report.Totals.DurationSeconds = total.DurationSeconds
 
-		saveTableToNumpy(*tableData)
+	report.Skipped = skippedTables(tables, results)
+	if len(grouped) > 0 {
+		if metadata.Tables, err = expandColumnGroups(cfg, metadata.Tables, grouped, rowCounts, written); err != nil {
+			return failf("failed to describe the column groups: %v", err)
+		}
+	}
+	if len(split) > 0 {
+		if metadata.Tables, err = expandSplits(cfg, metadata.Tables, split, rowCounts, written); err != nil {
+			return failf("failed to describe the splits: %v", err)
+		}
+	}
+	if len(hotCold.kept) > 0 {
+		if previous, err := readMetadata(filepath.Join(cfg.OutDir, metadataPath(opts.MetadataLayout))); err == nil {
+			hotCold.keepMetadata(metadata.Tables, previous)
+		} else {
+			log.Printf("failed to read the metadata of the kept cold partitions: %v", err)
+		}
+	}
+	if cfg.Reproducible && cfg.Sink.Exec == "" {
+		for name, table := range written {
+			if table.Checksums, err = fileChecksums(cfg, name); err != nil {
+				return failf("failed to checksum table %s: %v", name, err)
+			}
+		}
+	}
+	report.Checks = runChecks(cfg, written)
+	if cfg.Health != nil {
+		if report.Health, err = evaluateHealth(cfg, report); err != nil {
+			return failf("failed to evaluate the export's health: %v", err)
+		}
+	}
+	if len(report.Skipped) == 0 {
+		os.RemoveAll(checkpoints)
+	}
+	report.FinishedAt = time.Now().UTC()
+	if err := saveRunReport(cfg.OutDir, report); err != nil {
+		return failf("failed to save run report: %v", err)
 	}
 
+	headerRows := make(map[string]int, len(rowCounts))
+	for table, rows := range rowCounts {
+		headerRows[table] = rows
+	}
+	for _, entry := range hotCold.planned {
+		if hotCold.kept[entry.Cold.Table] {
+			headerRows[entry.Cold.Table] = entry.Cold.Rows
+		}
+	}
+	if metadata.Header, err = buildMetadataHeader(cfg, metadata, headerRows, report.StartedAt); err != nil {
+		return failf("failed to build the metadata header: %v", err)
+	}
+	metadataPath, err := writeMetadata(cfg.OutDir, opts.MetadataLayout, metadata)
 	if err != nil {
-		log.Fatalf("failed to fetch table data: %v", err)
+		return failf("failed to save metadata: %v", err)
+	}
+	if cfg.Profile {
+		if err := saveProfiles(cfg.OutDir, metadata.Tables, headerRows); err != nil {
+			return failf("failed to save column profiles: %v", err)
+		}
+	}
+	if err := saveVocabularies(cfg.OutDir, metadata.Tables); err != nil {
+		return failf("failed to save the vocabulary: %v", err)
+	}
+	if err := saveScalings(cfg.OutDir, metadata.Tables); err != nil {
+		return failf("failed to save the scaling parameters: %v", err)
+	}
+	if err := exporter.dictionaries.save(cfg.OutDir); err != nil {
+		return failf("failed to save the shared dictionaries: %v", err)
+	}
+
+	if len(hotCold.planned) > 0 {
+		hotCold.record(written, rowCounts, report.StartedAt)
+		if err := savePartitions(cfg.OutDir, hotCold.manifest); err != nil {
+			return failf("failed to save the partitions manifest: %v", err)
+		}
+	}
+
+	// The state only moves on once the export it describes is complete.
+	if opts.Incremental != "" {
+		if err := state.save(opts.Incremental); err != nil {
+			return failf("failed to save incremental state: %v", err)
+		}
+	}
+
+	if opts.EmitNotebook {
+		if err := saveNotebook(cfg, metadataPath, metadata); err != nil {
+			return failf("failed to save notebook: %v", err)
+		}
+	}
+	if opts.EmitLoader {
+		if err := saveLoader(cfg, metadataPath, metadata); err != nil {
+			return failf("failed to save loader: %v", err)
+		}
+	}
+
+	prov, err := buildProvenance(cfg, opts.ConfigPath, metadata)
+	if err != nil {
+		return failf("failed to build provenance: %v", err)
+	}
+	if err := saveProvenance(cfg.OutDir, prov); err != nil {
+		return failf("failed to save provenance: %v", err)
+	}
+	if err := saveDatasetReadme(cfg, metadataPath, metadata, prov, opts.EmitNotebook); err != nil {
+		return failf("failed to save the dataset README: %v", err)
+	}
+
+	if gmsURL := os.Getenv(envDataHubURL); gmsURL != "" {
+		if err := pushToDataHub(gmsURL, os.Getenv(envDataHubToken), cfg, metadata, rowCounts); err != nil {
+			log.Printf("failed to push metadata to DataHub: %v", err)
+		} else {
+			log.Printf("Pushed metadata for %d tables to DataHub", len(metadata.Tables))
+		}
+	}
+
+	if len(report.Skipped) > 0 {
+		var sb strings.Builder
+		for _, s := range report.Skipped {
+			fmt.Fprintf(&sb, "\n  %s (%d attempts): %s", s.Table, s.Attempts, s.Error)
+		}
+		log.Printf("Skipped %d of %d tables:%s", len(report.Skipped), len(tables), sb.String())
+	}
+	if len(tables) > 0 && len(report.Skipped) == len(tables) {
+		return failf("failed to export any table")
+	}
+	if report.Health != nil {
+		logHealth(report.Health)
+		if report.Health.Status == healthFail {
+			return exitUnhealthy
+		}
+	}
+	// Only healthy exports are uploaded.
+	if upload := cfg.Sink.Upload; upload != nil {
+		if err := uploadExport(ctx, *upload, cfg.OutDir); err != nil {
+			return failf("failed to upload the export: %v; run `%s` to resume", err, upload.command(cfg.OutDir))
+		}
 	}
+	return 0
 }
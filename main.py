@@ -1,4 +1,5 @@
 import os
+import sys
 import numpy as np
 import pandas as pd
 
@@ -29,7 +30,8 @@ npz_files = [
     "world_model_data_source_configuration.npz",
 ]
 
-folder = "data"
+# Export directory, matching the Go writer's -out flag.
+folder = sys.argv[1] if len(sys.argv) > 1 else "data"
 
 for file_name in npz_files:
     file_path = os.path.join(folder, file_name)
@@ -38,7 +40,34 @@ for file_name in npz_files:
         with np.load(file_path) as npz_data:
             # Create a dictionary from the NPZ file.
             # npz_data.files gives you the list of keys stored in the file.
-            data_dict = {key: npz_data[key] for key in npz_data.files}
+            data_dict = {}
+            for key in npz_data.files:
+                # Skip companion arrays and reserved entries such as an
+                # embedded __metadata__.json.
+                if key.startswith("__") or key.endswith(("__categories", "__offsets", "__mask", "__low")):
+                    continue
+                values = npz_data[key]
+                # Dictionary encoded columns store int codes plus a
+                # <col>__categories lookup array.
+                categories_key = key + "__categories"
+                if categories_key in npz_data.files:
+                    values = pd.Categorical.from_codes(
+                        values, categories=npz_data[categories_key]
+                    )
+                # Ragged array columns store the elements of all rows plus
+                # a <col>__offsets array of row ends after a leading 0.
+                # Binary columns are ragged uint8 arrays of their bytes.
+                offsets_key = key + "__offsets"
+                if offsets_key in npz_data.files:
+                    offsets = npz_data[offsets_key]
+                    values = [values[a:b] for a, b in zip(offsets[:-1], offsets[1:])]
+                    if npz_data[key].dtype == np.uint8:
+                        values = [v.tobytes() for v in values]
+                # Nulls are stored as zero values; <col>__mask marks them.
+                mask_key = key + "__mask"
+                if mask_key in npz_data.files:
+                    values = pd.Series(values).convert_dtypes().mask(npz_data[mask_key])
+                data_dict[key] = values
             
             # Create a DataFrame from the dictionary.
             df = pd.DataFrame(data_dict)
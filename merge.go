@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// runMerge implements the `merge` command:
+//
+//	merge -o <out.npz> <part.npz>...
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("o", "", "path of the merged NPZ file")
+	fs.Parse(args)
+
+	if *out == "" || fs.NArg() == 0 {
+		log.Fatalf("usage: merge -o <out.npz> <part.npz>...")
+	}
+	rows, err := mergeNpz(context.Background(), *out, fs.Args())
+	if err != nil {
+		log.Fatalf("failed to merge: %v", err)
+	}
+	log.Printf("Merged %d files with %d rows into %s", fs.NArg(), rows, *out)
+}
+
+// mergeNpz concatenates the arrays of NPZ files of the same table, in the
+// given order, into one archive at out and returns its number of rows.
+// Every part must have the same arrays with the same dtypes. Dictionary
+// encoded columns are re-encoded against the union of the parts'
+// categories, as are shared dictionary encoded ones, read with the
+// dictionaries next to each part, so the merged archive holds its own
+// categories. The offsets of ragged columns are shifted past the values of
+// the previous parts, and the embedded __metadata__.json of the last part
+// having one is kept with its row count updated. A null mask missing from
+// some parts means their values are all present. Canceling ctx stops the
+// merge between arrays.
+func mergeNpz(ctx context.Context, out string, parts []string) (int, error) {
+	readers := make([]*npz.Reader, len(parts))
+	for i, path := range parts {
+		r, err := npz.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		readers[i] = r
+	}
+
+	names := withoutMasks(npzColumnNames(readers[0]))
+	dtypes := make(map[string]string)
+	for _, name := range names {
+		dtypes[name] = npzDtype(readers[0], name)
+	}
+	for i, r := range readers[1:] {
+		other := withoutMasks(npzColumnNames(r))
+		if len(other) != len(names) {
+			return 0, fmt.Errorf("%s has %d arrays, %s has %d", parts[i+1], len(other), parts[0], len(names))
+		}
+		for _, name := range other {
+			want, ok := dtypes[name]
+			if !ok {
+				return 0, fmt.Errorf("%s has array %s, which %s lacks", parts[i+1], name, parts[0])
+			}
+			// String arrays of the parts can differ in width.
+			got := npzDtype(r, name)
+			if got != want && !(strings.HasPrefix(got, "<U") && strings.HasPrefix(want, "<U")) {
+				return 0, fmt.Errorf("array %s is %s in %s but %s in %s", name, got, parts[i+1], want, parts[0])
+			}
+		}
+	}
+
+	set := newSpillSet(spillConfig{})
+	defer set.close()
+	arrays := make(map[string]*columnBuffer)
+	rows := -1
+	for _, name := range names {
+		if strings.HasSuffix(name, categoriesSuffix) || strings.HasSuffix(name, dictionarySuffix) || strings.HasSuffix(name, offsetsSuffix) {
+			continue
+		}
+		shared := dtypes[name+dictionarySuffix] != ""
+		dictionary := dtypes[name+categoriesSuffix] != "" || shared
+		kind := npzKind(dtypes[name])
+		if dictionary {
+			kind = kindInt32
+		}
+		buf := set.newBuffer(name, kind)
+		arrays[name] = buf
+		dict := newDictionaryBuilder()
+		if dictionary && !shared {
+			// Keep the codes of the first part, and with them the order of
+			// an enum column's categories.
+			categories, err := readNpzColumn(readers[0], name+categoriesSuffix)
+			if err != nil {
+				return 0, fmt.Errorf("reading %s from %s: %w", name+categoriesSuffix, parts[0], err)
+			}
+			dict = newDictionaryBuilder(stringValues(categories)...)
+		}
+
+		var offsets *columnBuffer
+		if dtypes[name+offsetsSuffix] != "" {
+			offsets = set.newBuffer(name+offsetsSuffix, kindInt64)
+			offsets.appendInt64(0)
+			arrays[name+offsetsSuffix] = offsets
+		}
+
+		var mask *columnBuffer
+		for _, r := range readers {
+			if mask == nil && npzDtype(r, name+maskSuffix) != "" {
+				mask = set.newBuffer(name+maskSuffix, kindBool)
+				arrays[name+maskSuffix] = mask
+			}
+		}
+
+		n := 0
+		for i, r := range readers {
+			partRows := 0
+			if offsets != nil {
+				// The values of earlier parts precede this part's values.
+				base := int64(buf.count)
+				column, err := readNpzColumn(r, name+offsetsSuffix)
+				if err != nil {
+					return 0, fmt.Errorf("reading %s from %s: %w", name+offsetsSuffix, parts[i], err)
+				}
+				ends, _ := column.([]int64)
+				for _, end := range ends[min(1, len(ends)):] {
+					offsets.appendInt64(base + end)
+				}
+				partRows = max(len(ends)-1, 0)
+			}
+			var column interface{}
+			var err error
+			if dictionary {
+				column, err = readDecodedColumn(r, filepath.Dir(parts[i]), name)
+			} else {
+				column, err = readNpzColumn(r, name)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("reading %s from %s: %w", name, parts[i], err)
+			}
+			rv := reflect.ValueOf(column)
+			for j := 0; j < rv.Len(); j++ {
+				switch v := rv.Index(j).Interface().(type) {
+				case string:
+					if dictionary {
+						buf.appendInt32(dict.code(v))
+					} else {
+						buf.appendString(v)
+					}
+				case int64:
+					buf.appendInt64(v)
+				case int32:
+					buf.appendInt32(v)
+				case float64:
+					buf.appendFloat64(v)
+				case bool:
+					buf.appendBool(v)
+				case uint8:
+					buf.appendBytes([]byte{v})
+				case time.Time:
+					buf.appendTime(v)
+				case time.Duration:
+					buf.appendInt64(int64(v))
+				default:
+					return 0, fmt.Errorf("unsupported element type %T of %s", v, name)
+				}
+			}
+			if offsets == nil {
+				partRows = rv.Len()
+			}
+			n += partRows
+
+			if mask != nil {
+				if err := appendPartMask(mask, r, name, partRows); err != nil {
+					return 0, fmt.Errorf("reading %s from %s: %w", name+maskSuffix, parts[i], err)
+				}
+			}
+		}
+		if rows < 0 {
+			rows = n
+		} else if n != rows {
+			return 0, fmt.Errorf("array %s has %d rows, expected %d", name, n, rows)
+		}
+
+		if dictionary {
+			categories := set.newBuffer(name+categoriesSuffix, kindString)
+			for _, v := range dict.values {
+				categories.appendString(v)
+			}
+			arrays[name+categoriesSuffix] = categories
+		}
+	}
+
+	rows = max(rows, 0)
+	var files map[string][]byte
+	for i := len(readers) - 1; i >= 0 && files == nil; i-- {
+		var err error
+		if files, err = mergedEmbeddedMetadata(readers[i], rows); err != nil {
+			return 0, err
+		}
+	}
+	// The merged file is compressed like the first part.
+	stored, err := storedNpz(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	if err := writeNpz(ctx, out, arrays, files, stored); err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+// withoutMasks drops the null masks from array names, since a part only
+// has the mask of a column that isn't declared nullable if it got nulls.
+func withoutMasks(names []string) []string {
+	var kept []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, maskSuffix) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// appendPartMask appends a part's null mask of a column, or rows false
+// values if the part has none.
+func appendPartMask(mask *columnBuffer, r *npz.Reader, name string, rows int) error {
+	if npzDtype(r, name+maskSuffix) == "" {
+		for i := 0; i < rows; i++ {
+			mask.appendBool(false)
+		}
+		return nil
+	}
+	column, err := readNpzColumn(r, name+maskSuffix)
+	if err != nil {
+		return err
+	}
+	values, _ := column.([]bool)
+	if len(values) != rows {
+		return fmt.Errorf("mask has %d values, expected %d", len(values), rows)
+	}
+	for _, v := range values {
+		mask.appendBool(v)
+	}
+	return nil
+}
+
+// npzDtype returns the dtype of an array, with the width of unicode
+// strings dropped since it differs between parts.
+func npzDtype(r *npz.Reader, name string) string {
+	hdr := r.Header(name + ".npy")
+	if hdr == nil {
+		hdr = r.Header(name)
+	}
+	if hdr == nil {
+		return ""
+	}
+	if strings.HasPrefix(hdr.Descr.Type, "<U") {
+		return "<U"
+	}
+	return hdr.Descr.Type
+}
+
+// npzKind returns the columnBuffer kind of a dtype.
+func npzKind(dtype string) byte {
+	switch dtype {
+	case "<i8":
+		return kindInt64
+	case "<i4":
+		return kindInt32
+	case "<f8":
+		return kindFloat64
+	case "|b1":
+		return kindBool
+	case "|u1":
+		return kindUint8
+	case "<M8[ns]":
+		return kindDatetime
+	case "<M8[D]":
+		return kindDate
+	case "<m8[ns]":
+		return kindTimedelta
+	}
+	return kindString
+}
+
+// mergedEmbeddedMetadata returns the __metadata__.json of a part with the
+// row count of the merged file, and its shared dictionary encoded columns
+// dictionary encoded, or nil if it has none.
+func mergedEmbeddedMetadata(r *npz.Reader, rows int) (map[string][]byte, error) {
+	for _, key := range r.Keys() {
+		if key != embeddedMetadataName {
+			continue
+		}
+		rc, err := r.Open(key)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		var embedded EmbeddedMetadata
+		if err := json.Unmarshal(b, &embedded); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", embeddedMetadataName, err)
+		}
+		embedded.RowCount = rows
+		for i, field := range embedded.Table.Fields {
+			if field.Encoding == EncodingSharedDictionary {
+				embedded.Table.Fields[i].Encoding = EncodingDictionary
+				embedded.Table.Fields[i].Dictionary = ""
+			}
+		}
+		if b, err = json.Marshal(embedded); err != nil {
+			return nil, err
+		}
+		return map[string][]byte{embeddedMetadataName: b}, nil
+	}
+	return nil, nil
+}
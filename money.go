@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CurrencyConfig holds the base currency and exchange rates used to
+// normalize money columns.
+type CurrencyConfig struct {
+	// Base is the currency amounts are converted to, e.g. USD.
+	Base string `yaml:"base" toml:"base"`
+	// RatesFile lists, per currency code, how many units of Base one unit
+	// of that currency is worth. It is either a JSON object or a CSV file
+	// of currency,rate rows with an optional header.
+	RatesFile string `yaml:"rates_file" toml:"rates_file"`
+}
+
+// MoneyConfig describes an amount column and where its currency comes from.
+type MoneyConfig struct {
+	// Amount is the column holding the amounts.
+	Amount string `yaml:"amount" toml:"amount"`
+	// Currency is the column holding each row's currency code. Code is used
+	// instead for amounts that are all in one currency.
+	Currency string `yaml:"currency" toml:"currency"`
+	Code     string `yaml:"code" toml:"code"`
+	// Output names the normalized column, <amount>_<base> by default.
+	Output string `yaml:"output" toml:"output"`
+}
+
+// outputColumn returns the name of the normalized column.
+func (m MoneyConfig) outputColumn(base string) string {
+	if m.Output != "" {
+		return m.Output
+	}
+	return m.Amount + "_" + strings.ToLower(base)
+}
+
+// loadRates reads the exchange rates file. The base currency always has
+// rate 1.
+func loadRates(cfg CurrencyConfig) (map[string]float64, error) {
+	f, err := os.Open(cfg.RatesFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening rates file: %w", err)
+	}
+	defer f.Close()
+
+	raw := make(map[string]float64)
+	if strings.EqualFold(filepath.Ext(cfg.RatesFile), ".json") {
+		if err := json.NewDecoder(f).Decode(&raw); err != nil {
+			return nil, fmt.Errorf("parsing rates file %s: %w", cfg.RatesFile, err)
+		}
+	} else {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = 2
+		r.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("parsing rates file %s: %w", cfg.RatesFile, err)
+			}
+			rate, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+			if err != nil {
+				if line == 1 {
+					// Header row.
+					continue
+				}
+				return nil, fmt.Errorf("parsing rates file %s, line %d: %w", cfg.RatesFile, line, err)
+			}
+			raw[record[0]] = rate
+		}
+	}
+
+	rates := make(map[string]float64, len(raw)+1)
+	for code, rate := range raw {
+		if rate <= 0 {
+			return nil, fmt.Errorf("rates file %s: invalid rate %v for %s", cfg.RatesFile, rate, code)
+		}
+		rates[normalizeCurrency(code)] = rate
+	}
+	rates[normalizeCurrency(cfg.Base)] = 1
+	return rates, nil
+}
+
+func normalizeCurrency(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// moneyNormalizer adds a column per spec holding the amount converted to
+// the base currency. The original amount and currency columns are kept.
+// Rows with a null amount, an unparseable amount or a currency without a
+// rate get a null.
+type moneyNormalizer struct {
+	table string
+	specs []MoneyConfig
+	base  string
+	rates map[string]float64
+	// missing counts, per spec, the values of each currency without a rate.
+	missing []map[string]int
+}
+
+// newMoneyNormalizer validates the specs against the table's columns and
+// adds the normalized columns to them.
+func newMoneyNormalizer(table *TableData, specs []MoneyConfig, base string, rates map[string]float64) (*moneyNormalizer, error) {
+	n := &moneyNormalizer{table: table.TableName, specs: specs, base: base, rates: rates}
+	for _, spec := range specs {
+		columns := []string{spec.Amount}
+		if spec.Currency != "" {
+			columns = append(columns, spec.Currency)
+		}
+		for _, name := range columns {
+			found := false
+			for _, col := range table.Columns {
+				found = found || col.FieldName == name
+			}
+			if !found {
+				return nil, fmt.Errorf("table %s has no column %q for money normalization", table.TableName, name)
+			}
+		}
+
+		output := spec.outputColumn(base)
+		for _, col := range table.Columns {
+			if col.FieldName == output {
+				return nil, fmt.Errorf("table %s already has a column %q", table.TableName, output)
+			}
+		}
+
+		table.Columns = append(table.Columns, FieldMetadata{
+			FieldName:           output,
+			DataType:            DataTypeFloat,
+			IsNullable:          true,
+			TransformedFeatures: []string{"currency_normalized_" + normalizeCurrency(base)},
+		})
+		n.missing = append(n.missing, make(map[string]int))
+	}
+	return n, nil
+}
+
+// apply computes the normalized amounts of a batch.
+func (n *moneyNormalizer) apply(rows []TableRow) {
+	for i, spec := range n.specs {
+		output := spec.outputColumn(n.base)
+		for _, row := range rows {
+			code := spec.Code
+			if spec.Currency != "" {
+				c, _ := row[spec.Currency].(string)
+				if b, ok := row[spec.Currency].([]byte); ok {
+					c = string(b)
+				}
+				code = c
+			}
+			code = normalizeCurrency(code)
+
+			amount, ok := moneyAmount(row[spec.Amount])
+			rate, known := n.rates[code]
+			switch {
+			case !ok:
+				row[output] = nil
+			case !known:
+				n.missing[i][code]++
+				row[output] = nil
+			default:
+				row[output] = amount * rate
+			}
+		}
+	}
+}
+
+// finish reports the currencies that had no rate.
+func (n *moneyNormalizer) finish([]FieldMetadata) {
+	for i, spec := range n.specs {
+		for code, count := range n.missing[i] {
+			log.Printf("table %s: no %s rate for currency %q, %d values of %s exported as null",
+				n.table, n.base, code, count, spec.outputColumn(n.base))
+		}
+	}
+}
+
+// moneyAmount converts the driver's representation of an amount to a
+// float. PostgreSQL numeric values arrive as text.
+func moneyAmount(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultMongoURI is used when no MongoDB connection is configured.
+	defaultMongoURI = "mongodb://localhost:27017"
+
+	// mongoTimeout bounds metadata calls; batches of documents are bounded
+	// by the batch timeout.
+	mongoTimeout = defaultBatchTimeout
+)
+
+// mongoSource exports MongoDB collections. Nested documents are flattened
+// into dotted column names and the schema is inferred from sampled
+// documents.
+type mongoSource struct {
+	client *mongo.Client
+	dbName string
+}
+
+// connectToMongo connects to the MongoDB deployment configured in cfg.
+func connectToMongo(ctx context.Context, cfg ExportConfig) (*mongoSource, error) {
+	opts := options.Client().
+		ApplyURI(cfg.Connection.mongoURI()).
+		// Count the bytes exchanged with the server for the run report.
+		SetDialer(countingDialer{})
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Verify the connection.
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return &mongoSource{client: client, dbName: cfg.Connection.DBName}, nil
+}
+
+// mongoURI returns the MongoDB connection string. Without an explicit DSN
+// it is assembled from the individual fields.
+func (c ConnectionConfig) mongoURI() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+	if c.Host == "" {
+		return defaultMongoURI
+	}
+
+	u := url.URL{Scheme: "mongodb", Host: c.Host, Path: "/"}
+	if c.Port != 0 {
+		u.Host = fmt.Sprintf("%s:%d", c.Host, c.Port)
+	}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	}
+	return u.String()
+}
+
+func (s *mongoSource) Close() error {
+	return s.client.Disconnect(context.Background())
+}
+
+// FetchMetadata infers the fields of every selected collection from a
+// sample of its documents.
+func (s *mongoSource) FetchMetadata(ctx context.Context, cfg ExportConfig) (SchemaDetails, error) {
+	var schema SchemaDetails
+	db := s.client.Database(cfg.Connection.DBName)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	names, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return schema, fmt.Errorf("listing collections: %w", err)
+	}
+	existing := make(map[string]bool)
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	for _, tableCfg := range cfg.Tables {
+		if !existing[tableCfg.Name] {
+			continue
+		}
+
+		fields, err := s.inferFields(ctx, db.Collection(tableCfg.Name), cfg.SampleSize)
+		if err != nil {
+			return schema, fmt.Errorf("inferring schema of collection %s: %w", tableCfg.Name, err)
+		}
+		fields, omitted, err := selectColumns(tableCfg, fields)
+		if err != nil {
+			return schema, err
+		}
+		schema.Tables = append(schema.Tables, TableMetadata{TableName: tableCfg.Name, Fields: fields, OmittedColumns: omitted})
+	}
+
+	schema.DatasetMetadata = DatasetMetadata{
+		DatasetName: cfg.Connection.DBName,
+		SourceType:  "Document Database",
+		SourceDetails: map[string]interface{}{
+			"database_type":         "MongoDB",
+			"tables_or_collections": cfg.tableNames(),
+			"schema_sample_size":    cfg.SampleSize,
+		},
+	}
+	return schema, nil
+}
+
+// ListTables returns the names of the database's collections.
+func (s *mongoSource) ListTables(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+	names, err := s.client.Database(s.dbName).ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("listing collections: %w", err)
+	}
+	return names, nil
+}
+
+// inferFields samples up to n documents and derives one field per flattened
+// path. A path missing from some sampled documents is nullable, and a path
+// seen with conflicting types is exported as a string.
+func (s *mongoSource) inferFields(ctx context.Context, coll *mongo.Collection, n int) ([]FieldMetadata, error) {
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$sample", Value: bson.D{{Key: "size", Value: n}}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var order []string
+	types := make(map[string]string)
+	seen := make(map[string]int)
+	docs := 0
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		docs++
+
+		for _, e := range flattenDocument(doc) {
+			path, value := e.Key, e.Value
+			if _, ok := seen[path]; !ok {
+				order = append(order, path)
+			}
+			seen[path]++
+
+			dataType := mongoDataType(value)
+			switch current, ok := types[path]; {
+			case dataType == DataTypeNull:
+				if !ok {
+					types[path] = DataTypeNull
+				}
+			case !ok || current == DataTypeNull:
+				types[path] = dataType
+			case current != dataType:
+				types[path] = DataTypeString
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	fields := make([]FieldMetadata, 0, len(order))
+	for _, path := range order {
+		dataType := types[path]
+		if dataType == DataTypeNull {
+			dataType = DataTypeString
+		}
+		fields = append(fields, FieldMetadata{
+			FieldName:    path,
+			DataType:     dataType,
+			IsPrimaryKey: path == "_id",
+			IsNullable:   seen[path] < docs || types[path] == DataTypeNull,
+			IsPII:        isLikelyPII(path),
+		})
+	}
+	return fields, nil
+}
+
+// StreamTableData reads every document of the collection in _id order,
+// flattening each into a row, and passes each batch to emit.
+func (s *mongoSource) StreamTableData(ctx context.Context, table TableMetadata, cfg ExportConfig, emit func(rows []TableRow) error) error {
+	if len(table.Fields) == 0 {
+		return nil
+	}
+
+	hb := startHeartbeat(table.TableName)
+	defer hb.Stop()
+
+	coll := s.client.Database(cfg.Connection.DBName).Collection(table.TableName)
+	var lastID interface{}
+	offset := 0
+	for {
+		if err := exportPause.wait(ctx, table.TableName, offset); err != nil {
+			return err
+		}
+		hb.setOffset(offset)
+
+		// Page by _id rather than skip, so each batch is an index range scan.
+		filter := bson.D{}
+		if lastID != nil {
+			filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: lastID}}}}
+		}
+		findOpts := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(int64(cfg.BatchSize)).
+			SetBatchSize(int32(min(cfg.BatchSize, 1<<20)))
+
+		started := time.Now()
+		batchCtx, cancel := context.WithTimeout(ctx, cfg.batchTimeout())
+		batch, last, err := fetchMongoBatch(batchCtx, coll, filter, findOpts, table.Fields)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("reading collection %s at offset %d: %w", table.TableName, offset, err)
+		}
+		hb.addBatch(len(batch), time.Since(started))
+		if len(batch) > 0 {
+			if err := emit(batch); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < cfg.BatchSize {
+			break
+		}
+		lastID = last
+		offset += len(batch)
+	}
+
+	return nil
+}
+
+// fetchMongoBatch reads one batch of documents and returns them as rows
+// along with the _id of the last document.
+func fetchMongoBatch(ctx context.Context, coll *mongo.Collection, filter bson.D, opts *options.FindOptions, fields []FieldMetadata) ([]TableRow, interface{}, error) {
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var batch []TableRow
+	var lastID interface{}
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, nil, err
+		}
+		for _, e := range doc {
+			if e.Key == "_id" {
+				lastID = e.Value
+			}
+		}
+
+		flat := make(map[string]interface{})
+		for _, e := range flattenDocument(doc) {
+			flat[e.Key] = e.Value
+		}
+
+		row := make(TableRow, len(fields))
+		for _, field := range fields {
+			row[field.FieldName] = convertMongoValue(flat[field.FieldName])
+		}
+		batch = append(batch, row)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, err
+	}
+	return batch, lastID, nil
+}
+
+// flattenDocument returns every scalar or array value of a document keyed
+// by its dotted path, in document order, descending into embedded documents.
+func flattenDocument(doc bson.D) bson.D {
+	var flat bson.D
+	var walk func(prefix string, d bson.D)
+	walk = func(prefix string, d bson.D) {
+		for _, e := range d {
+			path := prefix + e.Key
+			if sub, ok := e.Value.(bson.D); ok && len(sub) > 0 {
+				walk(path+".", sub)
+				continue
+			}
+			flat = append(flat, bson.E{Key: path, Value: e.Value})
+		}
+	}
+	walk("", doc)
+	return flat
+}
+
+// mongoDataType maps a BSON value to our standardized types. Arrays and
+// other composite values are exported as JSON.
+func mongoDataType(v interface{}) string {
+	switch v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return DataTypeNull
+	case string, primitive.ObjectID:
+		return DataTypeString
+	case int32, int64:
+		return DataTypeInt
+	case float64, primitive.Decimal128:
+		return DataTypeFloat
+	case bool:
+		return DataTypeBool
+	case primitive.DateTime, primitive.Timestamp:
+		return DataTypeTime
+	case primitive.Binary:
+		return DataTypeBytes
+	default:
+		return DataTypeJSON
+	}
+}
+
+// convertMongoValue converts a BSON value to the Go types the NPZ writer
+// expects for its inferred data type.
+func convertMongoValue(v interface{}) interface{} {
+	if s, ok := mongoScalar(v); ok {
+		return s
+	}
+	b, err := json.Marshal(mongoJSONValue(v))
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+// mongoScalar converts scalar BSON values, reporting false for composite
+// and other values.
+func mongoScalar(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return nil, true
+	case int32:
+		return int64(v), true
+	case primitive.ObjectID:
+		return v.Hex(), true
+	case primitive.DateTime:
+		return v.Time().UTC(), true
+	case primitive.Timestamp:
+		return time.Unix(int64(v.T), 0).UTC(), true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return nil, true
+		}
+		return f, true
+	case primitive.Binary:
+		return v.Data, true
+	case string, int64, float64, bool:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// mongoJSONValue prepares composite BSON values for JSON encoding.
+func mongoJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.A:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = mongoJSONValue(e)
+		}
+		return values
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = mongoJSONValue(e.Value)
+		}
+		return m
+	default:
+		if s, ok := mongoScalar(v); ok {
+			return s
+		}
+		return v
+	}
+}
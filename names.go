@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Matching of configured table names against the source's, selected with
+// name_matching in the config: exact, or ignoring case as PostgreSQL does
+// for unquoted names.
+const (
+	nameMatchingExact           = "exact"
+	nameMatchingCaseInsensitive = "case_insensitive"
+)
+
+// tableLister is implemented by sources that can list their tables, so
+// configured names can be matched against them.
+type tableLister interface {
+	ListTables(ctx context.Context) ([]string, error)
+}
+
+// quoteIdent quotes a table or column name as an SQL identifier, so mixed
+// case names, reserved words and names with spaces are taken as they are,
+// and a name from the config can't end the identifier early. SQLite quotes
+// identifiers the same way.
+func quoteIdent(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// splitTableColumn splits a table.column entry at its last dot, since the
+// names of tables outside PostgreSQL's public schema are schema.table.
+func splitTableColumn(entry string) (table, column string, ok bool) {
+	i := strings.LastIndex(entry, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	return entry[:i], entry[i+1:], true
+}
+
+// resolveTableNames replaces the names of the selected tables with the
+// source's names they match, and returns the renamed ones as old to new
+// name. Without case insensitive matching a name differing only in case is
+// left alone, with a hint in the log.
+func resolveTableNames(cfg *ExportConfig, existing []string) (map[string]string, error) {
+	renamed := make(map[string]string)
+	resolved := make(map[string]string)
+	for i, t := range cfg.Tables {
+		name := t.Name
+		var matches []string
+		for _, e := range existing {
+			if e == t.Name {
+				matches = []string{e}
+				break
+			}
+			if strings.EqualFold(e, t.Name) {
+				matches = append(matches, e)
+			}
+		}
+		switch {
+		case len(matches) == 0 || matches[0] == t.Name:
+		case cfg.NameMatching != nameMatchingCaseInsensitive:
+			log.Printf("table %s not found, but %s differs only in case; give the exact name or set name_matching: %s",
+				t.Name, strings.Join(matches, ", "), nameMatchingCaseInsensitive)
+		case len(matches) > 1:
+			return nil, fmt.Errorf("table %s matches tables %s, which differ only in case; give the exact name", t.Name, strings.Join(matches, ", "))
+		default:
+			name = matches[0]
+			renamed[t.Name] = name
+			cfg.Tables[i].Name = name
+		}
+		if other, ok := resolved[name]; ok {
+			return nil, fmt.Errorf("tables %s and %s are both table %s", other, t.Name, name)
+		}
+		resolved[name] = t.Name
+	}
+	for i, c := range cfg.Checks {
+		if name, ok := renamed[c.Table]; ok {
+			cfg.Checks[i].Table = name
+		}
+		if name, ok := renamed[c.RefTable]; ok {
+			cfg.Checks[i].RefTable = name
+		}
+	}
+	return renamed, nil
+}
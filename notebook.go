@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// notebookName is the starter notebook written with -emit-notebook.
+const notebookName = "explore.ipynb"
+
+// notebookCell is a Jupyter notebook cell. Code cells need null
+// execution counts and empty outputs, markdown cells must not have them.
+type notebookCell map[string]interface{}
+
+func markdownCell(lines ...string) notebookCell {
+	return notebookCell{"cell_type": "markdown", "metadata": struct{}{}, "source": cellSource(lines)}
+}
+
+func codeCell(lines ...string) notebookCell {
+	return notebookCell{
+		"cell_type":       "code",
+		"metadata":        struct{}{},
+		"execution_count": nil,
+		"outputs":         []interface{}{},
+		"source":          cellSource(lines),
+	}
+}
+
+// cellSource splits the lines of a cell into the nbformat source list,
+// where every line but the last keeps its newline.
+func cellSource(lines []string) []string {
+	src := strings.Split(strings.Join(lines, "\n"), "\n")
+	for i := range src[:len(src)-1] {
+		src[i] += "\n"
+	}
+	return src
+}
+
+// pyString quotes s as a Python string literal.
+func pyString(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// saveNotebook writes explore.ipynb to outDir. It loads every exported
+// table with pandas, prints the schema from the metadata and plots the
+// distribution of each column. metadataPath is relative to the output
+// directory.
+func saveNotebook(cfg ExportConfig, metadataPath string, metadata SchemaDetails) error {
+	var exported []string
+	for _, table := range metadata.Tables {
+		if !strings.HasPrefix(table.Note, "skipped") && !strings.HasPrefix(table.Note, "failed") {
+			exported = append(exported, table.TableName)
+		}
+	}
+
+	intro := []string{
+		"# Exploring " + metadata.DatasetMetadata.DatasetName,
+		"",
+		fmt.Sprintf("Starter notebook generated by the exporter (version %s) next to the %s files it wrote.", ToolVersion, formatNames[cfg.Format]),
+		"Tables:",
+		"",
+	}
+	for _, name := range exported {
+		intro = append(intro, "- `"+name+"`")
+	}
+
+	cells := []notebookCell{
+		markdownCell(intro...),
+		codeCell(
+			"import json",
+			"import os",
+			"",
+			"import matplotlib.pyplot as plt",
+			"import numpy as np",
+			"import pandas as pd",
+			"",
+			"# The notebook sits next to the exported files.",
+			`DATA_DIR = "."`,
+			"METADATA_PATH = os.path.join(DATA_DIR, "+pyString(filepath.ToSlash(metadataPath))+")",
+			"FORMAT = "+pyString(cfg.Format),
+		),
+		codeCell(
+			"def load_metadata():",
+			`    """Returns the dataset metadata and the metadata of every table."""`,
+			"    with open(METADATA_PATH) as f:",
+			"        metadata = json.load(f)",
+			`    if "schema" in metadata:`,
+			`        return metadata["dataset_metadata"], metadata["schema"]`,
+			"    # Split layout: the index points at one file per table.",
+			"    tables = []",
+			`    for entry in metadata["tables"]:`,
+			`        with open(os.path.join(DATA_DIR, entry["path"])) as f:`,
+			"            tables.append(json.load(f))",
+			`    return metadata["dataset_metadata"], tables`,
+			"",
+			"",
+			"dataset, schema = load_metadata()",
+			`fields = {t["table_or_collection_name"]: t["fields"] for t in schema}`,
+			`print(dataset["dataset_name"], "-", dataset["source_type"])`,
+		),
+		markdownCell("## Schema"),
+		codeCell(
+			`schema_columns = ["field_name", "data_type", "nullable", "is_primary_key", "is_foreign_key",`,
+			`                  "referenced_table_or_collection", "encoding", "pii"]`,
+			"for table in schema:",
+			`    print(table["table_or_collection_name"], table.get("note", ""))`,
+			`    display(pd.DataFrame(table["fields"]).reindex(columns=schema_columns))`,
+		),
+		markdownCell("## Loading"),
+		codeCell(
+			"def load_table(name):",
+			`    """Loads an exported table, decoding dictionary encoded and ragged columns and nulls."""`,
+			`    if FORMAT == "parquet":`,
+			`        return pd.read_parquet(os.path.join(DATA_DIR, name + ".parquet"))`,
+			`    if FORMAT == "feather":`,
+			`        return pd.read_feather(os.path.join(DATA_DIR, name + ".feather"))`,
+			`    if FORMAT == "csv":`,
+			"        return pd.read_csv(os.path.join(DATA_DIR, name + \".csv\"), sep="+pyString(csvSep(cfg.CSVDelimiter))+")",
+			`    with np.load(os.path.join(DATA_DIR, name + ".npz")) as npz:`,
+			"        columns = {}",
+			"        for key in npz.files:",
+			"            # Skip companion arrays and reserved entries.",
+			`            if key.startswith("__") or key.endswith(("__categories", "__dictionary", "__offsets", "__mask", "__low")):`,
+			"                continue",
+			"            values = npz[key]",
+			`            if key + "__categories" in npz.files:`,
+			`                values = pd.Categorical.from_codes(values, categories=npz[key + "__categories"])`,
+			`            if key + "__dictionary" in npz.files:`,
+			`                dictionary = os.path.join(DATA_DIR, "dictionaries", str(npz[key + "__dictionary"][0]) + ".npy")`,
+			`                values = pd.Categorical.from_codes(values, categories=np.load(dictionary))`,
+			`            if key + "__offsets" in npz.files:`,
+			`                offsets = npz[key + "__offsets"]`,
+			"                values = [values[a:b] for a, b in zip(offsets[:-1], offsets[1:])]",
+			"                if npz[key].dtype == np.uint8:",
+			"                    # Binary columns.",
+			"                    values = [v.tobytes() for v in values]",
+			`            if key + "__mask" in npz.files:`,
+			`                values = pd.Series(values).convert_dtypes().mask(npz[key + "__mask"])`,
+			"            columns[key] = values",
+			"    # Keep the column order of the metadata.",
+			`    order = [f["field_name"] for f in fields[name] if f["field_name"] in columns]`,
+			"    return pd.DataFrame(columns)[order]",
+			"",
+			"",
+			"def plot_distributions(name, df, max_columns=12):",
+			`    """Plots histograms of numeric columns and the most common values of the others."""`,
+			"    # Keys, hashed IDs and PII say little about the data.",
+			`    skip = {f["field_name"] for f in fields[name]`,
+			`            if f["is_primary_key"] or f.get("encoding") == "siphash64" or f.get("pii")}`,
+			"    columns = [c for c in df.columns if c not in skip][:max_columns]",
+			"    if not columns or df.empty:",
+			"        return",
+			"    fig, axes = plt.subplots(len(columns), 1, figsize=(8, 2.5 * len(columns)), squeeze=False)",
+			"    for ax, column in zip(axes[:, 0], columns):",
+			"        values = df[column]",
+			"        if pd.api.types.is_numeric_dtype(values) and not pd.api.types.is_bool_dtype(values):",
+			"            values.plot.hist(ax=ax, bins=30)",
+			"        else:",
+			"            values.astype(str).value_counts().head(20).plot.bar(ax=ax)",
+			`        ax.set_title(f"{name}.{column}")`,
+			"    fig.tight_layout()",
+			"    plt.show()",
+			"",
+			"",
+			"tables = {}",
+		),
+	}
+
+	for _, name := range exported {
+		cells = append(cells,
+			markdownCell("## "+name),
+			codeCell(
+				"tables["+pyString(name)+"] = load_table("+pyString(name)+")",
+				"print(tables["+pyString(name)+"].shape)",
+				"tables["+pyString(name)+"].head()",
+			),
+			codeCell("plot_distributions("+pyString(name)+", tables["+pyString(name)+"])"),
+		)
+	}
+
+	nb := map[string]interface{}{
+		"cells": cells,
+		"metadata": map[string]interface{}{
+			"kernelspec": map[string]string{
+				"display_name": "Python 3",
+				"language":     "python",
+				"name":         "python3",
+			},
+			"language_info": map[string]string{"name": "python"},
+		},
+		"nbformat":       4,
+		"nbformat_minor": 4,
+	}
+	b, err := json.MarshalIndent(nb, "", " ")
+	if err != nil {
+		return err
+	}
+	return saveFile(filepath.Join(cfg.OutDir, notebookName), b)
+}
+
+// csvSep returns the delimiter of csv files as pandas expects it.
+func csvSep(delimiter string) string {
+	r, err := parseDelimiter(delimiter)
+	if err != nil {
+		return ","
+	}
+	return string(r)
+}
@@ -1,152 +1,697 @@
 package main
 
 import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/sbinet/npyio/npy"
 	"github.com/sbinet/npyio/npz"
 )
 
-// saveTableToNumpy saves the table as an NPZ file.
-// It builds a map[string]interface{} where each key is a column name
-// and the value is a slice of that column's data.
-func saveTableToNumpy(table TableData) {
-	nrows := len(table.Rows)
-	arrays := make(map[string]interface{})
+// npzWriter writes a table's NPZ archive from batches of rows as they are
+// fetched. It keeps a column buffer for each column holding that column's
+// data, spilling the buffers to temporary files when they grow past the
+// spill threshold, so only the current batch is held as rows. Nulls are
+// stored as the column's FillValue, or else as zero values or NaT for
+// timestamps and dates, with a boolean mask array marking them.
+type npzWriter struct {
+	path         string
+	tableName    string
+	columns      []FieldMetadata
+	set          *spillSet
+	arrays       map[string]*columnBuffer
+	dictionaries map[string]*dictionaryBuilder
+	// masks are true for the null values of a column.
+	masks map[string]*columnBuffer
+	rows  int
+	// part is set for the parts of a checkpointed table, which aren't
+	// the table's file.
+	part bool
+	// stored is set to store the arrays uncompressed and aligned.
+	stored bool
+}
+
+// newNpzWriter creates the writer of table.npz in outDir. The columns'
+// data types and encodings must be final.
+func newNpzWriter(outDir, tableName string, columns []FieldMetadata, spill spillConfig) *npzWriter {
+	w := &npzWriter{
+		path:         filepath.Join(outDir, tableName+".npz"),
+		tableName:    tableName,
+		columns:      columns,
+		set:          newSpillSet(spill),
+		arrays:       make(map[string]*columnBuffer),
+		dictionaries: make(map[string]*dictionaryBuilder),
+		masks:        make(map[string]*columnBuffer),
+	}
 
-	// Create a slice for each column based on its declared data type.
-	for _, col := range table.Columns {
+	// Create a buffer for each column based on its declared data type.
+	for _, col := range columns {
 		switch col.DataType {
 		case DataTypeInt:
-			arrays[col.FieldName] = make([]int64, nrows)
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindInt64)
 		case DataTypeFloat:
-			arrays[col.FieldName] = make([]float64, nrows)
-		case DataTypeString, DataTypeDate:
-			arrays[col.FieldName] = make([]string, nrows)
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindFloat64)
 		case DataTypeBool:
-			arrays[col.FieldName] = make([]bool, nrows)
-		case DataTypeUUID:
-			// Store UUID as a string.
-			arrays[col.FieldName] = make([]string, nrows)
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindBool)
 		case DataTypeTime:
-			// Store time as a formatted string.
-			arrays[col.FieldName] = make([]string, nrows)
-		case DataTypeNull:
-			// Instead of []interface{}, use []string for nil values.
-			arrays[col.FieldName] = make([]string, nrows)
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindDatetime)
+		case DataTypeDate:
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindDate)
+		case DataTypeTimeOfDay:
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindTimedelta)
 		default:
-			arrays[col.FieldName] = make([]interface{}, nrows)
+			// Strings, UUIDs, JSON, and nulls are all stored as strings.
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindString)
+		}
+
+		if col.Encoding == EncodingHash {
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindInt64)
+		}
+		if col.Encoding == EncodingDecimalString {
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindString)
+		}
+		if col.Encoding == EncodingDecimalScaled {
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindInt64)
+			if col.Precision > parquetDecimalMaxInt64 {
+				w.arrays[col.FieldName+lowSuffix] = w.set.newBuffer(col.FieldName+lowSuffix, kindInt64)
+			}
+		}
+		if col.Encoding == EncodingDictionary && col.DataType == DataTypeString {
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindInt32)
+			w.dictionaries[col.FieldName] = newDictionaryBuilder(col.EnumValues...)
+		}
+		if col.Encoding == EncodingSharedDictionary {
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kindInt32)
+		}
+		if col.Encoding == EncodingRagged {
+			kind := arrayElementKind(col.ElementType)
+			if col.DataType == DataTypeBytes {
+				kind = kindUint8
+			}
+			w.arrays[col.FieldName] = w.set.newBuffer(col.FieldName, kind)
+			offsets := w.set.newBuffer(col.FieldName+offsetsSuffix, kindInt64)
+			offsets.appendInt64(0)
+			w.arrays[col.FieldName+offsetsSuffix] = offsets
+		}
+		if col.IsNullable {
+			w.addMask(col.FieldName)
 		}
 	}
+	return w
+}
 
-	// Populate each column slice with data.
-	for r, row := range table.Rows {
-		for _, col := range table.Columns {
+// addMask adds the null mask of a column, with the rows written so far
+// marked present.
+func (w *npzWriter) addMask(name string) *columnBuffer {
+	mask := w.set.newBuffer(name+maskSuffix, kindBool)
+	for i := 0; i < w.rows; i++ {
+		mask.appendBool(false)
+	}
+	w.masks[name] = mask
+	w.arrays[name+maskSuffix] = mask
+	return mask
+}
+
+// writeRows appends a batch of rows to the column buffers.
+func (w *npzWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	outOfRange := make(map[string]int)
+	for _, row := range rows {
+		for _, col := range w.columns {
 			value := row[col.FieldName]
+			arr := w.arrays[col.FieldName]
+			if col.DataType == DataTypeTime && col.Encoding != EncodingHash {
+				if t, ok := timeValue(value); ok && !t.IsZero() && !inDatetime64Range(t) {
+					outOfRange[col.FieldName]++
+					value = nil
+				}
+			}
+			// Columns not declared nullable can still get nulls, such as
+			// values that failed to parse and timestamps out of range.
+			mask := w.masks[col.FieldName]
+			if mask == nil && value == nil {
+				mask = w.addMask(col.FieldName)
+			}
+			if mask != nil {
+				mask.appendBool(value == nil)
+			}
+			if col.Encoding == EncodingHash {
+				v, _ := value.(int64)
+				arr.appendInt64(v)
+				continue
+			}
+			if col.Encoding == EncodingRagged {
+				appendRagged(arr, w.arrays[col.FieldName+offsetsSuffix], value)
+				continue
+			}
+			if col.Encoding == EncodingSharedDictionary {
+				// Coded by the writer of the run's shared dictionaries.
+				code, ok := value.(int32)
+				if !ok {
+					code = -1
+				}
+				arr.appendInt32(code)
+				continue
+			}
+			if value == nil {
+				value = col.FillValue
+			}
+			if col.Encoding == EncodingDecimalString || col.Encoding == EncodingDecimalScaled {
+				w.appendDecimal(col, value)
+				continue
+			}
 			switch col.DataType {
 			case DataTypeInt:
-				arr := arrays[col.FieldName].([]int64)
 				if value == nil {
-					arr[r] = 0
+					arr.appendInt64(0)
 				} else {
 					switch v := value.(type) {
 					case int64:
-						arr[r] = v
+						arr.appendInt64(v)
 					case int:
-						arr[r] = int64(v)
+						arr.appendInt64(int64(v))
 					case float64:
-						arr[r] = int64(v)
+						arr.appendInt64(int64(v))
 					default:
 						log.Printf("unexpected type for column %s", col.FieldName)
+						arr.appendInt64(0)
 					}
 				}
 			case DataTypeFloat:
-				arr := arrays[col.FieldName].([]float64)
 				if value == nil {
-					arr[r] = 0.0
+					arr.appendFloat64(0.0)
 				} else {
 					switch v := value.(type) {
 					case float64:
-						arr[r] = v
+						arr.appendFloat64(v)
 					case float32:
-						arr[r] = float64(v)
+						arr.appendFloat64(float64(v))
+					case int64:
+						arr.appendFloat64(float64(v))
 					case int:
-						arr[r] = float64(v)
+						arr.appendFloat64(float64(v))
+					case []byte, string:
+						// PostgreSQL numeric values arrive as text.
+						f, _ := moneyAmount(v)
+						arr.appendFloat64(f)
 					default:
 						log.Printf("unexpected type for column %s", col.FieldName)
+						arr.appendFloat64(0.0)
 					}
 				}
-			case DataTypeString, DataTypeDate:
-				arr := arrays[col.FieldName].([]string)
-				if value == nil {
-					arr[r] = ""
-				} else {
+			case DataTypeString:
+				var s string
+				if value != nil {
 					if v, ok := value.(string); ok {
-						arr[r] = v
+						s = v
 					} else {
-						arr[r] = fmt.Sprintf("%v", value)
+						s = fmt.Sprintf("%v", value)
 					}
 				}
+				if dict, ok := w.dictionaries[col.FieldName]; ok {
+					arr.appendInt32(dict.code(s))
+				} else {
+					arr.appendString(s)
+				}
 			case DataTypeBool:
-				arr := arrays[col.FieldName].([]bool)
 				if value == nil {
-					arr[r] = false
+					arr.appendBool(false)
 				} else {
 					if v, ok := value.(bool); ok {
-						arr[r] = v
+						arr.appendBool(v)
 					} else {
 						log.Printf("unexpected type for column %s", col.FieldName)
+						arr.appendBool(false)
 					}
 				}
-			case DataTypeUUID:
-				arr := arrays[col.FieldName].([]string)
+			case DataTypeTime, DataTypeDate:
+				// Nulls are NaT.
 				if value == nil {
-					arr[r] = "null"
+					arr.appendTime(time.Time{})
 				} else {
-					if v, ok := value.(string); ok {
-						arr[r] = v
+					if t, ok := timeValue(value); ok {
+						arr.appendTime(t)
 					} else {
-						arr[r] = fmt.Sprintf("%v", value)
+						log.Printf("unexpected value for column %s", col.FieldName)
+						arr.appendTime(time.Time{})
 					}
 				}
-			case DataTypeTime:
-				arr := arrays[col.FieldName].([]string)
+			case DataTypeTimeOfDay:
+				// Nulls are NaT.
 				if value == nil {
-					arr[r] = "null"
+					arr.appendInt64(natValue)
 				} else {
-					if v, ok := value.(time.Time); ok {
-						arr[r] = v.Format(time.RFC3339)
-					} else if v, ok := value.(string); ok {
-						arr[r] = v
+					if d, ok := timeOfDayValue(value); ok {
+						arr.appendInt64(int64(d))
 					} else {
-						arr[r] = fmt.Sprintf("%v", value)
+						log.Printf("unexpected value for column %s", col.FieldName)
+						arr.appendInt64(natValue)
 					}
 				}
-			case DataTypeNull:
-				arr := arrays[col.FieldName].([]string)
+			case DataTypeBytes:
+				// Base64 text, with nulls stored as "".
+				b, ok := binaryValue(value)
+				if !ok && value != nil {
+					log.Printf("unexpected type for column %s", col.FieldName)
+				}
+				arr.appendString(base64.StdEncoding.EncodeToString(b))
+			case DataTypeJSON, DataTypeArray:
+				// Raw JSON text, with SQL nulls stored as JSON null.
+				if s, ok := jsonText(value); ok {
+					arr.appendString(s)
+				} else {
+					arr.appendString("null")
+				}
+			default:
+				// UUIDs, nulls, and unknown types.
 				if value == nil {
-					arr[r] = "null"
+					arr.appendString("null")
 				} else {
 					if s, ok := value.(string); ok {
-						arr[r] = s
+						arr.appendString(s)
 					} else {
-						arr[r] = fmt.Sprintf("%v", value)
+						arr.appendString(fmt.Sprintf("%v", value))
 					}
 				}
-			default:
-				arr := arrays[col.FieldName].([]interface{})
-				arr[r] = value
 			}
 		}
+		w.rows++
 	}
+	for _, col := range w.columns {
+		if n := outOfRange[col.FieldName]; n > 0 {
+			log.Printf("column %s: %d timestamps outside the datetime64[ns] range written as NaT", col.FieldName, n)
+		}
+	}
+	return nil
+}
+
+// close adds the categories of dictionary encoded columns and the names of
+// the dictionaries of shared dictionary encoded ones, and writes the
+// archive with the entries of files stored verbatim next to the arrays. It
+// returns the number of temporary bytes used.
+func (w *npzWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	defer w.set.close()
+
+	for name, dict := range w.dictionaries {
+		categories := w.set.newBuffer(name+categoriesSuffix, kindString)
+		for _, v := range dict.values {
+			categories.appendString(v)
+		}
+		w.arrays[name+categoriesSuffix] = categories
+	}
+	for _, col := range w.columns {
+		if col.Encoding == EncodingSharedDictionary {
+			dictionary := w.set.newBuffer(col.FieldName+dictionarySuffix, kindString)
+			dictionary.appendString(col.Dictionary)
+			w.arrays[col.FieldName+dictionarySuffix] = dictionary
+		}
+	}
+
+	if err := writeNpz(ctx, w.path, w.arrays, files, w.stored); err != nil {
+		return w.set.tempBytes, err
+	}
+
+	if !w.part {
+		log.Printf("Table %q saved successfully to %s", w.tableName, w.path)
+	}
+	return w.set.tempBytes, nil
+}
+
+// appendDecimal appends a value of a decimal_string or decimal_scaled
+// column, rounded to the column's scale. Nulls are "" or 0.
+func (w *npzWriter) appendDecimal(col FieldMetadata, value interface{}) {
+	arr := w.arrays[col.FieldName]
+	unscaled, ok := decimalValue(value, col.Scale)
+	if !ok && value != nil {
+		log.Printf("unexpected value for column %s", col.FieldName)
+	}
+	if col.Encoding == EncodingDecimalString {
+		if ok {
+			arr.appendString(formatDecimal(unscaled, col.Scale))
+		} else {
+			arr.appendString("")
+		}
+		return
+	}
+	if !ok {
+		unscaled = new(big.Int)
+	}
+	if low := w.arrays[col.FieldName+lowSuffix]; low != nil {
+		hi, lo := splitInt128(unscaled)
+		arr.appendInt64(hi)
+		low.appendInt64(lo)
+		return
+	}
+	arr.appendInt64(unscaled.Int64())
+}
+
+// discard removes the temporary files of a table that failed to export.
+func (w *npzWriter) discard() {
+	w.set.close()
+}
+
+// writeNpz writes the arrays, sorted by name, and any extra raw files into
+// a NumPy compressed archive, or with stored set an uncompressed one with
+// the arrays' data aligned. The archive is written next to fileName and
+// renamed into place once complete, so readers never see part of it. It
+// stops between arrays once ctx is canceled; an unfinished archive is
+// removed.
+func writeNpz(ctx context.Context, fileName string, arrays map[string]*columnBuffer, files map[string][]byte, stored bool) (err error) {
+	tmp := fileName + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	off := &offsetWriter{w: f}
+	zw := zip.NewWriter(off)
 
-	// Write the NPZ archive using the filename.
-	fileName := fmt.Sprintf("data/%s.npz", table.TableName)
-	// Assuming npz.Write is defined; replace with your npz writing function.
-	if err := npz.Write(fileName, arrays); err != nil {
-		log.Fatalf("failed to write npz file: %v", err)
+	names := make([]string, 0, len(arrays))
+	for name := range arrays {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	log.Printf("Table %q saved successfully to %s", table.TableName, fileName)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeArrayEntry(zw, off, name+".npy", arrays[name], stored); err != nil {
+			return fmt.Errorf("writing npz entry %q: %w", name, err)
+		}
+	}
+
+	names = names[:0]
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("creating npz entry %q: %w", name, err)
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			return fmt.Errorf("writing npz entry %q: %w", name, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+// readNpzColumn loads the named array from an open NPZ archive into a slice
+// whose element type matches the array's on-disk dtype.
+func readNpzColumn(r *npz.Reader, name string) (interface{}, error) {
+	key := name
+	hdr := r.Header(key)
+	if hdr == nil {
+		key = name + ".npy"
+		hdr = r.Header(key)
+	}
+	if hdr == nil {
+		return nil, fmt.Errorf("reading header of %q", name)
+	}
+	if strings.HasPrefix(hdr.Descr.Type, "<M8[") {
+		return readDatetimeColumn(r, key, hdr)
+	}
+	if hdr.Descr.Type == "<m8[ns]" {
+		return readTimedeltaColumn(r, key, hdr)
+	}
+	if strings.HasPrefix(hdr.Descr.Type, "<U") {
+		return readStringColumn(r, key, hdr)
+	}
+	rt := npy.TypeFrom(hdr.Descr.Type)
+	if rt == nil {
+		return nil, fmt.Errorf("unsupported dtype %q for %q", hdr.Descr.Type, key)
+	}
+	ptr := reflect.New(reflect.SliceOf(rt))
+	if err := r.Read(key, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// readStringColumn reads a fixed-width unicode array, which npyio returns
+// as its raw UTF-32 bytes.
+func readStringColumn(r *npz.Reader, key string, hdr *npy.Header) ([]string, error) {
+	if len(hdr.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v for %q", hdr.Descr.Shape, key)
+	}
+	rc, err := r.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// Skip the header.
+	if _, err := npy.NewReader(rc); err != nil {
+		return nil, err
+	}
+	values, err := decodeUnicode(rc, hdr.Descr.Type, hdr.Descr.Shape[0])
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+	return values, nil
+}
+
+// decodeUnicode reads the n values of a little-endian "<U" array from rd,
+// positioned at its data, without their NUL padding.
+func decodeUnicode(rd io.Reader, dtype string, n int) ([]string, error) {
+	width, err := strconv.Atoi(strings.TrimPrefix(dtype, "<U"))
+	if err != nil || width < 0 {
+		return nil, fmt.Errorf("unsupported dtype %q", dtype)
+	}
+	raw := make([]uint32, n*width)
+	if err := binary.Read(rd, binary.LittleEndian, raw); err != nil {
+		return nil, err
+	}
+	values := make([]string, n)
+	runes := make([]rune, 0, width)
+	for i := range values {
+		value := raw[i*width : (i+1)*width]
+		for len(value) > 0 && value[len(value)-1] == 0 {
+			value = value[:len(value)-1]
+		}
+		runes = runes[:0]
+		for _, c := range value {
+			runes = append(runes, rune(c))
+		}
+		values[i] = string(runes)
+	}
+	return values, nil
+}
+
+// readDatetimeColumn reads a datetime64 array of nanoseconds or days, which
+// npyio can't decode, as times in UTC, with NaT as the zero time.
+func readDatetimeColumn(r *npz.Reader, key string, hdr *npy.Header) ([]time.Time, error) {
+	var unit time.Duration
+	switch hdr.Descr.Type {
+	case "<M8[ns]":
+		unit = time.Nanosecond
+	case "<M8[D]":
+		unit = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("unsupported dtype %q for %q", hdr.Descr.Type, key)
+	}
+	if len(hdr.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v for %q", hdr.Descr.Shape, key)
+	}
+
+	rc, err := r.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// Skip the header.
+	if _, err := npy.NewReader(rc); err != nil {
+		return nil, err
+	}
+	raw := make([]int64, hdr.Descr.Shape[0])
+	if err := binary.Read(rc, binary.LittleEndian, raw); err != nil {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+
+	values := make([]time.Time, len(raw))
+	for i, v := range raw {
+		switch {
+		case v == natValue:
+		case unit == time.Nanosecond:
+			values[i] = time.Unix(0, v).UTC()
+		default:
+			values[i] = time.Unix(v*int64(unit/time.Second), 0).UTC()
+		}
+	}
+	return values, nil
+}
+
+// readTimedeltaColumn reads a timedelta64 array of nanoseconds, which
+// npyio can't decode, as durations, with NaT kept as the smallest one.
+func readTimedeltaColumn(r *npz.Reader, key string, hdr *npy.Header) ([]time.Duration, error) {
+	if len(hdr.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v for %q", hdr.Descr.Shape, key)
+	}
+	rc, err := r.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// Skip the header.
+	if _, err := npy.NewReader(rc); err != nil {
+		return nil, err
+	}
+	values := make([]time.Duration, hdr.Descr.Shape[0])
+	if err := binary.Read(rc, binary.LittleEndian, values); err != nil {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+	return values, nil
+}
+
+// npzColumnNames returns the array names stored in an NPZ archive, without
+// the ".npy" suffix some writers append. Reserved "__" entries such as the
+// embedded metadata are skipped.
+func npzColumnNames(r *npz.Reader) []string {
+	var names []string
+	for _, key := range r.Keys() {
+		if strings.HasPrefix(key, "__") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(key, ".npy"))
+	}
+	return names
+}
+
+// readNpyHeader reads the header of the .npy file at path.
+func readNpyHeader(path string) (npy.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return npy.Header{}, err
+	}
+	defer f.Close()
+	r, err := npy.NewReader(f)
+	if err != nil {
+		return npy.Header{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return r.Header, nil
+}
+
+// npyDataType returns the metadata data type of the arrays of a dtype, and
+// false for dtypes the exports don't use, such as objects and structs.
+func npyDataType(dtype string) (string, bool) {
+	switch dtype {
+	case "<M8[ns]":
+		return DataTypeTime, true
+	case "<M8[D]":
+		return DataTypeDate, true
+	case "<m8[ns]":
+		return DataTypeTimeOfDay, true
+	case "|b1":
+		return DataTypeBool, true
+	}
+	for _, prefix := range []string{"<i", "|i", "<u", "|u"} {
+		if strings.HasPrefix(dtype, prefix) {
+			return DataTypeInt, true
+		}
+	}
+	switch {
+	case strings.HasPrefix(dtype, "<f"):
+		return DataTypeFloat, true
+	case strings.HasPrefix(dtype, "<U"):
+		return DataTypeString, true
+	}
+	return "", false
+}
+
+// npzRowCount returns the number of rows of the table in an NPZ archive,
+// the length of its flat arrays or one less than that of the offsets of
+// ragged ones, and false for an archive without arrays.
+func npzRowCount(r *npz.Reader) (int, bool) {
+	for _, name := range npzColumnNames(r) {
+		if strings.HasSuffix(name, categoriesSuffix) || strings.HasSuffix(name, dictionarySuffix) || r.Header(name+offsetsSuffix+".npy") != nil || r.Header(name+offsetsSuffix) != nil {
+			continue
+		}
+		hdr := r.Header(name + ".npy")
+		if hdr == nil {
+			hdr = r.Header(name)
+		}
+		if hdr == nil || len(hdr.Descr.Shape) == 0 {
+			continue
+		}
+		if strings.HasSuffix(name, offsetsSuffix) {
+			return max(hdr.Descr.Shape[0]-1, 0), true
+		}
+		return hdr.Descr.Shape[0], true
+	}
+	return 0, false
+}
+
+// writeNpyFiles writes the .npy files of arrays, by array name, into an
+// NPZ archive as they are, sorted by name and deflated or with stored set
+// uncompressed. Like writeNpz it renames the archive into place.
+func writeNpyFiles(fileName string, arrays map[string]string, stored bool) (err error) {
+	tmp := fileName + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	zw := zip.NewWriter(f)
+	method := zip.Deflate
+	if stored {
+		method = zip.Store
+	}
+	names := make([]string, 0, len(arrays))
+	for name := range arrays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := os.ReadFile(arrays[name])
+		if err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: method})
+		if err != nil {
+			return fmt.Errorf("creating npz entry %q: %w", name, err)
+		}
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("writing npz entry %q: %w", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
 }
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fahadsiddiqui/npyio-starter-kit/reader"
+	"github.com/sbinet/npyio/npy"
+	"github.com/sbinet/npyio/npz"
+)
+
+// npzTestColumns are columns of every kind the NPZ writer stores, with
+// nulls.
+var npzTestColumns = []FieldMetadata{
+	{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true},
+	{FieldName: "score", DataType: DataTypeFloat, IsNullable: true},
+	{FieldName: "active", DataType: DataTypeBool},
+	{FieldName: "name", DataType: DataTypeString, IsNullable: true},
+	{FieldName: "seen_at", DataType: DataTypeTime, IsNullable: true},
+	{FieldName: "day", DataType: DataTypeDate},
+	{FieldName: "opens_at", DataType: DataTypeTimeOfDay, IsNullable: true},
+}
+
+// npzTestRows returns n rows of npzTestColumns.
+func npzTestRows(n int) []TableRow {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rows := make([]TableRow, n)
+	for i := range rows {
+		rows[i] = TableRow{
+			"id":       int64(i),
+			"score":    float64(i) / 4,
+			"active":   i%3 == 0,
+			"name":     fmt.Sprintf("name %d", i%17),
+			"seen_at":  start.Add(time.Duration(i) * time.Minute),
+			"day":      start.AddDate(0, 0, i%30).Truncate(24 * time.Hour),
+			"opens_at": time.Duration(i%96) * 15 * time.Minute,
+		}
+		if i%5 == 0 {
+			rows[i]["score"], rows[i]["name"], rows[i]["seen_at"], rows[i]["opens_at"] = nil, nil, nil, nil
+		}
+	}
+	return rows
+}
+
+// writeTestNpz writes rows to dir/<table>.npz in batches of batch rows.
+func writeTestNpz(t *testing.T, dir, table string, rows []TableRow, batch int, spill spillConfig) string {
+	t.Helper()
+	w := newNpzWriter(dir, table, npzTestColumns, spill)
+	for chunk := range slices.Chunk(rows, batch) {
+		// The writer may hold on to rows, so it gets copies.
+		var copies []TableRow
+		for _, row := range chunk {
+			copies = append(copies, maps.Clone(row))
+		}
+		if err := w.writeRows(context.Background(), copies); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.close(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return w.path
+}
+
+func TestNpzRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  int
+		spill spillConfig
+	}{
+		{"empty", 0, spillConfig{}},
+		{"in memory", 1000, spillConfig{}},
+		{"spilled", 1000, spillConfig{Threshold: 512}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.spill.Dir = t.TempDir()
+			rows := npzTestRows(tt.rows)
+			writeTestNpz(t, dir, "t", rows, 128, tt.spill)
+			checkTestNpz(t, dir, "t", rows)
+		})
+	}
+}
+
+// checkTestNpz reads dir/<table>.npz back with the reader package and
+// compares its columns with rows.
+func checkTestNpz(t *testing.T, dir, table string, rows []TableRow) {
+	t.Helper()
+	meta, err := json.Marshal(map[string]any{"schema": []map[string]any{{"table_or_collection_name": table, "fields": npzTestColumns}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), meta, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := reader.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ds.Table(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range npzTestColumns {
+		col, err := data.Column(field.FieldName)
+		if err != nil {
+			t.Fatalf("reading %s: %v", field.FieldName, err)
+		}
+		if col.Len() != len(rows) {
+			t.Fatalf("%s has %d values, want %d", field.FieldName, col.Len(), len(rows))
+		}
+		for i, row := range rows {
+			if want := row[field.FieldName]; col.Null(i) != (want == nil) {
+				t.Fatalf("%s[%d] null %v, want %v", field.FieldName, i, col.Null(i), want == nil)
+			} else if want != nil && fmt.Sprint(col.Value(i)) != fmt.Sprint(want) {
+				t.Fatalf("%s[%d] = %v, want %v", field.FieldName, i, col.Value(i), want)
+			}
+		}
+	}
+}
+
+// A table resumed from checkpointed parts is assembled into the archive a
+// single run writes, strings included.
+func TestAssembleNpzParts(t *testing.T) {
+	rows := npzTestRows(1000)
+	partsDir, dir := t.TempDir(), t.TempDir()
+	var parts []string
+	for i, chunk := range [][]TableRow{rows[:300], rows[300:301], rows[301:800], rows[800:]} {
+		parts = append(parts, writeTestNpz(t, partsDir, fmt.Sprintf("t.part%d", i), chunk, 64, spillConfig{Dir: t.TempDir()}))
+	}
+	c := &tableCheckpointer{dir: partsDir, table: "t"}
+	for _, part := range parts[:len(parts)-1] {
+		c.cp.Parts = append(c.cp.Parts, filepath.Base(part))
+	}
+	path := filepath.Join(dir, "t.npz")
+	if err := c.assemble(context.Background(), path, &npzWriter{path: parts[len(parts)-1]}); err != nil {
+		t.Fatal(err)
+	}
+	checkTestNpz(t, dir, "t", rows)
+
+	single := writeTestNpz(t, t.TempDir(), "t", rows, 64, spillConfig{Dir: t.TempDir()})
+	for _, name := range []string{"name", "name__mask", "id", "opens_at"} {
+		want, err := testNpyHeader(single, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := testNpyHeader(path, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Descr.Type != want.Descr.Type {
+			t.Errorf("%s merged as %s, want %s", name, got.Descr.Type, want.Descr.Type)
+		}
+	}
+}
+
+// testNpyHeader returns the header of an array of the NPZ archive at path.
+func testNpyHeader(path, name string) (*npy.Header, error) {
+	r, err := npz.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if hdr := r.Header(name + ".npy"); hdr != nil {
+		return hdr, nil
+	}
+	return nil, fmt.Errorf("%s has no array %s", path, name)
+}
+
+// Timestamps numpy can't hold as datetime64[ns] are written as masked NaT
+// rather than as wrapped-around nanoseconds.
+func TestNpzTimestampRange(t *testing.T) {
+	dir := t.TempDir()
+	columns := []FieldMetadata{{FieldName: "at", DataType: DataTypeTime}}
+	values := []time.Time{
+		time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(1, 1, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(1677, 9, 22, 0, 0, 0, 0, time.UTC),
+		time.Date(2262, 4, 12, 0, 0, 0, 0, time.UTC),
+	}
+	var rows []TableRow
+	for _, v := range values {
+		rows = append(rows, TableRow{"at": v})
+	}
+	w := newNpzWriter(dir, "t", columns, spillConfig{})
+	if err := w.writeRows(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.close(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := npz.Open(w.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	column, err := readNpzColumn(r, "at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask, err := readNpzColumn(r, "at"+maskSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, nulls := column.([]time.Time), mask.([]bool)
+	for i, v := range values {
+		inRange := i == 0 || i == 3
+		if nulls[i] == inRange || inRange && !got[i].Equal(v) || !inRange && !got[i].IsZero() {
+			t.Errorf("%v read back as %v, null %v", v, got[i], nulls[i])
+		}
+	}
+}
+
+func TestTimeOfDayValue(t *testing.T) {
+	tests := []struct {
+		value any
+		want  time.Duration
+		ok    bool
+	}{
+		{time.Date(0, 1, 1, 10, 30, 0, 5e8, time.UTC), 10*time.Hour + 30*time.Minute + 500*time.Millisecond, true},
+		// timetz values are kept as the time of day in UTC.
+		{time.Date(0, 1, 1, 1, 0, 0, 0, time.FixedZone("", 2*3600)), 23 * time.Hour, true},
+		{"23:59:59.999999", 24*time.Hour - time.Microsecond, true},
+		{"08:00:00+05:30", 2*time.Hour + 30*time.Minute, true},
+		{[]byte("00:00:00"), 0, true},
+		{90 * time.Minute, 90 * time.Minute, true},
+		{25 * time.Hour, 0, false},
+		{"noon", 0, false},
+		{int64(5), 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := timeOfDayValue(tt.value)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("timeOfDayValue(%v) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// Exports of the same rows have the same checksums however the rows were
+// batched and spilled, and are the same bytes.
+func TestNpzChecksumsByteIdentical(t *testing.T) {
+	rows := npzTestRows(2000)
+	var first map[string]string
+	var firstFile []byte
+	for i, tt := range []struct {
+		batch int
+		spill spillConfig
+	}{
+		{2000, spillConfig{}},
+		{7, spillConfig{}},
+		{100, spillConfig{Threshold: 256}},
+		{333, spillConfig{Threshold: 1 << 20}},
+	} {
+		dir := t.TempDir()
+		tt.spill.Dir = t.TempDir()
+		path := writeTestNpz(t, dir, "t", rows, tt.batch, tt.spill)
+		sums, err := fileChecksums(ExportConfig{OutDir: dir, Format: formatNPZ}, "t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first, firstFile = sums, b
+			if len(sums) == 0 {
+				t.Fatal("no checksums")
+			}
+			continue
+		}
+		if !maps.Equal(sums, first) {
+			t.Errorf("batches of %d rows, %+v: checksums %v, want %v", tt.batch, tt.spill, sums, first)
+		}
+		if !bytes.Equal(b, firstFile) {
+			t.Errorf("batches of %d rows, %+v: the archive differs", tt.batch, tt.spill)
+		}
+	}
+}
+
+func TestAppendNpzColumn(t *testing.T) {
+	dir := t.TempDir()
+	rows := npzTestRows(100)
+	path := writeTestNpz(t, dir, "t", rows, 100, spillConfig{})
+	cfg := ExportConfig{OutDir: dir, Format: formatNPZ}
+	before, err := fileChecksums(cfg, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeNpy := func(name string, values any) string {
+		p := filepath.Join(dir, name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := npy.Write(f, values); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	values := make([]float64, len(rows))
+	mask := make([]bool, len(rows))
+	for i := range values {
+		values[i] = float64(i) * 1.5
+		mask[i] = i%9 == 0
+	}
+	column := appendColumn{Name: "feature", Values: writeNpy("feature.npy", values), Mask: writeNpy("mask.npy", mask), Transform: "model_v1"}
+
+	tests := []struct {
+		name   string
+		column appendColumn
+		ok     bool
+	}{
+		{"append", column, true},
+		{"existing column", column, false},
+		{"replace", func() appendColumn { c := column; c.Replace = true; return c }(), true},
+		{"wrong length", appendColumn{Name: "short", Values: writeNpy("short.npy", values[:10])}, false},
+		{"companion name", appendColumn{Name: "x__mask", Values: column.Values}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, err := appendNpzColumn(path, tt.column)
+			if (err == nil) != tt.ok {
+				t.Fatalf("appendNpzColumn = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if field.DataType != DataTypeFloat || !field.IsNullable {
+				t.Errorf("appended %+v, want a nullable float column", field)
+			}
+		})
+	}
+
+	after, err := fileChecksums(cfg, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, sum := range before {
+		if after[name] != sum {
+			t.Errorf("array %s changed", name)
+		}
+	}
+	if after["feature"] == "" || after["feature"+maskSuffix] == "" {
+		t.Errorf("appended arrays missing from %v", slices.Sorted(maps.Keys(after)))
+	}
+	if _, err := os.Stat(path + ".append"); !os.IsNotExist(err) {
+		t.Errorf("temporary archive left behind: %v", err)
+	}
+}
+
+func TestWriteNpyFiles(t *testing.T) {
+	dir := t.TempDir()
+	arrays := make(map[string]string)
+	for _, name := range []string{"zeta", "alpha", "mid", "alpha__mask"} {
+		path := filepath.Join(dir, name+".npy")
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		arrays[name] = path
+	}
+	out := filepath.Join(dir, "t.npz")
+
+	// Map order varies between runs, the archive doesn't.
+	var first []byte
+	for i := range 5 {
+		if err := writeNpyFiles(out, arrays, false); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = b
+		} else if !bytes.Equal(b, first) {
+			t.Fatalf("archive %d differs from the first", i)
+		}
+	}
+	r, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	r.Close()
+	want := []string{"alpha.npy", "alpha__mask.npy", "mid.npy", "zeta.npy"}
+	if !slices.Equal(names, want) {
+		t.Errorf("entries %v, want %v", names, want)
+	}
+
+	// A failed write leaves the archive in place, and no temporary file.
+	arrays["missing"] = filepath.Join(dir, "missing.npy")
+	if err := writeNpyFiles(out, arrays, false); err == nil {
+		t.Fatal("writing a missing array succeeded")
+	}
+	b, err := os.ReadFile(out)
+	if err != nil || !bytes.Equal(b, first) {
+		t.Errorf("failed write changed the archive: %v", err)
+	}
+	if _, err := os.Stat(out + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary archive left behind: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Null policy actions.
+const (
+	nullMask     = "mask"
+	nullSentinel = "sentinel"
+	nullNaN      = "nan"
+	nullDropRow  = "drop_row"
+	nullError    = "error"
+)
+
+// NullPolicy is how the nulls of a column are exported.
+type NullPolicy struct {
+	// Action is one of:
+	//   - mask (the default): nulls are stored as zero values, or the
+	//     column's fill_value, and marked in the column's null mask
+	//   - sentinel: nulls are stored as Sentinel, without a mask
+	//   - nan: nulls of float columns are stored as NaN, without a mask
+	//   - drop_row: rows with a null are left out
+	//   - error: a null fails the table's export
+	Action string `yaml:"action" toml:"action"`
+	// Sentinel is the value the sentinel action stores, in the column's
+	// type: an integer, a number, true or false, an ISO date or timestamp,
+	// or text.
+	Sentinel string `yaml:"sentinel" toml:"sentinel"`
+}
+
+// validate checks the policy's action.
+func (p NullPolicy) validate() error {
+	switch p.Action {
+	case "", nullMask, nullNaN, nullDropRow, nullError:
+		if p.Sentinel != "" {
+			return fmt.Errorf("sentinel is only used by the %s action", nullSentinel)
+		}
+	case nullSentinel:
+	default:
+		return fmt.Errorf("unknown null policy action %q, expected %s, %s, %s, %s or %s", p.Action, nullMask, nullSentinel, nullNaN, nullDropRow, nullError)
+	}
+	return nil
+}
+
+// parseNullPolicy parses the -null-policy flag: an action, or
+// sentinel=<value>.
+func parseNullPolicy(s string) NullPolicy {
+	action, sentinel, _ := strings.Cut(s, "=")
+	return NullPolicy{Action: action, Sentinel: sentinel}
+}
+
+// sentinelValue returns a sentinel as a value of col's type.
+func sentinelValue(col FieldMetadata, sentinel string) (interface{}, bool) {
+	if col.Encoding == EncodingHash {
+		col.DataType = DataTypeInt
+	}
+	switch col.DataType {
+	case DataTypeInt:
+		v, err := strconv.ParseInt(sentinel, 10, 64)
+		return v, err == nil
+	case DataTypeFloat:
+		v, err := strconv.ParseFloat(sentinel, 64)
+		return v, err == nil
+	case DataTypeBool:
+		v, err := strconv.ParseBool(sentinel)
+		return v, err == nil
+	case DataTypeTime, DataTypeDate:
+		t, ok := timeValue(sentinel)
+		return t, ok
+	case DataTypeBytes:
+		return []byte(sentinel), true
+	case DataTypeArray:
+		// Arrays are stored as arrays or JSON, never as text.
+		return nil, false
+	}
+	return sentinel, true
+}
+
+// nullValueError is the error of a null in a column whose policy is error.
+// Another attempt would only fail again.
+type nullValueError struct {
+	table, column string
+}
+
+func (e *nullValueError) Error() string {
+	return fmt.Sprintf("column %s of table %s has a null, which its null policy doesn't allow", e.column, e.table)
+}
+
+// nullColumn is a column whose nulls a nullFilter replaces or acts on.
+type nullColumn struct {
+	name   string
+	action string
+	// value replaces the nulls of the sentinel and nan actions.
+	value interface{}
+}
+
+// nullFilter applies the null policies of a table's columns to its
+// batches, after the transforms. Columns with the default mask policy are
+// left to the writers.
+type nullFilter struct {
+	table   string
+	columns []nullColumn
+	// dropped is the number of rows left out by drop_row policies.
+	dropped int
+}
+
+// newNullFilter resolves the policy of every column of a table: its own,
+// or else def. The sentinel and nan actions of def only apply to the
+// columns that can hold the value; the others keep their masks. Columns
+// that won't have nulls are marked not nullable, so no mask is written.
+func newNullFilter(table *TableData, def NullPolicy, policies map[string]NullPolicy, decimalEncoding string) (*nullFilter, error) {
+	for name := range policies {
+		if !columnExists(table.Columns, name) {
+			return nil, fmt.Errorf("table %s has no column %q for a null policy", table.TableName, name)
+		}
+	}
+	f := &nullFilter{table: table.TableName}
+	for i := range table.Columns {
+		col := &table.Columns[i]
+		p, own := policies[col.FieldName]
+		if !own {
+			p = def
+		}
+		c := nullColumn{name: col.FieldName, action: p.Action}
+		switch p.Action {
+		case "", nullMask:
+			continue
+		case nullSentinel:
+			v, ok := sentinelValue(*col, p.Sentinel)
+			if !ok {
+				if own {
+					return nil, fmt.Errorf("null policy of %s.%s: sentinel %q is not a %s", table.TableName, col.FieldName, p.Sentinel, col.DataType)
+				}
+				continue
+			}
+			c.value = v
+			col.FillValue = rejectedValue(v)
+		case nullNaN:
+			// Decimals stored exactly have no NaN.
+			exact := col.Precision > 0 && decimalEncoding != "" && decimalEncoding != decimalsFloat
+			if col.DataType != DataTypeFloat || col.Encoding != "" || exact {
+				if own {
+					return nil, fmt.Errorf("null policy of %s.%s: %s needs a float column", table.TableName, col.FieldName, nullNaN)
+				}
+				continue
+			}
+			c.value = math.NaN()
+			col.FillValue = nil
+		}
+		col.IsNullable = false
+		f.columns = append(f.columns, c)
+	}
+	return f, nil
+}
+
+// nullFilter returns the null filter of a table of the export, marking the
+// columns that won't have nulls.
+func (c ExportConfig) nullFilter(table *TableData) (*nullFilter, error) {
+	return newNullFilter(table, c.NullPolicy, c.transforms(table.TableName).NullPolicy, c.DecimalEncoding)
+}
+
+// columnExists reports whether columns has the named column.
+func columnExists(columns []FieldMetadata, name string) bool {
+	for _, col := range columns {
+		if col.FieldName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filter applies the policies to a batch, returning the rows it keeps.
+func (f *nullFilter) filter(rows []TableRow) ([]TableRow, error) {
+	if len(f.columns) == 0 {
+		return rows, nil
+	}
+	kept := rows[:0]
+	for _, row := range rows {
+		drop := false
+		for _, c := range f.columns {
+			if row[c.name] != nil {
+				continue
+			}
+			switch c.action {
+			case nullError:
+				return nil, &nullValueError{table: f.table, column: c.name}
+			case nullDropRow:
+				drop = true
+			default:
+				row[c.name] = c.value
+			}
+		}
+		if drop {
+			f.dropped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
+
+// finish marks the columns of the policies not nullable again, after the
+// transforms marked the ones they stored nulls in.
+func (f *nullFilter) finish(columns []FieldMetadata) {
+	for _, c := range f.columns {
+		for i := range columns {
+			if columns[i].FieldName == c.name {
+				columns[i].IsNullable = false
+			}
+		}
+	}
+}
+
+// dropColumns lists the columns whose nulls drop rows.
+func (f *nullFilter) dropColumns() string {
+	var names []string
+	for _, c := range f.columns {
+		if c.action == nullDropRow {
+			names = append(names, c.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// maxOneHotValues caps the values a column is one-hot encoded into, since
+// every value adds an array as long as the table.
+const maxOneHotValues = 256
+
+// oneHotEncoder adds a bool column <column>__<value> for each listed value
+// of categorical columns, true in the rows holding that value. Nulls and
+// values that aren't listed are false in all of them.
+type oneHotEncoder struct {
+	table   string
+	columns []string
+	values  map[string][]string
+	// unlisted counts the values per column that are not listed.
+	unlisted map[string]int
+}
+
+// newOneHotEncoder adds the encoded columns of the listed values, or of
+// the labels of enum columns given no values.
+func newOneHotEncoder(table *TableData, oneHot map[string][]string) (*oneHotEncoder, error) {
+	e := &oneHotEncoder{table: table.TableName, values: make(map[string][]string), unlisted: make(map[string]int)}
+	for column := range oneHot {
+		e.columns = append(e.columns, column)
+	}
+	sort.Strings(e.columns)
+
+	for _, column := range e.columns {
+		idx := -1
+		for i, col := range table.Columns {
+			if col.FieldName == column {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("table %s has no column %q to one-hot encode", table.TableName, column)
+		}
+		values := oneHot[column]
+		if len(values) == 0 {
+			values = table.Columns[idx].EnumValues
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("one_hot of %s.%s needs a list of values, as it is not an enum column", table.TableName, column)
+		}
+		if len(values) > maxOneHotValues {
+			return nil, fmt.Errorf("one_hot of %s.%s has %d values, more than the %d allowed", table.TableName, column, len(values), maxOneHotValues)
+		}
+		e.values[column] = values
+		for _, value := range values {
+			output := column + "__" + value
+			if value == "" {
+				return nil, fmt.Errorf("one_hot of %s.%s lists an empty value", table.TableName, column)
+			}
+			if companionName(output) {
+				return nil, fmt.Errorf("one_hot of %s.%s can't encode %q: its column %q would be read as a companion array", table.TableName, column, value, output)
+			}
+			for _, col := range table.Columns {
+				if col.FieldName == output {
+					return nil, fmt.Errorf("table %s already has a column %q", table.TableName, output)
+				}
+			}
+			table.Columns = append(table.Columns, FieldMetadata{
+				FieldName:           output,
+				DataType:            DataTypeBool,
+				TransformedFeatures: []string{"one_hot_" + column},
+			})
+		}
+	}
+	return e, nil
+}
+
+// apply adds the encoded columns to a batch.
+func (e *oneHotEncoder) apply(rows []TableRow) {
+	for _, row := range rows {
+		for _, column := range e.columns {
+			value, ok := categoryText(row[column])
+			listed := false
+			for _, v := range e.values[column] {
+				hot := ok && v == value
+				row[column+"__"+v] = hot
+				listed = listed || hot
+			}
+			if ok && !listed {
+				e.unlisted[column]++
+			}
+		}
+	}
+}
+
+// categoryText returns the text of a categorical value; ok is false for
+// nil.
+func categoryText(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		return fmt.Sprintf("%v", v), true
+	}
+}
+
+// finish logs the columns that held values other than the listed ones.
+func (e *oneHotEncoder) finish(columns []FieldMetadata) {
+	for _, column := range e.columns {
+		if n := e.unlisted[column]; n > 0 {
+			log.Printf("column %s.%s: %d values are not listed in one_hot, their encoded columns are all false", e.table, column, n)
+		}
+	}
+}
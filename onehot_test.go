@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestNewOneHotEncoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		ok     bool
+	}{
+		{"listed values", []string{"free", "pro"}, true},
+		{"enum labels", nil, true},
+		{"null mask", []string{"free", "mask"}, false},
+		{"categories", []string{"categories"}, false},
+		{"nested suffix", []string{"x__offsets"}, false},
+		{"low", []string{"low"}, false},
+		{"dictionary", []string{"dictionary"}, false},
+		{"empty", []string{""}, false},
+		{"existing column", []string{"id"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &TableData{TableName: "users", Columns: []FieldMetadata{
+				{FieldName: "plan", DataType: DataTypeString, EnumValues: []string{"free", "pro", "team"}},
+				{FieldName: "plan__id", DataType: DataTypeBool},
+			}}
+			_, err := newOneHotEncoder(table, map[string][]string{"plan": tt.values})
+			if (err == nil) != tt.ok {
+				t.Fatalf("newOneHotEncoder(%q) = %v, want ok %v", tt.values, err, tt.ok)
+			}
+			want := 2 + len(tt.values)
+			if tt.values == nil {
+				want = 5
+			}
+			if tt.ok && len(table.Columns) != want {
+				t.Errorf("added %d columns, want %d", len(table.Columns)-2, want-2)
+			}
+		})
+	}
+}
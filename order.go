@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+)
+
+// sortTablesByForeignKeys orders tables so that every table comes after the
+// tables it references, breaking ties by priority, highest first, and then
+// by name. A table gets the highest priority of the tables depending on it,
+// so it isn't left waiting behind them. Tables in or depending on a
+// reference cycle cannot be ordered; they are appended by name and returned
+// in cyclic so callers can report them. Self references are ignored.
+func sortTablesByForeignKeys(tables []TableMetadata, priorities map[string]int) (ordered []TableMetadata, cyclic []string) {
+	byName := make(map[string]TableMetadata)
+	for _, table := range tables {
+		byName[table.TableName] = table
+	}
+
+	// dependents[parent] lists the tables referencing parent.
+	dependents := make(map[string][]string)
+	pending := make(map[string]int)
+	for _, table := range tables {
+		parents := make(map[string]bool)
+		for _, field := range table.Fields {
+			if !field.IsForeignKey || field.ReferencedTable == nil {
+				continue
+			}
+			parent := *field.ReferencedTable
+			if parent == table.TableName || parents[parent] {
+				continue
+			}
+			if _, ok := byName[parent]; !ok {
+				continue
+			}
+			parents[parent] = true
+			dependents[parent] = append(dependents[parent], table.TableName)
+		}
+		pending[table.TableName] = len(parents)
+	}
+
+	// Referenced tables inherit the priority of their dependents; each pass
+	// carries it one reference further.
+	priority := make(map[string]int)
+	for name := range byName {
+		priority[name] = priorities[name]
+	}
+	for changed := true; changed; {
+		changed = false
+		for parent, children := range dependents {
+			for _, child := range children {
+				if priority[child] > priority[parent] {
+					priority[parent] = priority[child]
+					changed = true
+				}
+			}
+		}
+	}
+
+	var ready []string
+	for name, n := range pending {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if priority[ready[i]] != priority[ready[j]] {
+				return priority[ready[i]] > priority[ready[j]]
+			}
+			return ready[i] < ready[j]
+		})
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, byName[name])
+		delete(pending, name)
+
+		for _, child := range dependents[name] {
+			pending[child]--
+			if pending[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+
+	for name := range pending {
+		cyclic = append(cyclic, name)
+	}
+	sort.Strings(cyclic)
+	for _, name := range cyclic {
+		ordered = append(ordered, byName[name])
+	}
+
+	return ordered, cyclic
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// OutputConfig is a further output of a run: the tables written again in
+// Format to OutDir, from the same rows as the export's own files, so that
+// the source is read once for every team that wants its own format.
+type OutputConfig struct {
+	Format string `yaml:"format" toml:"format"`
+	OutDir string `yaml:"out_dir" toml:"out_dir"`
+}
+
+// validateOutputs checks the further outputs of a run against its own.
+func (c ExportConfig) validateOutputs() error {
+	for _, out := range c.Outputs {
+		if out.OutDir == "" {
+			return fmt.Errorf("output %s has no out_dir", out.Format)
+		}
+		switch out.Format {
+		case formatNPZ, formatParquet, formatFeather, formatCSV:
+		default:
+			return fmt.Errorf("unknown output format %q, expected %s, %s, %s or %s", out.Format, formatNPZ, formatParquet, formatFeather, formatCSV)
+		}
+		for _, other := range append(c.Outputs, OutputConfig{Format: c.Format, OutDir: c.OutDir}) {
+			if other != out && other.Format == out.Format && other.OutDir == out.OutDir {
+				return fmt.Errorf("%s files are already written to %s", out.Format, out.OutDir)
+			}
+		}
+	}
+	if len(c.Outputs) > 0 && c.Sink.Exec != "" {
+		return fmt.Errorf("outputs can't be used with an exec sink")
+	}
+	return nil
+}
+
+// parseOutputs parses the -outputs flag, a comma-separated list of
+// format=dir entries.
+func parseOutputs(s string) ([]OutputConfig, error) {
+	var outputs []OutputConfig
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		format, dir, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -outputs entry %q, expected format=dir", entry)
+		}
+		outputs = append(outputs, OutputConfig{Format: format, OutDir: dir})
+	}
+	return outputs, nil
+}
+
+// multiOutputWriter writes a table's file and the files of the further
+// outputs from the same batches of rows.
+type multiOutputWriter struct {
+	tableWriter
+	outputs []tableWriter
+}
+
+// newMultiOutputWriter adds the writers of the further outputs of cfg to
+// the writer of a table's own file.
+func newMultiOutputWriter(ctx context.Context, cfg ExportConfig, w tableWriter, tableName string, columns []FieldMetadata, spill spillConfig) (*multiOutputWriter, error) {
+	mw := &multiOutputWriter{tableWriter: w}
+	for _, out := range cfg.Outputs {
+		ocfg := cfg
+		ocfg.Format, ocfg.OutDir, ocfg.Outputs = out.Format, out.OutDir, nil
+		ow, err := newTableWriter(ctx, ocfg, tableName, columns, spill)
+		if err != nil {
+			mw.discard()
+			return nil, fmt.Errorf("%s output: %w", out.Format, err)
+		}
+		mw.outputs = append(mw.outputs, ow)
+	}
+	return mw, nil
+}
+
+func (w *multiOutputWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	if err := w.tableWriter.writeRows(ctx, rows); err != nil {
+		return err
+	}
+	for _, ow := range w.outputs {
+		if err := ow.writeRows(ctx, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *multiOutputWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	temp, err := w.tableWriter.close(ctx, files)
+	for i, ow := range w.outputs {
+		if err != nil {
+			for _, rest := range w.outputs[i:] {
+				rest.discard()
+			}
+			return temp, err
+		}
+		var n int64
+		n, err = ow.close(ctx, files)
+		temp += n
+	}
+	return temp, err
+}
+
+func (w *multiOutputWriter) discard() {
+	w.tableWriter.discard()
+	for _, ow := range w.outputs {
+		ow.discard()
+	}
+}
+
+// chunkStats returns the statistics of the chunks of the table's own file.
+func (w *multiOutputWriter) chunkStats() []ChunkStats {
+	if cw, ok := w.tableWriter.(chunkedWriter); ok {
+		return cw.chunkStats()
+	}
+	return nil
+}
@@ -0,0 +1,1370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"math/bits"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// parquetRowGroupRows and parquetRowGroupBytes bound the rows buffered
+	// per row group before it is written out. parquet.row_group_rows in the
+	// config lowers the row limit.
+	parquetRowGroupRows  = 1 << 20
+	parquetRowGroupBytes = 64 << 20
+	// parquetPageBytes is the default size of the values of a data page.
+	parquetPageBytes = 1 << 20
+	// parquetMaxStatBytes bounds the min and max values recorded in the
+	// statistics of a page or column chunk; longer ones are left out.
+	parquetMaxStatBytes = 256
+	// parquetDictionaryRatio is the largest share of distinct values of
+	// the strings of a row group for which auto encoded columns get a
+	// dictionary.
+	parquetDictionaryRatio = 0.1
+	// deltaBlockSize and deltaMiniblocks lay out DELTA_BINARY_PACKED
+	// values: blocks of 128 deltas, each bit-packed as 4 miniblocks.
+	deltaBlockSize    = 128
+	deltaMiniblocks   = 4
+	deltaMiniblockLen = deltaBlockSize / deltaMiniblocks
+
+	parquetMagic = "PAR1"
+)
+
+// Parquet physical types.
+const (
+	parquetBoolean    = 0
+	parquetInt32      = 1
+	parquetInt64      = 2
+	parquetDouble     = 5
+	parquetByteArray  = 6
+	parquetFixedBytes = 7
+)
+
+// Parquet converted types, written next to the logical types for older
+// readers.
+const (
+	convertedUTF8            = 0
+	convertedDecimal         = 5
+	convertedDate            = 6
+	convertedTimeMicros      = 8
+	convertedTimestampMicros = 10
+	convertedJSON            = 19
+)
+
+// Parquet encodings, page types and compression codecs.
+const (
+	encodingPlain             = 0
+	encodingRLE               = 3
+	encodingDeltaBinaryPacked = 5
+	encodingRLEDictionary     = 8
+	pageData                  = 0
+	pageDictionary            = 2
+	codecUncompressed         = 0
+	codecSnappy               = 1
+	codecGzip                 = 2
+	codecZstd                 = 6
+	repetitionRequired        = 0
+	repetitionOptional        = 1
+	logicalTypeString         = 1
+	logicalTypeDecimal        = 5
+	logicalTypeDate           = 6
+	logicalTypeTime           = 7
+	logicalTypeTimestamp      = 8
+	logicalTypeJSON           = 12
+	logicalTypeUUID           = 14
+	logicalTimeUnitMicros     = 2
+	parquetDecimalMaxInt64    = 18
+)
+
+// The encodings of parquet_columns in the config.
+const (
+	parquetEncodingAuto       = "auto"
+	parquetEncodingPlain      = "plain"
+	parquetEncodingDictionary = "dictionary"
+	parquetEncodingDelta      = "delta"
+)
+
+var parquetEncodings = []string{parquetEncodingAuto, parquetEncodingPlain, parquetEncodingDictionary, parquetEncodingDelta}
+
+// parquetCodecs are the compression codecs by their name in the config.
+var parquetCodecs = map[string]int32{
+	"none":   codecUncompressed,
+	"snappy": codecSnappy,
+	"gzip":   codecGzip,
+	"zstd":   codecZstd,
+}
+
+// parquetWriter writes a table as a Parquet file from batches of rows. Rows
+// are buffered per column until a row group is full, which is then
+// encoded, compressed and appended to the file, so memory is bounded by
+// the row group size.
+type parquetWriter struct {
+	path      string
+	tableName string
+	f         *os.File
+	w         *bufio.Writer
+	offset    int64
+	columns   []*parquetColumn
+	groups    []parquetRowGroup
+	rows      int64
+	groupRows int
+	stats     *chunkStatsBuilder
+	opts      parquetOptions
+	// sortBy are the indices of the columns the rows of a row group are
+	// sorted on, with pending the group's rows while they are buffered.
+	sortBy  []int
+	pending []TableRow
+}
+
+// parquetOptions tune the layout of a Parquet file.
+type parquetOptions struct {
+	// rowGroupRows bounds the rows of a row group, pageBytes the encoded
+	// values of a data page.
+	rowGroupRows int
+	pageBytes    int
+	// sortBy orders the rows within each row group.
+	sortBy []sortColumn
+	// codec compresses the pages of the columns, unless columns, by
+	// column, set their own encoding and codec.
+	codec   parquetCodec
+	columns map[string]parquetColumnOptions
+}
+
+// parquetColumnOptions are the encoding and compression of a column.
+type parquetColumnOptions struct {
+	encoding string
+	codec    parquetCodec
+}
+
+// parquetCodec is the compression of the pages of a column, by its name
+// in the config, with the level of zstd. The zero value is Snappy.
+type parquetCodec struct {
+	name  string
+	level int
+}
+
+// parseParquetCodec returns the codec named in the config, with a zstd
+// level of 1 to 22 for zstd, 0 for its default of 3.
+func parseParquetCodec(name string, level int) (parquetCodec, error) {
+	if _, ok := parquetCodecs[cmp.Or(name, "snappy")]; !ok {
+		return parquetCodec{}, fmt.Errorf("invalid parquet codec %q, expected snappy, zstd, gzip or none", name)
+	}
+	if level != 0 && name != "zstd" {
+		return parquetCodec{}, fmt.Errorf("zstd_level %d needs the zstd codec", level)
+	}
+	if level < 0 || level > 22 {
+		return parquetCodec{}, fmt.Errorf("invalid zstd_level %d, expected 1 to 22", level)
+	}
+	if name == "zstd" {
+		level = cmp.Or(level, 3)
+	}
+	return parquetCodec{name: name, level: level}, nil
+}
+
+// id returns the codec's CompressionCodec of the footer.
+func (c parquetCodec) id() int32 {
+	return parquetCodecs[cmp.Or(c.name, "snappy")]
+}
+
+// zstdEncoders are the zstd encoders of the levels used, shared by the
+// writers since EncodeAll may be called concurrently.
+var zstdEncoders struct {
+	sync.Mutex
+	byLevel map[int]*zstd.Encoder
+}
+
+// compress compresses the data of a page.
+func (c parquetCodec) compress(data []byte) ([]byte, error) {
+	switch c.id() {
+	case codecUncompressed:
+		return data, nil
+	case codecGzip:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case codecZstd:
+		zstdEncoders.Lock()
+		enc := zstdEncoders.byLevel[c.level]
+		if enc == nil {
+			var err error
+			enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				zstdEncoders.Unlock()
+				return nil, err
+			}
+			if zstdEncoders.byLevel == nil {
+				zstdEncoders.byLevel = make(map[int]*zstd.Encoder)
+			}
+			zstdEncoders.byLevel[c.level] = enc
+		}
+		zstdEncoders.Unlock()
+		return enc.EncodeAll(data, nil), nil
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// sortColumn is a column rows are sorted on, with nulls first.
+type sortColumn struct {
+	name       string
+	descending bool
+}
+
+// parquetColumn buffers the values of one column for the current row group.
+type parquetColumn struct {
+	field      FieldMetadata
+	physical   int32
+	typeLength int32
+	optional   bool
+	// encoding is the column's encoding in the config, with auto resolved
+	// to dictionary for dictionary encoded strings, and codec the
+	// compression of its pages. dictionary is set while the buffered
+	// values are dictionary codes.
+	encoding   string
+	codec      parquetCodec
+	dictionary bool
+
+	// present holds the definition level of every row, values the PLAIN
+	// encoding of the non-null values, and indices their dictionary codes.
+	present []uint32
+	values  []byte
+	bools   []bool
+	dict    *dictionaryBuilder
+	indices []uint32
+	// invalid counts the values that could not be converted to the
+	// column's type and were written as nulls.
+	invalid int
+}
+
+// parquetRowGroup and parquetChunk record where row groups and their
+// column chunks were written, for the footer.
+type parquetRowGroup struct {
+	chunks    []parquetChunk
+	rows      int64
+	totalSize int64
+}
+
+type parquetChunk struct {
+	encodings        []int32
+	codec            parquetCodec
+	values           int64
+	uncompressedSize int64
+	compressedSize   int64
+	dataOffset       int64
+	dictionaryOffset int64
+	stats            parquetStats
+}
+
+// parquetStats are the statistics of a page or column chunk: its nulls
+// and, when ok, the PLAIN encoding of its smallest and largest values.
+type parquetStats struct {
+	nulls    int64
+	min, max []byte
+	ok       bool
+}
+
+// parquetPage is the range of the rows of a column chunk written as one
+// data page, with the range of their non-null values and of the bytes of
+// those values in the column's buffer.
+type parquetPage struct {
+	rowStart, rowEnd     int
+	valueStart, valueEnd int
+	byteStart, byteEnd   int
+}
+
+// newParquetWriter creates the Parquet file of a table at path. The
+// columns' data types and encodings must be final.
+func newParquetWriter(path, tableName string, columns []FieldMetadata, opts parquetOptions) (*parquetWriter, error) {
+	if opts.rowGroupRows <= 0 {
+		opts.rowGroupRows = parquetRowGroupRows
+	}
+	if opts.pageBytes <= 0 {
+		opts.pageBytes = parquetPageBytes
+	}
+	for name := range opts.columns {
+		if !slices.ContainsFunc(columns, func(field FieldMetadata) bool { return field.FieldName == name }) {
+			return nil, fmt.Errorf("parquet_columns column %s is not exported", name)
+		}
+	}
+	var sortBy []int
+	for _, s := range opts.sortBy {
+		i := slices.IndexFunc(columns, func(field FieldMetadata) bool { return field.FieldName == s.name })
+		if i < 0 {
+			return nil, fmt.Errorf("sort_by column %s is not exported", s.name)
+		}
+		sortBy = append(sortBy, i)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &parquetWriter{path: path, tableName: tableName, f: f, w: bufio.NewWriter(f), stats: newChunkStatsBuilder(columns), opts: opts, sortBy: sortBy}
+	for _, field := range columns {
+		copts, ok := opts.columns[field.FieldName]
+		if !ok {
+			copts = parquetColumnOptions{encoding: parquetEncodingAuto, codec: opts.codec}
+		}
+		c, err := newParquetColumn(field, copts)
+		if err != nil {
+			f.Close()
+			os.Remove(path)
+			return nil, err
+		}
+		w.columns = append(w.columns, c)
+	}
+	if err := w.write([]byte(parquetMagic)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return w, nil
+}
+
+func newParquetColumn(field FieldMetadata, opts parquetColumnOptions) (*parquetColumn, error) {
+	c := &parquetColumn{field: field, optional: field.IsNullable, encoding: cmp.Or(opts.encoding, parquetEncodingAuto), codec: opts.codec}
+	switch {
+	case field.Encoding == EncodingHash, field.DataType == DataTypeInt, field.DataType == DataTypeTime,
+		field.DataType == DataTypeTimeOfDay:
+		c.physical = parquetInt64
+	case field.DataType == DataTypeFloat && field.Precision > parquetDecimalMaxInt64:
+		c.physical = parquetFixedBytes
+		c.typeLength = decimalByteLength(field.Precision)
+	case field.DataType == DataTypeFloat && field.Precision > 0:
+		c.physical = parquetInt64
+	case field.DataType == DataTypeFloat:
+		c.physical = parquetDouble
+	case field.DataType == DataTypeBool:
+		c.physical = parquetBoolean
+	case field.DataType == DataTypeDate:
+		c.physical = parquetInt32
+	case field.DataType == DataTypeUUID:
+		c.physical = parquetFixedBytes
+		c.typeLength = 16
+	default:
+		c.physical = parquetByteArray
+		if c.encoding == parquetEncodingAuto && field.Encoding == EncodingDictionary && field.DataType == DataTypeString {
+			c.encoding = parquetEncodingDictionary
+		}
+	}
+	switch {
+	case c.encoding == parquetEncodingDictionary && c.physical != parquetByteArray:
+		return nil, fmt.Errorf("column %s: dictionary encoding needs a string or bytes column", field.FieldName)
+	case c.encoding == parquetEncodingDelta && c.physical != parquetInt32 && c.physical != parquetInt64:
+		return nil, fmt.Errorf("column %s: delta encoding needs an integer, date or timestamp column", field.FieldName)
+	}
+	c.dictionary = c.encoding == parquetEncodingDictionary
+	if c.dictionary {
+		c.dict = newDictionaryBuilder(field.EnumValues...)
+	}
+	return c, nil
+}
+
+// decimalByteLength returns the bytes needed to store the unscaled values
+// of a decimal with the given precision in two's complement.
+func decimalByteLength(precision int) int32 {
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)), nil)
+	n := int32(1)
+	for limit.BitLen() > int(n)*8-1 {
+		n++
+	}
+	return n
+}
+
+func (w *parquetWriter) write(p []byte) error {
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return err
+}
+
+// writeRows buffers a batch of rows, writing out row groups as they fill
+// until ctx is canceled.
+// Rows to be sorted are kept as they are until their row group is full,
+// so those row groups are only bounded by their number of rows.
+func (w *parquetWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	for _, row := range rows {
+		if w.sortBy != nil {
+			w.pending = append(w.pending, row)
+		} else {
+			w.appendRow(row)
+		}
+		w.stats.add(row)
+		w.groupRows++
+		if w.groupRows >= w.opts.rowGroupRows || w.groupRows%1024 == 0 && w.bufferedBytes() >= parquetRowGroupBytes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := w.flushRowGroup(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *parquetWriter) appendRow(row TableRow) {
+	for _, c := range w.columns {
+		c.append(row[c.field.FieldName])
+	}
+}
+
+// sortPending sorts the rows of the row group on the sortBy columns and
+// appends them to the column buffers.
+func (w *parquetWriter) sortPending() {
+	sort.SliceStable(w.pending, func(i, j int) bool {
+		for k, col := range w.sortBy {
+			name := w.columns[col].field.FieldName
+			c := compareValues(w.pending[i][name], w.pending[j][name])
+			if w.opts.sortBy[k].descending && w.pending[i][name] != nil && w.pending[j][name] != nil {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	for _, row := range w.pending {
+		w.appendRow(row)
+	}
+	clear(w.pending)
+	w.pending = w.pending[:0]
+}
+
+// compareValues orders two values of a column, nulls first.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmp.Compare(a, b)
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return cmp.Compare(a, b)
+		}
+	case bool:
+		if b, ok := b.(bool); ok && a != b {
+			if a {
+				return 1
+			}
+			return -1
+		}
+		return 0
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b)
+		}
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b)
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func (w *parquetWriter) bufferedBytes() int64 {
+	var n int64
+	for _, c := range w.columns {
+		n += int64(len(c.values) + 4*len(c.indices) + len(c.bools) + 4*len(c.present))
+	}
+	return n
+}
+
+// append converts a value to the column's physical type and buffers it.
+func (c *parquetColumn) append(value interface{}) {
+	if value != nil {
+		if ok := c.appendValue(value); ok {
+			c.present = append(c.present, 1)
+			return
+		}
+		c.invalid++
+	}
+	if c.optional {
+		c.present = append(c.present, 0)
+		return
+	}
+	// Required columns have no way to store a null; write the zero value
+	// as the NPZ writer does.
+	c.present = append(c.present, 1)
+	switch c.physical {
+	case parquetBoolean:
+		c.bools = append(c.bools, false)
+	case parquetInt32:
+		c.values = binary.LittleEndian.AppendUint32(c.values, 0)
+	case parquetInt64, parquetDouble:
+		c.values = binary.LittleEndian.AppendUint64(c.values, 0)
+	case parquetFixedBytes:
+		c.values = append(c.values, make([]byte, c.typeLength)...)
+	default:
+		c.appendBytes(nil)
+	}
+}
+
+// appendValue buffers a non-null value and reports whether it could be
+// converted.
+func (c *parquetColumn) appendValue(value interface{}) bool {
+	field := c.field
+	switch {
+	case field.Encoding == EncodingHash:
+		v, ok := value.(int64)
+		c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+		return ok
+	case c.physical == parquetBoolean:
+		v, ok := value.(bool)
+		if ok {
+			c.bools = append(c.bools, v)
+		}
+		return ok
+	case field.DataType == DataTypeTime:
+		t, ok := timeValue(value)
+		if ok {
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(t.UnixMicro()))
+		}
+		return ok
+	case field.DataType == DataTypeTimeOfDay:
+		d, ok := timeOfDayValue(value)
+		if ok {
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(d.Microseconds()))
+		}
+		return ok
+	case field.DataType == DataTypeDate:
+		t, ok := timeValue(value)
+		if ok {
+			days := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(int32(days)))
+		}
+		return ok
+	case field.DataType == DataTypeUUID:
+		u, ok := uuidBytes(value)
+		if ok {
+			c.values = append(c.values, u[:]...)
+		}
+		return ok
+	case field.DataType == DataTypeFloat && field.Precision > 0:
+		unscaled, ok := decimalValue(value, field.Scale)
+		if !ok {
+			return false
+		}
+		if c.physical == parquetInt64 {
+			if !unscaled.IsInt64() {
+				return false
+			}
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(unscaled.Int64()))
+			return true
+		}
+		b, ok := twosComplement(unscaled, int(c.typeLength))
+		if ok {
+			c.values = append(c.values, b...)
+		}
+		return ok
+	case c.physical == parquetInt64:
+		switch v := value.(type) {
+		case int64:
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+		case int:
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+		case float64:
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(int64(v)))
+		default:
+			return false
+		}
+		return true
+	case c.physical == parquetDouble:
+		f, ok := moneyAmount(value)
+		if ok {
+			c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(f))
+		}
+		return ok
+	case field.DataType == DataTypeJSON, field.DataType == DataTypeArray:
+		s, _ := jsonText(value)
+		c.appendBytes([]byte(s))
+		return true
+	default:
+		switch v := value.(type) {
+		case string:
+			c.appendBytes([]byte(v))
+		case []byte:
+			c.appendBytes(v)
+		case time.Time:
+			c.appendBytes([]byte(v.Format(time.RFC3339)))
+		default:
+			c.appendBytes(fmt.Appendf(nil, "%v", v))
+		}
+		return true
+	}
+}
+
+func (c *parquetColumn) appendBytes(b []byte) {
+	if c.dictionary {
+		c.indices = append(c.indices, uint32(c.dict.code(string(b))))
+		return
+	}
+	c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(b)))
+	c.values = append(c.values, b...)
+}
+
+// timeValue returns the time of a timestamp or date value, parsing text.
+func timeValue(value interface{}) (time.Time, bool) {
+	var s string
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return time.Time{}, false
+	}
+	for _, layout := range isoDateFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// timeOfDayValue returns the time since midnight of a time of day value:
+// the clock of a time in UTC, as drivers return time and timetz columns on
+// the zero date, a duration read back from an export, or text.
+func timeOfDayValue(value interface{}) (time.Duration, bool) {
+	var s string
+	switch v := value.(type) {
+	case time.Duration:
+		return v, v >= 0 && v < 24*time.Hour
+	case time.Time:
+		t := v.UTC()
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+			time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond()), true
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return 0, false
+	}
+	for _, layout := range copyTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return timeOfDayValue(t)
+		}
+	}
+	return 0, false
+}
+
+// formatTimeOfDay formats a time since midnight as hh:mm:ss with its
+// fraction of a second.
+func formatTimeOfDay(d time.Duration) string {
+	return time.Unix(0, int64(d)).UTC().Format("15:04:05.999999999")
+}
+
+// uuidBytes parses the text form of a UUID.
+func uuidBytes(value interface{}) ([16]byte, bool) {
+	var u [16]byte
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case [16]byte:
+		return v, true
+	default:
+		return u, false
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return u, false
+	}
+	copy(u[:], b)
+	return u, true
+}
+
+// decimalValue returns the unscaled integer of a decimal value, rounding
+// half away from zero to the column's scale.
+func decimalValue(value interface{}, scale int) (*big.Int, bool) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return nil, false
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return nil, false
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if m.Abs(m).Lsh(m, 1).Cmp(r.Denom()) >= 0 {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q, true
+}
+
+// twosComplement encodes v as an n-byte big-endian two's complement number.
+func twosComplement(v *big.Int, n int) ([]byte, bool) {
+	if v.BitLen() > n*8-1 {
+		return nil, false
+	}
+	b := make([]byte, n)
+	if v.Sign() >= 0 {
+		v.FillBytes(b)
+		return b, true
+	}
+	// -v = 2^(8n) - |v|
+	mod := new(big.Int).Lsh(big.NewInt(1), uint(n*8))
+	mod.Add(mod, v).FillBytes(b)
+	return b, true
+}
+
+// flushRowGroup writes the buffered values of every column as a column
+// chunk with an optional dictionary page and one data page.
+func (w *parquetWriter) flushRowGroup() error {
+	if w.groupRows == 0 {
+		return nil
+	}
+	if w.sortBy != nil {
+		w.sortPending()
+	}
+	group := parquetRowGroup{rows: int64(w.groupRows)}
+	for _, c := range w.columns {
+		chunk, err := w.writeChunk(c)
+		if err != nil {
+			return fmt.Errorf("writing column %s: %w", c.field.FieldName, err)
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.totalSize += chunk.uncompressedSize
+	}
+	w.groups = append(w.groups, group)
+	w.stats.flush()
+	w.rows += int64(w.groupRows)
+	w.groupRows = 0
+	return nil
+}
+
+// chunkStats returns the statistics of the row groups written.
+func (w *parquetWriter) chunkStats() []ChunkStats {
+	return w.stats.chunks
+}
+
+func (w *parquetWriter) writeChunk(c *parquetColumn) (parquetChunk, error) {
+	chunk := parquetChunk{values: int64(len(c.present)), dictionaryOffset: -1, codec: c.codec}
+	valueEncoding := c.chooseEncoding()
+	if valueEncoding != encodingDeltaBinaryPacked {
+		// The values or the dictionary page are PLAIN.
+		chunk.encodings = append(chunk.encodings, encodingPlain)
+	}
+	if c.optional {
+		chunk.encodings = append(chunk.encodings, encodingRLE)
+	}
+	if valueEncoding != encodingPlain {
+		chunk.encodings = append(chunk.encodings, valueEncoding)
+	}
+
+	width := 0
+	if c.dictionary {
+		var dict []byte
+		for _, v := range c.dict.values {
+			dict = binary.LittleEndian.AppendUint32(dict, uint32(len(v)))
+			dict = append(dict, v...)
+		}
+		chunk.dictionaryOffset = w.offset
+		if err := w.writePage(&chunk, pageDictionary, dict, func(t *thriftWriter) {
+			t.structField(7, func() {
+				t.i32Field(1, int32(len(c.dict.values)))
+				t.i32Field(2, encodingPlain)
+			})
+		}); err != nil {
+			return chunk, err
+		}
+
+		width = max(1, bits.Len32(uint32(len(c.dict.values)-1)))
+	}
+
+	chunk.dataOffset = w.offset
+	pages := c.pages(w.opts.pageBytes)
+	for _, p := range pages {
+		var page []byte
+		if c.optional {
+			levels := encodeHybrid(c.present[p.rowStart:p.rowEnd], 1)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+			page = append(page, levels...)
+		}
+		switch {
+		case c.dictionary:
+			page = append(page, byte(width))
+			page = append(page, encodeHybrid(c.indices[p.valueStart:p.valueEnd], width)...)
+		case c.physical == parquetBoolean:
+			page = append(page, packBools(c.bools[p.valueStart:p.valueEnd])...)
+		case valueEncoding == encodingDeltaBinaryPacked:
+			page = append(page, encodeDelta(c.values[p.byteStart:p.byteEnd], c.valueSize(0))...)
+		default:
+			page = append(page, c.values[p.byteStart:p.byteEnd]...)
+		}
+
+		stats := c.statistics(p)
+		if err := w.writePage(&chunk, pageData, page, func(t *thriftWriter) {
+			t.structField(5, func() {
+				t.i32Field(1, int32(p.rowEnd-p.rowStart))
+				t.i32Field(2, valueEncoding)
+				t.i32Field(3, encodingRLE)
+				t.i32Field(4, encodingRLE)
+				t.structField(5, func() { stats.write(t) })
+			})
+		}); err != nil {
+			return chunk, err
+		}
+	}
+	chunk.stats = c.statistics(parquetPage{rowEnd: len(c.present), valueEnd: pages[len(pages)-1].valueEnd, byteEnd: len(c.values)})
+
+	if c.invalid > 0 {
+		log.Printf("column %s.%s: %d values could not be converted to the Parquet type and were written as null",
+			w.tableName, c.field.FieldName, c.invalid)
+	}
+	c.present, c.values, c.bools, c.indices, c.invalid = c.present[:0], c.values[:0], c.bools[:0], c.indices[:0], 0
+	c.dictionary, c.dict = c.encoding == parquetEncodingDictionary, nil
+	if c.dictionary {
+		c.dict = newDictionaryBuilder(c.field.EnumValues...)
+	}
+	return chunk, nil
+}
+
+// chooseEncoding returns the encoding of the values buffered for the row
+// group. Auto encoded columns get a dictionary when their strings have few
+// distinct values, and delta encoding when that makes their integers
+// smaller, as it does for timestamps and increasing ids.
+func (c *parquetColumn) chooseEncoding() int32 {
+	switch {
+	case c.dictionary:
+		return encodingRLEDictionary
+	case c.encoding == parquetEncodingDelta:
+		return encodingDeltaBinaryPacked
+	case c.encoding != parquetEncodingAuto:
+		return encodingPlain
+	case c.physical == parquetByteArray:
+		if c.dictionaryEncode() {
+			return encodingRLEDictionary
+		}
+	case c.physical == parquetInt32, c.physical == parquetInt64:
+		if len(encodeDelta(c.values, c.valueSize(0))) < len(c.values) {
+			return encodingDeltaBinaryPacked
+		}
+	}
+	return encodingPlain
+}
+
+// dictionaryEncode replaces the buffered strings of the row group with
+// dictionary codes when at most parquetDictionaryRatio of them are
+// distinct, and reports whether it did.
+func (c *parquetColumn) dictionaryEncode() bool {
+	n := 0
+	for _, level := range c.present {
+		n += int(level)
+	}
+	limit := int(parquetDictionaryRatio * float64(n))
+	dict := newDictionaryBuilder()
+	indices := make([]uint32, 0, n)
+	for i := 0; i < len(c.values); {
+		size := int(binary.LittleEndian.Uint32(c.values[i:]))
+		indices = append(indices, uint32(dict.code(string(c.values[i+4:i+4+size]))))
+		if len(dict.values) > limit {
+			return false
+		}
+		i += 4 + size
+	}
+	c.dictionary, c.dict, c.indices, c.values = true, dict, indices, c.values[:0]
+	return true
+}
+
+// encodeDelta encodes little-endian integers of size bytes, 4 or 8, with
+// the DELTA_BINARY_PACKED encoding. Deltas wrap around in the width of the
+// values, as readers decode them.
+func encodeDelta(values []byte, size int) []byte {
+	n := len(values) / size
+	value := func(i int) int64 {
+		if size == 4 {
+			return int64(int32(binary.LittleEndian.Uint32(values[i*4:])))
+		}
+		return int64(binary.LittleEndian.Uint64(values[i*8:]))
+	}
+
+	out := binary.AppendUvarint(nil, deltaBlockSize)
+	out = binary.AppendUvarint(out, deltaMiniblocks)
+	out = binary.AppendUvarint(out, uint64(n))
+	if n == 0 {
+		return binary.AppendVarint(out, 0)
+	}
+	prev := value(0)
+	out = binary.AppendVarint(out, prev)
+
+	deltas := make([]int64, 0, deltaBlockSize)
+	for start := 1; start < n; start += deltaBlockSize {
+		deltas = deltas[:0]
+		for i := start; i < min(start+deltaBlockSize, n); i++ {
+			v := value(i)
+			d := v - prev
+			if size == 4 {
+				d = int64(int32(d))
+			}
+			deltas = append(deltas, d)
+			prev = v
+		}
+		minDelta := slices.Min(deltas)
+		out = binary.AppendVarint(out, minDelta)
+
+		// The bit widths of the miniblocks precede them; those of unused
+		// miniblocks of the last block are 0 and their bodies left out.
+		widths := len(out)
+		out = append(out, make([]byte, deltaMiniblocks)...)
+		for m := 0; m*deltaMiniblockLen < len(deltas); m++ {
+			block := deltas[m*deltaMiniblockLen : min((m+1)*deltaMiniblockLen, len(deltas))]
+			var largest uint64
+			for _, d := range block {
+				largest = max(largest, uint64(d-minDelta))
+			}
+			width := bits.Len64(largest)
+			out[widths+m] = byte(width)
+			packed := make([]byte, deltaMiniblockLen*width/8)
+			for k, d := range block {
+				u := uint64(d - minDelta)
+				for b := 0; b < width; b++ {
+					if u>>b&1 == 1 {
+						bit := k*width + b
+						packed[bit/8] |= 1 << (bit % 8)
+					}
+				}
+			}
+			out = append(out, packed...)
+		}
+	}
+	return out
+}
+
+// pages splits the buffered rows of a column into data pages of about
+// limit bytes of values each.
+func (c *parquetColumn) pages(limit int) []parquetPage {
+	var pages []parquetPage
+	var p parquetPage
+	size := 0
+	for i, level := range c.present {
+		if level == 1 {
+			n := c.valueSize(p.byteEnd)
+			p.valueEnd++
+			if !c.dictionary && c.physical != parquetBoolean {
+				p.byteEnd += n
+			}
+			size += n
+		}
+		p.rowEnd = i + 1
+		if size >= limit {
+			pages = append(pages, p)
+			p = parquetPage{rowStart: p.rowEnd, rowEnd: p.rowEnd, valueStart: p.valueEnd, valueEnd: p.valueEnd, byteStart: p.byteEnd, byteEnd: p.byteEnd}
+			size = 0
+		}
+	}
+	if p.rowEnd > p.rowStart || len(pages) == 0 {
+		pages = append(pages, p)
+	}
+	return pages
+}
+
+// valueSize returns the encoded size of the value at offset of the
+// column's buffer: for dictionary codes and booleans, which are not kept
+// there, an estimate.
+func (c *parquetColumn) valueSize(offset int) int {
+	switch {
+	case c.dictionary:
+		return 4
+	case c.physical == parquetBoolean:
+		return 1
+	case c.physical == parquetInt32:
+		return 4
+	case c.physical == parquetInt64, c.physical == parquetDouble:
+		return 8
+	case c.physical == parquetFixedBytes:
+		return int(c.typeLength)
+	}
+	return 4 + int(binary.LittleEndian.Uint32(c.values[offset:]))
+}
+
+// statistics returns the nulls and the range of the values of a page
+// range. Decimals and UUIDs stored as fixed-length bytes, whose order
+// differs from that of their bytes, and NaNs get no range.
+func (c *parquetColumn) statistics(p parquetPage) parquetStats {
+	stats := parquetStats{nulls: int64((p.rowEnd - p.rowStart) - (p.valueEnd - p.valueStart))}
+	var less func(a, b []byte) bool
+	switch c.physical {
+	case parquetInt32:
+		less = func(a, b []byte) bool {
+			return int32(binary.LittleEndian.Uint32(a)) < int32(binary.LittleEndian.Uint32(b))
+		}
+	case parquetInt64:
+		less = func(a, b []byte) bool {
+			return int64(binary.LittleEndian.Uint64(a)) < int64(binary.LittleEndian.Uint64(b))
+		}
+	case parquetDouble:
+		less = func(a, b []byte) bool {
+			return math.Float64frombits(binary.LittleEndian.Uint64(a)) < math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+	case parquetBoolean, parquetByteArray:
+		less = func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+	default:
+		return stats
+	}
+	add := func(v []byte) {
+		if !stats.ok {
+			stats.min, stats.max, stats.ok = v, v, true
+			return
+		}
+		if less(v, stats.min) {
+			stats.min = v
+		}
+		if less(stats.max, v) {
+			stats.max = v
+		}
+	}
+
+	switch {
+	case c.dictionary:
+		for _, code := range c.indices[p.valueStart:p.valueEnd] {
+			add([]byte(c.dict.values[code]))
+		}
+	case c.physical == parquetBoolean:
+		for _, v := range c.bools[p.valueStart:p.valueEnd] {
+			if v {
+				add([]byte{1})
+			} else {
+				add([]byte{0})
+			}
+		}
+	case c.physical == parquetByteArray:
+		for i := p.byteStart; i < p.byteEnd; {
+			n := int(binary.LittleEndian.Uint32(c.values[i:]))
+			add(c.values[i+4 : i+4+n])
+			i += 4 + n
+		}
+	default:
+		size := c.valueSize(0)
+		for i := p.byteStart; i < p.byteEnd; i += size {
+			v := c.values[i : i+size]
+			if c.physical == parquetDouble && math.IsNaN(math.Float64frombits(binary.LittleEndian.Uint64(v))) {
+				continue
+			}
+			add(v)
+		}
+	}
+	if len(stats.min) > parquetMaxStatBytes || len(stats.max) > parquetMaxStatBytes {
+		stats.ok = false
+	}
+	// The values are copied, since the buffers are reused.
+	stats.min, stats.max = bytes.Clone(stats.min), bytes.Clone(stats.max)
+	return stats
+}
+
+// write writes the fields of the Statistics struct.
+func (s parquetStats) write(t *thriftWriter) {
+	t.i64Field(3, s.nulls)
+	if s.ok {
+		t.stringField(5, string(s.max))
+		t.stringField(6, string(s.min))
+	}
+}
+
+// writePage compresses a page and writes it with its header; header adds
+// the page type specific header fields.
+func (w *parquetWriter) writePage(chunk *parquetChunk, pageType int32, data []byte, header func(*thriftWriter)) error {
+	compressed, err := chunk.codec.compress(data)
+	if err != nil {
+		return err
+	}
+	t := &thriftWriter{}
+	t.writeStruct(func() {
+		t.i32Field(1, pageType)
+		t.i32Field(2, int32(len(data)))
+		t.i32Field(3, int32(len(compressed)))
+		header(t)
+	})
+	chunk.uncompressedSize += int64(len(t.buf) + len(data))
+	chunk.compressedSize += int64(len(t.buf) + len(compressed))
+	if err := w.write(t.buf); err != nil {
+		return err
+	}
+	return w.write(compressed)
+}
+
+// packBools bit-packs booleans LSB first, as the PLAIN encoding requires.
+func packBools(values []bool) []byte {
+	b := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			b[i/8] |= 1 << (i % 8)
+		}
+	}
+	return b
+}
+
+// encodeHybrid encodes values with the RLE/bit-packing hybrid encoding:
+// runs of at least 8 equal values as RLE runs, the rest bit-packed in
+// groups of 8.
+func encodeHybrid(values []uint32, width int) []byte {
+	runLength := func(i int) int {
+		j := i + 1
+		for j < len(values) && values[j] == values[i] {
+			j++
+		}
+		return j - i
+	}
+
+	var out []byte
+	for i := 0; i < len(values); {
+		if run := runLength(i); run >= 8 {
+			out = binary.AppendUvarint(out, uint64(run)<<1)
+			for b := 0; b < (width+7)/8; b++ {
+				out = append(out, byte(values[i]>>(8*b)))
+			}
+			i += run
+			continue
+		}
+
+		// Bit-pack groups of 8 until an RLE run starts at a group boundary.
+		// Only the last group of the data may be padded.
+		start := i
+		for i < len(values) {
+			i += 8
+			if i < len(values) && runLength(i) >= 8 {
+				break
+			}
+		}
+		groups := (min(i, len(values)) - start + 7) / 8
+		out = binary.AppendUvarint(out, uint64(groups)<<1|1)
+		packed := make([]byte, groups*width)
+		for k := 0; k < groups*8 && start+k < len(values); k++ {
+			v := values[start+k]
+			for b := 0; b < width; b++ {
+				if v>>b&1 == 1 {
+					bit := k*width + b
+					packed[bit/8] |= 1 << (bit % 8)
+				}
+			}
+		}
+		out = append(out, packed...)
+	}
+	return out
+}
+
+// close writes the last row group and the footer. The entries of files are
+// stored as key-value metadata. Parquet files need no temporary files, so
+// it returns 0 temporary bytes.
+func (w *parquetWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.flushRowGroup(); err != nil {
+		w.discard()
+		return 0, err
+	}
+
+	t := &thriftWriter{}
+	t.writeStruct(func() { w.writeFooter(t, files) })
+	footer := t.buf
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(t.buf)))
+	footer = append(footer, parquetMagic...)
+	if err := w.write(footer); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.w.Flush(); err != nil {
+		w.discard()
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.path)
+		return 0, err
+	}
+
+	log.Printf("Table %q saved successfully to %s", w.tableName, w.path)
+	return 0, nil
+}
+
+// writeFooter writes the FileMetaData struct.
+func (w *parquetWriter) writeFooter(t *thriftWriter, files map[string][]byte) {
+	t.i32Field(1, 1)
+	t.structListField(2, len(w.columns)+1, func(i int) {
+		if i == 0 {
+			t.stringField(4, w.tableName)
+			t.i32Field(5, int32(len(w.columns)))
+			return
+		}
+		w.columns[i-1].writeSchemaElement(t)
+	})
+	t.i64Field(3, w.rows)
+	t.structListField(4, len(w.groups), func(i int) {
+		group := w.groups[i]
+		t.structListField(1, len(group.chunks), func(j int) {
+			chunk := group.chunks[j]
+			c := w.columns[j]
+			offset := chunk.dataOffset
+			if chunk.dictionaryOffset >= 0 {
+				offset = chunk.dictionaryOffset
+			}
+			t.i64Field(2, offset)
+			t.structField(3, func() {
+				t.i32Field(1, c.physical)
+				t.i32ListField(2, chunk.encodings)
+				t.stringListField(3, []string{c.field.FieldName})
+				t.i32Field(4, chunk.codec.id())
+				t.i64Field(5, chunk.values)
+				t.i64Field(6, chunk.uncompressedSize)
+				t.i64Field(7, chunk.compressedSize)
+				t.i64Field(9, chunk.dataOffset)
+				if chunk.dictionaryOffset >= 0 {
+					t.i64Field(11, chunk.dictionaryOffset)
+				}
+				t.structField(12, func() { chunk.stats.write(t) })
+			})
+		})
+		t.i64Field(2, group.totalSize)
+		t.i64Field(3, group.rows)
+		if len(w.sortBy) > 0 {
+			t.structListField(4, len(w.sortBy), func(k int) {
+				t.i32Field(1, int32(w.sortBy[k]))
+				t.boolField(2, w.opts.sortBy[k].descending)
+				t.boolField(3, true)
+			})
+		}
+	})
+
+	if len(files) > 0 {
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.structListField(5, len(names), func(i int) {
+			t.stringField(1, names[i])
+			t.stringField(2, string(files[names[i]]))
+		})
+	}
+	t.stringField(6, "npyio-starter-kit version "+ToolVersion)
+}
+
+// writeSchemaElement describes the column in the file schema, with its
+// logical type and the equivalent converted type.
+func (c *parquetColumn) writeSchemaElement(t *thriftWriter) {
+	field := c.field
+	t.i32Field(1, c.physical)
+	if c.physical == parquetFixedBytes {
+		t.i32Field(2, c.typeLength)
+	}
+	repetition := int32(repetitionRequired)
+	if c.optional {
+		repetition = repetitionOptional
+	}
+	t.i32Field(3, repetition)
+	t.stringField(4, field.FieldName)
+
+	isDecimal := field.DataType == DataTypeFloat && field.Precision > 0
+	switch {
+	case field.Encoding == EncodingHash:
+	case field.DataType == DataTypeTime:
+		t.i32Field(6, convertedTimestampMicros)
+		t.structField(10, func() {
+			t.structField(logicalTypeTimestamp, func() {
+				t.boolField(1, true)
+				t.structField(2, func() {
+					t.structField(logicalTimeUnitMicros, func() {})
+				})
+			})
+		})
+	case field.DataType == DataTypeTimeOfDay:
+		t.i32Field(6, convertedTimeMicros)
+		t.structField(10, func() {
+			t.structField(logicalTypeTime, func() {
+				t.boolField(1, true)
+				t.structField(2, func() {
+					t.structField(logicalTimeUnitMicros, func() {})
+				})
+			})
+		})
+	case field.DataType == DataTypeDate:
+		t.i32Field(6, convertedDate)
+		t.structField(10, func() {
+			t.structField(logicalTypeDate, func() {})
+		})
+	case isDecimal:
+		t.i32Field(6, convertedDecimal)
+		t.i32Field(7, int32(field.Scale))
+		t.i32Field(8, int32(field.Precision))
+		t.structField(10, func() {
+			t.structField(logicalTypeDecimal, func() {
+				t.i32Field(1, int32(field.Scale))
+				t.i32Field(2, int32(field.Precision))
+			})
+		})
+	case field.DataType == DataTypeUUID:
+		t.structField(10, func() {
+			t.structField(logicalTypeUUID, func() {})
+		})
+	case field.DataType == DataTypeJSON, field.DataType == DataTypeArray:
+		t.i32Field(6, convertedJSON)
+		t.structField(10, func() {
+			t.structField(logicalTypeJSON, func() {})
+		})
+	case field.DataType == DataTypeBytes:
+		// Plain BYTE_ARRAY, not text.
+	case c.physical == parquetByteArray:
+		t.i32Field(6, convertedUTF8)
+		t.structField(10, func() {
+			t.structField(logicalTypeString, func() {})
+		})
+	}
+}
+
+// discard removes the partially written file of a table that failed to
+// export.
+func (w *parquetWriter) discard() {
+	w.f.Close()
+	os.Remove(w.path)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fahadsiddiqui/npyio-starter-kit/reader"
+)
+
+func TestParquetEncodings(t *testing.T) {
+	columns := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt},
+		{FieldName: "created_at", DataType: DataTypeTime, IsNullable: true},
+		{FieldName: "day", DataType: DataTypeDate},
+		{FieldName: "status", DataType: DataTypeString},
+		{FieldName: "name", DataType: DataTypeString, IsNullable: true},
+		{FieldName: "extreme", DataType: DataTypeInt},
+		{FieldName: "opens_at", DataType: DataTypeTimeOfDay},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var rows []TableRow
+	for i := range 1000 {
+		row := TableRow{
+			"id":         int64(i * 3),
+			"created_at": start.Add(time.Duration(i) * time.Second),
+			"day":        start.AddDate(0, 0, i/100),
+			"status":     []string{"new", "paid", "shipped"}[i%3],
+			"name":       fmt.Sprintf("user %d", i),
+			"extreme":    []int64{math.MinInt64, math.MaxInt64, 0}[i%3],
+			"opens_at":   time.Duration(i%48) * 30 * time.Minute,
+		}
+		if i%7 == 0 {
+			row["created_at"], row["name"] = nil, nil
+		}
+		rows = append(rows, row)
+	}
+
+	tests := []struct {
+		codec   string
+		level   int
+		columns map[string]parquetColumnOptions
+		// want are the value encodings expected of the columns.
+		want []int32
+	}{
+		{codec: "snappy", want: []int32{encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingRLEDictionary, encodingPlain, encodingPlain, encodingDeltaBinaryPacked}},
+		{codec: "zstd", level: 19, want: []int32{encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingRLEDictionary, encodingPlain, encodingPlain, encodingDeltaBinaryPacked}},
+		{codec: "gzip", want: []int32{encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingRLEDictionary, encodingPlain, encodingPlain, encodingDeltaBinaryPacked}},
+		{
+			codec: "none",
+			columns: map[string]parquetColumnOptions{
+				"id":      {encoding: parquetEncodingPlain},
+				"status":  {encoding: parquetEncodingPlain, codec: parquetCodec{name: "zstd", level: 3}},
+				"name":    {encoding: parquetEncodingDictionary},
+				"extreme": {encoding: parquetEncodingDelta},
+			},
+			want: []int32{encodingPlain, encodingDeltaBinaryPacked, encodingDeltaBinaryPacked, encodingPlain, encodingRLEDictionary, encodingDeltaBinaryPacked, encodingDeltaBinaryPacked},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			dir := t.TempDir()
+			codec, err := parseParquetCodec(tt.codec, tt.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := parquetOptions{rowGroupRows: 300, pageBytes: 512, codec: codec, columns: tt.columns}
+			w, err := newParquetWriter(filepath.Join(dir, "t.parquet"), "t", columns, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.writeRows(context.Background(), rows); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.close(context.Background(), nil); err != nil {
+				t.Fatal(err)
+			}
+			for j, c := range w.groups[0].chunks {
+				if !slices.Contains(c.encodings, tt.want[j]) {
+					t.Errorf("column %s has encodings %v, want %d", columns[j].FieldName, c.encodings, tt.want[j])
+				}
+			}
+
+			meta, err := json.Marshal(map[string]any{"schema": []map[string]any{{"table_or_collection_name": "t", "fields": columns}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "metadata.json"), meta, 0644); err != nil {
+				t.Fatal(err)
+			}
+			ds, err := reader.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table, err := ds.Table("t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range columns {
+				col, err := table.Column(field.FieldName)
+				if err != nil {
+					t.Fatalf("reading %s: %v", field.FieldName, err)
+				}
+				if col.Len() != len(rows) {
+					t.Fatalf("%s has %d values, want %d", field.FieldName, col.Len(), len(rows))
+				}
+				for i, row := range rows {
+					got, want := col.Value(i), row[field.FieldName]
+					if fmt.Sprint(got) != fmt.Sprint(want) {
+						t.Fatalf("%s[%d] = %v, want %v", field.FieldName, i, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Once the export is canceled, the writers stop before writing out the next
+// row group or record batch.
+func TestWriteRowsCanceled(t *testing.T) {
+	columns := []FieldMetadata{{FieldName: "id", DataType: DataTypeInt}}
+	rows := make([]TableRow, 3000)
+	for i := range rows {
+		rows[i] = TableRow{"id": int64(i)}
+	}
+	dir := t.TempDir()
+	pw, err := newParquetWriter(filepath.Join(dir, "t.parquet"), "t", columns, parquetOptions{rowGroupRows: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, err := newArrowWriter(filepath.Join(dir, "t.feather"), "t", columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, w := range []tableWriter{pw, aw} {
+		if err := w.writeRows(ctx, slices.Repeat(rows, 1+arrowBatchRows/len(rows))); !errors.Is(err, context.Canceled) {
+			t.Errorf("%T.writeRows() = %v, want %v", w, err, context.Canceled)
+		}
+		w.discard()
+	}
+}
+
+func TestParseParquetCodec(t *testing.T) {
+	tests := []struct {
+		name  string
+		level int
+		want  parquetCodec
+		ok    bool
+	}{
+		{"", 0, parquetCodec{}, true},
+		{"zstd", 0, parquetCodec{name: "zstd", level: 3}, true},
+		{"zstd", 19, parquetCodec{name: "zstd", level: 19}, true},
+		{"none", 0, parquetCodec{name: "none"}, true},
+		{"zstd", 23, parquetCodec{}, false},
+		{"snappy", 5, parquetCodec{}, false},
+		{"lz4", 0, parquetCodec{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseParquetCodec(tt.name, tt.level)
+		if (err == nil) != tt.ok || tt.ok && got != tt.want {
+			t.Errorf("parseParquetCodec(%q, %d) = %v, %v, want %v", tt.name, tt.level, got, err, tt.want)
+		}
+	}
+}
+
+// pyarrowCheck prints the arrow types and the values of the columns of the
+// Parquet and Feather files it is given, as JSON, with timestamps in
+// microseconds and dates and times of day in ISO format.
+const pyarrowCheck = `
+import datetime, json, sys
+import pyarrow as pa, pyarrow.feather, pyarrow.parquet
+
+def kind(t):
+    if pa.types.is_dictionary(t):
+        t = t.value_type
+    for name in ("int64", "float64", "boolean", "string", "date32", "time64", "timestamp"):
+        if getattr(pa.types, "is_" + name)(t):
+            return name
+    return str(t)
+
+def value(v):
+    if isinstance(v, datetime.datetime):
+        if v.tzinfo is None:
+            v = v.replace(tzinfo=datetime.timezone.utc)
+        return (v - datetime.datetime(1970, 1, 1, tzinfo=datetime.timezone.utc)) // datetime.timedelta(microseconds=1)
+    if isinstance(v, (datetime.date, datetime.time)):
+        return v.isoformat()
+    return v
+
+out = {}
+for path in sys.argv[1:]:
+    table = pa.parquet.read_table(path) if path.endswith(".parquet") else pa.feather.read_table(path)
+    out[path] = {f.name: {"type": kind(f.type), "values": [value(v) for v in table.column(f.name).to_pylist()]} for f in table.schema}
+json.dump(out, sys.stdout)
+`
+
+// The Parquet and Feather writers are written from the format specs, so
+// check that pyarrow reads what they write with the expected types.
+func TestPyarrowReadsWriters(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not found")
+	}
+	if err := exec.Command(python, "-c", "import pyarrow").Run(); err != nil {
+		t.Skip("pyarrow not installed")
+	}
+
+	columns := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt},
+		{FieldName: "price", DataType: DataTypeFloat, IsNullable: true},
+		{FieldName: "active", DataType: DataTypeBool},
+		{FieldName: "status", DataType: DataTypeString},
+		{FieldName: "created_at", DataType: DataTypeTime, IsNullable: true},
+		{FieldName: "day", DataType: DataTypeDate},
+		{FieldName: "opens_at", DataType: DataTypeTimeOfDay},
+	}
+	kinds := map[string]string{
+		"id": "int64", "price": "float64", "active": "boolean", "status": "string",
+		"created_at": "timestamp", "day": "date32", "opens_at": "time64",
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var rows []TableRow
+	want := map[string][]any{}
+	for i := range 500 {
+		row := TableRow{
+			"id":         int64(i),
+			"price":      float64(i) / 4,
+			"active":     i%2 == 0,
+			"status":     []string{"new", "paid", "shipped"}[i%3],
+			"created_at": start.Add(time.Duration(i) * 1500 * time.Millisecond),
+			"day":        start.AddDate(0, 0, i/50),
+			"opens_at":   time.Duration(i%48) * 30 * time.Minute,
+		}
+		if i%7 == 0 {
+			row["price"], row["created_at"] = nil, nil
+		}
+		rows = append(rows, row)
+		for name, v := range row {
+			switch v := v.(type) {
+			case int64:
+				want[name] = append(want[name], float64(v))
+			case time.Time:
+				if name == "day" {
+					want[name] = append(want[name], v.Format(time.DateOnly))
+				} else {
+					want[name] = append(want[name], float64(v.UnixMicro()))
+				}
+			case time.Duration:
+				want[name] = append(want[name], formatTimeOfDay(v))
+			default:
+				want[name] = append(want[name], v)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	pw, err := newParquetWriter(filepath.Join(dir, "t.parquet"), "t", columns, parquetOptions{rowGroupRows: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, err := newArrowWriter(filepath.Join(dir, "t.feather"), "t", columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []tableWriter{pw, aw} {
+		if err := w.writeRows(context.Background(), rows); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.close(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := []string{pw.path, aw.path}
+	cmd := exec.Command(python, append([]string{"-c", pyarrowCheck}, paths...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("pyarrow failed to read the files: %v\n%s", err, stderr.Bytes())
+	}
+	var got map[string]map[string]struct {
+		Type   string `json:"type"`
+		Values []any  `json:"values"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		for _, field := range columns {
+			col, ok := got[path][field.FieldName]
+			if !ok {
+				t.Errorf("%s: pyarrow read no column %s", filepath.Base(path), field.FieldName)
+				continue
+			}
+			if col.Type != kinds[field.FieldName] {
+				t.Errorf("%s: %s read as %s, want %s", filepath.Base(path), field.FieldName, col.Type, kinds[field.FieldName])
+			}
+			if !slices.Equal(col.Values, want[field.FieldName]) {
+				t.Errorf("%s: %s read as %v, want %v", filepath.Base(path), field.FieldName, col.Values, want[field.FieldName])
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// partitionsFile is the manifest of the partitions of hot/cold tables in
+// the output directory, merged across runs.
+const partitionsFile = "partitions.json"
+
+// Partitions of a hot/cold table, exported as <table>.hot and <table>.cold.
+const (
+	partitionHot  = "hot"
+	partitionCold = "cold"
+)
+
+// HotColdConfig splits a table on a timestamp or date column into a hot
+// partition of recent rows, exported by every run, and a cold partition of
+// the older ones, exported again only once it is ColdEvery old.
+type HotColdConfig struct {
+	Column string `yaml:"column" toml:"column"`
+	// HotWindow is how far before the start of the current day, in UTC,
+	// the hot partition reaches, as a duration such as 168h.
+	HotWindow string `yaml:"hot_window" toml:"hot_window"`
+	// ColdEvery is how old the cold partition gets before a run exports it
+	// again, as a duration such as 720h.
+	ColdEvery string `yaml:"cold_every" toml:"cold_every"`
+}
+
+// validate checks the column and durations.
+func (h HotColdConfig) validate() error {
+	if h.Column == "" || h.HotWindow == "" || h.ColdEvery == "" {
+		return fmt.Errorf("hot_cold needs a column, hot_window and cold_every")
+	}
+	for _, d := range []string{h.HotWindow, h.ColdEvery} {
+		v, err := time.ParseDuration(d)
+		if err != nil {
+			return fmt.Errorf("hot_cold: %w", err)
+		}
+		if v <= 0 {
+			return fmt.Errorf("hot_cold: invalid duration %s, expected a positive duration", d)
+		}
+	}
+	return nil
+}
+
+// partitionName returns the name a partition of table is exported as.
+func partitionName(table, partition string) string {
+	return table + "." + partition
+}
+
+// TablePartitions is the entry of a hot/cold table in partitions.json.
+// Reading both partitions' files gives the whole table.
+type TablePartitions struct {
+	Column    string `json:"column"`
+	HotWindow string `json:"hot_window"`
+	// Boundary splits the partitions: the hot partition has the rows whose
+	// column is at or after it, the cold one the others, including nulls.
+	Boundary time.Time     `json:"boundary"`
+	Hot      PartitionInfo `json:"hot"`
+	Cold     PartitionInfo `json:"cold"`
+}
+
+// PartitionInfo is the export of a partition.
+type PartitionInfo struct {
+	// Table is the partition's name in the metadata.
+	Table      string    `json:"table"`
+	File       string    `json:"file"`
+	Rows       int       `json:"rows"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// loadPartitions reads the partitions.json of an output directory, or
+// returns an empty manifest if there is none yet.
+func loadPartitions(outDir string) (map[string]TablePartitions, error) {
+	manifest := make(map[string]TablePartitions)
+	path := filepath.Join(outDir, partitionsFile)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// savePartitions writes partitions.json, replacing it only once it is
+// complete.
+func savePartitions(outDir string, manifest map[string]TablePartitions) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(outDir, partitionsFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// hotColdPlan is how a run exports the partitions of the hot/cold tables.
+type hotColdPlan struct {
+	manifest map[string]TablePartitions
+	// planned are the entries the run writes once the partitions it
+	// exports are written, by table.
+	planned map[string]TablePartitions
+	// kept are the cold partitions that aren't due for another export.
+	kept map[string]bool
+}
+
+// splitHotColdTables replaces the hot/cold tables among tables with their
+// partitions, filtered on the boundary of the table's manifest entry while
+// its cold partition is younger than cold_every, and otherwise on a new
+// boundary hot_window before the start of the day. Kept cold partitions are
+// listed but not exported. With reuse, such as for -patch-columns, the
+// boundaries of the manifest are kept regardless of age.
+func splitHotColdTables(cfg ExportConfig, tables []TableMetadata, manifest map[string]TablePartitions, now time.Time, reuse bool) ([]TableMetadata, *hotColdPlan, error) {
+	plan := &hotColdPlan{manifest: manifest, planned: make(map[string]TablePartitions), kept: make(map[string]bool)}
+	var split []TableMetadata
+	for _, table := range tables {
+		t, ok := cfg.table(table.TableName)
+		if !ok || t.HotCold == nil || table.SourceTable != "" {
+			split = append(split, table)
+			continue
+		}
+		h := *t.HotCold
+		var column *FieldMetadata
+		for i := range table.Fields {
+			if table.Fields[i].FieldName == h.Column {
+				column = &table.Fields[i]
+			}
+		}
+		if column == nil || (column.DataType != DataTypeTime && column.DataType != DataTypeDate) {
+			return nil, nil, fmt.Errorf("hot_cold column %q of table %s is not an exported timestamp or date column", h.Column, table.TableName)
+		}
+		window, _ := time.ParseDuration(h.HotWindow)
+		every, _ := time.ParseDuration(h.ColdEvery)
+
+		hot := table
+		hot.TableName = partitionName(table.TableName, partitionHot)
+		hot.SourceTable = table.TableName
+		// The sizes are the whole table's.
+		hot.EstimatedRows, hot.ExactRows, hot.SizeBytes = nil, nil, nil
+		cold := hot
+		cold.TableName = partitionName(table.TableName, partitionCold)
+
+		entry := TablePartitions{
+			Column:    h.Column,
+			HotWindow: h.HotWindow,
+			Boundary:  now.Truncate(24 * time.Hour).Add(-window),
+			Hot:       PartitionInfo{Table: hot.TableName, File: filepath.Base(cfg.outputPath(hot.TableName))},
+			Cold:      PartitionInfo{Table: cold.TableName, File: filepath.Base(cfg.outputPath(cold.TableName))},
+		}
+		if prev, ok := manifest[table.TableName]; ok && prev.Column == h.Column && prev.HotWindow == h.HotWindow &&
+			prev.Cold.File == entry.Cold.File && (reuse || now.Sub(prev.Cold.ExportedAt) < every) {
+			if _, err := os.Stat(cfg.outputPath(cold.TableName)); err == nil {
+				entry.Boundary, entry.Cold = prev.Boundary, prev.Cold
+				plan.kept[cold.TableName] = true
+				cold.Note = "kept from the export of " + prev.Cold.ExportedAt.Format(time.RFC3339)
+			}
+		}
+
+		boundary := boundaryLiteral(*column, entry.Boundary)
+		hot.Where = andFilter(table.Where, fmt.Sprintf("%s >= %s", quoteIdent(h.Column), boundary))
+		cold.Where = andFilter(table.Where, fmt.Sprintf("(%s < %s OR %s IS NULL)", quoteIdent(h.Column), boundary, quoteIdent(h.Column)))
+		plan.planned[table.TableName] = entry
+		split = append(split, hot, cold)
+	}
+	return split, plan, nil
+}
+
+// boundaryLiteral formats a boundary as a SQL literal the column compares
+// to, without a time zone so that SQLite's text timestamps compare too.
+func boundaryLiteral(column FieldMetadata, t time.Time) string {
+	if column.DataType == DataTypeDate {
+		return "'" + t.Format(time.DateOnly) + "'"
+	}
+	return "'" + t.Format(time.DateTime) + "'"
+}
+
+// andFilter adds a condition to a table's row filter.
+func andFilter(where, condition string) string {
+	if where == "" {
+		return condition
+	}
+	return "(" + where + ") AND " + condition
+}
+
+// keepMetadata copies the fields, layout and chunks of the kept cold
+// partitions from the metadata of the export that wrote them.
+func (p *hotColdPlan) keepMetadata(tables []TableMetadata, previous SchemaDetails) {
+	for i := range tables {
+		if !p.kept[tables[i].TableName] {
+			continue
+		}
+		for _, prev := range previous.Tables {
+			if prev.TableName == tables[i].TableName {
+				tables[i].Fields, tables[i].Arrays, tables[i].Chunks = prev.Fields, prev.Arrays, prev.Chunks
+			}
+		}
+	}
+}
+
+// record updates the manifest with the partitions the run exported, for
+// the tables whose exported partitions were all written, given the rows
+// written per partition.
+func (p *hotColdPlan) record(written map[string]*TableMetadata, rows map[string]int, exportedAt time.Time) {
+	for table, entry := range p.planned {
+		complete := true
+		for _, info := range []*PartitionInfo{&entry.Hot, &entry.Cold} {
+			if p.kept[info.Table] {
+				continue
+			}
+			if written[info.Table] == nil {
+				complete = false
+				break
+			}
+			info.Rows = rows[info.Table]
+			info.ExportedAt = exportedAt
+		}
+		if complete {
+			p.manifest[table] = entry
+		}
+	}
+}
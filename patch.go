@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbinet/npyio/npz"
+)
+
+// parsePatchColumns parses the table.column entries of -patch-columns into
+// the columns to patch per table.
+func parsePatchColumns(entries []string) (map[string][]string, error) {
+	columns := make(map[string][]string)
+	for _, entry := range entries {
+		table, column, ok := splitTableColumn(strings.TrimSpace(entry))
+		if !ok || table == "" || column == "" {
+			return nil, fmt.Errorf("invalid patch column %q, expected table.column", entry)
+		}
+		columns[table] = append(columns[table], column)
+	}
+	return columns, nil
+}
+
+// patchExport re-exports the -patch-columns of each table and writes them
+// into the table's existing NPZ archive, then updates the metadata of the
+// patched columns. Canceling ctx stops at the table being patched.
+func patchExport(ctx context.Context, opts exportOptions, src exportSource, tables []TableMetadata, spill spillConfig, rates map[string]float64, dims map[string]*dimension, key hashKey) error {
+	cfg := opts.Export
+	metadata, err := readMetadata(filepath.Join(cfg.OutDir, metadataPath(opts.MetadataLayout)))
+	if err != nil {
+		return fmt.Errorf("reading the metadata of the export: %w", err)
+	}
+
+	for _, table := range tables {
+		columns := opts.PatchColumns[table.TableName]
+		if table.SourceTable != "" {
+			columns = opts.PatchColumns[table.SourceTable]
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		fields, err := patchTable(ctx, opts, src, table, columns, spill, rates, dims, key)
+		if err != nil {
+			return fmt.Errorf("patching table %s: %w", table.TableName, err)
+		}
+		// Patching moves the arrays of an uncompressed archive.
+		layout, err := npzLayout(cfg.outputPath(table.TableName))
+		if err != nil {
+			return fmt.Errorf("reading the array layout of table %s: %w", table.TableName, err)
+		}
+		for i := range metadata.Tables {
+			if metadata.Tables[i].TableName == table.TableName {
+				metadata.Tables[i].Fields = patchedFields(metadata.Tables[i].Fields, fields)
+				metadata.Tables[i].Arrays = layout
+			}
+		}
+	}
+
+	// The header keeps describing the export, with the patched schema.
+	if metadata.Header != nil {
+		if metadata.Header.SchemaHash, err = schemaHash(metadata.Tables); err != nil {
+			return err
+		}
+	}
+	if _, err := writeMetadata(cfg.OutDir, opts.MetadataLayout, metadata); err != nil {
+		return fmt.Errorf("saving metadata: %w", err)
+	}
+	if cfg.Profile && metadata.Header != nil {
+		if err := saveProfiles(cfg.OutDir, metadata.Tables, metadata.Header.Rows); err != nil {
+			return fmt.Errorf("saving column profiles: %w", err)
+		}
+	}
+	return nil
+}
+
+// patchTable reads the primary key and the given columns of a table,
+// through the table's column transforms, and replaces those columns in its
+// NPZ archive, matching rows on the primary key. Rows that are no longer in
+// the table keep their values and new rows are left out. A column the
+// archive doesn't have yet is added, null for the rows left out. It returns
+// the metadata of the patched columns.
+func patchTable(ctx context.Context, opts exportOptions, src exportSource, table TableMetadata, columns []string, spill spillConfig, rates map[string]float64, dims map[string]*dimension, key hashKey) ([]FieldMetadata, error) {
+	var keys []string
+	for _, field := range table.Fields {
+		if field.IsPrimaryKey {
+			keys = append(keys, field.FieldName)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no primary key to match rows on")
+	}
+
+	// Transforms add columns, so look the columns up in what is written.
+	cfg := opts.Export
+	written := &TableData{TableName: table.TableName, Columns: slices.Clone(table.Fields)}
+	if _, err := newRowTransforms(written, cfg.transforms(table.TableName), cfg.Currency.Base, rates, dims, key, cfg.FreezeVocabulary); err != nil {
+		return nil, fmt.Errorf("preparing column transforms: %w", err)
+	}
+	if _, err := cfg.nullFilter(written); err != nil {
+		return nil, err
+	}
+	for _, name := range columns {
+		if !slices.ContainsFunc(written.Columns, func(f FieldMetadata) bool { return f.FieldName == name }) {
+			return nil, fmt.Errorf("no column %q", name)
+		}
+	}
+
+	// Read only the key and patched columns, and what they are computed from.
+	cfg.Tables = slices.Clone(cfg.Tables)
+	table = pruneToFeatures(&cfg, []TableMetadata{table}, map[string][]string{table.TableName: append(slices.Clone(keys), columns...)})[0]
+	tableData := &TableData{TableName: table.TableName, Columns: slices.Clone(table.Fields)}
+	transforms, err := newRowTransforms(tableData, cfg.transforms(table.TableName), cfg.Currency.Base, rates, dims, key, cfg.FreezeVocabulary)
+	if err != nil {
+		return nil, fmt.Errorf("preparing column transforms: %w", err)
+	}
+	nulls, err := cfg.nullFilter(tableData)
+	if err != nil {
+		return nil, err
+	}
+	var fields []FieldMetadata
+	for _, name := range columns {
+		i := slices.IndexFunc(tableData.Columns, func(f FieldMetadata) bool { return f.FieldName == name })
+		fields = append(fields, tableData.Columns[i])
+	}
+
+	path := cfg.outputPath(table.TableName)
+	r, err := npz.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	archived, _, err := findTableMetadata(r, path, table.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if archived == nil {
+		return nil, fmt.Errorf("no metadata found for %s", path)
+	}
+
+	// Index the archived rows by their key.
+	var keyColumns [][]interface{}
+	for _, name := range keys {
+		i := slices.IndexFunc(archived.Fields, func(f FieldMetadata) bool { return f.FieldName == name })
+		if i < 0 {
+			return nil, fmt.Errorf("key column %s is not in %s", name, path)
+		}
+		values, err := readArchivedValues(r, filepath.Dir(path), archived.Fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("reading key column %s: %w", name, err)
+		}
+		keyColumns = append(keyColumns, values)
+	}
+	rows := len(keyColumns[0])
+	index := make(map[string]int, rows)
+	for i := 0; i < rows; i++ {
+		k := make([]interface{}, len(keyColumns))
+		for j, values := range keyColumns {
+			k[j] = values[i]
+		}
+		index[patchKey(k)] = i
+	}
+
+	// Start from the archived values, so rows missing from the table keep
+	// them.
+	values := make([][]interface{}, len(fields))
+	for i, field := range fields {
+		j := slices.IndexFunc(archived.Fields, func(f FieldMetadata) bool { return f.FieldName == field.FieldName })
+		if j < 0 {
+			values[i] = make([]interface{}, rows)
+			continue
+		}
+		if archived.Fields[j].Encoding == EncodingSharedDictionary {
+			return nil, fmt.Errorf("column %s is stored in a shared dictionary, which can't be patched", field.FieldName)
+		}
+		if values[i], err = readArchivedValues(r, filepath.Dir(path), archived.Fields[j]); err != nil {
+			return nil, fmt.Errorf("reading column %s: %w", field.FieldName, err)
+		}
+		if field.Encoding == "" && field.DataType == archived.Fields[j].DataType {
+			fields[i].Encoding = archived.Fields[j].Encoding
+		}
+	}
+
+	// Label encoded and scaled columns keep the codes and parameters of
+	// the archive.
+	restoreTransforms(transforms, archived.Fields)
+	if scaler := scalerToFit(transforms); scaler != nil {
+		scratch, err := newRowTransforms(&TableData{TableName: table.TableName, Columns: slices.Clone(table.Fields)}, cfg.transforms(table.TableName), cfg.Currency.Base, rates, dims, key, cfg.FreezeVocabulary)
+		if err != nil {
+			return nil, fmt.Errorf("preparing column transforms: %w", err)
+		}
+		if err := fitScaling(ctx, src, table, cfg, opts.MemoryBudgetMB<<20, scaler, scratch, nil, tableData.Columns); err != nil {
+			return nil, fmt.Errorf("fitting the scaling: %w", err)
+		}
+	}
+
+	matched, added := 0, 0
+	err = streamTable(ctx, src, table, cfg, opts.MemoryBudgetMB<<20, func(batch []TableRow) error {
+		for _, t := range transforms {
+			t.apply(batch)
+		}
+		// Rows dropped for their nulls keep their archived values.
+		batch, err := nulls.filter(batch)
+		if err != nil {
+			return err
+		}
+		tableData.Rows = batch
+		sampleExampleValues(tableData, opts.MetadataExamples)
+		for _, row := range batch {
+			k := make([]interface{}, len(keys))
+			for j, name := range keys {
+				k[j] = row[name]
+			}
+			i, ok := index[patchKey(k)]
+			if !ok {
+				added++
+				continue
+			}
+			matched++
+			for j, field := range fields {
+				values[j][i] = row[field.FieldName]
+			}
+		}
+		return nil
+	})
+	tableData.Rows = nil
+	if err != nil {
+		return nil, fmt.Errorf("fetching table data: %w", err)
+	}
+	for _, t := range transforms {
+		t.finish(tableData.Columns)
+	}
+	nulls.finish(tableData.Columns)
+	// Pick up the examples and what the transforms recorded.
+	for i, field := range fields {
+		for _, col := range tableData.Columns {
+			if col.FieldName == field.FieldName {
+				fields[i] = col
+				fields[i].Encoding = field.Encoding
+			}
+		}
+	}
+	// The profiles cover the archived values of the rows the table no
+	// longer has, like the patched arrays.
+	if cfg.Profile {
+		profiler := newTableProfiler(fields)
+		for j, c := range profiler.columns {
+			for _, v := range values[j] {
+				c.add(v)
+			}
+		}
+		profiler.finish(fields)
+	}
+	if added > 0 {
+		log.Printf("Table %q: %d rows are not in %s and were left out", table.TableName, added, path)
+	}
+	if missing := rows - matched; missing > 0 {
+		log.Printf("Table %q: %d rows of %s are no longer in the table and keep their values", table.TableName, missing, path)
+	}
+
+	// Write the patched columns to an archive of their own, then swap their
+	// arrays into the table's archive.
+	patch := &TableData{TableName: table.TableName, Columns: fields, Rows: patchRows(fields, values, 0, min(rows, dictionarySampleRows))}
+	applyArrayEncoding(patch, opts.ArrayEncoding)
+	applyBinaryEncoding(patch, opts.BinaryEncoding)
+	applyDecimalEncoding(patch, cfg.DecimalEncoding)
+	applyDictionaryEncoding(patch, opts.DictEncoding, cfg.transforms(table.TableName).Dictionary)
+	w := newNpzWriter(spill.Dir, table.TableName, patch.Columns, spill)
+	// The patched arrays are compressed like the archive's.
+	if w.stored, err = storedNpz(path); err != nil {
+		w.discard()
+		return nil, err
+	}
+	for start := 0; start < rows; start += BATCHSIZE {
+		if err := w.writeRows(ctx, patchRows(fields, values, start, min(start+BATCHSIZE, rows))); err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	if _, err := w.close(ctx, nil); err != nil {
+		return nil, err
+	}
+	defer os.Remove(w.path)
+	if err := replaceArrays(path, w.path, patch.Columns); err != nil {
+		return nil, err
+	}
+	log.Printf("Patched %d columns of %d rows into %s", len(fields), rows, path)
+	return patch.Columns, nil
+}
+
+// readArchivedValues reads a column of an NPZ archive in dir as one value
+// per row, with nulls restored from its mask.
+func readArchivedValues(r *npz.Reader, dir string, field FieldMetadata) ([]interface{}, error) {
+	column, err := readDecodedColumn(r, dir, field.FieldName)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(column)
+	var mask []bool
+	if m, err := readNpzColumn(r, field.FieldName+maskSuffix); err == nil {
+		mask, _ = m.([]bool)
+	}
+	values := make([]interface{}, rv.Len())
+	for i := range values {
+		if i < len(mask) && mask[i] {
+			continue
+		}
+		values[i] = npzValue(field, rv.Index(i).Interface())
+	}
+	return values, nil
+}
+
+// patchKey returns the lookup key of a row's primary key values, which
+// compares equal for the values read from the source and from an archive.
+func patchKey(values []interface{}) string {
+	var b strings.Builder
+	for _, v := range values {
+		switch t := v.(type) {
+		case time.Time:
+			v = t.UnixNano()
+		case []byte:
+			v = string(t)
+		}
+		fmt.Fprintf(&b, "%v\x00", v)
+	}
+	return b.String()
+}
+
+// patchRows builds the rows start to end of the patched columns.
+func patchRows(fields []FieldMetadata, values [][]interface{}, start, end int) []TableRow {
+	rows := make([]TableRow, end-start)
+	for i := range rows {
+		row := make(TableRow, len(fields))
+		for j, field := range fields {
+			row[field.FieldName] = values[j][start+i]
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// patchedFields returns fields with the patched columns replaced, and
+// appended if they are new.
+func patchedFields(fields, patched []FieldMetadata) []FieldMetadata {
+	fields = slices.Clone(fields)
+	for _, p := range patched {
+		if i := slices.IndexFunc(fields, func(f FieldMetadata) bool { return f.FieldName == p.FieldName }); i >= 0 {
+			fields[i] = p
+		} else {
+			fields = append(fields, p)
+		}
+	}
+	return fields
+}
+
+// replaceArrays rewrites the archive at path with the arrays of the given
+// columns, including their masks, categories, offsets and low halves, taken from the
+// archive at patchPath. Other entries are copied without decompressing
+// them, and an embedded __metadata__.json gets the columns' new metadata.
+func replaceArrays(path, patchPath string, columns []FieldMetadata) error {
+	target, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	patch, err := zip.OpenReader(patchPath)
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+
+	replaced := make(map[string]bool)
+	for _, col := range columns {
+		for _, suffix := range []string{"", maskSuffix, categoriesSuffix, offsetsSuffix, lowSuffix} {
+			replaced[col.FieldName+suffix+".npy"] = true
+		}
+	}
+	entries := make(map[string]*zip.File)
+	for _, f := range target.File {
+		if !replaced[f.Name] {
+			entries[f.Name] = f
+		}
+	}
+	for _, f := range patch.File {
+		entries[f.Name] = f
+	}
+	// Arrays first, in name order, then the other files, as writeNpz does.
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ai, aj := strings.HasSuffix(names[i], ".npy"), strings.HasSuffix(names[j], ".npy")
+		if ai != aj {
+			return ai
+		}
+		return names[i] < names[j]
+	})
+
+	tmp := path + ".patch"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	off := &offsetWriter{w: out}
+	zw := zip.NewWriter(off)
+	for _, name := range names {
+		f := entries[name]
+		if name != embeddedMetadataName {
+			if err := copyArrayEntry(zw, off, f); err != nil {
+				return fmt.Errorf("copying npz entry %q: %w", name, err)
+			}
+			continue
+		}
+		b, err := patchedEmbeddedMetadata(f, columns)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("creating npz entry %q: %w", name, err)
+		}
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("writing npz entry %q: %w", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// patchedEmbeddedMetadata returns an archive's __metadata__.json with the
+// metadata of the patched columns.
+func patchedEmbeddedMetadata(f *zip.File, columns []FieldMetadata) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	var embedded EmbeddedMetadata
+	if err := json.Unmarshal(b, &embedded); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", embeddedMetadataName, err)
+	}
+	embedded.Table.Fields = patchedFields(embedded.Table.Fields, columns)
+	return json.Marshal(embedded)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// pauseController lets an operator pause a running export. The export
+// checks it between batches, so a pause takes effect once the current batch
+// has finished, and resuming continues with the next batch. Once it takes
+// effect the registered releasers let go of what the export holds on the
+// database, and take it up again on resume.
+type pauseController struct {
+	mu     sync.Mutex
+	paused bool
+	// by names what started the current pause, empty for an operator.
+	by     string
+	resume chan struct{}
+	// released is set once the releasers let go during the current pause.
+	releasers []pauseReleaser
+	released  bool
+}
+
+// pauseReleaser is implemented by sources that hold connections on the
+// database, which they close while the export is paused.
+type pauseReleaser interface {
+	releaseForPause()
+	reacquireAfterPause()
+}
+
+// register adds a releaser, called at the next pause.
+func (p *pauseController) register(r pauseReleaser) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releasers = append(p.releasers, r)
+}
+
+var exportPause = &pauseController{}
+
+// Pause requests a pause and reports whether the state changed. A pause
+// already in effect becomes the operator's.
+func (p *pauseController) Pause() bool {
+	return p.PauseBy("")
+}
+
+// PauseBy requests a pause on behalf of by, which ResumeBy lifts only
+// while it's still by's, and reports whether the state changed.
+func (p *pauseController) PauseBy(by string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		if by == "" {
+			p.by = ""
+		}
+		return false
+	}
+	p.paused = true
+	p.by = by
+	p.resume = make(chan struct{})
+	return true
+}
+
+// Resume lifts a pause and reports whether the state changed.
+func (p *pauseController) Resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumeLocked()
+}
+
+// ResumeBy lifts a pause that by started, and reports whether it did.
+func (p *pauseController) ResumeBy(by string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.by != by {
+		return false
+	}
+	return p.resumeLocked()
+}
+
+func (p *pauseController) resumeLocked() bool {
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	p.by = ""
+	if p.released {
+		p.released = false
+		for _, r := range p.releasers {
+			r.reacquireAfterPause()
+		}
+	}
+	close(p.resume)
+	return true
+}
+
+// Toggle pauses a running export or resumes a paused one.
+func (p *pauseController) Toggle() {
+	if !p.Pause() {
+		p.Resume()
+	}
+}
+
+func (p *pauseController) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// wait blocks while the export is paused, returning the context's error
+// if it is canceled meanwhile.
+func (p *pauseController) wait(ctx context.Context, table string, offset int) error {
+	p.mu.Lock()
+	if !p.paused {
+		p.mu.Unlock()
+		return nil
+	}
+	resume := p.resume
+	if !p.released {
+		p.released = true
+		for _, r := range p.releasers {
+			r.releaseForPause()
+		}
+	}
+	p.mu.Unlock()
+
+	log.Printf("export paused before table %q offset %d, waiting for resume", table, offset)
+	select {
+	case <-resume:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	log.Printf("export resumed at table %q offset %d", table, offset)
+	return nil
+}
+
+// servePauseAPI exposes POST /pause, POST /resume, and GET /status.
+func servePauseAPI(addr string) {
+	mux := http.NewServeMux()
+	status := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"paused": exportPause.Paused()})
+	}
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		if exportPause.Pause() {
+			log.Printf("pause requested via API")
+		}
+		status(w)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		if exportPause.Resume() {
+			log.Printf("resume requested via API")
+		}
+		status(w)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status(w)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("pause API stopped: %v", err)
+		}
+	}()
+	log.Printf("pause API listening on %s", addr)
+}
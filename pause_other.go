@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// handlePauseSignals is a no-op where SIGUSR1 does not exist; use the
+// pause API instead.
+func handlePauseSignals() {}
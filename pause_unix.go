@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals toggles pause/resume on every SIGUSR1.
+func handlePauseSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			exportPause.Toggle()
+			if exportPause.Paused() {
+				log.Printf("SIGUSR1 received, pausing after the current batch")
+			} else {
+				log.Printf("SIGUSR1 received, resuming")
+			}
+		}
+	}()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// rowTransform rewrites the rows of a table batch by batch as they stream
+// from the source to the writer. Its constructor updates the column
+// metadata once, before the first batch.
+type rowTransform interface {
+	// apply transforms a batch in place.
+	apply(rows []TableRow)
+	// finish is called after the last batch to report on the rows seen
+	// and complete the column metadata.
+	finish(columns []FieldMetadata)
+}
+
+// resumableTransform is a rowTransform whose state is kept in the column
+// metadata, such as a vocabulary, and continues from that of the columns
+// of a checkpoint or of an archive being patched.
+type resumableTransform interface {
+	restore(columns []FieldMetadata)
+}
+
+// restoreTransforms continues the resumable transforms from the columns.
+func restoreTransforms(transforms []rowTransform, columns []FieldMetadata) {
+	for _, t := range transforms {
+		if r, ok := t.(resumableTransform); ok {
+			r.restore(columns)
+		}
+	}
+}
+
+// newRowTransforms builds the configured transforms of a table in the
+// order they run: dimension joins, JSON flattening, text parsing, money
+// normalization, datetime expansion, one-hot encoding, label encoding,
+// scaling, then hashing.
+func newRowTransforms(table *TableData, t ColumnTransforms, base string, rates map[string]float64, dims map[string]*dimension, key hashKey, frozen bool) ([]rowTransform, error) {
+	joiner, err := newTableJoiner(table, t.Joins, dims)
+	if err != nil {
+		return nil, err
+	}
+	flattener, err := newJSONFlattener(table, t.FlattenJSON)
+	if err != nil {
+		return nil, err
+	}
+	parsers, err := newColumnParsers(table, t.Parse)
+	if err != nil {
+		return nil, err
+	}
+	money, err := newMoneyNormalizer(table, t.Money, base, rates)
+	if err != nil {
+		return nil, err
+	}
+	expander, err := newDatetimeExpander(table, t.ExpandDatetime)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := newOneHotEncoder(table, t.OneHot)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := newLabelEncoder(table, t.LabelEncode, frozen)
+	if err != nil {
+		return nil, err
+	}
+	scaler, err := newColumnScaler(table, t.Scale)
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := newColumnHasher(table, t.HashColumns, key)
+	if err != nil {
+		return nil, err
+	}
+	return []rowTransform{joiner, flattener, parsers, money, expander, encoder, labels, scaler, hasher}, nil
+}
+
+// rowOverhead approximates the memory a row map spends per value on top of
+// the value itself.
+const rowOverhead = 64
+
+// rowsMemory approximates the memory held by a batch of rows.
+func rowsMemory(rows []TableRow) int64 {
+	var n int64
+	for _, row := range rows {
+		for _, value := range row {
+			n += valueSize(value) + rowOverhead
+		}
+	}
+	return n
+}
+
+// errWriterStopped is returned to the source once the writer has failed.
+var errWriterStopped = errors.New("writer stopped")
+
+// batchQueue hands batches from the source to the writer. The rows queued
+// or being written are bounded by a memory budget: the source blocks until
+// enough of them have been written. A batch larger than the whole budget
+// is let through once the writer has caught up.
+type batchQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	budget  int64
+	used    int64
+	batches []queuedBatch
+	done    bool
+	err     error
+	stopped bool
+}
+
+// queuedBatch is a batch with its memory as estimated when it was queued,
+// since transforms change the rows before the memory is released.
+type queuedBatch struct {
+	rows []TableRow
+	size int64
+}
+
+func newBatchQueue(budget int64) *batchQueue {
+	q := &batchQueue{budget: budget}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// put queues a batch, waiting for room in the budget.
+func (q *batchQueue) put(rows []TableRow) error {
+	size := rowsMemory(rows)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.stopped && q.used > 0 && q.used+size > q.budget {
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return errWriterStopped
+	}
+	q.used += size
+	q.batches = append(q.batches, queuedBatch{rows, size})
+	q.cond.Broadcast()
+	return nil
+}
+
+// close marks the end of the source's batches, with the error it failed
+// with if any.
+func (q *batchQueue) close(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.done = true
+	q.err = err
+	q.cond.Broadcast()
+}
+
+// take returns the next batch. It returns false once the source is done
+// and every batch has been taken.
+func (q *batchQueue) take() (queuedBatch, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.batches) == 0 && !q.done {
+		q.cond.Wait()
+	}
+	if len(q.batches) == 0 {
+		return queuedBatch{}, false
+	}
+	b := q.batches[0]
+	q.batches = q.batches[1:]
+	return b, true
+}
+
+// release returns the memory of a written batch to the budget.
+func (q *batchQueue) release(b queuedBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used -= b.size
+	q.cond.Broadcast()
+}
+
+// stop makes the source's next put fail so that it stops reading.
+func (q *batchQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopped = true
+	q.cond.Broadcast()
+}
+
+// streamTable reads the table's rows from the source in a separate
+// goroutine and passes each batch to write as it arrives, holding at most
+// budget bytes of rows at a time. It returns once every batch is written,
+// or the first error of either side. Once ctx is canceled it stops before
+// the next batch and returns ctx's error.
+func streamTable(ctx context.Context, src exportSource, table TableMetadata, cfg ExportConfig, budget int64, write func(rows []TableRow) error) error {
+	q := newBatchQueue(budget)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		q.close(src.StreamTableData(ctx, table, cfg, q.put))
+	}()
+
+	for {
+		b, ok := q.take()
+		if !ok {
+			break
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = write(b.rows)
+		}
+		q.release(b)
+		if err != nil {
+			q.stop()
+			<-readerDone
+			return err
+		}
+	}
+	<-readerDone
+	return q.err
+}
+
+// sleepContext pauses for d, returning ctx's error early if it is canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// profileFile holds the column profiles of an export with profile
+	// set, next to the metadata.
+	profileFile = "stats.json"
+
+	// hllPrecision is the number of hash bits that pick a HyperLogLog
+	// register; 2^12 registers estimate distinct counts within about 1.6%.
+	hllPrecision = 12
+
+	// exactProfileValues is the number of values of a column profiled
+	// exactly; past it, distinct counts and quantiles are estimated.
+	exactProfileValues = 1 << 15
+)
+
+// Methods a column's profile was computed with.
+const (
+	// profileExact profiles count every distinct value and sort every
+	// value for the quantiles.
+	profileExact = "exact"
+	// profileApproximate profiles estimate the distinct count with
+	// HyperLogLog and the quantiles with a t-digest, from every value.
+	profileApproximate = "approximate"
+	// profileSampled profiles are approximate ones of a sample of the
+	// rows, taken once the table's share of the profile budget ran out.
+	profileSampled = "sampled"
+)
+
+// profileQuantiles are the quantiles of numeric columns, by their name in
+// the profile.
+var profileQuantiles = []struct {
+	name string
+	q    float64
+}{{"p1", 0.01}, {"p5", 0.05}, {"p25", 0.25}, {"p50", 0.5}, {"p75", 0.75}, {"p95", 0.95}, {"p99", 0.99}}
+
+// ColumnProfile is a column's profile, computed from the values exported
+// with profile set. Min and Max are left out of PII and hashed columns and
+// of columns whose values don't order, such as JSON; Mean, StdDev, the
+// population standard deviation, and Quantiles are set for numeric
+// columns. NaN and infinite values count as values but not towards the
+// range, the mean or the quantiles.
+type ColumnProfile struct {
+	Count int64 `json:"count"`
+	Nulls int64 `json:"null_count"`
+	// DistinctCount is exact for exact profiles, and otherwise a
+	// HyperLogLog estimate.
+	DistinctCount int64       `json:"distinct_count"`
+	Min           interface{} `json:"min,omitempty"`
+	Max           interface{} `json:"max,omitempty"`
+	Mean          *float64    `json:"mean,omitempty"`
+	StdDev        *float64    `json:"stddev,omitempty"`
+	// Quantiles are keyed p1, p5, p25, p50, p75, p95 and p99.
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+	// Method is exact, approximate or sampled.
+	Method string `json:"method"`
+	// SampledValues is the number of values a sampled profile was
+	// computed from, of the Count values of the column.
+	SampledValues int64 `json:"sampled_values,omitempty"`
+}
+
+// TableProfile is a table's entry in stats.json.
+type TableProfile struct {
+	Table   string                    `json:"table"`
+	Rows    int                       `json:"rows"`
+	Columns map[string]*ColumnProfile `json:"columns"`
+}
+
+// tableProfiler profiles the columns of a table as its rows are exported.
+// With a budget, once profiling took longer than it, only every stride-th
+// row is profiled, the stride doubling with every further tenth of the
+// budget spent, so a huge table is profiled from a sample of its rows.
+type tableProfiler struct {
+	columns []*columnProfiler
+	budget  time.Duration
+	// spent is the time spent profiling, and strided what was spent when
+	// the stride last doubled.
+	spent, strided time.Duration
+	stride         int64
+	rows           int64
+}
+
+// columnProfiler accumulates a column's profile, with the mean and the sum
+// of squared deviations of its numbers kept by Welford's method, weighted
+// by the stride of the sample each number was taken from. The
+// hashes and numbers of its first values are kept for an exact profile,
+// and once there are too many, or values were skipped, the numbers go to a
+// t-digest instead.
+type columnProfiler struct {
+	field     FieldMetadata
+	count     int64
+	nulls     int64
+	min, max  interface{}
+	numbers   float64
+	mean, m2  float64
+	registers []uint8
+	// skipped counts the values left out of the sample, and weight is the
+	// number of values each profiled one stands for.
+	skipped int64
+	weight  float64
+	exact   bool
+	hashes  []uint64
+	values  []float64
+	digest  *tdigest
+	// ordered is set for the columns that get a range, numeric for those
+	// that also get a mean.
+	ordered bool
+	numeric bool
+}
+
+// columnProfileState is a columnProfiler as stored in a checkpoint.
+type columnProfileState struct {
+	Column    string      `json:"column"`
+	Count     int64       `json:"count"`
+	Nulls     int64       `json:"nulls"`
+	Min       *typedValue `json:"min,omitempty"`
+	Max       *typedValue `json:"max,omitempty"`
+	Numbers   float64     `json:"numbers"`
+	Mean      float64     `json:"mean"`
+	M2        float64     `json:"m2"`
+	Registers []uint8     `json:"registers"`
+	Skipped   int64       `json:"skipped,omitempty"`
+	Digest    []centroid  `json:"digest,omitempty"`
+}
+
+// newTableProfiler returns the profiler of a table's columns.
+func newTableProfiler(columns []FieldMetadata) *tableProfiler {
+	p := &tableProfiler{stride: 1}
+	for _, field := range columns {
+		c := &columnProfiler{field: field, registers: make([]uint8, 1<<hllPrecision), exact: true, weight: 1}
+		if field.Encoding != EncodingHash && !field.IsPII {
+			switch field.DataType {
+			case DataTypeInt, DataTypeFloat:
+				c.ordered, c.numeric = true, true
+			case DataTypeString, DataTypeUUID, DataTypeTime, DataTypeDate:
+				c.ordered = true
+			}
+		}
+		p.columns = append(p.columns, c)
+	}
+	return p
+}
+
+// add profiles a batch of rows, or a sample of them once the budget is
+// spent.
+func (p *tableProfiler) add(rows []TableRow) {
+	start := time.Now()
+	for _, c := range p.columns {
+		c.weight = float64(p.stride)
+		for i, row := range rows {
+			if p.stride > 1 && (p.rows+int64(i))%p.stride != 0 {
+				c.skip(row[c.field.FieldName])
+			} else {
+				c.add(row[c.field.FieldName])
+			}
+		}
+	}
+	p.rows += int64(len(rows))
+	if p.budget > 0 {
+		p.spent += time.Since(start)
+		if p.spent > p.budget && p.spent-p.strided > p.budget/10 {
+			p.stride *= 2
+			p.strided = p.spent
+		}
+	}
+}
+
+// skip counts a value left out of the sample.
+func (c *columnProfiler) skip(value interface{}) {
+	if value == nil {
+		c.nulls++
+		return
+	}
+	c.count++
+	c.skipped++
+	c.inexact()
+}
+
+// inexact drops the values kept for an exact profile, moving the numbers
+// to a t-digest.
+func (c *columnProfiler) inexact() {
+	if !c.exact {
+		return
+	}
+	c.exact = false
+	if c.numeric {
+		c.digest = newTDigest()
+		for _, f := range c.values {
+			c.digest.add(f, 1)
+		}
+	}
+	c.hashes, c.values = nil, nil
+}
+
+func (c *columnProfiler) add(value interface{}) {
+	if value == nil {
+		c.nulls++
+		return
+	}
+	c.count++
+	// The sketch's hash only needs to be the same in every run, so a
+	// resumed export continues it.
+	h := uint64(hashKey{}.sum(value))
+	i := h >> (64 - hllPrecision)
+	if rank := uint8(bits.LeadingZeros64(h<<hllPrecision|1<<(hllPrecision-1)) + 1); rank > c.registers[i] {
+		c.registers[i] = rank
+	}
+	if c.exact && len(c.hashes) == exactProfileValues {
+		c.inexact()
+	}
+	if c.exact {
+		c.hashes = append(c.hashes, h)
+	}
+	if !c.ordered {
+		return
+	}
+
+	v, ok := c.rangeValue(value)
+	if !ok {
+		return
+	}
+	if c.min == nil || laterWatermark(v, c.min) {
+		c.min = v
+	}
+	if c.max == nil || laterWatermark(c.max, v) {
+		c.max = v
+	}
+	if c.numeric {
+		f, _ := moneyAmount(v)
+		c.numbers += c.weight
+		delta := f - c.mean
+		c.mean += delta * c.weight / c.numbers
+		c.m2 += c.weight * delta * (f - c.mean)
+		if c.exact {
+			c.values = append(c.values, f)
+		} else {
+			c.digest.add(f, c.weight)
+		}
+	}
+}
+
+// rangeValue returns a value in the form its column's range is kept in:
+// int64 for int columns, finite float64 for float columns, times and text.
+func (c *columnProfiler) rangeValue(value interface{}) (interface{}, bool) {
+	if !c.numeric {
+		return rangeValue(c.field, value)
+	}
+	if c.field.DataType == DataTypeInt {
+		switch v := value.(type) {
+		case int64:
+			return v, true
+		case int:
+			return int64(v), true
+		}
+	}
+	f, ok := moneyAmount(value)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	if c.field.DataType == DataTypeInt {
+		return int64(f), true
+	}
+	return f, true
+}
+
+// distinct returns the number of distinct values of an exact profile, or
+// else the HyperLogLog estimate, with linear counting while registers are
+// still empty.
+func (c *columnProfiler) distinct() int64 {
+	if c.exact {
+		hashes := slices.Clone(c.hashes)
+		slices.Sort(hashes)
+		return int64(len(slices.Compact(hashes)))
+	}
+	m := float64(len(c.registers))
+	var sum float64
+	var zeros int
+	for _, r := range c.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return min(int64(math.Round(estimate)), c.count)
+}
+
+// quantiles returns the quantiles of a numeric column's numbers, by linear
+// interpolation between the sorted numbers of an exact profile.
+func (c *columnProfiler) quantiles() map[string]float64 {
+	if c.numbers == 0 || (!c.exact && len(c.digest.state()) == 0) {
+		return nil
+	}
+	var sorted []float64
+	if c.exact {
+		sorted = slices.Clone(c.values)
+		slices.Sort(sorted)
+	}
+	quantiles := make(map[string]float64, len(profileQuantiles))
+	for _, pq := range profileQuantiles {
+		if sorted == nil {
+			quantiles[pq.name] = c.digest.quantile(pq.q)
+			continue
+		}
+		pos := pq.q * float64(len(sorted)-1)
+		i := int(pos)
+		v := sorted[i]
+		if i+1 < len(sorted) {
+			v += (sorted[i+1] - v) * (pos - float64(i))
+		}
+		quantiles[pq.name] = v
+	}
+	return quantiles
+}
+
+// profile returns the column's profile.
+func (c *columnProfiler) profile() *ColumnProfile {
+	p := &ColumnProfile{Count: c.count, Nulls: c.nulls, DistinctCount: c.distinct(), Min: c.min, Max: c.max, Method: profileExact}
+	switch {
+	case c.skipped > 0:
+		p.Method, p.SampledValues = profileSampled, c.count-c.skipped
+	case !c.exact:
+		p.Method = profileApproximate
+	}
+	if c.field.DataType == DataTypeDate {
+		if t, ok := c.min.(time.Time); ok {
+			p.Min = t.Format(time.DateOnly)
+			p.Max = c.max.(time.Time).Format(time.DateOnly)
+		}
+	}
+	if c.numbers > 0 {
+		mean, stddev := c.mean, math.Sqrt(c.m2/c.numbers)
+		p.Mean, p.StdDev = &mean, &stddev
+		p.Quantiles = c.quantiles()
+	}
+	return p
+}
+
+// finish records the profiles in the metadata of the columns.
+func (p *tableProfiler) finish(columns []FieldMetadata) {
+	for _, c := range p.columns {
+		for i := range columns {
+			if columns[i].FieldName == c.field.FieldName {
+				columns[i].Profile = c.profile()
+			}
+		}
+	}
+}
+
+// state returns the profiler's state for a checkpoint.
+func (p *tableProfiler) state() ([]columnProfileState, error) {
+	states := make([]columnProfileState, len(p.columns))
+	for i, c := range p.columns {
+		states[i] = columnProfileState{
+			Column: c.field.FieldName, Count: c.count, Nulls: c.nulls,
+			Numbers: c.numbers, Mean: c.mean, M2: c.m2, Registers: c.registers,
+			Skipped: c.skipped,
+		}
+		// The numbers of an exact profile are checkpointed as a digest,
+		// so the resumed profile is approximate.
+		switch {
+		case c.exact && c.numeric:
+			d := newTDigest()
+			for _, f := range c.values {
+				d.add(f, 1)
+			}
+			states[i].Digest = d.state()
+		case c.numeric:
+			states[i].Digest = c.digest.state()
+		}
+		if c.min == nil {
+			continue
+		}
+		lo, err := newTypedValue(c.min)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := newTypedValue(c.max)
+		if err != nil {
+			return nil, err
+		}
+		states[i].Min, states[i].Max = &lo, &hi
+	}
+	return states, nil
+}
+
+// restore continues the profiles of a checkpoint's state.
+func (p *tableProfiler) restore(states []columnProfileState) error {
+	if len(states) != len(p.columns) {
+		return fmt.Errorf("the checkpoint profiles %d columns, expected %d", len(states), len(p.columns))
+	}
+	for i, c := range p.columns {
+		s := states[i]
+		if s.Column != c.field.FieldName || len(s.Registers) != len(c.registers) {
+			return fmt.Errorf("the checkpoint's profile of column %s doesn't match", s.Column)
+		}
+		c.count, c.nulls, c.numbers, c.mean, c.m2 = s.Count, s.Nulls, s.Numbers, s.Mean, s.M2
+		c.skipped = s.Skipped
+		copy(c.registers, s.Registers)
+		var err error
+		if s.Min != nil {
+			if c.min, err = s.Min.decode(); err != nil {
+				return err
+			}
+		}
+		if s.Max != nil {
+			if c.max, err = s.Max.decode(); err != nil {
+				return err
+			}
+		}
+		c.inexact()
+		if c.numeric {
+			lo, _ := moneyAmount(c.min)
+			hi, _ := moneyAmount(c.max)
+			c.digest = restoreTDigest(s.Digest, lo, hi)
+		}
+	}
+	return nil
+}
+
+// profileBudget shares the time profile_budget allows profiling among the
+// tables of a run. Each table takes an equal share of what is left for the
+// tables not yet profiled, and gives back what it didn't spend.
+type profileBudget struct {
+	mu     sync.Mutex
+	left   time.Duration
+	tables int
+}
+
+func newProfileBudget(total time.Duration, tables int) *profileBudget {
+	return &profileBudget{left: total, tables: tables}
+}
+
+// take gives a profiler its table's share of the budget. A nil budget
+// leaves the profiler unlimited.
+func (b *profileBudget) take(p *tableProfiler) {
+	if b == nil || p == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p.budget = b.left / time.Duration(max(b.tables, 1))
+	b.left -= p.budget
+	b.tables--
+	// A table without any budget left is sampled from the start.
+	p.budget = max(p.budget, time.Nanosecond)
+}
+
+// giveBack returns the share the profiler didn't spend.
+func (b *profileBudget) giveBack(p *tableProfiler) {
+	if b == nil || p == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.left += max(p.budget-p.spent, 0)
+}
+
+// saveProfiles writes stats.json with the profiles of the tables' columns,
+// rows being the rows of each table.
+func saveProfiles(outDir string, tables []TableMetadata, rows map[string]int) error {
+	profiles := []TableProfile{}
+	for _, table := range tables {
+		entry := TableProfile{Table: table.TableName, Rows: rows[table.TableName], Columns: make(map[string]*ColumnProfile)}
+		for _, field := range table.Fields {
+			if field.Profile != nil {
+				entry.Columns[field.FieldName] = field.Profile
+			}
+		}
+		if len(entry.Columns) > 0 {
+			profiles = append(profiles, entry)
+		}
+	}
+	b, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return saveFile(filepath.Join(outDir, profileFile), b)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// progressFile is the file in the output directory that progress
+// snapshots are appended to.
+const progressFile = "progress.jsonl"
+
+// ProgressSnapshot is the state of a running export at one moment,
+// recorded so that a run that dies unattended can be reconstructed later.
+type ProgressSnapshot struct {
+	Time           time.Time `json:"time"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	// HeapBytes is the memory held by live objects, SysBytes the memory
+	// obtained from the operating system.
+	HeapBytes  uint64          `json:"heap_bytes"`
+	SysBytes   uint64          `json:"sys_bytes"`
+	Goroutines int             `json:"goroutines"`
+	Paused     bool            `json:"paused"`
+	Tables     []TableProgress `json:"tables"`
+}
+
+// TableProgress is the progress of a table being read.
+type TableProgress struct {
+	Table  string `json:"table"`
+	Rows   int64  `json:"rows"`
+	Offset int64  `json:"offset"`
+	// RowsPerSecond is the rate since the previous snapshot, or since the
+	// table started.
+	RowsPerSecond float64 `json:"rows_per_second"`
+	Batches       int64   `json:"batches"`
+	// The time taken to read a batch, over every batch of the table.
+	LastBatchSeconds float64 `json:"last_batch_seconds"`
+	MeanBatchSeconds float64 `json:"mean_batch_seconds"`
+	MaxBatchSeconds  float64 `json:"max_batch_seconds"`
+}
+
+// progressRecorder appends a ProgressSnapshot to a file at a fixed
+// interval, syncing each one to disk.
+type progressRecorder struct {
+	f     *os.File
+	start time.Time
+	// last holds the rows and time of each table at the previous snapshot.
+	last map[*heartbeat]progressMark
+	done chan struct{}
+	stop chan struct{}
+}
+
+type progressMark struct {
+	rows int64
+	at   time.Time
+}
+
+// startProgressRecorder starts recording snapshots to path, replacing the
+// snapshots of an earlier run. It returns nil if interval is 0 or the file
+// can't be created, which is logged but doesn't stop the export.
+func startProgressRecorder(path string, interval time.Duration) *progressRecorder {
+	if interval <= 0 {
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("failed to create %s, progress is not recorded: %v", path, err)
+		return nil
+	}
+	r := &progressRecorder{
+		f:     f,
+		start: time.Now(),
+		last:  make(map[*heartbeat]progressMark),
+		done:  make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+func (r *progressRecorder) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			r.record()
+			return
+		case <-ticker.C:
+			r.record()
+		}
+	}
+}
+
+// record appends a snapshot of the current progress.
+func (r *progressRecorder) record() {
+	now := time.Now()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s := ProgressSnapshot{
+		Time:           now.UTC(),
+		ElapsedSeconds: now.Sub(r.start).Seconds(),
+		HeapBytes:      mem.HeapAlloc,
+		SysBytes:       mem.Sys,
+		Goroutines:     runtime.NumGoroutine(),
+		Paused:         exportPause.Paused(),
+		Tables:         []TableProgress{},
+	}
+
+	last := make(map[*heartbeat]progressMark)
+	activeHeartbeats.Range(func(k, _ interface{}) bool {
+		hb := k.(*heartbeat)
+		rows := hb.rows.Load()
+		prev, ok := r.last[hb]
+		if !ok {
+			prev = progressMark{at: hb.start}
+		}
+		p := TableProgress{
+			Table:            hb.table,
+			Rows:             rows,
+			Offset:           hb.offset.Load(),
+			Batches:          hb.batches.Load(),
+			LastBatchSeconds: time.Duration(hb.batchLatest.Load()).Seconds(),
+			MaxBatchSeconds:  time.Duration(hb.batchMax.Load()).Seconds(),
+		}
+		if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+			p.RowsPerSecond = float64(rows-prev.rows) / elapsed
+		}
+		if p.Batches > 0 {
+			p.MeanBatchSeconds = time.Duration(hb.batchTotal.Load()).Seconds() / float64(p.Batches)
+		}
+		s.Tables = append(s.Tables, p)
+		last[hb] = progressMark{rows: rows, at: now}
+		return true
+	})
+	r.last = last
+	sort.Slice(s.Tables, func(i, j int) bool { return s.Tables[i].Table < s.Tables[j].Table })
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("failed to marshal progress snapshot: %v", err)
+		return
+	}
+	if _, err := r.f.Write(append(b, '\n')); err != nil {
+		log.Printf("failed to record progress: %v", err)
+		return
+	}
+	r.f.Sync()
+}
+
+// Stop records a last snapshot and closes the file.
+func (r *progressRecorder) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.f.Close()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ToolVersion is the exporter version recorded in generated artifacts.
+const ToolVersion = "0.1.0"
+
+// Provenance describes how a dataset snapshot was produced, so that it can
+// be reproduced later from the same source and configuration.
+type Provenance struct {
+	ToolVersion  string              `json:"tool_version"`
+	GeneratedAt  time.Time           `json:"generated_at"`
+	SourceDSN    string              `json:"source_dsn"`
+	SchemaHash   string              `json:"schema_hash"`
+	Format       string              `json:"format"`
+	ConfigCommit string              `json:"config_commit,omitempty"`
+	Queries      map[string]string   `json:"queries"`
+	Views        map[string]string   `json:"views,omitempty"`
+	Params       map[string]string   `json:"params,omitempty"`
+	Transforms   map[string][]string `json:"transforms,omitempty"`
+	// Snapshot is the snapshot the tables were read from with -snapshot.
+	Snapshot *SnapshotInfo `json:"snapshot,omitempty"`
+}
+
+// buildProvenance collects the provenance record for an export of the given
+// schema, defined by the config file at configPath, if any.
+func buildProvenance(cfg ExportConfig, configPath string, schema SchemaDetails) (Provenance, error) {
+	hash, err := schemaHash(schema.Tables)
+	if err != nil {
+		return Provenance{}, err
+	}
+
+	prov := Provenance{
+		ToolVersion:  ToolVersion,
+		GeneratedAt:  time.Now().UTC(),
+		SourceDSN:    redactDSN(cfg.Connection.sourceDSN()),
+		SchemaHash:   hash,
+		Format:       cfg.Format,
+		ConfigCommit: configCommit(configPath),
+		Queries:      make(map[string]string),
+		Views:        make(map[string]string),
+		Params:       cfg.Params,
+		Transforms:   make(map[string][]string),
+		Snapshot:     schema.DatasetMetadata.Snapshot,
+	}
+
+	for _, v := range cfg.Views {
+		prov.Views[v.Name] = v.SQL
+	}
+	for _, table := range schema.Tables {
+		switch {
+		case cfg.Connection.Source == sourceMongoDB:
+			prov.Queries[table.TableName] = fmt.Sprintf("db.%s.find({_id: {$gt: $last_id}}).sort({_id: 1}).limit(%d)", table.TableName, cfg.BatchSize)
+		case table.Query != "":
+			prov.Queries[table.TableName] = fmt.Sprintf("%s LIMIT %d OFFSET $offset", selectQuery(table), cfg.BatchSize)
+		case table.Kind == relationView:
+			prov.Queries[table.TableName] = fmt.Sprintf("%s LIMIT %d OFFSET $offset", tablePageKey(table, postgresRowIdentity).query(table, 0, false), cfg.BatchSize)
+		default:
+			fallback := postgresRowIdentity
+			if cfg.Connection.Source == sourceSQLite {
+				fallback = sqliteRowIdentity
+			}
+			prov.Queries[table.TableName] = tablePageKey(table, fallback).query(table, cfg.BatchSize, true)
+		}
+		for _, field := range table.Fields {
+			if len(field.TransformedFeatures) > 0 {
+				prov.Transforms[table.TableName+"."+field.FieldName] = field.TransformedFeatures
+			}
+		}
+	}
+
+	return prov, nil
+}
+
+// schemaHash returns a SHA-256 fingerprint of the structure of the tables:
+// their names and schemas, and the names, types, nullability, precision
+// and scale, enum values and keys of their columns. Statistics, profiles,
+// examples, checksums and the rest of the metadata of an export are left
+// out, so exports of the same schema share a hash.
+func schemaHash(tables []TableMetadata) (string, error) {
+	type column struct {
+		Name            string   `json:"name"`
+		DataType        string   `json:"data_type"`
+		ElementType     string   `json:"element_type,omitempty"`
+		Nullable        bool     `json:"nullable"`
+		Precision       int      `json:"precision,omitempty"`
+		Scale           int      `json:"scale,omitempty"`
+		EnumValues      []string `json:"enum_values,omitempty"`
+		PrimaryKey      bool     `json:"primary_key,omitempty"`
+		ReferencedTable *string  `json:"referenced_table,omitempty"`
+		ReferencedField *string  `json:"referenced_field,omitempty"`
+	}
+	type table struct {
+		Name    string   `json:"name"`
+		Schema  string   `json:"schema,omitempty"`
+		Columns []column `json:"columns"`
+	}
+	structure := make([]table, 0, len(tables))
+	for _, t := range tables {
+		s := table{Name: t.TableName, Schema: t.Schema}
+		for _, f := range t.Fields {
+			c := column{
+				Name:        f.FieldName,
+				DataType:    f.DataType,
+				ElementType: f.ElementType,
+				Nullable:    f.IsNullable,
+				Precision:   f.Precision,
+				Scale:       f.Scale,
+				EnumValues:  f.EnumValues,
+				PrimaryKey:  f.IsPrimaryKey,
+			}
+			if f.IsForeignKey {
+				c.ReferencedTable, c.ReferencedField = f.ReferencedTable, f.ReferencedField
+			}
+			s.Columns = append(s.Columns, c)
+		}
+		structure = append(structure, s)
+	}
+	// The hash doesn't depend on the order the tables are listed in.
+	slices.SortStableFunc(structure, func(a, b table) int {
+		return cmp.Or(cmp.Compare(a.Schema, b.Schema), cmp.Compare(a.Name, b.Name))
+	})
+	b, err := json.Marshal(structure)
+	if err != nil {
+		return "", fmt.Errorf("hashing schema: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// MetadataHeader is the header of the metadata, describing the export
+// that wrote it.
+type MetadataHeader struct {
+	ExportedAt  time.Time `json:"exported_at"`
+	ToolVersion string    `json:"tool_version"`
+	// SourceHost is the host and port of the source, without credentials,
+	// or the path of a SQLite database.
+	SourceHost string        `json:"source_host,omitempty"`
+	Snapshot   *SnapshotInfo `json:"snapshot,omitempty"`
+	// Rows are the rows of each table the export wrote, none for
+	// -schema-only.
+	Rows       map[string]int `json:"rows,omitempty"`
+	SchemaHash string         `json:"schema_hash"`
+}
+
+// buildMetadataHeader builds the header of an export's metadata.
+func buildMetadataHeader(cfg ExportConfig, schema SchemaDetails, rows map[string]int, exportedAt time.Time) (*MetadataHeader, error) {
+	hash, err := schemaHash(schema.Tables)
+	if err != nil {
+		return nil, err
+	}
+	return &MetadataHeader{
+		ExportedAt:  exportedAt,
+		ToolVersion: ToolVersion,
+		SourceHost:  sourceHost(cfg.Connection),
+		Snapshot:    schema.DatasetMetadata.Snapshot,
+		Rows:        rows,
+		SchemaHash:  hash,
+	}, nil
+}
+
+// sourceHost returns the host and port of a connection, leaving out the
+// user, password and options of its DSN.
+func sourceHost(c ConnectionConfig) string {
+	dsn := c.sourceDSN()
+	if c.Source == sourceSQLite {
+		path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+		return path
+	}
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+	settings, err := parseDSNSettings(dsn)
+	if err != nil {
+		return ""
+	}
+	var host, port string
+	for _, s := range settings {
+		switch s.key {
+		case "host":
+			host = s.value
+		case "port":
+			port = s.value
+		}
+	}
+	if host != "" && port != "" {
+		return host + ":" + port
+	}
+	return host
+}
+
+// dsnSecrets are the settings of a connection string left out of the
+// provenance.
+var dsnSecrets = []string{"password", "sslpassword"}
+
+// redactDSN masks the password of URL style connection strings and leaves
+// out the dsnSecrets of their query and of key=value style ones. Paths,
+// such as those of SQLite databases, are kept as they are.
+func redactDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "<unparseable dsn>"
+		}
+		query := u.Query()
+		if slices.ContainsFunc(dsnSecrets, query.Has) {
+			for _, key := range dsnSecrets {
+				query.Del(key)
+			}
+			u.RawQuery = query.Encode()
+		}
+		return u.Redacted()
+	}
+	if !strings.Contains(dsn, "=") {
+		return dsn
+	}
+
+	settings, err := parseDSNSettings(dsn)
+	if err != nil {
+		return "<unparseable dsn>"
+	}
+	kept := settings[:0]
+	for _, s := range settings {
+		if !slices.Contains(dsnSecrets, s.key) {
+			kept = append(kept, s)
+		}
+	}
+	return formatDSNSettings(kept)
+}
+
+// dsnSetting is a keyword and its value in a key=value connection string.
+type dsnSetting struct {
+	key, value string
+}
+
+// parseDSNSettings parses a key=value connection string the way libpq
+// does: spaces may surround the =, and values may be single-quoted, with
+// \' and \\ standing for a quote and a backslash.
+func parseDSNSettings(dsn string) ([]dsnSetting, error) {
+	var settings []dsnSetting
+	s := dsn
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return settings, nil
+		}
+		end := strings.IndexFunc(s, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+		if end <= 0 {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", s)
+		}
+		key := s[:end]
+		s = strings.TrimLeftFunc(s[end:], unicode.IsSpace)
+		if !strings.HasPrefix(s, "=") {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", key)
+		}
+		s = strings.TrimLeftFunc(s[1:], unicode.IsSpace)
+
+		var value strings.Builder
+		quoted := strings.HasPrefix(s, "'")
+		if quoted {
+			s = s[1:]
+		}
+		closed := !quoted
+		for s != "" {
+			c := s[0]
+			if c == '\\' && len(s) > 1 {
+				value.WriteByte(s[1])
+				s = s[2:]
+				continue
+			}
+			if quoted && c == '\'' {
+				s = s[1:]
+				closed = true
+				break
+			}
+			if !quoted && unicode.IsSpace(rune(c)) {
+				break
+			}
+			value.WriteByte(c)
+			s = s[1:]
+		}
+		if !closed {
+			return nil, fmt.Errorf("unterminated quoted value of %q in connection string", key)
+		}
+		settings = append(settings, dsnSetting{key: key, value: value.String()})
+	}
+}
+
+// formatDSNSettings is the inverse of parseDSNSettings.
+func formatDSNSettings(settings []dsnSetting) string {
+	parts := make([]string, len(settings))
+	for i, s := range settings {
+		parts[i] = s.key + "=" + quoteDSNValue(s.value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// configCommit returns the HEAD commit of the git repository holding the
+// config file at path, or an empty string without a config file or when
+// it's not under version control.
+func configCommit(path string) string {
+	if path == "" {
+		return ""
+	}
+	return gitCommit(filepath.Dir(path))
+}
+
+// gitCommit returns the HEAD commit of the git repository containing dir,
+// or an empty string when dir is not under version control.
+func gitCommit(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		dsn  string
+		want string
+	}{
+		{
+			name: "url password",
+			dsn:  "postgres://app:s3cret@db:5432/shop?sslmode=require",
+			want: "postgres://app:xxxxx@db:5432/shop?sslmode=require",
+		},
+		{
+			name: "url password parameters",
+			dsn:  "postgres://app@db/shop?password=s3cret&sslmode=require&sslpassword=k3y",
+			want: "postgres://app@db/shop?sslmode=require",
+		},
+		{
+			name: "key value",
+			dsn:  "host=db user=app password=s3cret dbname=shop",
+			want: "host=db user=app dbname=shop",
+		},
+		{
+			name: "spaces around equals",
+			dsn:  "host = db password = s3cret dbname=shop",
+			want: "host=db dbname=shop",
+		},
+		{
+			name: "quoted password with spaces",
+			dsn:  "host=db password='s3 cr et' dbname=shop",
+			want: "host=db dbname=shop",
+		},
+		{
+			name: "escaped quote in password",
+			dsn:  `host=db password='it\'s a secret' dbname=shop`,
+			want: "host=db dbname=shop",
+		},
+		{
+			name: "ssl key password",
+			dsn:  "host=db sslpassword='k 3y' sslmode=verify-full",
+			want: "host=db sslmode=verify-full",
+		},
+		{
+			name: "quoted values are kept quoted",
+			dsn:  "host=db application_name='nightly export' password=x",
+			want: "host=db application_name='nightly export'",
+		},
+		{
+			name: "unterminated quote",
+			dsn:  "host=db password='s3cret",
+			want: "<unparseable dsn>",
+		},
+		{
+			name: "sqlite path",
+			dsn:  "/var/data/shop.db",
+			want: "/var/data/shop.db",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactDSN(tt.dsn)
+			if got != tt.want {
+				t.Errorf("redactDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+			}
+			for _, secret := range []string{"s3cret", "s3 cr et", "secret", "k3y", "k 3y"} {
+				if strings.Contains(got, secret) && tt.want != "<unparseable dsn>" {
+					t.Errorf("redactDSN(%q) = %q leaks %q", tt.dsn, got, secret)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDSNSettings(t *testing.T) {
+	settings, err := parseDSNSettings(`host = db  port=5433 password='a b\'c\\d' options='-c search_path=x'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dsnSetting{
+		{"host", "db"},
+		{"port", "5433"},
+		{"password", `a b'c\d`},
+		{"options", "-c search_path=x"},
+	}
+	if len(settings) != len(want) {
+		t.Fatalf("got %d settings %v, want %v", len(settings), settings, want)
+	}
+	for i := range want {
+		if settings[i] != want[i] {
+			t.Errorf("setting %d = %v, want %v", i, settings[i], want[i])
+		}
+	}
+
+	formatted := formatDSNSettings(settings)
+	again, err := parseDSNSettings(formatted)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", formatted, err)
+	}
+	for i := range want {
+		if again[i] != want[i] {
+			t.Errorf("round trip of %q: setting %d = %v, want %v", formatted, i, again[i], want[i])
+		}
+	}
+
+	for _, dsn := range []string{"host", "=db", "host=db password='x"} {
+		if _, err := parseDSNSettings(dsn); err == nil {
+			t.Errorf("parseDSNSettings(%q) succeeded, want an error", dsn)
+		}
+	}
+}
+
+func TestSourceHost(t *testing.T) {
+	c := ConnectionConfig{Source: sourcePostgres, DSN: "host = db.internal port=5433 password='a b'"}
+	if got := sourceHost(c); got != "db.internal:5433" {
+		t.Errorf("sourceHost = %q, want db.internal:5433", got)
+	}
+}
+
+func TestSchemaHash(t *testing.T) {
+	users := "users"
+	id := "id"
+	base := func() []TableMetadata {
+		return []TableMetadata{
+			{TableName: "users", Fields: []FieldMetadata{
+				{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true},
+				{FieldName: "status", DataType: DataTypeString, IsNullable: true, EnumValues: []string{"new", "paid"}},
+			}},
+			{TableName: "orders", Schema: "sales", Fields: []FieldMetadata{
+				{FieldName: "user_id", DataType: DataTypeInt, IsForeignKey: true, ReferencedTable: &users, ReferencedField: &id},
+				{FieldName: "total", DataType: DataTypeFloat, Precision: 12, Scale: 2},
+			}},
+		}
+	}
+	want, err := schemaHash(base())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(tables []TableMetadata) []TableMetadata
+		same   bool
+	}{
+		{"table order", func(tables []TableMetadata) []TableMetadata {
+			return []TableMetadata{tables[1], tables[0]}
+		}, true},
+		{"statistics and profile", func(tables []TableMetadata) []TableMetadata {
+			tables[0].Fields[0].Stats = &ColumnStats{}
+			tables[0].Fields[0].Profile = &ColumnProfile{Count: 10}
+			tables[0].Fields[1].ExampleValues = []string{"new"}
+			return tables
+		}, true},
+		{"export details", func(tables []TableMetadata) []TableMetadata {
+			tables[0].Checksums = map[string]string{"id": "00"}
+			tables[0].Note = "sampled"
+			tables[0].Fields[1].Encoding = EncodingDictionary
+			rows := int64(10)
+			tables[0].ExactRows = &rows
+			return tables
+		}, true},
+		{"column type", func(tables []TableMetadata) []TableMetadata {
+			tables[0].Fields[0].DataType = DataTypeString
+			return tables
+		}, false},
+		{"nullability", func(tables []TableMetadata) []TableMetadata {
+			tables[0].Fields[0].IsNullable = true
+			return tables
+		}, false},
+		{"scale", func(tables []TableMetadata) []TableMetadata {
+			tables[1].Fields[1].Scale = 4
+			return tables
+		}, false},
+		{"enum values", func(tables []TableMetadata) []TableMetadata {
+			tables[0].Fields[1].EnumValues = append(tables[0].Fields[1].EnumValues, "shipped")
+			return tables
+		}, false},
+		{"foreign key", func(tables []TableMetadata) []TableMetadata {
+			tables[1].Fields[0].IsForeignKey = false
+			return tables
+		}, false},
+		{"schema", func(tables []TableMetadata) []TableMetadata {
+			tables[1].Schema = "public"
+			return tables
+		}, false},
+		{"column name", func(tables []TableMetadata) []TableMetadata {
+			tables[1].Fields[1].FieldName = "amount"
+			return tables
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := schemaHash(tt.change(base()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.same {
+				t.Errorf("hash changed %v, want %v", got != want, !tt.same)
+			}
+		})
+	}
+}
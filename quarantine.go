@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// rejectsDir is the directory of the output directory that -quarantine
+// writes the rejected rows of each table to, as <table>.jsonl.
+const rejectsDir = "rejects"
+
+// conversionErrorsColumn holds, in a row a transform failed to convert a
+// value of, the errors of those values.
+const conversionErrorsColumn = "__conversion_errors"
+
+// ConversionError is a value that could not be converted to its column's
+// type.
+type ConversionError struct {
+	Column string      `json:"column"`
+	Value  interface{} `json:"value"`
+	Error  string      `json:"error"`
+}
+
+// RejectedRow is a line of a table's rejects file.
+type RejectedRow struct {
+	Row    map[string]interface{} `json:"row"`
+	Errors []ConversionError      `json:"errors"`
+}
+
+// addConversionError records on a row that value, of column, failed to
+// convert.
+func addConversionError(row TableRow, column string, value interface{}, err error) {
+	errs, _ := row[conversionErrorsColumn].([]ConversionError)
+	row[conversionErrorsColumn] = append(errs, ConversionError{Column: column, Value: rejectedValue(value), Error: err.Error()})
+}
+
+// conversionError returns why a value can't be stored as its column's
+// type, where the writers would otherwise store a zero value in its place.
+// Nulls and text convert to any type that is stored as text.
+func conversionError(col FieldMetadata, value interface{}) error {
+	if value == nil || col.Encoding == EncodingHash {
+		return nil
+	}
+	switch col.DataType {
+	case DataTypeInt:
+		switch v := value.(type) {
+		case int64, int:
+			return nil
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt64 {
+				return nil
+			}
+			return fmt.Errorf("%v is not an integer", v)
+		}
+		return fmt.Errorf("%s is not an integer", describeValue(value))
+	case DataTypeFloat:
+		if _, ok := moneyAmount(value); !ok {
+			return fmt.Errorf("%s is not a number", describeValue(value))
+		}
+	case DataTypeBool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s is not a boolean", describeValue(value))
+		}
+	case DataTypeTime, DataTypeDate:
+		if _, ok := timeValue(value); !ok {
+			return fmt.Errorf("%s is not a %s", describeValue(value), col.DataType)
+		}
+	case DataTypeTimeOfDay:
+		if _, ok := timeOfDayValue(value); !ok {
+			return fmt.Errorf("%s is not a time of day", describeValue(value))
+		}
+	case DataTypeBytes:
+		if _, ok := binaryValue(value); !ok {
+			return fmt.Errorf("%s is not binary data", describeValue(value))
+		}
+	}
+	return nil
+}
+
+// describeValue renders a value for a conversion error.
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []byte:
+		return strconv.Quote(string(v))
+	}
+	return fmt.Sprintf("%v (%T)", value, value)
+}
+
+// rejectedValue returns a value as it is written to a rejects file: text
+// for bytes and for floats JSON has no number for.
+func rejectedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// rowQuarantine takes the rows with values that failed to convert out of
+// a table's batches and appends them, with their errors, to the table's
+// rejects file. When it is disabled the rows are kept, with the values
+// the parsers failed on null and the others coerced by the writers.
+type rowQuarantine struct {
+	enabled bool
+	path    string
+	f       *os.File
+	// rows and size are the rows and bytes written to the file.
+	rows int
+	size int64
+}
+
+func newRowQuarantine(outDir, table string, enabled bool) *rowQuarantine {
+	return &rowQuarantine{enabled: enabled, path: filepath.Join(outDir, rejectsDir, table+".jsonl")}
+}
+
+// open continues the rejects file after the first rows and size bytes, the
+// ones a checkpoint recorded, dropping what an earlier attempt wrote after
+// them. With no rows the file of an earlier attempt or run is removed.
+func (q *rowQuarantine) open(rows int, size int64) error {
+	if !q.enabled {
+		return nil
+	}
+	q.rows, q.size = rows, size
+	if size == 0 {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	f, err := os.OpenFile(q.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	q.f = f
+	return nil
+}
+
+// filter returns the rows of a batch that convert to the types of columns,
+// writing the others to the rejects file.
+func (q *rowQuarantine) filter(rows []TableRow, columns []FieldMetadata) ([]TableRow, error) {
+	if !q.enabled {
+		for _, row := range rows {
+			delete(row, conversionErrorsColumn)
+		}
+		return rows, nil
+	}
+	kept := rows[:0]
+	var buf []byte
+	for _, row := range rows {
+		errs, _ := row[conversionErrorsColumn].([]ConversionError)
+		delete(row, conversionErrorsColumn)
+		for _, col := range columns {
+			if err := conversionError(col, row[col.FieldName]); err != nil {
+				errs = append(errs, ConversionError{Column: col.FieldName, Value: rejectedValue(row[col.FieldName]), Error: err.Error()})
+			}
+		}
+		if len(errs) == 0 {
+			kept = append(kept, row)
+			continue
+		}
+		values := make(map[string]interface{}, len(columns))
+		for _, col := range columns {
+			values[col.FieldName] = rejectedValue(row[col.FieldName])
+		}
+		// Parsed values that failed are null in the row.
+		for _, e := range errs {
+			values[e.Column] = e.Value
+		}
+		b, err := json.Marshal(RejectedRow{Row: values, Errors: errs})
+		if err != nil {
+			return nil, fmt.Errorf("encoding a rejected row: %w", err)
+		}
+		buf = append(append(buf, b...), '\n')
+		q.rows++
+	}
+	if len(buf) == 0 {
+		return kept, nil
+	}
+	if q.f == nil {
+		if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(q.path)
+		if err != nil {
+			return nil, err
+		}
+		q.f = f
+	}
+	n, err := q.f.Write(buf)
+	q.size += int64(n)
+	if err != nil {
+		return nil, fmt.Errorf("writing %s: %w", q.path, err)
+	}
+	return kept, nil
+}
+
+// close closes the rejects file.
+func (q *rowQuarantine) close() {
+	if q.f != nil {
+		q.f.Close()
+		q.f = nil
+	}
+}
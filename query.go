@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// paramEnvPrefix prefixes environment variables supplying query parameter
+// values, e.g. NPZ_PARAM_START_DATE for :start_date.
+const paramEnvPrefix = "NPZ_PARAM_"
+
+// bindNamedParams rewrites the :name placeholders of a query to the
+// positional $n placeholders understood by PostgreSQL and returns the
+// parameter names in order. A name used more than once maps to the same
+// position. Casts (::type), strings, quoted identifiers and comments are
+// left alone.
+func bindNamedParams(query string) (string, []string) {
+	var b strings.Builder
+	var names []string
+	positions := make(map[string]int)
+
+	for i := 0; i < len(query); i++ {
+		if end, ok := skipSQLLiteral(query, i); ok {
+			b.WriteString(query[i:end])
+			i = end - 1
+			continue
+		}
+		c := query[i]
+		switch {
+		case c == ':' && i+1 < len(query) && query[i+1] == ':':
+			b.WriteString("::")
+			i++
+			continue
+		case c == ':' && i+1 < len(query) && isParamStart(query[i+1]):
+			j := i + 1
+			for j < len(query) && isParamChar(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+			pos, ok := positions[name]
+			if !ok {
+				names = append(names, name)
+				pos = len(names)
+				positions[name] = pos
+			}
+			fmt.Fprintf(&b, "$%d", pos)
+			i = j - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), names
+}
+
+// skipSQLLiteral returns the end of the string constant, escape string,
+// dollar-quoted string, quoted identifier or comment starting at
+// query[i], and false if none does. An unterminated one runs to the end.
+func skipSQLLiteral(query string, i int) (int, bool) {
+	c := query[i]
+	switch {
+	case c == '\'':
+		// E'...' strings escape quotes with backslashes.
+		escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i == 1 || !isIdentByte(query[i-2]))
+		return skipQuoted(query, i, escapes), true
+	case c == '"':
+		return skipQuoted(query, i, false), true
+	case strings.HasPrefix(query[i:], "--"):
+		if n := strings.IndexByte(query[i:], '\n'); n >= 0 {
+			return i + n + 1, true
+		}
+		return len(query), true
+	case strings.HasPrefix(query[i:], "/*"):
+		return skipBlockComment(query, i), true
+	case c == '$' && (i == 0 || !isIdentByte(query[i-1])):
+		tag, ok := dollarTag(query[i:])
+		if !ok {
+			return i, false
+		}
+		if n := strings.Index(query[i+len(tag):], tag); n >= 0 {
+			return i + len(tag) + n + len(tag), true
+		}
+		return len(query), true
+	}
+	return i, false
+}
+
+// skipQuoted returns the end of the quoted string or identifier starting
+// at query[i], whose quote is doubled inside it, and with escapes also
+// escaped with a backslash. An unterminated one runs to the end.
+func skipQuoted(query string, i int, escapes bool) int {
+	quote := query[i]
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case escapes && query[j] == '\\':
+			j++
+		case query[j] == quote && j+1 < len(query) && query[j+1] == quote:
+			j++
+		case query[j] == quote:
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+// skipBlockComment returns the end of the /* comment */ starting at
+// query[i], which may nest.
+func skipBlockComment(query string, i int) int {
+	depth := 0
+	for j := i; j+1 < len(query); j++ {
+		switch query[j : j+2] {
+		case "/*":
+			depth++
+			j++
+		case "*/":
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(query)
+}
+
+// dollarTag returns the opening $tag$ of a dollar-quoted string at the
+// start of s, whose tag is empty or an identifier without dollar signs.
+func dollarTag(s string) (string, bool) {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '$':
+			return s[:j+1], true
+		case j > 1 && '0' <= c && c <= '9', c == '_', c >= 0x80, 'a' <= c|0x20 && c|0x20 <= 'z':
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// isIdentByte reports whether c can continue an unquoted identifier or
+// keyword.
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || '0' <= c && c <= '9' || 'a' <= c|0x20 && c|0x20 <= 'z'
+}
+
+func isParamStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isParamChar(c byte) bool {
+	return isParamStart(c) || '0' <= c && c <= '9'
+}
+
+// resolveParams fills in the values of query and table filter parameters
+// from the environment, overriding values from the config file, and from
+// -param flags, which override both.
+func (c *ExportConfig) resolveParams(flagParams map[string]string) {
+	if c.Params == nil {
+		c.Params = make(map[string]string)
+	}
+	var sources []string
+	for _, q := range c.Queries {
+		sources = append(sources, q.SQL)
+	}
+	for _, t := range c.Tables {
+		sources = append(sources, t.Where)
+	}
+	for _, sql := range sources {
+		_, names := bindNamedParams(sql)
+		for _, name := range names {
+			if v, ok := os.LookupEnv(paramEnvPrefix + strings.ToUpper(name)); ok {
+				c.Params[name] = v
+			}
+		}
+	}
+	for name, v := range flagParams {
+		c.Params[name] = v
+	}
+}
+
+// queryArgs returns the positional arguments for the named parameters.
+func (c ExportConfig) queryArgs(names []string) ([]interface{}, error) {
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		v, ok := c.Params[name]
+		if !ok {
+			return nil, fmt.Errorf("no value for query parameter :%s (use -param %s=... or %s%s)",
+				name, name, paramEnvPrefix, strings.ToUpper(name))
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+// fetchQueryMetadata describes the result columns of a configured query by
+// executing it without returning rows. mapType converts the driver's type
+// names to our standardized types.
+func fetchQueryMetadata(ctx context.Context, db *sql.DB, cfg ExportConfig, q QueryConfig, mapType func(string) string) (TableMetadata, error) {
+	query, names := bindNamedParams(q.SQL)
+	args, err := cfg.queryArgs(names)
+	if err != nil {
+		return TableMetadata{}, fmt.Errorf("query %s: %w", q.Name, err)
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM (%s) AS q LIMIT 0", query), args...)
+	if err != nil {
+		return TableMetadata{}, fmt.Errorf("describing query %s: %w", q.Name, err)
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return TableMetadata{}, fmt.Errorf("describing query %s: %w", q.Name, err)
+	}
+
+	tableMeta := TableMetadata{TableName: q.Name, Query: q.SQL}
+	for _, ct := range colTypes {
+		field := FieldMetadata{
+			FieldName: ct.Name(),
+			DataType:  mapType(ct.DatabaseTypeName()),
+			// Nullability of computed columns is not known.
+			IsNullable: true,
+			IsPII:      isLikelyPII(ct.Name()),
+		}
+		if precision, scale, ok := ct.DecimalSize(); ok && field.DataType == DataTypeFloat && precision > 0 {
+			field.Precision, field.Scale = int(precision), int(scale)
+		}
+		if field.DataType == DataTypeArray {
+			field.ElementType = mapType(strings.TrimPrefix(ct.DatabaseTypeName(), "_"))
+		}
+		tableMeta.Fields = append(tableMeta.Fields, field)
+	}
+	return tableMeta, nil
+}
+
+// mapColumnType converts the PostgreSQL type names reported for result
+// columns to our standardized types.
+func mapColumnType(dbType string) string {
+	switch dbType {
+	case "VARCHAR", "TEXT", "BPCHAR", "NAME":
+		return DataTypeString
+	case "INT2", "INT4", "INT8":
+		return DataTypeInt
+	case "NUMERIC", "FLOAT4", "FLOAT8":
+		return DataTypeFloat
+	case "BOOL":
+		return DataTypeBool
+	case "TIMESTAMP", "TIMESTAMPTZ":
+		return DataTypeTime
+	case "TIME", "TIMETZ":
+		return DataTypeTimeOfDay
+	case "DATE":
+		return DataTypeDate
+	case "UUID":
+		return DataTypeUUID
+	case "JSON", "JSONB":
+		return DataTypeJSON
+	case "BYTEA":
+		return DataTypeBytes
+	default:
+		// Array types are named after their element type, e.g. _INT4.
+		if strings.HasPrefix(dbType, "_") {
+			return DataTypeArray
+		}
+		return DataTypeString
+	}
+}
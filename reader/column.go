@@ -0,0 +1,133 @@
+package reader
+
+import (
+	"fmt"
+	"iter"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Column is a column of a table, decoded to a slice of the Go type of its
+// data type:
+//   - int: int64, as are hashed columns
+//   - float: float64, or decimal text for decimals stored exactly
+//   - bool: bool
+//   - timestamp and date: time.Time in UTC
+//   - time: time.Duration since midnight
+//   - bytes: []byte
+//   - array: []any for ragged arrays, JSON text otherwise
+//   - string, uuid, json and null: string
+type Column struct {
+	Field  Field
+	values any
+	nulls  []bool
+}
+
+// newColumn returns a column of values, a slice of the field's Go type,
+// with nulls true where a value is null, or nil without nulls.
+func newColumn(field Field, values any, nulls []bool) *Column {
+	return &Column{Field: field, values: values, nulls: nulls}
+}
+
+// Len returns the number of values of the column.
+func (c *Column) Len() int {
+	switch v := c.values.(type) {
+	case []int64:
+		return len(v)
+	case []float64:
+		return len(v)
+	case []bool:
+		return len(v)
+	case []time.Time:
+		return len(v)
+	case []time.Duration:
+		return len(v)
+	case [][]byte:
+		return len(v)
+	case [][]any:
+		return len(v)
+	case []string:
+		return len(v)
+	}
+	return 0
+}
+
+// Null reports whether the i'th value is null.
+func (c *Column) Null(i int) bool {
+	return c.nulls != nil && c.nulls[i]
+}
+
+// Value returns the i'th value, or nil for a null.
+func (c *Column) Value(i int) any {
+	if c.Null(i) {
+		return nil
+	}
+	switch v := c.values.(type) {
+	case []int64:
+		return v[i]
+	case []float64:
+		return v[i]
+	case []bool:
+		return v[i]
+	case []time.Time:
+		return v[i]
+	case []time.Duration:
+		return v[i]
+	case [][]byte:
+		return v[i]
+	case [][]any:
+		return v[i]
+	case []string:
+		return v[i]
+	}
+	return nil
+}
+
+// All returns an iterator over the positions and values of the column,
+// with nil for nulls.
+func (c *Column) All() iter.Seq2[int, any] {
+	return func(yield func(int, any) bool) {
+		for i := 0; i < c.Len(); i++ {
+			if !yield(i, c.Value(i)) {
+				return
+			}
+		}
+	}
+}
+
+// Values returns an iterator over the values of a column whose Go type is
+// T, with ok false for nulls, whose value is T's zero value.
+func Values[T any](c *Column) (iter.Seq2[T, bool], error) {
+	values, ok := c.values.([]T)
+	if !ok {
+		var zero T
+		return nil, fmt.Errorf("column %s holds %T values, not %T", c.Field.Name, c.values, zero)
+	}
+	return func(yield func(T, bool) bool) {
+		var zero T
+		for i, v := range values {
+			if c.Null(i) {
+				v = zero
+			}
+			if !yield(v, !c.Null(i)) {
+				return
+			}
+		}
+	}, nil
+}
+
+// formatDecimal formats an unscaled decimal value at the given scale.
+func formatDecimal(unscaled *big.Int, scale int) string {
+	digits := new(big.Int).Abs(unscaled).String()
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if unscaled.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
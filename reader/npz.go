@@ -0,0 +1,470 @@
+package reader
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbinet/npyio/npy"
+	"github.com/sbinet/npyio/npz"
+)
+
+// Companion arrays of the columns of an NPZ archive.
+const (
+	maskSuffix       = "__mask"
+	categoriesSuffix = "__categories"
+	offsetsSuffix    = "__offsets"
+	lowSuffix        = "__low"
+	dictionarySuffix = "__dictionary"
+)
+
+// dictionaryDir is the directory next to the archives holding the shared
+// dictionaries, as <name>.npy string arrays.
+const dictionaryDir = "dictionaries"
+
+// natValue is numpy's NaT, the datetime64 of missing times.
+const natValue = math.MinInt64
+
+// readNpz reads columns of an NPZ archive, decoding shared dictionary
+// encoded ones with the dictionaries next to it.
+func readNpz(path string, fields []Field) ([]*Column, error) {
+	r, err := npz.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	columns := make([]*Column, len(fields))
+	for i, field := range fields {
+		if columns[i], err = readNpzColumn(r, filepath.Dir(path), field); err != nil {
+			return nil, fmt.Errorf("reading column %s: %w", field.Name, err)
+		}
+	}
+	return columns, nil
+}
+
+// readNpzColumn reads a column and its companion arrays, from an archive
+// in dir.
+func readNpzColumn(r *npz.Reader, dir string, field Field) (*Column, error) {
+	var values any
+	var nulls []bool
+	var err error
+	if hasArray(r, field.Name+offsetsSuffix) {
+		values, err = readRagged(r, field)
+	} else {
+		values, nulls, err = readFlat(r, dir, field)
+	}
+	if err != nil {
+		return nil, err
+	}
+	column := newColumn(field, values, nulls)
+
+	if hasArray(r, field.Name+maskSuffix) {
+		m, err := readArray(r, field.Name+maskSuffix)
+		if err != nil {
+			return nil, err
+		}
+		mask, _ := m.([]bool)
+		if len(mask) != column.Len() {
+			return nil, fmt.Errorf("null mask has %d values, expected %d", len(mask), column.Len())
+		}
+		if column.nulls == nil {
+			column.nulls = make([]bool, len(mask))
+		}
+		for i, null := range mask {
+			column.nulls[i] = column.nulls[i] || null
+		}
+	}
+	return column, nil
+}
+
+// readFlat reads a column stored as one value per row, returning the
+// placeholders of missing values, such as NaT, as nulls.
+func readFlat(r *npz.Reader, dir string, field Field) (any, []bool, error) {
+	raw, err := readArray(r, field.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasArray(r, field.Name+categoriesSuffix) || hasArray(r, field.Name+dictionarySuffix) {
+		labels, err := readCategories(r, dir, field)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes := reflect.ValueOf(raw)
+		values := make([]string, codes.Len())
+		for i := range values {
+			if c, _ := numericValue(codes.Index(i)).(int64); c >= 0 && c < int64(len(labels)) {
+				values[i] = labels[c]
+			}
+		}
+		raw = values
+	}
+	if field.Encoding == encodingDecimalScaled {
+		if raw, err = readScaled(r, field, raw); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch v := raw.(type) {
+	case []time.Time:
+		nulls := make([]bool, len(v))
+		for i, t := range v {
+			nulls[i] = t.IsZero()
+		}
+		return v, nulls, nil
+	case []time.Duration:
+		nulls := make([]bool, len(v))
+		for i, d := range v {
+			nulls[i] = d == natValue
+		}
+		return v, nulls, nil
+	case []string:
+		return textValues(field, v)
+	case []bool:
+		return v, nil, nil
+	}
+	rv := reflect.ValueOf(raw)
+	if rv.Kind() != reflect.Slice {
+		return nil, nil, fmt.Errorf("unsupported array %T", raw)
+	}
+	if field.DataType == TypeFloat {
+		values := make([]float64, rv.Len())
+		for i := range values {
+			switch v := numericValue(rv.Index(i)).(type) {
+			case int64:
+				values[i] = float64(v)
+			case float64:
+				values[i] = v
+			}
+		}
+		return values, nil, nil
+	}
+	values := make([]int64, rv.Len())
+	for i := range values {
+		switch v := numericValue(rv.Index(i)).(type) {
+		case int64:
+			values[i] = v
+		case float64:
+			values[i] = int64(v)
+		}
+	}
+	return values, nil, nil
+}
+
+// textValues converts a column stored as text to its Go type, returning
+// the placeholders of missing values as nulls.
+func textValues(field Field, text []string) (any, []bool, error) {
+	nulls := make([]bool, len(text))
+	for i, s := range text {
+		switch field.DataType {
+		case TypeTime, TypeUUID, TypeJSON, TypeArray, TypeNull:
+			nulls[i] = s == "null"
+		case TypeDate:
+			nulls[i] = s == ""
+		}
+	}
+	switch field.DataType {
+	case TypeBytes:
+		values := make([][]byte, len(text))
+		for i, s := range text {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("decoding row %d: %w", i, err)
+			}
+			values[i] = b
+		}
+		return values, nulls, nil
+	case TypeTime, TypeDate:
+		values := make([]time.Time, len(text))
+		for i, s := range text {
+			if nulls[i] {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				t, err = time.Parse(time.DateOnly, s)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing row %d: %w", i, err)
+			}
+			values[i] = t.UTC()
+		}
+		return values, nulls, nil
+	}
+	return text, nulls, nil
+}
+
+// readScaled returns the values of a decimal_scaled column as decimal
+// text, given its array of unscaled values or of their high halves.
+func readScaled(r *npz.Reader, field Field, raw any) ([]string, error) {
+	unscaled, _ := raw.([]int64)
+	var low []int64
+	if hasArray(r, field.Name+lowSuffix) {
+		v, err := readArray(r, field.Name+lowSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if low, _ = v.([]int64); len(low) != len(unscaled) {
+			return nil, fmt.Errorf("%s has %d values, expected %d", field.Name+lowSuffix, len(low), len(unscaled))
+		}
+	}
+	values := make([]string, len(unscaled))
+	for i, v := range unscaled {
+		n := big.NewInt(v)
+		if low != nil {
+			n.Lsh(n, 64).Or(n, new(big.Int).SetUint64(uint64(low[i])))
+		}
+		values[i] = formatDecimal(n, field.Scale)
+	}
+	return values, nil
+}
+
+// readRagged reads a ragged column, whose rows are ranges of one values
+// array, as []byte rows for binary columns and []any rows for arrays.
+func readRagged(r *npz.Reader, field Field) (any, error) {
+	o, err := readArray(r, field.Name+offsetsSuffix)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := readArray(r, field.Name)
+	if err != nil {
+		return nil, err
+	}
+	ends, _ := o.([]int64)
+	elements := reflect.ValueOf(raw)
+	for i := 1; i < len(ends); i++ {
+		if ends[i-1] > ends[i] || ends[i] > int64(elements.Len()) {
+			return nil, fmt.Errorf("invalid offsets")
+		}
+	}
+	rows := max(len(ends)-1, 0)
+
+	if field.DataType == TypeBytes {
+		b, _ := raw.([]uint8)
+		values := make([][]byte, rows)
+		for i := range values {
+			values[i] = b[ends[i]:ends[i+1]]
+		}
+		return values, nil
+	}
+	values := make([][]any, rows)
+	for i := range values {
+		values[i] = make([]any, 0, ends[i+1]-ends[i])
+		for j := ends[i]; j < ends[i+1]; j++ {
+			values[i] = append(values[i], numericValue(elements.Index(int(j))))
+		}
+	}
+	return values, nil
+}
+
+// numericValue returns a numpy element as an int64, float64, bool or
+// string.
+func numericValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return v.Interface()
+}
+
+// hasArray reports whether the archive has the named array.
+func hasArray(r *npz.Reader, name string) bool {
+	return r.Header(name) != nil || r.Header(name+".npy") != nil
+}
+
+// readCategories reads the values of the codes of a dictionary encoded
+// column, from its categories or its shared dictionary in dir.
+func readCategories(r *npz.Reader, dir string, field Field) ([]string, error) {
+	if hasArray(r, field.Name+categoriesSuffix) {
+		categories, err := readArray(r, field.Name+categoriesSuffix)
+		if err != nil {
+			return nil, err
+		}
+		labels, _ := categories.([]string)
+		return labels, nil
+	}
+	name, err := readArray(r, field.Name+dictionarySuffix)
+	if err != nil {
+		return nil, err
+	}
+	names, _ := name.([]string)
+	if len(names) != 1 {
+		return nil, fmt.Errorf("%s names %d dictionaries", field.Name+dictionarySuffix, len(names))
+	}
+	path := filepath.Join(dir, dictionaryDir, names[0]+".npy")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	nr, err := npy.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(nr.Header.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v of %s", nr.Header.Descr.Shape, path)
+	}
+	labels, err := readUnicode(f, nr.Header.Descr.Type, nr.Header.Descr.Shape[0])
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return labels, nil
+}
+
+// readArray reads an array of an NPZ archive as a slice.
+func readArray(r *npz.Reader, name string) (any, error) {
+	key := name
+	hdr := r.Header(key)
+	if hdr == nil {
+		key = name + ".npy"
+		hdr = r.Header(key)
+	}
+	if hdr == nil {
+		return nil, fmt.Errorf("no array %q", name)
+	}
+	if strings.HasPrefix(hdr.Descr.Type, "<M8[") {
+		return readDatetimes(r, key, hdr)
+	}
+	if hdr.Descr.Type == "<m8[ns]" {
+		return readTimedeltas(r, key, hdr)
+	}
+	if strings.HasPrefix(hdr.Descr.Type, "<U") {
+		return readStrings(r, key, hdr)
+	}
+	rt := npy.TypeFrom(hdr.Descr.Type)
+	if rt == nil {
+		return nil, fmt.Errorf("unsupported dtype %q of %q", hdr.Descr.Type, key)
+	}
+	ptr := reflect.New(reflect.SliceOf(rt))
+	if err := r.Read(key, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// readStrings reads a fixed-width unicode array, which npyio returns as
+// its raw UTF-32 bytes.
+func readStrings(r *npz.Reader, key string, hdr *npy.Header) ([]string, error) {
+	if len(hdr.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v of %q", hdr.Descr.Shape, key)
+	}
+	rc, err := r.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// Skip the header.
+	if _, err := npy.NewReader(rc); err != nil {
+		return nil, err
+	}
+	values, err := readUnicode(rc, hdr.Descr.Type, hdr.Descr.Shape[0])
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+	return values, nil
+}
+
+// readUnicode reads the n values of a little-endian "<U" array from rd,
+// positioned at its data, without their NUL padding.
+func readUnicode(rd io.Reader, dtype string, n int) ([]string, error) {
+	width, err := strconv.Atoi(strings.TrimPrefix(dtype, "<U"))
+	if err != nil || width < 0 {
+		return nil, fmt.Errorf("unsupported dtype %q", dtype)
+	}
+	raw := make([]uint32, n*width)
+	if err := binary.Read(rd, binary.LittleEndian, raw); err != nil {
+		return nil, err
+	}
+	values := make([]string, n)
+	runes := make([]rune, 0, width)
+	for i := range values {
+		value := raw[i*width : (i+1)*width]
+		for len(value) > 0 && value[len(value)-1] == 0 {
+			value = value[:len(value)-1]
+		}
+		runes = runes[:0]
+		for _, c := range value {
+			runes = append(runes, rune(c))
+		}
+		values[i] = string(runes)
+	}
+	return values, nil
+}
+
+// readDatetimes reads a datetime64 array of nanoseconds or days, which
+// npyio can't decode, as times in UTC, with NaT as the zero time.
+func readDatetimes(r *npz.Reader, key string, hdr *npy.Header) ([]time.Time, error) {
+	var unit time.Duration
+	switch hdr.Descr.Type {
+	case "<M8[ns]":
+		unit = time.Nanosecond
+	case "<M8[D]":
+		unit = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("unsupported dtype %q of %q", hdr.Descr.Type, key)
+	}
+	if len(hdr.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v of %q", hdr.Descr.Shape, key)
+	}
+
+	rc, err := r.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// Skip the header.
+	if _, err := npy.NewReader(rc); err != nil {
+		return nil, err
+	}
+	raw := make([]int64, hdr.Descr.Shape[0])
+	if err := binary.Read(rc, binary.LittleEndian, raw); err != nil {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+
+	values := make([]time.Time, len(raw))
+	for i, v := range raw {
+		switch {
+		case v == natValue:
+		case unit == time.Nanosecond:
+			values[i] = time.Unix(0, v).UTC()
+		default:
+			values[i] = time.Unix(v*int64(unit/time.Second), 0).UTC()
+		}
+	}
+	return values, nil
+}
+
+// readTimedeltas reads a timedelta64 array of nanoseconds, which npyio
+// can't decode, as durations, with NaT kept as the smallest one.
+func readTimedeltas(r *npz.Reader, key string, hdr *npy.Header) ([]time.Duration, error) {
+	if len(hdr.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v of %q", hdr.Descr.Shape, key)
+	}
+	rc, err := r.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// Skip the header.
+	if _, err := npy.NewReader(rc); err != nil {
+		return nil, err
+	}
+	values := make([]time.Duration, hdr.Descr.Shape[0])
+	if err := binary.Read(rc, binary.LittleEndian, values); err != nil {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+	return values, nil
+}
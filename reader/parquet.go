@@ -0,0 +1,574 @@
+package reader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const parquetMagic = "PAR1"
+
+// Parquet physical types.
+const (
+	parquetBoolean    = 0
+	parquetInt32      = 1
+	parquetInt64      = 2
+	parquetFloat      = 4
+	parquetDouble     = 5
+	parquetByteArray  = 6
+	parquetFixedBytes = 7
+)
+
+// Parquet encodings, page types, codecs and schema properties.
+const (
+	encodingPlain             = 0
+	encodingPlainDict         = 2
+	encodingDeltaBinaryPacked = 5
+	encodingRLEDictionary     = 8
+	pageData                  = 0
+	pageDictionary            = 2
+	codecUncompressed         = 0
+	codecSnappy               = 1
+	codecGzip                 = 2
+	codecZstd                 = 6
+	repetitionOptional        = 1
+	convertedDecimal          = 5
+	logicalTypeDecimal        = 5
+	logicalTypeTime           = 7
+	logicalTypeTimestamp      = 8
+	logicalTimeUnitMillis     = 1
+	logicalTimeUnitNanos      = 3
+	// maxDefinitionLevel is the definition level of the values of the
+	// flat optional columns the exporter writes.
+	maxDefinitionLevel = 1
+)
+
+// parquetSchemaColumn is a leaf column of a Parquet file's schema.
+type parquetSchemaColumn struct {
+	index      int
+	physical   int64
+	typeLength int
+	optional   bool
+	decimal    bool
+	scale      int
+	// unit is the unit of a timestamp or time of day.
+	unit time.Duration
+}
+
+// readParquet reads columns of a Parquet file written by the exporter:
+// flat columns with PLAIN, dictionary or delta encoded values in version 1
+// data pages, uncompressed or compressed with Snappy, gzip or zstd.
+func readParquet(path string, fields []Field) ([]*Column, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n := len(data)
+	if n < 12 || string(data[:4]) != parquetMagic || string(data[n-4:]) != parquetMagic {
+		return nil, fmt.Errorf("%s is not a Parquet file", path)
+	}
+	size := int(binary.LittleEndian.Uint32(data[n-8:]))
+	if size > n-12 {
+		return nil, fmt.Errorf("invalid footer length %d", size)
+	}
+	footer, err := (&thriftReader{buf: data[n-8-size : n-8]}).readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("reading footer: %w", err)
+	}
+
+	schema := make(map[string]parquetSchemaColumn)
+	for i, e := range footer.list(2) {
+		if i == 0 {
+			// The root.
+			continue
+		}
+		se, _ := e.(thriftStructValue)
+		c := parquetSchemaColumn{
+			index:      i - 1,
+			physical:   se.int(1),
+			typeLength: int(se.int(2)),
+			optional:   se.int(3) == repetitionOptional,
+			decimal:    se.int(6) == convertedDecimal || se.structField(10).has(logicalTypeDecimal),
+			scale:      int(se.int(7)),
+			unit:       time.Microsecond,
+		}
+		ts := se.structField(10).structField(logicalTypeTimestamp)
+		if ts == nil {
+			ts = se.structField(10).structField(logicalTypeTime)
+		}
+		if ts != nil {
+			switch unit := ts.structField(2); {
+			case unit.has(logicalTimeUnitMillis):
+				c.unit = time.Millisecond
+			case unit.has(logicalTimeUnitNanos):
+				c.unit = time.Nanosecond
+			}
+		}
+		schema[se.str(4)] = c
+	}
+
+	columns := make([]*Column, len(fields))
+	for i, field := range fields {
+		sc, ok := schema[field.Name]
+		if !ok {
+			return nil, fmt.Errorf("no column %s", field.Name)
+		}
+		var values []any
+		for _, g := range footer.list(4) {
+			group, _ := g.(thriftStructValue)
+			chunks := group.list(1)
+			if sc.index >= len(chunks) {
+				return nil, fmt.Errorf("row group without column %s", field.Name)
+			}
+			chunk, _ := chunks[sc.index].(thriftStructValue)
+			if values, err = readParquetChunk(data, chunk.structField(3), sc, values); err != nil {
+				return nil, fmt.Errorf("reading column %s: %w", field.Name, err)
+			}
+		}
+		if columns[i], err = parquetColumn(field, sc, values); err != nil {
+			return nil, fmt.Errorf("reading column %s: %w", field.Name, err)
+		}
+	}
+	return columns, nil
+}
+
+// readParquetChunk appends the values of a column chunk to values, with
+// nil for nulls: bools, int64s, float64s and []byte.
+func readParquetChunk(data []byte, meta thriftStructValue, sc parquetSchemaColumn, values []any) ([]any, error) {
+	codec := meta.int(4)
+	offset := meta.int(9)
+	if meta.has(11) {
+		offset = meta.int(11)
+	}
+	remaining := meta.int(5)
+
+	var dict []any
+	for remaining > 0 {
+		if offset < 0 || offset >= int64(len(data)) {
+			return nil, fmt.Errorf("invalid page offset %d", offset)
+		}
+		r := &thriftReader{buf: data, pos: int(offset)}
+		header, err := r.readStruct()
+		if err != nil {
+			return nil, fmt.Errorf("reading page header: %w", err)
+		}
+		end := r.pos + int(header.int(3))
+		if end > len(data) || end < r.pos {
+			return nil, fmt.Errorf("truncated page")
+		}
+		page := data[r.pos:end]
+		offset = int64(end)
+		if page, err = decompress(codec, page); err != nil {
+			return nil, fmt.Errorf("decompressing page: %w", err)
+		}
+
+		switch header.int(1) {
+		case pageDictionary:
+			n := int(header.structField(7).int(1))
+			if dict, err = plainValues(page, sc, n); err != nil {
+				return nil, err
+			}
+		case pageData:
+			dp := header.structField(5)
+			n := int(dp.int(1))
+			if values, err = dataPageValues(page, sc, n, dp.int(2), dict, values); err != nil {
+				return nil, err
+			}
+			remaining -= int64(n)
+		default:
+			return nil, fmt.Errorf("unsupported page type %d", header.int(1))
+		}
+	}
+	return values, nil
+}
+
+// zstdDecoder is the decoder of zstd compressed pages, created on first
+// use.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil)
+})
+
+// decompress returns the data of a page compressed with codec.
+func decompress(codec int64, page []byte) ([]byte, error) {
+	switch codec {
+	case codecUncompressed:
+		return page, nil
+	case codecSnappy:
+		return snappy.Decode(nil, page)
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case codecZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(page, nil)
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d", codec)
+}
+
+// dataPageValues appends the n values of a data page to values.
+func dataPageValues(page []byte, sc parquetSchemaColumn, n int, encoding int64, dict, values []any) ([]any, error) {
+	defined := n
+	var levels []uint32
+	if sc.optional {
+		if len(page) < 4 {
+			return nil, fmt.Errorf("truncated definition levels")
+		}
+		size := int(binary.LittleEndian.Uint32(page))
+		if 4+size > len(page) {
+			return nil, fmt.Errorf("truncated definition levels")
+		}
+		var err error
+		if levels, err = decodeHybrid(page[4:4+size], maxDefinitionLevel, n); err != nil {
+			return nil, err
+		}
+		page = page[4+size:]
+		defined = 0
+		for _, l := range levels {
+			if l == maxDefinitionLevel {
+				defined++
+			}
+		}
+	}
+
+	var present []any
+	switch encoding {
+	case encodingPlain:
+		var err error
+		if present, err = plainValues(page, sc, defined); err != nil {
+			return nil, err
+		}
+	case encodingPlainDict, encodingRLEDictionary:
+		if len(page) < 1 {
+			return nil, fmt.Errorf("truncated dictionary indices")
+		}
+		codes, err := decodeHybrid(page[1:], int(page[0]), defined)
+		if err != nil {
+			return nil, err
+		}
+		present = make([]any, len(codes))
+		for i, code := range codes {
+			if int(code) >= len(dict) {
+				return nil, fmt.Errorf("dictionary index %d out of range", code)
+			}
+			present[i] = dict[code]
+		}
+	case encodingDeltaBinaryPacked:
+		var err error
+		if present, err = deltaValues(page, sc, defined); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %d", encoding)
+	}
+
+	if levels == nil {
+		return append(values, present...), nil
+	}
+	for _, l := range levels {
+		if l == maxDefinitionLevel {
+			values = append(values, present[0])
+			present = present[1:]
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return values, nil
+}
+
+// plainValues decodes n PLAIN encoded values.
+func plainValues(data []byte, sc parquetSchemaColumn, n int) ([]any, error) {
+	values := make([]any, 0, n)
+	pos := 0
+	truncated := fmt.Errorf("truncated values")
+	for i := 0; i < n; i++ {
+		switch sc.physical {
+		case parquetBoolean:
+			if i/8 >= len(data) {
+				return nil, truncated
+			}
+			values = append(values, data[i/8]>>(i%8)&1 == 1)
+			continue
+		case parquetInt32:
+			if pos+4 > len(data) {
+				return nil, truncated
+			}
+			values = append(values, int64(int32(binary.LittleEndian.Uint32(data[pos:]))))
+			pos += 4
+		case parquetInt64:
+			if pos+8 > len(data) {
+				return nil, truncated
+			}
+			values = append(values, int64(binary.LittleEndian.Uint64(data[pos:])))
+			pos += 8
+		case parquetFloat:
+			if pos+4 > len(data) {
+				return nil, truncated
+			}
+			values = append(values, float64(math.Float32frombits(binary.LittleEndian.Uint32(data[pos:]))))
+			pos += 4
+		case parquetDouble:
+			if pos+8 > len(data) {
+				return nil, truncated
+			}
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data[pos:])))
+			pos += 8
+		case parquetByteArray:
+			if pos+4 > len(data) {
+				return nil, truncated
+			}
+			size := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+			if pos+size > len(data) || size < 0 {
+				return nil, truncated
+			}
+			values = append(values, data[pos:pos+size])
+			pos += size
+		case parquetFixedBytes:
+			if pos+sc.typeLength > len(data) {
+				return nil, truncated
+			}
+			values = append(values, data[pos:pos+sc.typeLength])
+			pos += sc.typeLength
+		default:
+			return nil, fmt.Errorf("unsupported physical type %d", sc.physical)
+		}
+	}
+	return values, nil
+}
+
+// deltaValues decodes n DELTA_BINARY_PACKED integers, which wrap around
+// in the width of 32-bit columns.
+func deltaValues(data []byte, sc parquetSchemaColumn, n int) ([]any, error) {
+	pos := 0
+	next := func(signed bool) (int64, error) {
+		var v int64
+		var k int
+		if signed {
+			v, k = binary.Varint(data[pos:])
+		} else {
+			var u uint64
+			u, k = binary.Uvarint(data[pos:])
+			v = int64(u)
+		}
+		if k <= 0 {
+			return 0, fmt.Errorf("truncated delta values")
+		}
+		pos += k
+		return v, nil
+	}
+	var header [4]int64
+	for i := range header {
+		v, err := next(i == 3)
+		if err != nil {
+			return nil, err
+		}
+		header[i] = v
+	}
+	blockSize, miniblocks, v := header[0], header[1], header[3]
+	if miniblocks <= 0 || blockSize <= 0 || blockSize%miniblocks != 0 || blockSize/miniblocks%8 != 0 {
+		return nil, fmt.Errorf("invalid delta block size %d with %d miniblocks", blockSize, miniblocks)
+	}
+	miniblockLen := int(blockSize / miniblocks)
+
+	values := make([]any, 0, n)
+	if n > 0 {
+		values = append(values, v)
+	}
+	for len(values) < n {
+		minDelta, err := next(true)
+		if err != nil {
+			return nil, err
+		}
+		if pos+int(miniblocks) > len(data) {
+			return nil, fmt.Errorf("truncated delta values")
+		}
+		widths := data[pos : pos+int(miniblocks)]
+		pos += int(miniblocks)
+		for _, width := range widths {
+			if len(values) == n {
+				break
+			}
+			if width > 64 {
+				return nil, fmt.Errorf("invalid delta bit width %d", width)
+			}
+			size := miniblockLen * int(width) / 8
+			if pos+size > len(data) {
+				return nil, fmt.Errorf("truncated delta values")
+			}
+			for k := 0; k < miniblockLen && len(values) < n; k++ {
+				var u uint64
+				for b := 0; b < int(width); b++ {
+					bit := k*int(width) + b
+					u |= uint64(data[pos+bit/8]>>(bit%8)&1) << b
+				}
+				v += minDelta + int64(u)
+				if sc.physical == parquetInt32 {
+					v = int64(int32(v))
+				}
+				values = append(values, v)
+			}
+			pos += size
+		}
+	}
+	return values, nil
+}
+
+// decodeHybrid decodes n values of the RLE/bit-packing hybrid encoding.
+func decodeHybrid(data []byte, width, n int) ([]uint32, error) {
+	values := make([]uint32, 0, n)
+	pos := 0
+	for len(values) < n {
+		h, k := binary.Uvarint(data[pos:])
+		if k <= 0 {
+			return nil, fmt.Errorf("truncated run")
+		}
+		pos += k
+		if h&1 == 0 {
+			// An RLE run of one value.
+			size := (width + 7) / 8
+			if pos+size > len(data) {
+				return nil, fmt.Errorf("truncated run")
+			}
+			var v uint32
+			for b := 0; b < size; b++ {
+				v |= uint32(data[pos+b]) << (8 * b)
+			}
+			pos += size
+			for run := int(h >> 1); run > 0 && len(values) < n; run-- {
+				values = append(values, v)
+			}
+			continue
+		}
+		// Bit-packed groups of 8 values.
+		count := int(h>>1) * 8
+		if pos+count*width/8 > len(data) {
+			return nil, fmt.Errorf("truncated run")
+		}
+		for k := 0; k < count; k++ {
+			var v uint32
+			for b := 0; b < width; b++ {
+				bit := k*width + b
+				v |= uint32(data[pos+bit/8]>>(bit%8)&1) << b
+			}
+			if len(values) < n {
+				values = append(values, v)
+			}
+		}
+		pos += count * width / 8
+	}
+	return values, nil
+}
+
+// parquetColumn converts the values read from a Parquet column to the Go
+// type of the field.
+func parquetColumn(field Field, sc parquetSchemaColumn, values []any) (*Column, error) {
+	nulls := make([]bool, len(values))
+	for i, v := range values {
+		nulls[i] = v == nil
+	}
+	switch {
+	case field.DataType == TypeTime || field.DataType == TypeDate:
+		out := make([]time.Time, len(values))
+		for i, v := range values {
+			n, _ := v.(int64)
+			switch {
+			case v == nil:
+			case sc.physical == parquetInt32:
+				out[i] = time.Unix(n*86400, 0).UTC()
+			case sc.unit == time.Millisecond:
+				out[i] = time.UnixMilli(n).UTC()
+			case sc.unit == time.Nanosecond:
+				out[i] = time.Unix(0, n).UTC()
+			default:
+				out[i] = time.UnixMicro(n).UTC()
+			}
+		}
+		return newColumn(field, out, nulls), nil
+	case field.DataType == TypeTimeOfDay:
+		out := make([]time.Duration, len(values))
+		for i, v := range values {
+			n, _ := v.(int64)
+			out[i] = time.Duration(n) * sc.unit
+		}
+		return newColumn(field, out, nulls), nil
+	case field.DataType == TypeBytes:
+		out := make([][]byte, len(values))
+		for i, v := range values {
+			b, _ := v.([]byte)
+			out[i] = bytes.Clone(b)
+		}
+		return newColumn(field, out, nulls), nil
+	case sc.decimal:
+		out := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case int64:
+				out[i] = formatDecimal(big.NewInt(v), sc.scale)
+			case []byte:
+				out[i] = formatDecimal(fromTwosComplement(v), sc.scale)
+			}
+		}
+		return newColumn(field, out, nulls), nil
+	case sc.physical == parquetBoolean:
+		out := make([]bool, len(values))
+		for i, v := range values {
+			out[i], _ = v.(bool)
+		}
+		return newColumn(field, out, nulls), nil
+	case sc.physical == parquetFloat || sc.physical == parquetDouble:
+		out := make([]float64, len(values))
+		for i, v := range values {
+			out[i], _ = v.(float64)
+		}
+		return newColumn(field, out, nulls), nil
+	case sc.physical == parquetInt32 || sc.physical == parquetInt64:
+		out := make([]int64, len(values))
+		for i, v := range values {
+			out[i], _ = v.(int64)
+		}
+		return newColumn(field, out, nulls), nil
+	case field.DataType == TypeUUID && sc.physical == parquetFixedBytes:
+		out := make([]string, len(values))
+		for i, v := range values {
+			if b, ok := v.([]byte); ok && len(b) == 16 {
+				h := hex.EncodeToString(b)
+				out[i] = h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+			}
+		}
+		return newColumn(field, out, nulls), nil
+	case sc.physical == parquetByteArray || sc.physical == parquetFixedBytes:
+		out := make([]string, len(values))
+		for i, v := range values {
+			b, _ := v.([]byte)
+			out[i] = string(b)
+		}
+		return newColumn(field, out, nulls), nil
+	}
+	return nil, fmt.Errorf("unsupported physical type %d", sc.physical)
+}
+
+// fromTwosComplement decodes a big-endian two's complement number.
+func fromTwosComplement(b []byte) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return v
+}
@@ -0,0 +1,275 @@
+// Package reader reads the exports written by the exporter from Go: the
+// metadata of an export directory and the columns of its NPZ and Parquet
+// files, decoded to Go values and exposed as iterators.
+//
+//	ds, err := reader.Open("data")
+//	users, err := ds.Table("users")
+//	ids, err := users.Column("id")
+//	values, err := reader.Values[int64](ids)
+//	for id, ok := range values {
+//		...
+//	}
+package reader
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Data types of the metadata.
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+	TypeTime   = "timestamp"
+	TypeDate   = "date"
+	TypeUUID   = "uuid"
+	TypeJSON   = "json"
+	TypeArray  = "array"
+	TypeBytes  = "bytes"
+	TypeNull   = "null"
+	// TypeTimeOfDay is a time of day without a date, in UTC.
+	TypeTimeOfDay = "time"
+)
+
+// Column encodings of the metadata.
+const (
+	encodingDictionary    = "dictionary"
+	encodingRagged        = "ragged"
+	encodingBase64        = "base64"
+	encodingDecimalString = "decimal_string"
+	encodingDecimalScaled = "decimal_scaled"
+	encodingHash          = "siphash64"
+)
+
+// Header describes the export that wrote the metadata.
+type Header struct {
+	ExportedAt  time.Time      `json:"exported_at"`
+	ToolVersion string         `json:"tool_version"`
+	SourceHost  string         `json:"source_host,omitempty"`
+	Rows        map[string]int `json:"rows,omitempty"`
+	SchemaHash  string         `json:"schema_hash"`
+}
+
+// Field is a column of a table's metadata.
+type Field struct {
+	Name         string `json:"field_name"`
+	DataType     string `json:"data_type"`
+	IsPrimaryKey bool   `json:"is_primary_key"`
+	IsNullable   bool   `json:"nullable"`
+	Encoding     string `json:"encoding,omitempty"`
+	// Precision and Scale are set for decimal columns with a declared
+	// precision.
+	Precision int `json:"precision,omitempty"`
+	Scale     int `json:"scale,omitempty"`
+	// ElementType is the data type of the elements of array columns.
+	ElementType string `json:"element_type,omitempty"`
+}
+
+// exact reports whether a float column holds decimals stored exactly,
+// which are read as decimal text.
+func (f Field) exact() bool {
+	return f.Encoding == encodingDecimalString || f.Encoding == encodingDecimalScaled
+}
+
+// ColumnGroup is set on the tables of an export that are a column group
+// of a table split into several files.
+type ColumnGroup struct {
+	Table string   `json:"table"`
+	Name  string   `json:"name"`
+	Index int      `json:"index"`
+	Count int      `json:"count"`
+	Key   []string `json:"key,omitempty"`
+}
+
+// Table is a table of an export.
+type Table struct {
+	Name        string       `json:"table_or_collection_name"`
+	Fields      []Field      `json:"fields"`
+	Note        string       `json:"note,omitempty"`
+	ColumnGroup *ColumnGroup `json:"column_group,omitempty"`
+	// Path is the table's NPZ or Parquet file.
+	Path string `json:"-"`
+}
+
+// Dataset is an export directory.
+type Dataset struct {
+	Dir string
+	// Header is nil for exports written before the metadata had one.
+	Header *Header
+	tables []*Table
+}
+
+// metadata is the metadata.json of an export, or the metadata/index.json
+// of the split layout, whose tables are in files of their own.
+type metadata struct {
+	Header *Header  `json:"header"`
+	Tables []*Table `json:"schema"`
+	Index  []struct {
+		Path string `json:"path"`
+	} `json:"tables"`
+}
+
+// Open reads the metadata of the export in dir.
+func Open(dir string) (*Dataset, error) {
+	path := filepath.Join(dir, "metadata.json")
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		path = filepath.Join(dir, "metadata", "index.json")
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	// Index paths are relative to the export directory.
+	for _, entry := range m.Index {
+		tb, err := os.ReadFile(filepath.Join(dir, entry.Path))
+		if err != nil {
+			return nil, err
+		}
+		var table Table
+		if err := json.Unmarshal(tb, &table); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", entry.Path, err)
+		}
+		m.Tables = append(m.Tables, &table)
+	}
+
+	ds := &Dataset{Dir: dir, Header: m.Header}
+	for _, table := range m.Tables {
+		for _, ext := range []string{".npz", ".parquet"} {
+			if _, err := os.Stat(filepath.Join(dir, table.Name+ext)); err == nil {
+				table.Path = filepath.Join(dir, table.Name+ext)
+				break
+			}
+		}
+		ds.tables = append(ds.tables, table)
+	}
+	return ds, nil
+}
+
+// Tables returns an iterator over the tables of the export, in the order
+// of the metadata.
+func (d *Dataset) Tables() iter.Seq[*Table] {
+	return func(yield func(*Table) bool) {
+		for _, t := range d.tables {
+			if !yield(t) {
+				return
+			}
+		}
+	}
+}
+
+// Table returns the named table.
+func (d *Dataset) Table(name string) (*Table, error) {
+	for _, t := range d.tables {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("the export has no table %s", name)
+}
+
+// ColumnGroups returns the column groups the named table was split into,
+// in order, so that only the groups needed are read.
+func (d *Dataset) ColumnGroups(table string) []*Table {
+	var groups []*Table
+	for _, t := range d.tables {
+		if t.ColumnGroup != nil && t.ColumnGroup.Table == table {
+			groups = append(groups, t)
+		}
+	}
+	return groups
+}
+
+// ColumnGroup returns the named column group of a table.
+func (d *Dataset) ColumnGroup(table, group string) (*Table, error) {
+	for _, t := range d.ColumnGroups(table) {
+		if t.ColumnGroup.Name == group {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("the export has no column group %s of table %s", group, table)
+}
+
+// Field returns the named field of the table.
+func (t *Table) Field(name string) (Field, bool) {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// Column reads the named column of the table.
+func (t *Table) Column(name string) (*Column, error) {
+	field, ok := t.Field(name)
+	if !ok {
+		return nil, fmt.Errorf("table %s has no column %s", t.Name, name)
+	}
+	columns, err := t.read([]Field{field})
+	if err != nil {
+		return nil, err
+	}
+	return columns[0], nil
+}
+
+// Rows returns an iterator over the rows of the table, reading every
+// column first. Nulls are nil.
+func (t *Table) Rows() iter.Seq2[Row, error] {
+	return func(yield func(Row, error) bool) {
+		columns, err := t.read(t.Fields)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		rows := 0
+		if len(columns) > 0 {
+			rows = columns[0].Len()
+		}
+		for i := 0; i < rows; i++ {
+			row := make(Row, len(columns))
+			for _, c := range columns {
+				row[c.Field.Name] = c.Value(i)
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Row is a row of a table by column name.
+type Row map[string]any
+
+// read reads and decodes columns of the table's file.
+func (t *Table) read(fields []Field) ([]*Column, error) {
+	var columns []*Column
+	var err error
+	switch filepath.Ext(t.Path) {
+	case ".npz":
+		columns, err = readNpz(t.Path, fields)
+	case ".parquet":
+		columns, err = readParquet(t.Path, fields)
+	default:
+		return nil, fmt.Errorf("table %s has no NPZ or Parquet file", t.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading table %s: %w", t.Name, err)
+	}
+	for _, c := range columns {
+		if c.Len() != columns[0].Len() {
+			return nil, fmt.Errorf("reading table %s: column %s has %d values, expected %d", t.Name, c.Field.Name, c.Len(), columns[0].Len())
+		}
+	}
+	return columns, nil
+}
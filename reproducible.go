@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Guarantees of the order of a table's rows, recorded in the metadata.
+const (
+	// rowOrderPrimaryKey rows are ordered on the table's primary key, or
+	// a MongoDB collection's _id, and come out the same whenever the data
+	// is the same.
+	rowOrderPrimaryKey = "primary_key"
+	// rowOrderRowID rows are ordered on the source's row identifier,
+	// PostgreSQL's ctid or SQLite's rowid, which only orders them the same
+	// while the table's storage is unchanged, such as within a snapshot.
+	rowOrderRowID = "row_id"
+	// rowOrderColumns rows are ordered on all of their columns but JSON
+	// ones, which can't be ordered.
+	rowOrderColumns = "all_columns"
+	// rowOrderNone rows come in whatever order the database returns them.
+	rowOrderNone = "none"
+)
+
+// RowOrder records the order a table's rows were exported in.
+type RowOrder struct {
+	Guarantee string   `json:"guarantee"`
+	Columns   []string `json:"columns,omitempty"`
+}
+
+// rowOrder returns the order a table is read in. Tables are read in the
+// order of their key, and views in that of their columns. Query results
+// are ordered on their columns only with reproducible, as the sort is
+// otherwise left to the query.
+func (c ExportConfig) rowOrder(table TableMetadata) *RowOrder {
+	if table.Kind == relationView || table.Query != "" {
+		columns := orderColumns(table)
+		if len(columns) == 0 || (table.Query != "" && !c.Reproducible) {
+			return &RowOrder{Guarantee: rowOrderNone}
+		}
+		return &RowOrder{Guarantee: rowOrderColumns, Columns: columns}
+	}
+	if c.Connection.Source == sourceMongoDB {
+		return &RowOrder{Guarantee: rowOrderPrimaryKey, Columns: []string{"_id"}}
+	}
+	var key []string
+	for _, field := range table.Fields {
+		if field.IsPrimaryKey {
+			key = append(key, field.FieldName)
+		}
+	}
+	if len(key) > 0 {
+		return &RowOrder{Guarantee: rowOrderPrimaryKey, Columns: key}
+	}
+	if c.Connection.Source == sourceSQLite {
+		return &RowOrder{Guarantee: rowOrderRowID, Columns: []string{sqliteRowIdentity.column}}
+	}
+	return &RowOrder{Guarantee: rowOrderRowID, Columns: []string{postgresRowIdentity.column}}
+}
+
+// orderColumns returns the columns the rows of views and query results are
+// ordered on: all of them but JSON ones.
+func orderColumns(table TableMetadata) []string {
+	var columns []string
+	for _, field := range table.Fields {
+		if field.DataType != DataTypeJSON {
+			columns = append(columns, field.FieldName)
+		}
+	}
+	return columns
+}
+
+// fileChecksums returns the SHA-256 of every array of a table's NPZ file,
+// by array name, or of its file in the other formats, by file name, as hex
+// digits.
+func fileChecksums(cfg ExportConfig, table string) (map[string]string, error) {
+	path := cfg.outputPath(table)
+	sums := make(map[string]string)
+	if cfg.Format != formatNPZ {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sum, err := sha256Hex(f)
+		if err != nil {
+			return nil, err
+		}
+		sums[filepath.Base(path)] = sum
+		return sums, nil
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		name, ok := strings.CutSuffix(f.Name, ".npy")
+		if !ok {
+			// Embedded metadata isn't an array.
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		sum, err := sha256Hex(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		sums[name] = sum
+	}
+	return sums, nil
+}
+
+func sha256Hex(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
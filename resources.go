@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+)
+
+// I/O scheduling classes of resources.io_class.
+const (
+	ioClassBestEffort = "best_effort"
+	ioClassIdle       = "idle"
+)
+
+// ResourceConfig constrains what a run takes from the host it shares with
+// other services. The zero value leaves everything as it is.
+type ResourceConfig struct {
+	// MaxProcs is GOMAXPROCS, the CPUs running the exporter's Go code at
+	// once, 0 for all of them.
+	MaxProcs int `yaml:"max_procs" toml:"max_procs"`
+	// Nice is the exporter's scheduling niceness, up to 19 for the lowest
+	// CPU priority.
+	Nice int `yaml:"nice" toml:"nice"`
+	// IOClass is the Linux I/O scheduling class: best_effort, with
+	// IOLevel from 0 (highest) to 7 (lowest), or idle to only get disk
+	// time no one else wants.
+	IOClass string `yaml:"io_class" toml:"io_class"`
+	IOLevel int    `yaml:"io_level" toml:"io_level"`
+	// Concurrency is the number of tables exported at once, which
+	// -concurrency overrides; 0 for the default of 1.
+	Concurrency int `yaml:"concurrency" toml:"concurrency"`
+}
+
+// validate checks the resource limits.
+func (r ResourceConfig) validate() error {
+	if r.MaxProcs < 0 {
+		return fmt.Errorf("invalid resources max_procs %d, expected a positive number", r.MaxProcs)
+	}
+	if r.Nice < -20 || r.Nice > 19 {
+		return fmt.Errorf("invalid resources nice %d, expected -20 to 19", r.Nice)
+	}
+	switch r.IOClass {
+	case "", ioClassIdle:
+		if r.IOLevel != 0 {
+			return fmt.Errorf("resources io_level needs io_class %s", ioClassBestEffort)
+		}
+	case ioClassBestEffort:
+		if r.IOLevel < 0 || r.IOLevel > 7 {
+			return fmt.Errorf("invalid resources io_level %d, expected 0 to 7", r.IOLevel)
+		}
+	default:
+		return fmt.Errorf("unknown resources io_class %q, expected %s or %s", r.IOClass, ioClassBestEffort, ioClassIdle)
+	}
+	if r.Concurrency < 0 {
+		return fmt.Errorf("invalid resources concurrency %d, expected a positive number", r.Concurrency)
+	}
+	return nil
+}
+
+// apply applies the limits to the running process.
+func (r ResourceConfig) apply() error {
+	var applied []string
+	if r.MaxProcs > 0 {
+		runtime.GOMAXPROCS(r.MaxProcs)
+		applied = append(applied, fmt.Sprintf("GOMAXPROCS %d", r.MaxProcs))
+	}
+	if r.Nice != 0 {
+		if err := setNice(r.Nice); err != nil {
+			return fmt.Errorf("setting nice %d: %w", r.Nice, err)
+		}
+		applied = append(applied, fmt.Sprintf("nice %d", r.Nice))
+	}
+	if r.IOClass != "" {
+		if err := setIOPriority(r.IOClass, r.IOLevel); err != nil {
+			return fmt.Errorf("setting I/O class %s: %w", r.IOClass, err)
+		}
+		if r.IOClass == ioClassBestEffort {
+			applied = append(applied, fmt.Sprintf("I/O class %s level %d", r.IOClass, r.IOLevel))
+		} else {
+			applied = append(applied, "I/O class "+r.IOClass)
+		}
+	}
+	if len(applied) > 0 {
+		log.Printf("Running with %s", strings.Join(applied, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ioprio_set(2) constants, which the syscall package lacks.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+)
+
+// setNice sets the niceness of every thread of the process. Linux keeps
+// it per thread, and new threads inherit it from the thread creating them.
+func setNice(nice int) error {
+	return eachThread(func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// setIOPriority sets the I/O scheduling class of every thread of the
+// process, which Linux also keeps per thread.
+func setIOPriority(class string, level int) error {
+	prio := ioprioClassBE<<ioprioClassShift | level
+	if class == ioClassIdle {
+		prio = ioprioClassIdle << ioprioClassShift
+	}
+	return eachThread(func(tid int) error {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// eachThread calls fn with the id of every thread of the process.
+func eachThread(fn func(tid int) error) error {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// Threads can exit while they are walked.
+		if err := fn(tid); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
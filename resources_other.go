@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// setNice is only implemented on Linux, where niceness is per thread.
+func setNice(nice int) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// setIOPriority is only implemented on Linux, which has I/O scheduling
+// classes.
+func setIOPriority(class string, level int) error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Methods of sampling the rows of a table. PostgreSQL tables are sampled
+// with TABLESAMPLE BERNOULLI, every row with the sample's probability, or
+// SYSTEM, whole pages of rows, which reads less of the table but samples
+// the rows stored on a page together. SQLite has no TABLESAMPLE, so its
+// tables are sampled row by row with random().
+const (
+	sampleBernoulli = "bernoulli"
+	sampleSystem    = "system"
+	sampleRandom    = "random"
+)
+
+// sampleRandomScale is the range of the random() values of SQLite rows
+// that the sample fraction is compared to.
+const sampleRandomScale = 1 << 20
+
+// errRowLimit stops reading a table once its limit of rows was exported.
+var errRowLimit = errors.New("reached the row limit")
+
+// SampleConfig exports a sample of a table's rows rather than all of them,
+// for quick experiments with a huge table. Zero values export every row.
+type SampleConfig struct {
+	// Fraction is the share of the table's rows to sample, such as 0.01
+	// for 1%. Query results aren't sampled.
+	Fraction float64 `yaml:"fraction" toml:"fraction"`
+	// Method is bernoulli (the default) or system, for PostgreSQL tables.
+	Method string `yaml:"method" toml:"method"`
+	// Seed makes the TABLESAMPLE of PostgreSQL tables repeatable, so
+	// every batch of a table sees the same sample and the same seed
+	// samples the same rows of an unchanged table.
+	Seed int64 `yaml:"seed" toml:"seed"`
+	// Limit caps the rows exported, the first ones in the order the table
+	// is read in, after sampling.
+	Limit int `yaml:"limit" toml:"limit"`
+}
+
+// SampleInfo records in the metadata how a table was sampled.
+type SampleInfo struct {
+	// Method is bernoulli, system or random, and empty when the table is
+	// only limited.
+	Method   string  `json:"method,omitempty"`
+	Fraction float64 `json:"fraction,omitempty"`
+	Seed     int64   `json:"seed,omitempty"`
+	Limit    int     `json:"limit,omitempty"`
+}
+
+// validate checks the fraction, method and limit of a sample.
+func (s SampleConfig) validate() error {
+	if s.Fraction < 0 || s.Fraction > 1 {
+		return fmt.Errorf("invalid sample fraction %g, expected a number from 0 to 1", s.Fraction)
+	}
+	switch s.Method {
+	case "", sampleBernoulli, sampleSystem:
+	default:
+		return fmt.Errorf("invalid sample method %q, expected %s or %s", s.Method, sampleBernoulli, sampleSystem)
+	}
+	if s.Limit < 0 {
+		return fmt.Errorf("invalid limit %d, expected a positive number", s.Limit)
+	}
+	return nil
+}
+
+// override returns the sample with the values set in o replacing them.
+func (s SampleConfig) override(o SampleConfig) SampleConfig {
+	if o.Fraction != 0 {
+		s.Fraction = o.Fraction
+	}
+	if o.Method != "" {
+		s.Method = o.Method
+	}
+	if o.Seed != 0 {
+		s.Seed = o.Seed
+	}
+	if o.Limit != 0 {
+		s.Limit = o.Limit
+	}
+	return s
+}
+
+// sampleInfo returns how a table is sampled, nil for tables exported
+// whole. Tables are sampled by the source's method, while query results
+// and views, which TABLESAMPLE can't read, are only limited.
+func (c ExportConfig) sampleInfo(table TableMetadata) *SampleInfo {
+	s := c.sample(table.TableName)
+	info := &SampleInfo{Limit: s.Limit}
+	switch {
+	case s.Fraction == 0 || s.Fraction == 1 || table.Query != "":
+	case table.Kind == relationView:
+		log.Printf("View %q can't be sampled, exporting all of its rows", table.TableName)
+	case c.Connection.Source == sourceSQLite:
+		info.Method, info.Fraction = sampleRandom, s.Fraction
+	default:
+		info.Method, info.Fraction, info.Seed = s.Method, s.Fraction, s.Seed
+		if info.Method == "" {
+			info.Method = sampleBernoulli
+		}
+	}
+	if info.Method == "" && info.Limit == 0 {
+		return nil
+	}
+	return info
+}
+
+// tableSample returns the TABLESAMPLE clause following the name of a table
+// sampled by PostgreSQL, and the condition selecting the rows of one
+// sampled with random(). Both are empty for tables exported whole.
+func (t TableMetadata) tableSample() (clause, condition string) {
+	s := t.Sample
+	if s == nil {
+		return "", ""
+	}
+	switch s.Method {
+	case sampleBernoulli, sampleSystem:
+		return fmt.Sprintf(" TABLESAMPLE %s (%g) REPEATABLE (%d)", strings.ToUpper(s.Method), s.Fraction*100, s.Seed), ""
+	case sampleRandom:
+		return "", fmt.Sprintf("(random() & %d) < %d", sampleRandomScale-1, int64(s.Fraction*sampleRandomScale))
+	}
+	return "", ""
+}
+
+// describe summarizes the sample for the dataset README.
+func (s SampleInfo) describe() string {
+	var parts []string
+	if s.Method != "" {
+		parts = append(parts, fmt.Sprintf("%g%% %s sample", s.Fraction*100, s.Method))
+	}
+	if s.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("at most %d rows", s.Limit))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+const (
+	// Scaling methods of numeric columns, set per column with scale.
+	scaleMinMax = "min_max"
+	scaleZScore = "z_score"
+
+	// scalingFile holds the scaling parameters of the scaled columns of an
+	// export, next to the metadata, as table to column to parameters.
+	scalingFile = "scaling.json"
+)
+
+// ColumnScaling records how a numeric column was scaled and the parameters
+// fitted to its values, so serving-time data can be scaled the same way.
+// Std is the population standard deviation.
+type ColumnScaling struct {
+	Method string  `json:"method"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Std    float64 `json:"std"`
+	// Count is the number of values the parameters were fitted to.
+	Count int64 `json:"count"`
+	// FitOn is the split fitted to, train for split tables, whose val and
+	// test rows are scaled with the train split's parameters.
+	FitOn string `json:"fit_on,omitempty"`
+}
+
+// Scalings are the scaling parameters of columns by table and column, the
+// layout of scalingFile.
+type Scalings map[string]map[string]ColumnScaling
+
+// scale returns a value scaled by the column's parameters. Constant columns
+// scale to 0.
+func (s ColumnScaling) scale(v float64) float64 {
+	switch s.Method {
+	case scaleMinMax:
+		if s.Max == s.Min {
+			return 0
+		}
+		return (v - s.Min) / (s.Max - s.Min)
+	default:
+		if s.Std == 0 {
+			return 0
+		}
+		return (v - s.Mean) / s.Std
+	}
+}
+
+// scalingFit accumulates the parameters of a column from its values.
+type scalingFit struct {
+	n        int64
+	mean, m2 float64
+	min, max float64
+}
+
+func (f *scalingFit) add(v float64) {
+	if f.n == 0 {
+		f.min, f.max = v, v
+	}
+	f.n++
+	d := v - f.mean
+	f.mean += d / float64(f.n)
+	f.m2 += d * (v - f.mean)
+	f.min, f.max = min(f.min, v), max(f.max, v)
+}
+
+func (f *scalingFit) params(method string) *ColumnScaling {
+	s := &ColumnScaling{Method: method, Min: f.min, Max: f.max, Mean: f.mean, Count: f.n}
+	if f.n > 0 {
+		s.Std = math.Sqrt(f.m2 / float64(f.n))
+	}
+	return s
+}
+
+// columnScaler replaces the values of numeric columns with their min-max
+// scaled or standardized values, as floats. Parameters are given by the
+// column metadata, from -scaling or a checkpoint, or fitted to the table
+// by a pass over it before the export. A scaler without the parameters of
+// a column fits them from the values it sees instead, leaving them as they
+// are.
+type columnScaler struct {
+	columns []string
+	methods map[string]string
+	params  map[string]*ColumnScaling
+	fits    map[string]*scalingFit
+}
+
+// newColumnScaler turns the columns into float columns, taking the
+// parameters of their metadata.
+func newColumnScaler(table *TableData, scale map[string]string) (*columnScaler, error) {
+	s := &columnScaler{methods: scale, params: make(map[string]*ColumnScaling), fits: make(map[string]*scalingFit)}
+	for column := range scale {
+		s.columns = append(s.columns, column)
+	}
+	sort.Strings(s.columns)
+
+	for _, name := range s.columns {
+		idx := -1
+		for i, col := range table.Columns {
+			if col.FieldName == name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("table %s has no column %q to scale", table.TableName, name)
+		}
+		col := &table.Columns[idx]
+		if col.DataType != DataTypeInt && col.DataType != DataTypeFloat {
+			return nil, fmt.Errorf("column %s.%s is %s, only numeric columns can be scaled", table.TableName, name, col.DataType)
+		}
+		if col.Scaling != nil {
+			p := *col.Scaling
+			p.Method = scale[name]
+			s.params[name] = &p
+		} else {
+			s.fits[name] = &scalingFit{}
+		}
+		col.DataType = DataTypeFloat
+		col.Precision, col.Scale = 0, 0
+		col.FillValue = nil
+		col.TransformedFeatures = append(col.TransformedFeatures, "scaled_"+scale[name])
+	}
+	s.record(table.Columns)
+	return s, nil
+}
+
+// unfitted reports whether the scaler lacks the parameters of a column.
+func (s *columnScaler) unfitted() bool {
+	return len(s.params) < len(s.columns)
+}
+
+// apply scales the values of a batch in place, or adds them to the fits of
+// the columns without parameters. Nulls and values that aren't numbers
+// become nulls.
+func (s *columnScaler) apply(rows []TableRow) {
+	for _, name := range s.columns {
+		p, fit := s.params[name], s.fits[name]
+		for _, row := range rows {
+			v, ok := moneyAmount(row[name])
+			switch {
+			case !ok || math.IsNaN(v) || math.IsInf(v, 0):
+				row[name] = nil
+			case p != nil:
+				row[name] = p.scale(v)
+			default:
+				fit.add(v)
+			}
+		}
+	}
+}
+
+// fitted takes the parameters fitted by another scaler of the table on the
+// split fitOn, or all rows if empty, for the columns without any.
+func (s *columnScaler) fitted(from *columnScaler, fitOn string) {
+	for _, name := range s.columns {
+		if s.params[name] == nil {
+			p := from.fits[name].params(s.methods[name])
+			p.FitOn = fitOn
+			s.params[name] = p
+		}
+	}
+}
+
+// restore takes the parameters recorded in the columns of a checkpoint or
+// of the archive being patched.
+func (s *columnScaler) restore(columns []FieldMetadata) {
+	for _, col := range columns {
+		if _, ok := s.methods[col.FieldName]; ok && col.Scaling != nil {
+			p := *col.Scaling
+			s.params[col.FieldName] = &p
+		}
+	}
+}
+
+// record sets the parameters in the column metadata.
+func (s *columnScaler) record(columns []FieldMetadata) {
+	for i := range columns {
+		if p := s.params[columns[i].FieldName]; p != nil {
+			columns[i].Scaling = p
+		}
+	}
+}
+
+func (s *columnScaler) finish(columns []FieldMetadata) {
+	s.record(columns)
+}
+
+// scalerToFit returns the scaler of a table's transforms if it lacks the
+// parameters of a column.
+func scalerToFit(transforms []rowTransform) *columnScaler {
+	for _, t := range transforms {
+		if s, ok := t.(*columnScaler); ok && s.unfitted() {
+			return s
+		}
+	}
+	return nil
+}
+
+// fitScaling reads the table once through scratch, a second set of its
+// transforms, to fit the parameters the scaler lacks, and records them in
+// the columns. The fit covers the rows the table's limits admit, and of a
+// split table only those of its train split, so that no statistics of the
+// val and test rows leak into the training data.
+func fitScaling(ctx context.Context, src exportSource, table TableMetadata, cfg ExportConfig, budget int64, scaler *columnScaler, scratch []rowTransform, split *splitter, columns []FieldMetadata) error {
+	train := -1
+	if split != nil {
+		train = split.train()
+	}
+	if train >= 0 {
+		log.Printf("Fitting the scaling of table %q on its train split", table.TableName)
+	} else {
+		log.Printf("Fitting the scaling of table %q", table.TableName)
+	}
+	limiter := newTableLimiter(cfg.limits(table.TableName), table.Sample)
+	meter := startUsageMeter(table.TableName)
+	err := streamTable(ctx, src, table, cfg, budget, func(rows []TableRow) error {
+		if n := len(rows); n > 0 {
+			delete(rows[n-1], resumeKeyColumn)
+		}
+		rows, limitErr := limiter.admit(rows, meter)
+		if train >= 0 {
+			rows = slices.DeleteFunc(rows, func(row TableRow) bool { return split.assign(row) != train })
+		}
+		for _, t := range scratch {
+			t.apply(rows)
+		}
+		return limitErr
+	})
+	var limitErr *limitError
+	if err != nil && !errors.Is(err, errRowLimit) && !errors.As(err, &limitErr) {
+		return err
+	}
+	fit := scalerToFit(scratch)
+	if fit == nil {
+		return fmt.Errorf("table %s has no columns to fit", table.TableName)
+	}
+	fitOn := ""
+	if train >= 0 {
+		fitOn = splitTrain
+	}
+	scaler.fitted(fit, fitOn)
+	scaler.record(columns)
+	return nil
+}
+
+// loadScalings reads the scaling file of an earlier export.
+func loadScalings(path string) (Scalings, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scalings Scalings
+	if err := json.Unmarshal(b, &scalings); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return scalings, nil
+}
+
+// useScalings sets the parameters the scaled columns of the tables are
+// scaled with instead of fitting them.
+func useScalings(cfg ExportConfig, tables []TableMetadata, scalings Scalings) {
+	for _, table := range tables {
+		for column := range cfg.transforms(table.TableName).Scale {
+			s, ok := scalings[table.TableName][column]
+			if !ok {
+				log.Printf("scaling: no parameters for %s.%s, fitting them", table.TableName, column)
+				continue
+			}
+			for i := range table.Fields {
+				if table.Fields[i].FieldName == column {
+					table.Fields[i].Scaling = &s
+				}
+			}
+		}
+	}
+}
+
+// saveScalings writes the parameters of the scaled columns of the tables
+// to scalingFile in outDir, if there are any. The splits of a table share
+// its parameters, which are written under the table's name for -scaling.
+func saveScalings(outDir string, tables []TableMetadata) error {
+	scalings := make(Scalings)
+	for _, table := range tables {
+		name := table.TableName
+		if table.Split != nil {
+			name = table.Split.Table
+		}
+		for _, field := range table.Fields {
+			if field.Scaling == nil {
+				continue
+			}
+			if scalings[name] == nil {
+				scalings[name] = make(map[string]ColumnScaling)
+			}
+			scalings[name][field.FieldName] = *field.Scaling
+		}
+	}
+	if len(scalings) == 0 {
+		return nil
+	}
+	b, err := json.MarshalIndent(scalings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return saveFile(filepath.Join(outDir, scalingFile), b)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+)
+
+// rowsSource is a source of one table's rows, in batches of 100.
+type rowsSource struct {
+	rows []TableRow
+}
+
+func (s rowsSource) FetchMetadata(ctx context.Context, cfg ExportConfig) (SchemaDetails, error) {
+	return SchemaDetails{}, nil
+}
+
+func (s rowsSource) StreamTableData(ctx context.Context, table TableMetadata, cfg ExportConfig, emit func(rows []TableRow) error) error {
+	for chunk := range slices.Chunk(s.rows, 100) {
+		var batch []TableRow
+		for _, row := range chunk {
+			batch = append(batch, TableRow{"id": row["id"], "v": row["v"]})
+		}
+		if err := emit(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s rowsSource) Close() error {
+	return nil
+}
+
+func TestFitScalingTrainSplit(t *testing.T) {
+	columns := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true},
+		{FieldName: "v", DataType: DataTypeFloat},
+	}
+	table := TableMetadata{TableName: "t", Fields: columns}
+	var rows []TableRow
+	for i := range 1000 {
+		rows = append(rows, TableRow{"id": int64(i), "v": float64(i * i % 997)})
+	}
+	split, err := tableSplitter(table, SplitConfig{Train: 0.6, Val: 0.2, Test: 0.2, Seed: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		split *splitter
+		fitOn string
+	}{
+		{"whole table", nil, ""},
+		{"train split", split, splitTrain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want scalingFit
+			for _, row := range rows {
+				if tt.split == nil || tt.split.assign(row) == tt.split.train() {
+					want.add(row["v"].(float64))
+				}
+			}
+			if tt.split != nil && want.n == int64(len(rows)) {
+				t.Fatal("every row went to the train split")
+			}
+			newScaler := func() *columnScaler {
+				s, err := newColumnScaler(&TableData{TableName: "t", Columns: slices.Clone(columns)}, map[string]string{"v": scaleZScore})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			scaler, fitted := newScaler(), slices.Clone(columns)
+			if err := fitScaling(context.Background(), rowsSource{rows}, table, ExportConfig{}, 1<<20, scaler, []rowTransform{newScaler()}, tt.split, fitted); err != nil {
+				t.Fatal(err)
+			}
+			got := fitted[1].Scaling
+			if got == nil {
+				t.Fatal("no scaling recorded")
+			}
+			if got.Count != want.n || math.Abs(got.Mean-want.mean) > 1e-9 || got.FitOn != tt.fitOn {
+				t.Errorf("fitted count %d, mean %g on %q, want %d, %g on %q", got.Count, got.Mean, got.FitOn, want.n, want.mean, tt.fitOn)
+			}
+		})
+	}
+}
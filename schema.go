@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ColumnStats are a column's planner statistics from pg_stats, as of its
+// table's last ANALYZE, recorded with -schema-only -schema-stats.
+type ColumnStats struct {
+	NullFraction float64 `json:"null_fraction"`
+	// DistinctValues is the estimated number of distinct non-null values.
+	DistinctValues float64 `json:"distinct_values"`
+	// AverageWidth is the average stored width of the values in bytes.
+	AverageWidth int `json:"average_width"`
+}
+
+// schemaStatsSource is implemented by sources that keep statistics about
+// their tables, which -schema-stats reads instead of scanning the data.
+type schemaStatsSource interface {
+	FetchSchemaStats(ctx context.Context, tables []TableMetadata) error
+}
+
+func (s *postgresSource) FetchSchemaStats(ctx context.Context, tables []TableMetadata) error {
+	return fetchSchemaStats(ctx, s.db, tables)
+}
+
+// fetchTableSize sets the planner's row estimate of a PostgreSQL table from
+// pg_class, which tables that were never analyzed lack, and its size on
+// disk, with its indexes and TOAST data. Its ColumnBytes are the row
+// estimate times the average width of the exported columns in pg_stats,
+// or without statistics for all of them their share of the table's size
+// without indexes. With exact_counts it also counts the rows the export
+// reads. Views store no rows, so they only get counted.
+func fetchTableSize(ctx context.Context, db *sql.DB, cfg ExportConfig, table *TableMetadata) error {
+	if table.Kind == relationView {
+		if cfg.ExactCounts {
+			return countRows(ctx, db, cfg, table)
+		}
+		return nil
+	}
+	var columns []string
+	for _, field := range table.Fields {
+		columns = append(columns, field.FieldName)
+	}
+	var reltuples float64
+	var size, dataSize, widths, width int64
+	err := db.QueryRowContext(ctx, `
+		SELECT c.reltuples, pg_total_relation_size(c.oid), pg_table_size(c.oid), s.columns, s.width
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN LATERAL (
+			SELECT count(*) AS columns, coalesce(sum(avg_width), 0) AS width
+			FROM pg_stats
+			WHERE schemaname = n.nspname
+			  AND tablename = c.relname
+			  AND attname = ANY($3)
+			  AND inherited = (c.relkind = 'p')
+		) s
+		WHERE n.nspname = $2
+		  AND c.relname = $1
+	`, table.relationName(), table.Schema, pq.Array(columns)).Scan(&reltuples, &size, &dataSize, &widths, &width)
+	if err != nil {
+		return fmt.Errorf("querying size of table %s: %w", table.TableName, err)
+	}
+	// reltuples is -1 before the first ANALYZE.
+	columnBytes := dataSize * int64(len(columns)) / int64(max(len(columns)+len(table.OmittedColumns), 1))
+	if reltuples >= 0 {
+		estimate := int64(reltuples)
+		table.EstimatedRows = &estimate
+		if widths == int64(len(columns)) {
+			columnBytes = estimate * width
+		}
+	}
+	table.SizeBytes = &size
+	table.ColumnBytes = &columnBytes
+	if cfg.ExactCounts {
+		return countRows(ctx, db, cfg, table)
+	}
+	return nil
+}
+
+// countRows sets the number of rows of a table that its export reads,
+// through its row filter.
+func countRows(ctx context.Context, db *sql.DB, cfg ExportConfig, table *TableMetadata) error {
+	query := "SELECT count(*) FROM " + table.sourceIdent()
+	if table.Where != "" {
+		query += " WHERE " + table.Where
+	}
+	query, names := bindNamedParams(query)
+	args, err := cfg.queryArgs(names)
+	if err != nil {
+		return fmt.Errorf("%s: %w", table.TableName, err)
+	}
+	var n int64
+	if err := db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return fmt.Errorf("counting rows of table %s: %w", table.TableName, err)
+	}
+	table.ExactRows = &n
+	return nil
+}
+
+// fetchSchemaStats adds the column statistics from pg_stats to the tables.
+// Query exports and tables that were never analyzed get none.
+func fetchSchemaStats(ctx context.Context, db *sql.DB, tables []TableMetadata) error {
+	for i := range tables {
+		table := &tables[i]
+		if table.Query != "" {
+			continue
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT attname, null_frac, n_distinct, avg_width
+			FROM pg_stats
+			WHERE schemaname = $2
+			  AND tablename = $1
+			  AND NOT inherited
+		`, table.relationName(), table.Schema)
+		if err != nil {
+			return fmt.Errorf("querying statistics for table %s: %w", table.TableName, err)
+		}
+		var estimate int64
+		if table.EstimatedRows != nil {
+			estimate = *table.EstimatedRows
+		}
+		stats := make(map[string]*ColumnStats)
+		for rows.Next() {
+			var name string
+			var s ColumnStats
+			if err := rows.Scan(&name, &s.NullFraction, &s.DistinctValues, &s.AverageWidth); err != nil {
+				rows.Close()
+				return fmt.Errorf("scanning statistics for table %s: %w", table.TableName, err)
+			}
+			// A negative n_distinct is the negated fraction of rows that
+			// are distinct, for columns expected to grow with the table.
+			if s.DistinctValues < 0 {
+				s.DistinctValues = -s.DistinctValues * float64(estimate)
+			}
+			stats[name] = &s
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("reading statistics for table %s: %w", table.TableName, err)
+		}
+
+		for j := range table.Fields {
+			table.Fields[j].Stats = stats[table.Fields[j].FieldName]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/sbinet/npyio/npy"
+	"github.com/sbinet/npyio/npz"
+)
+
+const (
+	// EncodingSharedDictionary marks string columns stored as the int32
+	// codes of a dictionary kept outside the archive, in dictionaryDir, so
+	// columns of any table naming the same dictionary share its codes.
+	// Nulls are coded -1.
+	EncodingSharedDictionary = "shared_dictionary"
+
+	// dictionarySuffix names the companion array holding the name of a
+	// shared dictionary encoded column's dictionary.
+	dictionarySuffix = "__dictionary"
+
+	// dictionaryDir is the directory of the output directory holding the
+	// shared dictionaries, as <name>.npy string arrays whose value at an
+	// index is the value of that code.
+	dictionaryDir = "dictionaries"
+)
+
+// sharedDictionaries are the shared dictionaries of a run by name. Tables
+// exported concurrently add to them, and codes once given don't change.
+type sharedDictionaries struct {
+	mu    sync.Mutex
+	dicts map[string]*dictionaryBuilder
+}
+
+func newSharedDictionaries() *sharedDictionaries {
+	return &sharedDictionaries{dicts: make(map[string]*dictionaryBuilder)}
+}
+
+// useSharedDictionaries sets the encoding of the columns of a table stored
+// in shared dictionaries, given as column to dictionary name.
+func useSharedDictionaries(table *TableData, columns map[string]string) error {
+	for column, name := range columns {
+		idx := slices.IndexFunc(table.Columns, func(f FieldMetadata) bool { return f.FieldName == column })
+		if idx < 0 {
+			return fmt.Errorf("table %s has no column %q to store in a shared dictionary", table.TableName, column)
+		}
+		col := &table.Columns[idx]
+		if col.DataType != DataTypeString {
+			return fmt.Errorf("column %s.%s is %s, only string columns can be stored in a shared dictionary", table.TableName, column, col.DataType)
+		}
+		col.Encoding = EncodingSharedDictionary
+		col.Dictionary = name
+	}
+	return nil
+}
+
+// wrap returns a writer that codes the values of the shared dictionary
+// columns of the rows it writes, or w itself for tables without any.
+func (s *sharedDictionaries) wrap(w tableWriter, columns []FieldMetadata) tableWriter {
+	sw := &sharedDictionaryWriter{tableWriter: w, dicts: s, columns: make(map[string]string)}
+	for _, col := range columns {
+		if col.Encoding == EncodingSharedDictionary && col.Dictionary != "" {
+			sw.names = append(sw.names, col.FieldName)
+			sw.columns[col.FieldName] = col.Dictionary
+		}
+	}
+	if len(sw.names) == 0 {
+		return w
+	}
+	sort.Strings(sw.names)
+	return sw
+}
+
+// save writes each dictionary to dictionaryDir in outDir.
+func (s *sharedDictionaries) save(outDir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dicts) == 0 {
+		return nil
+	}
+	dir := filepath.Join(outDir, dictionaryDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	set := newSpillSet(spillConfig{})
+	defer set.close()
+	for name, dict := range s.dicts {
+		values := set.newBuffer(name, kindString)
+		for _, v := range dict.values {
+			values.appendString(v)
+		}
+		var b bytes.Buffer
+		if err := values.writeNpy(&b); err != nil {
+			return err
+		}
+		if err := saveFile(filepath.Join(dir, name+".npy"), b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedDictionaryWriter replaces the values of a table's shared
+// dictionary columns with their codes while the rows are written, and puts
+// them back after, since the rows are profiled and sampled as they are.
+type sharedDictionaryWriter struct {
+	tableWriter
+	dicts *sharedDictionaries
+	// columns are the dictionaries of the columns, by column; names are
+	// the columns in order.
+	columns map[string]string
+	names   []string
+}
+
+func (w *sharedDictionaryWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	values := make([][]interface{}, len(w.names))
+	w.dicts.mu.Lock()
+	for i, column := range w.names {
+		dict := w.dicts.dicts[w.columns[column]]
+		if dict == nil {
+			dict = newDictionaryBuilder()
+			w.dicts.dicts[w.columns[column]] = dict
+		}
+		values[i] = make([]interface{}, len(rows))
+		for j, row := range rows {
+			values[i][j] = row[column]
+			if s, ok := categoryText(row[column]); ok {
+				row[column] = dict.code(s)
+			}
+		}
+	}
+	w.dicts.mu.Unlock()
+
+	err := w.tableWriter.writeRows(ctx, rows)
+	for i, column := range w.names {
+		for j, row := range rows {
+			row[column] = values[i][j]
+		}
+	}
+	return err
+}
+
+// readSharedDictionary reads the values of the shared dictionary of a
+// column of an NPZ archive in dir, and false for columns without one.
+func readSharedDictionary(r *npz.Reader, dir, column string) ([]string, bool, error) {
+	if npzDtype(r, column+dictionarySuffix) == "" {
+		return nil, false, nil
+	}
+	name, err := readNpzColumn(r, column+dictionarySuffix)
+	if err != nil {
+		return nil, true, err
+	}
+	names := stringValues(name)
+	if len(names) != 1 {
+		return nil, true, fmt.Errorf("%s names %d dictionaries", column+dictionarySuffix, len(names))
+	}
+	values, err := readNpyStrings(filepath.Join(dir, dictionaryDir, names[0]+".npy"))
+	return values, true, err
+}
+
+// readNpyStrings reads the string array of the .npy file at path.
+func readNpyStrings(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := npy.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(r.Header.Descr.Shape) != 1 {
+		return nil, fmt.Errorf("unsupported shape %v of %s", r.Header.Descr.Shape, path)
+	}
+	values, err := decodeUnicode(f, r.Header.Descr.Type, r.Header.Descr.Shape[0])
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// SinkConfig sends the exported tables somewhere other than files in the
+// output directory.
+type SinkConfig struct {
+	// Exec is a shell command started for every table, which reads the
+	// table as an Arrow IPC stream on its standard input.
+	Exec string `yaml:"exec" toml:"exec"`
+	// Upload uploads the files of the export to object storage once they
+	// are written.
+	Upload *UploadConfig `yaml:"upload" toml:"upload"`
+}
+
+// execSink streams a table to a command run with sh -c, which learns the
+// table's name from the NPZ_TABLE environment variable. The command's
+// output goes to the exporter's standard error, and the table only counts
+// as exported if the command exits successfully once it has read the whole
+// stream.
+type execSink struct {
+	*arrowWriter
+	cmd *exec.Cmd
+}
+
+// newExecSink starts the sink command of a table and writes the schema of
+// the stream to it.
+// The command is killed if ctx is canceled.
+func newExecSink(ctx context.Context, command, tableName string, columns []FieldMetadata) (*execSink, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "NPZ_TABLE="+tableName)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting the sink command: %w", err)
+	}
+	s := &execSink{cmd: cmd}
+	if s.arrowWriter, err = newArrowStreamWriter(stdin, tableName, columns); err != nil {
+		s.kill()
+		return nil, fmt.Errorf("writing to the sink command: %w", err)
+	}
+	return s, nil
+}
+
+func (s *execSink) writeRows(ctx context.Context, rows []TableRow) error {
+	if err := s.arrowWriter.writeRows(ctx, rows); err != nil {
+		return fmt.Errorf("writing to the sink command: %w", err)
+	}
+	return nil
+}
+
+// close ends the stream and waits for the command to exit.
+func (s *execSink) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	if _, err := s.arrowWriter.close(ctx, files); err != nil {
+		s.kill()
+		return 0, fmt.Errorf("writing to the sink command: %w", err)
+	}
+	if err := s.cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("sink command: %w", err)
+	}
+	log.Printf("Table %q streamed to the sink command", s.tableName)
+	return 0, nil
+}
+
+// discard stops the command of a table that failed to export, without
+// ending the stream, so the command can tell it is incomplete.
+func (s *execSink) discard() {
+	s.kill()
+}
+
+func (s *execSink) kill() {
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SnapshotInfo identifies the point in time an export with -snapshot
+// reflects.
+type SnapshotInfo struct {
+	// LSN is PostgreSQL's write-ahead log position of the snapshot, or on
+	// a standby the position replayed.
+	LSN     string    `json:"lsn"`
+	TakenAt time.Time `json:"taken_at"`
+}
+
+// snapshotSource is implemented by sources that can read every table of
+// an export from one consistent snapshot.
+type snapshotSource interface {
+	// BeginSnapshot makes every later read use one snapshot, held until
+	// the source is closed.
+	BeginSnapshot(ctx context.Context) (SnapshotInfo, error)
+}
+
+// dbQuerier runs queries on a database or in one of its transactions.
+type dbQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// pgSnapshot is a snapshot exported by a transaction that stays open for
+// the run, pauses included, so that other transactions can import it.
+type pgSnapshot struct {
+	mu sync.RWMutex
+	tx *sql.Tx
+	id string
+}
+
+// use calls f with the snapshot's id while the snapshot is held, so that
+// importing it doesn't race its release, or with "" once it was released.
+func (s *pgSnapshot) use(f func(id string) error) error {
+	if s == nil {
+		return f("")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return f(s.id)
+}
+
+// release ends the snapshot's transaction when the source is closed.
+func (s *pgSnapshot) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		return
+	}
+	// The snapshot's transaction only read.
+	s.tx.Rollback()
+	s.tx, s.id = nil, ""
+}
+
+// BeginSnapshot exports the snapshot of a repeatable read transaction,
+// which every batch query then imports. Tables exported concurrently and
+// minutes apart thus see the same data, and foreign keys between them
+// don't dangle.
+func (s *postgresSource) BeginSnapshot(ctx context.Context) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	// The transaction outlives ctx, which would roll it back when canceled;
+	// Close ends it.
+	tx, err := s.db.BeginTx(context.WithoutCancel(ctx), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return info, err
+	}
+	var id string
+	err = tx.QueryRowContext(ctx, `
+		SELECT pg_export_snapshot(),
+		       CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END::text,
+		       now()
+	`).Scan(&id, &info.LSN, &info.TakenAt)
+	if err != nil {
+		tx.Rollback()
+		return info, fmt.Errorf("exporting snapshot: %w", err)
+	}
+	info.TakenAt = info.TakenAt.UTC()
+	s.snapshot = &pgSnapshot{tx: tx, id: id}
+	return info, nil
+}
+
+// beginSnapshotTx begins a read-only transaction that reads from the
+// exported snapshot.
+func beginSnapshotTx(ctx context.Context, db *sql.DB, snapshot string) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	// SET TRANSACTION SNAPSHOT takes no parameters.
+	if _, err := tx.ExecContext(ctx, "SET TRANSACTION SNAPSHOT "+quoteLiteral(snapshot)); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("importing snapshot %s: %w", snapshot, err)
+	}
+	return tx, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A pause closes idle connections but keeps the snapshot, which batches
+// read after it import, until the source is closed.
+func TestPauseKeepsSnapshot(t *testing.T) {
+	db := sql.OpenDB(dsnConnector{dsn: ":memory:", drv: &sqlite3.SQLiteDriver{}})
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &postgresSource{db: db, snapshot: &pgSnapshot{tx: tx, id: "00000003-00000002-1"}}
+
+	src.releaseForPause()
+	src.reacquireAfterPause()
+	var id string
+	src.snapshot.use(func(s string) error {
+		id = s
+		return nil
+	})
+	if id != "00000003-00000002-1" {
+		t.Errorf("snapshot after a pause = %q, want it kept", id)
+	}
+
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src.snapshot.use(func(s string) error {
+		id = s
+		return nil
+	})
+	if id != "" {
+		t.Errorf("snapshot after closing = %q, want it released", id)
+	}
+}
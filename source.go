@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Source backends, selected with connection.source in the config or -source.
+const (
+	sourcePostgres = "postgres"
+	sourceMongoDB  = "mongodb"
+	sourceSQLite   = "sqlite"
+)
+
+// sqlMaxIdleConns is database/sql's default of idle connections kept.
+const sqlMaxIdleConns = 2
+
+// exportSource is a database that tables or collections are exported from.
+// Every source streams the same TableRow batches, so the rest of the
+// pipeline does not depend on the backend.
+type exportSource interface {
+	FetchMetadata(ctx context.Context, cfg ExportConfig) (SchemaDetails, error)
+	// StreamTableData passes the table's rows to emit batch by batch,
+	// stopping with ctx's error once ctx is canceled.
+	StreamTableData(ctx context.Context, table TableMetadata, cfg ExportConfig, emit func(rows []TableRow) error) error
+	Close() error
+}
+
+// openSource connects to the source configured in cfg.
+func openSource(ctx context.Context, cfg ExportConfig) (exportSource, error) {
+	switch cfg.Connection.Source {
+	case sourceMongoDB:
+		src, err := connectToMongo(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return src, nil
+	case sourceSQLite:
+		src, err := connectToSQLite(ctx, cfg.Connection.DSN, cfg.Views)
+		if err != nil {
+			return nil, err
+		}
+		return src, nil
+	case sourcePostgres, "":
+		db, err := connectToDB(ctx, cfg.Connection.dataSourceName(), cfg.Views)
+		if err != nil {
+			return nil, err
+		}
+		return &postgresSource{db: db, dsn: cfg.Connection.dataSourceName(), schemas: cfg.listedSchemas(), includeViews: cfg.IncludeViews}, nil
+	default:
+		return nil, fmt.Errorf("unknown source %q", cfg.Connection.Source)
+	}
+}
+
+// sourceDSN returns the connection string of the configured source.
+func (c ConnectionConfig) sourceDSN() string {
+	switch c.Source {
+	case sourceMongoDB:
+		return c.mongoURI()
+	case sourceSQLite:
+		return c.DSN
+	default:
+		return c.dataSourceName()
+	}
+}
+
+// postgresSource exports PostgreSQL tables and queries.
+type postgresSource struct {
+	db  *sql.DB
+	dsn string
+	// snapshot is the snapshot of -snapshot, nil without one.
+	snapshot *pgSnapshot
+	// copyConfig is the connection configuration of -fast-copy, nil
+	// without it.
+	copyConfig *pgconn.Config
+	// schemas are the schemas whose tables are listed.
+	schemas []string
+	// includeViews lists views next to tables, with include_views.
+	includeViews bool
+}
+
+func (s *postgresSource) FetchMetadata(ctx context.Context, cfg ExportConfig) (SchemaDetails, error) {
+	return fetchMetadata(ctx, s.db, cfg)
+}
+
+func (s *postgresSource) ListTables(ctx context.Context) ([]string, error) {
+	return listTables(ctx, s.db, s.schemas, s.includeViews)
+}
+
+func (s *postgresSource) StreamTableData(ctx context.Context, table TableMetadata, cfg ExportConfig, emit func(rows []TableRow) error) error {
+	if s.copyConfig != nil {
+		return copyTableData(ctx, s.db, s.copyConfig, s.snapshot, table, cfg, postgresRowIdentity, emit)
+	}
+	return StreamTableData(ctx, s.db, s.snapshot, table, cfg, postgresRowIdentity, emit)
+}
+
+// releaseForPause closes the idle connections, so that a paused export
+// holds no more than the transaction of -snapshot on the server. That one
+// is kept, since batches read after the pause import the snapshot that
+// the metadata records.
+func (s *postgresSource) releaseForPause() {
+	s.db.SetMaxIdleConns(0)
+}
+
+// reacquireAfterPause lets connections be reused again.
+func (s *postgresSource) reacquireAfterPause() {
+	s.db.SetMaxIdleConns(sqlMaxIdleConns)
+}
+
+func (s *postgresSource) Close() error {
+	if s.snapshot != nil {
+		s.snapshot.release()
+	}
+	return s.db.Close()
+}
+
+// selectColumns keeps only the included columns of a table, in the
+// configured order, or all columns without included columns, and drops the
+// excluded columns. It also returns the names of the columns left out.
+func selectColumns(t TableConfig, fields []FieldMetadata) ([]FieldMetadata, []string, error) {
+	byName := make(map[string]FieldMetadata, len(fields))
+	for _, field := range fields {
+		byName[field.FieldName] = field
+	}
+	selected := fields
+	if columns := t.includedColumns(); len(columns) > 0 {
+		selected = nil
+		for _, col := range columns {
+			field, ok := byName[col]
+			if !ok {
+				return nil, nil, fmt.Errorf("table %s has no column %q", t.Name, col)
+			}
+			selected = append(selected, field)
+		}
+	}
+	for _, col := range t.ExcludeColumns {
+		// A misspelled exclusion would silently export the column.
+		if _, ok := byName[col]; !ok {
+			return nil, nil, fmt.Errorf("table %s has no column %q to exclude", t.Name, col)
+		}
+	}
+	selected = slices.DeleteFunc(slices.Clone(selected), func(f FieldMetadata) bool {
+		return slices.Contains(t.ExcludeColumns, f.FieldName)
+	})
+
+	var omitted []string
+	for _, field := range fields {
+		if !slices.ContainsFunc(selected, func(f FieldMetadata) bool { return f.FieldName == field.FieldName }) {
+			omitted = append(omitted, field.FieldName)
+		}
+	}
+	return selected, omitted, nil
+}
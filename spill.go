@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// Element kinds of a columnBuffer.
+const (
+	kindInt64   = 'i'
+	kindInt32   = 'c'
+	kindFloat64 = 'f'
+	kindBool    = 'b'
+	kindUint8   = 'u'
+	kindString  = 'U'
+	// Timestamps as nanoseconds and dates as days since the epoch, both
+	// int64 since numpy's datetime64 always is.
+	kindDatetime = 'M'
+	kindDate     = 'D'
+	// Times of day as nanoseconds since midnight, numpy's timedelta64.
+	kindTimedelta = 'm'
+)
+
+// spillConfig controls where and when column buffers move to disk.
+type spillConfig struct {
+	// Dir holds the temporary files; it is created per run and removed
+	// when the run ends.
+	Dir string
+	// Threshold is the number of buffered bytes per table above which
+	// buffers are spilled to temporary files.
+	Threshold int64
+}
+
+// spillSet owns the column buffers of one table. Once their combined
+// in-memory size exceeds the threshold, every buffer is flushed to its own
+// temporary file, keeping memory bounded for very wide or text-heavy tables.
+type spillSet struct {
+	cfg       spillConfig
+	buffers   []*columnBuffer
+	inMemory  int64
+	tempBytes int64
+}
+
+func newSpillSet(cfg spillConfig) *spillSet {
+	return &spillSet{cfg: cfg}
+}
+
+// newBuffer creates a buffer for the named array.
+func (s *spillSet) newBuffer(name string, kind byte) *columnBuffer {
+	b := &columnBuffer{name: name, kind: kind, set: s}
+	s.buffers = append(s.buffers, b)
+	return b
+}
+
+// spill moves the in-memory content of every buffer to its temporary file.
+func (s *spillSet) spill() error {
+	for _, b := range s.buffers {
+		if b.mem.Len() == 0 {
+			continue
+		}
+		if b.file == nil {
+			f, err := os.CreateTemp(s.cfg.Dir, "spill-*.bin")
+			if err != nil {
+				return fmt.Errorf("creating spill file: %w", err)
+			}
+			b.file = f
+		}
+		n, err := b.mem.WriteTo(b.file)
+		if err != nil {
+			return fmt.Errorf("spilling column %s: %w", b.name, err)
+		}
+		s.tempBytes += n
+	}
+	s.inMemory = 0
+	return nil
+}
+
+// close removes the temporary files of all buffers.
+func (s *spillSet) close() {
+	for _, b := range s.buffers {
+		if b.file != nil {
+			b.file.Close()
+			os.Remove(b.file.Name())
+			b.file = nil
+		}
+	}
+}
+
+// columnBuffer accumulates the little-endian encoded values of one output
+// array. Strings are kept length-prefixed and only expanded to numpy's
+// fixed-width UTF-32 once the longest value is known.
+type columnBuffer struct {
+	name  string
+	kind  byte
+	count int
+	width int
+	mem   bytes.Buffer
+	file  *os.File
+	set   *spillSet
+	err   error
+	tmp   [binary.MaxVarintLen64]byte
+}
+
+func (b *columnBuffer) write(p []byte) {
+	b.mem.Write(p)
+	b.grew(len(p))
+}
+
+func (b *columnBuffer) writeString(s string) {
+	b.mem.WriteString(s)
+	b.grew(len(s))
+}
+
+// grew accounts for n newly buffered bytes, spilling if over the threshold.
+func (b *columnBuffer) grew(n int) {
+	b.set.inMemory += int64(n)
+	if b.set.cfg.Threshold > 0 && b.set.inMemory > b.set.cfg.Threshold && b.err == nil {
+		b.err = b.set.spill()
+	}
+}
+
+func (b *columnBuffer) appendInt64(v int64) {
+	binary.LittleEndian.PutUint64(b.tmp[:8], uint64(v))
+	b.write(b.tmp[:8])
+	b.count++
+}
+
+func (b *columnBuffer) appendInt32(v int32) {
+	binary.LittleEndian.PutUint32(b.tmp[:4], uint32(v))
+	b.write(b.tmp[:4])
+	b.count++
+}
+
+func (b *columnBuffer) appendFloat64(v float64) {
+	binary.LittleEndian.PutUint64(b.tmp[:8], math.Float64bits(v))
+	b.write(b.tmp[:8])
+	b.count++
+}
+
+// appendBytes appends each byte of p as an element of a uint8 buffer.
+func (b *columnBuffer) appendBytes(p []byte) {
+	b.write(p)
+	b.count += len(p)
+}
+
+func (b *columnBuffer) appendBool(v bool) {
+	b.tmp[0] = 0
+	if v {
+		b.tmp[0] = 1
+	}
+	b.write(b.tmp[:1])
+	b.count++
+}
+
+// natValue is numpy's NaT, the missing datetime64 value.
+const natValue = math.MinInt64
+
+// The range of datetime64[ns], whose smallest int64 is NaT.
+var (
+	minDatetime64 = time.Unix(0, natValue+1).UTC()
+	maxDatetime64 = time.Unix(0, math.MaxInt64).UTC()
+)
+
+// inDatetime64Range reports whether a timestamp can be stored as
+// datetime64[ns], from 1677-09-21 to 2262-04-11.
+func inDatetime64Range(t time.Time) bool {
+	return !t.Before(minDatetime64) && !t.After(maxDatetime64)
+}
+
+// appendTime appends a timestamp or date to a datetime64 buffer, with the
+// zero time stored as NaT. Timestamps must be in the datetime64[ns] range.
+func (b *columnBuffer) appendTime(t time.Time) {
+	switch {
+	case t.IsZero():
+		b.appendInt64(natValue)
+	case b.kind == kindDate:
+		b.appendInt64(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400)
+	default:
+		b.appendInt64(t.UnixNano())
+	}
+}
+
+func (b *columnBuffer) appendString(v string) {
+	if n := utf8.RuneCountInString(v); n > b.width {
+		b.width = n
+	}
+	n := binary.PutUvarint(b.tmp[:], uint64(len(v)))
+	b.write(b.tmp[:n])
+	b.writeString(v)
+	b.count++
+}
+
+// dtype returns the numpy dtype of the buffered array.
+func (b *columnBuffer) dtype() string {
+	switch b.kind {
+	case kindInt64:
+		return "<i8"
+	case kindInt32:
+		return "<i4"
+	case kindFloat64:
+		return "<f8"
+	case kindBool:
+		return "|b1"
+	case kindUint8:
+		return "|u1"
+	case kindDatetime:
+		return "<M8[ns]"
+	case kindDate:
+		return "<M8[D]"
+	case kindTimedelta:
+		return "<m8[ns]"
+	default:
+		return fmt.Sprintf("<U%d", max(b.width, 1))
+	}
+}
+
+// writeNpy writes the buffered array in the .npy format. It can be called
+// again to write the array once more.
+func (b *columnBuffer) writeNpy(w io.Writer) error {
+	if b.err != nil {
+		return b.err
+	}
+	if err := writeNpyHeader(w, b.dtype(), b.count); err != nil {
+		return err
+	}
+
+	data := io.Reader(bytes.NewReader(b.mem.Bytes()))
+	if b.file != nil {
+		if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		data = io.MultiReader(b.file, data)
+	}
+
+	if b.kind != kindString {
+		_, err := io.Copy(w, data)
+		return err
+	}
+
+	// Expand length-prefixed UTF-8 strings to NUL padded UTF-32LE.
+	br := bufio.NewReader(data)
+	bw := bufio.NewWriter(w)
+	width := max(b.width, 1)
+	var s []byte
+	var cell [4]byte
+	for i := 0; i < b.count; i++ {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("reading buffered column %s: %w", b.name, err)
+		}
+		if cap(s) < int(n) {
+			s = make([]byte, n)
+		}
+		s = s[:n]
+		if _, err := io.ReadFull(br, s); err != nil {
+			return fmt.Errorf("reading buffered column %s: %w", b.name, err)
+		}
+
+		runes := 0
+		for len(s) > 0 {
+			r, size := utf8.DecodeRune(s)
+			s = s[size:]
+			binary.LittleEndian.PutUint32(cell[:], uint32(r))
+			bw.Write(cell[:])
+			runes++
+		}
+		binary.LittleEndian.PutUint32(cell[:], 0)
+		for ; runes < width; runes++ {
+			bw.Write(cell[:])
+		}
+	}
+	return bw.Flush()
+}
+
+// writeNpyHeader writes a version 1.0 .npy header for a 1-d C-order array,
+// padded so the data starts on a 64-byte boundary.
+func writeNpyHeader(w io.Writer, dtype string, n int) error {
+	dict := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%d,), }", dtype, n)
+	// magic (6) + version (2) + header length (2) + dict + trailing newline.
+	pad := 64 - (10+len(dict)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header := dict + string(bytes.Repeat([]byte{' '}, pad)) + "\n"
+	if len(header) > math.MaxUint16 {
+		return fmt.Errorf("npy header too long for dtype %s", dtype)
+	}
+
+	buf := make([]byte, 0, 10+len(header))
+	buf = append(buf, "\x93NUMPY\x01\x00"...)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(header)))
+	buf = append(buf, header...)
+	_, err := w.Write(buf)
+	return err
+}
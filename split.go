@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+)
+
+// Names of the splits of a table.
+const (
+	splitTrain = "train"
+	splitVal   = "val"
+	splitTest  = "test"
+)
+
+// SplitConfig splits a table's rows into train, val and test files by
+// ratio, leaving out the splits with a ratio of 0.
+type SplitConfig struct {
+	Train float64 `yaml:"train" toml:"train"`
+	Val   float64 `yaml:"val" toml:"val"`
+	Test  float64 `yaml:"test" toml:"test"`
+	// Stratify is a column whose every value is split by the ratios, such
+	// as a label.
+	Stratify string `yaml:"stratify" toml:"stratify"`
+	// Seed is hashed with each row's key, so the same rows split the same
+	// way in any order.
+	Seed int64 `yaml:"seed" toml:"seed"`
+}
+
+// SplitInfo marks a table entry of the metadata as a split of a table.
+type SplitInfo struct {
+	// Table is the name of the split table.
+	Table    string  `json:"table"`
+	Name     string  `json:"name"`
+	Ratio    float64 `json:"ratio"`
+	Seed     int64   `json:"seed"`
+	Stratify string  `json:"stratify,omitempty"`
+}
+
+// splitPart is a split with its ratio.
+type splitPart struct {
+	name  string
+	ratio float64
+}
+
+// parts returns the splits with a ratio above 0, in train, val, test
+// order.
+func (s SplitConfig) parts() []splitPart {
+	var parts []splitPart
+	for _, p := range []splitPart{{splitTrain, s.Train}, {splitVal, s.Val}, {splitTest, s.Test}} {
+		if p.ratio > 0 {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// validate checks the ratios of a split.
+func (s SplitConfig) validate() error {
+	if s.Train < 0 || s.Val < 0 || s.Test < 0 {
+		return fmt.Errorf("invalid split ratios %g, %g and %g, expected positive numbers", s.Train, s.Val, s.Test)
+	}
+	if sum := s.Train + s.Val + s.Test; math.Abs(sum-1) > 1e-9 {
+		return fmt.Errorf("split ratios add up to %g, expected 1", sum)
+	}
+	return nil
+}
+
+// info describes a split of table for the metadata.
+func (s SplitConfig) info(table string, part splitPart) *SplitInfo {
+	return &SplitInfo{Table: table, Name: part.name, Ratio: part.ratio, Seed: s.Seed, Stratify: s.Stratify}
+}
+
+// splitColumn holds, in every row of a split table, the index of the split
+// the row was assigned as read, before the transforms change the values
+// it's hashed by.
+const splitColumn = "__split"
+
+// splitName returns the name a split of table is exported as.
+func splitName(table, split string) string {
+	return table + "." + split
+}
+
+// splitter assigns the rows of a table to splits by hashing the seed, the
+// row's value of the stratify column and its primary key, or all its
+// columns for tables without one, to a number from 0 to 1 compared with the
+// running total of the ratios. A row goes to the same split in any order
+// and in any export of the same seed. Rows are assigned by their values as
+// read, so scaling fitted on the train split doesn't move rows between
+// splits.
+type splitter struct {
+	cfg   SplitConfig
+	parts []splitPart
+	// bounds are the running totals of the ratios.
+	bounds []float64
+	// key are the columns hashed.
+	key []string
+}
+
+func newSplitter(cfg SplitConfig, columns []FieldMetadata) *splitter {
+	s := &splitter{cfg: cfg, parts: cfg.parts()}
+	var total float64
+	for _, p := range s.parts {
+		total += p.ratio
+		s.bounds = append(s.bounds, total)
+	}
+	for _, field := range columns {
+		if field.IsPrimaryKey {
+			s.key = append(s.key, field.FieldName)
+		}
+	}
+	if len(s.key) == 0 {
+		for _, field := range columns {
+			s.key = append(s.key, field.FieldName)
+		}
+		sort.Strings(s.key)
+	}
+	return s
+}
+
+// tableSplitter returns the splitter of a table, keyed by its columns as
+// read.
+func tableSplitter(table TableMetadata, split SplitConfig) (*splitter, error) {
+	if split.Stratify != "" && !slices.ContainsFunc(table.Fields, func(f FieldMetadata) bool { return f.FieldName == split.Stratify }) {
+		return nil, fmt.Errorf("table %s has no column %q to stratify on", table.TableName, split.Stratify)
+	}
+	return newSplitter(split, table.Fields), nil
+}
+
+// mark sets the split of every row in splitColumn.
+func (s *splitter) mark(rows []TableRow) {
+	for _, row := range rows {
+		row[splitColumn] = s.assign(row)
+	}
+}
+
+// train returns the index of the train split, or -1 without one.
+func (s *splitter) train() int {
+	return slices.IndexFunc(s.parts, func(p splitPart) bool { return p.name == splitTrain })
+}
+
+// assign returns the index of the part a row goes to.
+func (s *splitter) assign(row TableRow) int {
+	h := fnv.New64a()
+	h.Write(binary.LittleEndian.AppendUint64(nil, uint64(s.cfg.Seed)))
+	if s.cfg.Stratify != "" {
+		writeSplitValue(h, row[s.cfg.Stratify])
+	}
+	for _, column := range s.key {
+		writeSplitValue(h, row[column])
+	}
+	// FNV mixes its last bytes poorly into the high bits, which the
+	// splitmix64 finalizer spreads.
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	u := float64(x>>11) / (1 << 53)
+	for i, bound := range s.bounds {
+		if u < bound {
+			return i
+		}
+	}
+	return len(s.parts) - 1
+}
+
+// writeSplitValue writes a value to a split hash, prefixed so that nulls,
+// and values across columns, can't run together.
+func writeSplitValue(h hash.Hash, v interface{}) {
+	k, ok := joinKey(v)
+	if !ok {
+		h.Write([]byte{0})
+		return
+	}
+	h.Write(binary.LittleEndian.AppendUint64([]byte{1}, uint64(len(k))))
+	h.Write([]byte(k))
+}
+
+// splitWriter writes the splits of a table, each to a file of its own.
+type splitWriter struct {
+	splitter *splitter
+	table    string
+	writers  []tableWriter
+	// rows counts the rows of each split.
+	rows []int
+}
+
+// newSplitWriter creates the writers of the splits of a table, which
+// writes rows to the split marked by the splitter. Each split spills on its
+// share of the spill threshold.
+func newSplitWriter(ctx context.Context, cfg ExportConfig, tableName string, columns []FieldMetadata, s *splitter, spill spillConfig) (*splitWriter, error) {
+	w := &splitWriter{splitter: s, table: tableName}
+	w.rows = make([]int, len(w.splitter.parts))
+	spill.Threshold /= int64(len(w.splitter.parts))
+	for _, part := range w.splitter.parts {
+		pw, err := newTableWriter(ctx, cfg, splitName(tableName, part.name), columns, spill)
+		if err != nil {
+			w.discard()
+			return nil, err
+		}
+		w.writers = append(w.writers, pw)
+	}
+	return w, nil
+}
+
+func (w *splitWriter) writeRows(ctx context.Context, rows []TableRow) error {
+	batches := make([][]TableRow, len(w.writers))
+	for _, row := range rows {
+		i, ok := row[splitColumn].(int)
+		if !ok {
+			return fmt.Errorf("row of table %s has no split", w.table)
+		}
+		delete(row, splitColumn)
+		batches[i] = append(batches[i], row)
+	}
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := w.writers[i].writeRows(ctx, batch); err != nil {
+			return err
+		}
+		w.rows[i] += len(batch)
+	}
+	return nil
+}
+
+func (w *splitWriter) close(ctx context.Context, files map[string][]byte) (int64, error) {
+	var temp int64
+	for i, pw := range w.writers {
+		partFiles, err := w.partFiles(files, i)
+		if err != nil {
+			for _, rest := range w.writers[i:] {
+				rest.discard()
+			}
+			return temp, err
+		}
+		n, err := pw.close(ctx, partFiles)
+		temp += n
+		if err != nil {
+			for _, rest := range w.writers[i+1:] {
+				rest.discard()
+			}
+			return temp, err
+		}
+	}
+	return temp, nil
+}
+
+func (w *splitWriter) discard() {
+	for _, pw := range w.writers {
+		pw.discard()
+	}
+}
+
+// partFiles returns the extra files of the i-th split, whose embedded
+// metadata names the split and counts its rows.
+func (w *splitWriter) partFiles(files map[string][]byte, i int) (map[string][]byte, error) {
+	b, ok := files[embeddedMetadataName]
+	if !ok {
+		return files, nil
+	}
+	var embedded EmbeddedMetadata
+	if err := json.Unmarshal(b, &embedded); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", embeddedMetadataName, err)
+	}
+	part := w.splitter.parts[i]
+	embedded.Table.TableName = splitName(w.table, part.name)
+	embedded.Table.SourceTable = w.table
+	embedded.Table.Split = w.splitter.cfg.info(w.table, part)
+	embedded.RowCount = w.rows[i]
+	b, err := json.Marshal(embedded)
+	if err != nil {
+		return nil, err
+	}
+	partFiles := maps.Clone(files)
+	partFiles[embeddedMetadataName] = b
+	return partFiles, nil
+}
+
+// tableSplits are the splits a table was written in, with their rows.
+type tableSplits struct {
+	cfg   SplitConfig
+	parts []splitPart
+	rows  []int
+}
+
+// expandSplits replaces the entries of the tables written in splits with
+// an entry per split, and moves their written entries to the splits,
+// whose rows replace the table's.
+func expandSplits(cfg ExportConfig, tables []TableMetadata, split map[string]tableSplits, rows map[string]int, written map[string]*TableMetadata) ([]TableMetadata, error) {
+	var expanded []TableMetadata
+	for _, table := range tables {
+		s, ok := split[table.TableName]
+		if !ok {
+			expanded = append(expanded, table)
+			continue
+		}
+		for i, part := range s.parts {
+			entry := table
+			entry.TableName = splitName(table.TableName, part.name)
+			entry.SourceTable = table.TableName
+			entry.Split = s.cfg.info(table.TableName, part)
+			entry.Chunks, entry.SizeBytes = nil, nil
+			if cfg.NPZCompression == npzCompressionNone {
+				layout, err := npzLayout(cfg.outputPath(entry.TableName))
+				if err != nil {
+					return nil, fmt.Errorf("reading the array layout of table %s: %w", entry.TableName, err)
+				}
+				entry.Arrays = layout
+			}
+			rows[entry.TableName] = s.rows[i]
+			expanded = append(expanded, entry)
+		}
+		delete(rows, table.TableName)
+		delete(written, table.TableName)
+	}
+	// The entries of the other tables moved with the slice.
+	for i := range expanded {
+		if written[expanded[i].TableName] != nil || expanded[i].Split != nil {
+			written[expanded[i].TableName] = &expanded[i]
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestSplitterAssign(t *testing.T) {
+	keyed := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true},
+		{FieldName: "label", DataType: DataTypeString, IsNullable: true},
+		{FieldName: "v", DataType: DataTypeFloat},
+	}
+	unkeyed := []FieldMetadata{
+		{FieldName: "id", DataType: DataTypeInt},
+		{FieldName: "label", DataType: DataTypeString, IsNullable: true},
+	}
+	rows := make([]TableRow, 20000)
+	for i := range rows {
+		var label interface{} = []string{"a", "b", "c", "d"}[i%4]
+		if i%10 == 0 {
+			label = nil
+		}
+		rows[i] = TableRow{"id": int64(i), "label": label, "v": float64(i) / 3}
+	}
+
+	tests := []struct {
+		name    string
+		cfg     SplitConfig
+		columns []FieldMetadata
+	}{
+		{"primary key", SplitConfig{Train: 0.8, Val: 0.1, Test: 0.1, Seed: 42}, keyed},
+		{"stratified", SplitConfig{Train: 0.7, Test: 0.3, Stratify: "label", Seed: 7}, keyed},
+		{"all columns", SplitConfig{Train: 0.5, Val: 0.25, Test: 0.25}, unkeyed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSplitter(tt.cfg, tt.columns)
+			want := make(map[int64]int)
+			for _, row := range rows {
+				want[row["id"].(int64)] = s.assign(row)
+			}
+
+			// Any order, and a new splitter, give the same splits.
+			shuffled := append([]TableRow(nil), rows...)
+			rand.New(rand.NewPCG(1, 2)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			again := newSplitter(tt.cfg, tt.columns)
+			for _, row := range shuffled {
+				if got := again.assign(row); got != want[row["id"].(int64)] {
+					t.Fatalf("row %v went to split %d, then %d", row["id"], want[row["id"].(int64)], got)
+				}
+			}
+
+			// Every stratum, or the whole table, keeps the ratios.
+			strata := make(map[interface{}][]int)
+			for _, row := range rows {
+				var stratum interface{}
+				if tt.cfg.Stratify != "" {
+					stratum = row[tt.cfg.Stratify]
+				}
+				if strata[stratum] == nil {
+					strata[stratum] = make([]int, len(s.parts))
+				}
+				strata[stratum][want[row["id"].(int64)]]++
+			}
+			for stratum, counts := range strata {
+				total := 0
+				for _, n := range counts {
+					total += n
+				}
+				for i, part := range s.parts {
+					share := float64(counts[i]) / float64(total)
+					if math.Abs(share-part.ratio) > 0.03 {
+						t.Errorf("stratum %v: split %s has %.3f of the rows, want %g", stratum, part.name, share, part.ratio)
+					}
+				}
+			}
+		})
+	}
+
+	// Another seed splits differently.
+	a := newSplitter(SplitConfig{Train: 0.5, Test: 0.5, Seed: 1}, keyed)
+	b := newSplitter(SplitConfig{Train: 0.5, Test: 0.5, Seed: 2}, keyed)
+	same := 0
+	for _, row := range rows {
+		if a.assign(row) == b.assign(row) {
+			same++
+		}
+	}
+	if same == len(rows) {
+		t.Error("seeds 1 and 2 split the rows the same way")
+	}
+}
+
+func TestSplitWriterEmbeddedMetadata(t *testing.T) {
+	dir := t.TempDir()
+	columns := []FieldMetadata{{FieldName: "id", DataType: DataTypeInt, IsPrimaryKey: true}}
+	cfg := ExportConfig{OutDir: dir, Format: formatNPZ}
+	split := SplitConfig{Train: 0.8, Test: 0.2, Seed: 3}
+	s, err := tableSplitter(TableMetadata{TableName: "t", Fields: columns}, split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newSplitWriter(context.Background(), cfg, "t", columns, s, spillConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []TableRow
+	for i := range 1000 {
+		rows = append(rows, TableRow{"id": int64(i)})
+	}
+	s.mark(rows)
+	if err := w.writeRows(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	files, err := embeddedMetadataFiles(DatasetMetadata{}, TableData{TableName: "t", Columns: columns}, len(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.close(context.Background(), files); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i, part := range w.splitter.parts {
+		name := splitName("t", part.name)
+		embedded, err := readEmbeddedMetadata(cfg.outputPath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if embedded.Table.TableName != name || embedded.Table.Split == nil || embedded.Table.Split.Name != part.name {
+			t.Errorf("%s embeds the metadata of %s, split %+v", name, embedded.Table.TableName, embedded.Table.Split)
+		}
+		if embedded.RowCount != w.rows[i] {
+			t.Errorf("%s embeds row_count %d, has %d rows", name, embedded.RowCount, w.rows[i])
+		}
+		total += embedded.RowCount
+	}
+	if total != len(rows) {
+		t.Errorf("splits embed %d rows, want %d", total, len(rows))
+	}
+}
+
+// readEmbeddedMetadata reads the metadata embedded in an NPZ archive.
+func readEmbeddedMetadata(path string) (EmbeddedMetadata, error) {
+	var embedded EmbeddedMetadata
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return embedded, err
+	}
+	defer r.Close()
+	f, err := r.Open(embeddedMetadataName)
+	if err != nil {
+		return embedded, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&embedded)
+	return embedded, err
+}
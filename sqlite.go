@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteSource exports tables and queries of a local SQLite database file.
+type sqliteSource struct {
+	db *sql.DB
+}
+
+// connectToSQLite opens the SQLite database at path read-only, creating
+// the views on every connection.
+func connectToSQLite(ctx context.Context, path string, views []ViewConfig) (*sqliteSource, error) {
+	dsn := path
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + path + "?mode=ro"
+	}
+	db := sql.OpenDB(viewConnector{Connector: dsnConnector{dsn: dsn, drv: &sqlite3.SQLiteDriver{}}, views: views})
+	// Verify the file is a readable database.
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, "SELECT count(*) FROM sqlite_master"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteSource{db: db}, nil
+}
+
+func (s *sqliteSource) Close() error {
+	return s.db.Close()
+}
+
+// StreamTableData runs the same batched SELECTs as for PostgreSQL, which
+// SQLite understands as well, paginating on rowid instead of ctid.
+func (s *sqliteSource) StreamTableData(ctx context.Context, table TableMetadata, cfg ExportConfig, emit func(rows []TableRow) error) error {
+	return StreamTableData(ctx, s.db, nil, table, cfg, sqliteRowIdentity, emit)
+}
+
+// FetchMetadata collects the columns, primary keys and foreign keys of the
+// selected tables from PRAGMA table_info and PRAGMA foreign_key_list.
+func (s *sqliteSource) FetchMetadata(ctx context.Context, cfg ExportConfig) (SchemaDetails, error) {
+	var schema SchemaDetails
+	tableNames := cfg.tableNames()
+
+	names, err := s.ListTables(ctx)
+	if err != nil {
+		return schema, err
+	}
+
+	for _, tableCfg := range cfg.Tables {
+		if !slices.Contains(names, tableCfg.Name) {
+			continue
+		}
+
+		fields, err := s.tableFields(ctx, tableCfg.Name, cfg.FillDefaults)
+		if err != nil {
+			return schema, err
+		}
+		fields, omitted, err := selectColumns(tableCfg, fields)
+		if err != nil {
+			return schema, err
+		}
+		table := TableMetadata{TableName: tableCfg.Name, Fields: fields, Where: tableCfg.Where, OmittedColumns: omitted}
+		if cfg.ExactCounts {
+			if err := countRows(ctx, s.db, cfg, &table); err != nil {
+				return schema, err
+			}
+		}
+		schema.Tables = append(schema.Tables, table)
+	}
+
+	dropUnselectedForeignKeys(schema.Tables, tableNames)
+
+	for _, q := range cfg.Queries {
+		tableMeta, err := fetchQueryMetadata(ctx, s.db, cfg, q, mapSQLiteType)
+		if err != nil {
+			return schema, err
+		}
+		schema.Tables = append(schema.Tables, tableMeta)
+	}
+
+	schema.DatasetMetadata = DatasetMetadata{
+		DatasetName: cfg.Connection.DBName,
+		SourceType:  "Relational Database",
+		SourceDetails: map[string]interface{}{
+			"database_type":         "SQLite",
+			"tables_or_collections": tableNames,
+		},
+	}
+	return schema, nil
+}
+
+// ListTables returns the names of the tables, without SQLite's own.
+func (s *sqliteSource) ListTables(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name
+		FROM sqlite_master
+		WHERE type = 'table'
+		  AND name NOT LIKE 'sqlite_%'
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("querying tables: %w", err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scanning table name: %w", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("processing tables: %w", err)
+	}
+	return names, nil
+}
+
+// tableFields describes the columns of a table, with fillDefaults their
+// fill values.
+func (s *sqliteSource) tableFields(ctx context.Context, tableName string, fillDefaults bool) ([]FieldMetadata, error) {
+	// PRAGMA arguments cannot be bound, so quote the name as an identifier.
+	quoted := quoteIdent(tableName)
+
+	colRows, err := s.db.QueryContext(ctx, "PRAGMA table_info("+quoted+")")
+	if err != nil {
+		return nil, fmt.Errorf("querying columns for table %s: %w", tableName, err)
+	}
+	var fields []FieldMetadata
+	for colRows.Next() {
+		var (
+			cid          int
+			name, typ    string
+			notNull, pk  int
+			defaultValue sql.NullString
+		)
+		if err := colRows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			colRows.Close()
+			return nil, fmt.Errorf("scanning column for table %s: %w", tableName, err)
+		}
+		field := FieldMetadata{
+			FieldName:    name,
+			DataType:     mapSQLiteType(typ),
+			IsPrimaryKey: pk > 0,
+			// SQLite allows NULL in primary key columns unless declared NOT NULL,
+			// except for INTEGER PRIMARY KEY (the rowid).
+			IsNullable: notNull == 0 && !(pk > 0 && strings.EqualFold(typ, "INTEGER")),
+			IsPII:      isLikelyPII(name),
+		}
+		field.Precision, field.Scale = sqliteDecimalSize(typ)
+		if fillDefaults && defaultValue.Valid {
+			field.FillValue, _ = constantDefault(field, defaultValue.String)
+		}
+		fields = append(fields, field)
+	}
+	colRows.Close()
+	if err := colRows.Err(); err != nil {
+		return nil, fmt.Errorf("processing columns for table %s: %w", tableName, err)
+	}
+
+	fkRows, err := s.db.QueryContext(ctx, "PRAGMA foreign_key_list("+quoted+")")
+	if err != nil {
+		return nil, fmt.Errorf("querying foreign keys for table %s: %w", tableName, err)
+	}
+	defer fkRows.Close()
+	for fkRows.Next() {
+		var (
+			id, seq                  int
+			foreignTable, from       string
+			to                       sql.NullString
+			onUpdate, onDelete, mtch string
+		)
+		if err := fkRows.Scan(&id, &seq, &foreignTable, &from, &to, &onUpdate, &onDelete, &mtch); err != nil {
+			return nil, fmt.Errorf("scanning foreign key for table %s: %w", tableName, err)
+		}
+		for i := range fields {
+			if fields[i].FieldName != from {
+				continue
+			}
+			foreignTable := foreignTable
+			// Without an explicit column the reference is to the primary key.
+			foreignColumn := to.String
+			if !to.Valid {
+				foreignColumn = "rowid"
+			}
+			fields[i].IsForeignKey = true
+			fields[i].ReferencedTable = &foreignTable
+			fields[i].ReferencedField = &foreignColumn
+		}
+	}
+	if err := fkRows.Err(); err != nil {
+		return nil, fmt.Errorf("processing foreign keys for table %s: %w", tableName, err)
+	}
+	return fields, nil
+}
+
+// sqliteDecimalSize returns the precision and scale declared by a
+// DECIMAL(p,s) or NUMERIC(p,s) column type, or zeros for other types.
+func sqliteDecimalSize(declared string) (int, int) {
+	t := strings.ToUpper(strings.ReplaceAll(declared, " ", ""))
+	for _, prefix := range []string{"DECIMAL(", "NUMERIC("} {
+		if !strings.HasPrefix(t, prefix) {
+			continue
+		}
+		var precision, scale int
+		n, _ := fmt.Sscanf(t[len(prefix):], "%d,%d)", &precision, &scale)
+		if n == 0 || precision <= 0 || scale < 0 || scale > precision {
+			return 0, 0
+		}
+		return precision, scale
+	}
+	return 0, 0
+}
+
+// mapSQLiteType converts a declared SQLite column type to our standardized
+// types, following SQLite's type affinity rules and recognizing common
+// names for booleans, dates, UUIDs, JSON and binary data.
+func mapSQLiteType(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "BOOL"):
+		return DataTypeBool
+	case strings.Contains(t, "UUID"):
+		return DataTypeUUID
+	case strings.Contains(t, "JSON"):
+		return DataTypeJSON
+	case strings.Contains(t, "BLOB"), strings.Contains(t, "BINARY"):
+		return DataTypeBytes
+	case strings.Contains(t, "DATETIME"), strings.Contains(t, "TIMESTAMP"):
+		return DataTypeTime
+	case strings.Contains(t, "DATE"):
+		return DataTypeDate
+	case strings.Contains(t, "INT"):
+		return DataTypeInt
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return DataTypeString
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"),
+		strings.Contains(t, "NUMERIC"), strings.Contains(t, "DECIMAL"):
+		return DataTypeFloat
+	default:
+		// Untyped columns.
+		return DataTypeString
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+const (
+	// tdigestCompression bounds the number of centroids of a t-digest to
+	// about twice its value; quantiles come within a fraction of a percent
+	// of their rank, and closer near the tails.
+	tdigestCompression = 100
+	// tdigestBuffer is the number of values added before they are merged
+	// into the centroids.
+	tdigestBuffer = 500
+)
+
+// centroid is the mean of a run of values of a t-digest and their count.
+type centroid struct {
+	Mean   float64 `json:"mean"`
+	Weight float64 `json:"weight"`
+}
+
+// tdigest is a merging t-digest, which estimates the quantiles of a stream
+// of values from a few hundred centroids: small ones at the tails and
+// larger ones in the middle.
+type tdigest struct {
+	centroids []centroid
+	buffer    []centroid
+	// total is the weight of the centroids.
+	total    float64
+	min, max float64
+}
+
+func newTDigest() *tdigest {
+	return &tdigest{min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// add adds a finite value standing for weight values.
+func (d *tdigest) add(v, weight float64) {
+	d.buffer = append(d.buffer, centroid{Mean: v, Weight: weight})
+	d.min, d.max = min(d.min, v), max(d.max, v)
+	if len(d.buffer) >= tdigestBuffer {
+		d.merge()
+	}
+}
+
+// merge merges the buffered values into the centroids, joining neighbours
+// while the joined centroid stays within the size its quantile allows.
+func (d *tdigest) merge() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	points := append(d.centroids, d.buffer...)
+	d.buffer = d.buffer[:0]
+	slices.SortFunc(points, func(a, b centroid) int {
+		switch {
+		case a.Mean < b.Mean:
+			return -1
+		case a.Mean > b.Mean:
+			return 1
+		}
+		return 0
+	})
+	d.total = 0
+	for _, p := range points {
+		d.total += p.Weight
+	}
+
+	merged := []centroid{points[0]}
+	before := 0.0
+	for _, p := range points[1:] {
+		last := &merged[len(merged)-1]
+		w := last.Weight + p.Weight
+		q := (before + w/2) / d.total
+		if w <= max(4*d.total*q*(1-q)/tdigestCompression, 1) {
+			last.Mean += (p.Mean - last.Mean) * p.Weight / w
+			last.Weight = w
+			continue
+		}
+		before += last.Weight
+		merged = append(merged, p)
+	}
+	d.centroids = merged
+}
+
+// quantile returns the estimate of the q quantile, interpolating between
+// the centroids and the extremes, or NaN without values.
+func (d *tdigest) quantile(q float64) float64 {
+	d.merge()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	rank := q * d.total
+	prevMean, prevRank := d.min, 0.0
+	before := 0.0
+	for _, c := range d.centroids {
+		center := before + c.Weight/2
+		if rank < center {
+			if center == prevRank {
+				return c.Mean
+			}
+			return prevMean + (c.Mean-prevMean)*(rank-prevRank)/(center-prevRank)
+		}
+		prevMean, prevRank = c.Mean, center
+		before += c.Weight
+	}
+	if d.total == prevRank {
+		return d.max
+	}
+	return prevMean + (d.max-prevMean)*(rank-prevRank)/(d.total-prevRank)
+}
+
+// state returns the digest's centroids, with the buffered values merged.
+func (d *tdigest) state() []centroid {
+	d.merge()
+	return d.centroids
+}
+
+// restoreTDigest returns a digest continuing from the centroids of a
+// checkpoint and the extremes of its values.
+func restoreTDigest(centroids []centroid, lo, hi float64) *tdigest {
+	d := &tdigest{centroids: slices.Clone(centroids), min: lo, max: hi}
+	for _, c := range centroids {
+		d.total += c.Weight
+	}
+	return d
+}
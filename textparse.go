@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseConfig converts a column stored as text into a numeric or temporal
+// column during export.
+type ParseConfig struct {
+	// Type is the target data type: int, float, date or timestamp.
+	Type string `yaml:"type" toml:"type"`
+	// Locale picks the decimal and grouping separators of numbers and the
+	// default date layouts, e.g. en_US, de_DE or fr_FR.
+	Locale string `yaml:"locale" toml:"locale"`
+	// DecimalSeparator and GroupSeparator override the locale's separators.
+	DecimalSeparator string `yaml:"decimal_separator" toml:"decimal_separator"`
+	GroupSeparator   string `yaml:"group_separator" toml:"group_separator"`
+	// Formats are Go time layouts tried in order for dates and timestamps.
+	Formats []string `yaml:"formats" toml:"formats"`
+}
+
+// numberFormat holds the separators used by a locale.
+type numberFormat struct {
+	decimal string
+	groups  []string
+}
+
+// localeNumberFormats maps a language or language_REGION to its separators.
+// Region entries take precedence over the language entry.
+var localeNumberFormats = map[string]numberFormat{
+	"en":    {".", []string{","}},
+	"ja":    {".", []string{","}},
+	"zh":    {".", []string{","}},
+	"de":    {",", []string{"."}},
+	"de_CH": {".", []string{"'", "’"}},
+	"es":    {",", []string{"."}},
+	"it":    {",", []string{"."}},
+	"nl":    {",", []string{"."}},
+	"pt":    {",", []string{"."}},
+	"tr":    {",", []string{"."}},
+	"fr":    {",", []string{" ", "\u00a0", "\u202f"}},
+	"pl":    {",", []string{" ", "\u00a0"}},
+	"ru":    {",", []string{" ", "\u00a0"}},
+	"sv":    {",", []string{" ", "\u00a0"}},
+}
+
+// localeDateFormats maps a language or language_REGION to the date layouts
+// tried after ISO 8601.
+var localeDateFormats = map[string][]string{
+	"en":    {"01/02/2006", "1/2/2006"},
+	"en_GB": {"02/01/2006", "2/1/2006"},
+	"de":    {"02.01.2006", "2.1.2006"},
+	"fr":    {"02/01/2006"},
+	"es":    {"02/01/2006"},
+	"it":    {"02/01/2006"},
+	"pt":    {"02/01/2006"},
+	"nl":    {"02-01-2006"},
+	"pl":    {"02.01.2006"},
+	"ru":    {"02.01.2006"},
+	"ja":    {"2006/01/02"},
+	"zh":    {"2006/01/02"},
+}
+
+// isoDateFormats are always tried first.
+var isoDateFormats = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+// lookupLocale returns the entry for locale, falling back from
+// language_REGION to language. Both "de-DE" and "de_DE" are accepted.
+func lookupLocale[T any](m map[string]T, locale string) (T, bool) {
+	locale = strings.ReplaceAll(locale, "-", "_")
+	if v, ok := m[locale]; ok {
+		return v, true
+	}
+	lang, _, _ := strings.Cut(locale, "_")
+	v, ok := m[strings.ToLower(lang)]
+	return v, ok
+}
+
+// textParser converts the text values of one column.
+type textParser struct {
+	dataType string
+	number   numberFormat
+	formats  []string
+}
+
+// newTextParser validates a ParseConfig and builds its parser.
+func newTextParser(cfg ParseConfig) (*textParser, error) {
+	p := &textParser{number: numberFormat{".", []string{","}}}
+
+	switch cfg.Type {
+	case DataTypeInt, DataTypeFloat, DataTypeDate, DataTypeTime:
+		p.dataType = cfg.Type
+	default:
+		return nil, fmt.Errorf("invalid parse type %q, expected %s, %s, %s or %s",
+			cfg.Type, DataTypeInt, DataTypeFloat, DataTypeDate, DataTypeTime)
+	}
+
+	if cfg.Locale != "" {
+		number, okNumber := lookupLocale(localeNumberFormats, cfg.Locale)
+		formats, okDate := lookupLocale(localeDateFormats, cfg.Locale)
+		if !okNumber && !okDate {
+			return nil, fmt.Errorf("unsupported locale %q", cfg.Locale)
+		}
+		if okNumber {
+			p.number = number
+		}
+		p.formats = formats
+	}
+	if cfg.DecimalSeparator != "" {
+		p.number.decimal = cfg.DecimalSeparator
+	}
+	if cfg.GroupSeparator != "" {
+		p.number.groups = []string{cfg.GroupSeparator}
+	}
+	if p.number.decimal == "" || slices.Contains(p.number.groups, p.number.decimal) {
+		return nil, fmt.Errorf("decimal separator %q conflicts with the group separator", p.number.decimal)
+	}
+	if len(cfg.Formats) > 0 {
+		p.formats = cfg.Formats
+	} else {
+		p.formats = append(append([]string{}, isoDateFormats...), p.formats...)
+	}
+	return p, nil
+}
+
+// parse converts a single value. Empty strings become nulls.
+func (p *textParser) parse(value interface{}) (interface{}, error) {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		// Already typed by the driver.
+		return value, nil
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	switch p.dataType {
+	case DataTypeInt, DataTypeFloat:
+		for _, g := range p.number.groups {
+			s = strings.ReplaceAll(s, g, "")
+		}
+		s = strings.Replace(s, p.number.decimal, ".", 1)
+		if p.dataType == DataTypeInt {
+			return strconv.ParseInt(s, 10, 64)
+		}
+		return strconv.ParseFloat(s, 64)
+	default:
+		for _, layout := range p.formats {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("no format matches %q", s)
+	}
+}
+
+// parsedColumn is a column converted by a textParser, with the count of
+// values that failed to parse.
+type parsedColumn struct {
+	name     string
+	parser   *textParser
+	failed   int
+	firstErr error
+}
+
+// columnParsers converts the configured text columns of a table as its
+// rows stream through the export.
+type columnParsers struct {
+	table   string
+	rows    int
+	columns []*parsedColumn
+}
+
+// newColumnParsers builds the parsers configured for the table and updates
+// the data types of their columns.
+func newColumnParsers(table *TableData, parsers map[string]ParseConfig) (*columnParsers, error) {
+	for name := range parsers {
+		found := false
+		for _, col := range table.Columns {
+			found = found || col.FieldName == name
+		}
+		if !found {
+			return nil, fmt.Errorf("table %s has no column %q to parse", table.TableName, name)
+		}
+	}
+
+	p := &columnParsers{table: table.TableName}
+	for i, col := range table.Columns {
+		cfg, ok := parsers[col.FieldName]
+		if !ok {
+			continue
+		}
+		parser, err := newTextParser(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("column %s.%s: %w", table.TableName, col.FieldName, err)
+		}
+		p.columns = append(p.columns, &parsedColumn{name: col.FieldName, parser: parser})
+
+		table.Columns[i].DataType = parser.dataType
+		// The default and labels were of the text column.
+		table.Columns[i].FillValue = nil
+		table.Columns[i].EnumValues = nil
+		table.Columns[i].TransformedFeatures = append(table.Columns[i].TransformedFeatures, "parsed_"+parser.dataType)
+	}
+	return p, nil
+}
+
+// apply converts the configured columns of a batch in place. Values that
+// fail to parse become nulls, and the failure is recorded on the row for
+// -quarantine.
+func (p *columnParsers) apply(rows []TableRow) {
+	p.rows += len(rows)
+	for _, col := range p.columns {
+		for _, row := range rows {
+			v, err := col.parser.parse(row[col.name])
+			if err != nil {
+				col.failed++
+				if col.firstErr == nil {
+					col.firstErr = err
+				}
+				addConversionError(row, col.name, row[col.name], err)
+				v = nil
+			}
+			row[col.name] = v
+		}
+	}
+}
+
+// finish reports the values that could not be parsed and marks their
+// columns nullable.
+func (p *columnParsers) finish(columns []FieldMetadata) {
+	for _, col := range p.columns {
+		if col.failed == 0 {
+			continue
+		}
+		log.Printf("column %s.%s: %d of %d values could not be parsed as %s (first error: %v)",
+			p.table, col.name, col.failed, p.rows, col.parser.dataType, col.firstErr)
+		for i := range columns {
+			if columns[i].FieldName == col.name {
+				columns[i].IsNullable = true
+			}
+		}
+	}
+}
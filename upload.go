@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// uploadStateDir holds, in the output directory, the state of the
+	// multipart uploads in progress, one file per object.
+	uploadStateDir = ".upload"
+
+	defaultPartSizeMB = 64
+	// S3 takes parts of 5 MB to 5 GB, at most 10,000 of them per object.
+	minPartSizeMB = 5
+	maxPartSizeMB = 5 << 10
+	maxParts      = 10000
+
+	// uploadAttempts is how many times a request is sent before the upload
+	// fails, uploadBackoff multiplied by the attempt number apart.
+	uploadAttempts = 5
+	uploadBackoff  = 2 * time.Second
+	// uploadTimeout bounds a single request, such as a part's upload.
+	uploadTimeout = 15 * time.Minute
+
+	// Credentials of the object store, as the AWS tools read them.
+	envAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	envSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	envSessionToken    = "AWS_SESSION_TOKEN"
+	envRegion          = "AWS_REGION"
+)
+
+// UploadConfig uploads the files of an export to a bucket of S3 or of a
+// store with its API, such as GCS through its XML API or MinIO, once they
+// are all written. Credentials come from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type UploadConfig struct {
+	// URL is where the files go, as s3://bucket/prefix.
+	URL string `yaml:"url" toml:"url"`
+	// Endpoint is the URL of the store, by default AWS S3 in the region.
+	// The bucket is then addressed in the path rather than the host name.
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Region signs the requests, AWS_REGION or us-east-1 by default.
+	Region string `yaml:"region" toml:"region"`
+	// PartSizeMB is the size of the parts of multipart uploads. Files up
+	// to this size are uploaded in one request.
+	PartSizeMB int `yaml:"part_size_mb" toml:"part_size_mb"`
+}
+
+// bucket returns the bucket and key prefix of the upload's URL.
+func (c UploadConfig) bucket() (bucket, prefix string, err error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid upload url %q, expected s3://bucket/prefix", c.URL)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+func (c UploadConfig) validate() error {
+	if _, _, err := c.bucket(); err != nil {
+		return err
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid upload endpoint %q, expected an http or https URL", c.Endpoint)
+		}
+	}
+	if c.PartSizeMB != 0 && (c.PartSizeMB < minPartSizeMB || c.PartSizeMB > maxPartSizeMB) {
+		return fmt.Errorf("invalid upload part_size_mb %d, expected %d to %d", c.PartSizeMB, minPartSizeMB, maxPartSizeMB)
+	}
+	return nil
+}
+
+// command returns the upload command that resumes the upload of dir.
+func (c UploadConfig) command(dir string) string {
+	args := []string{"upload"}
+	if c.Endpoint != "" {
+		args = append(args, "-endpoint", c.Endpoint)
+	}
+	if c.Region != "" {
+		args = append(args, "-region", c.Region)
+	}
+	if c.PartSizeMB != 0 {
+		args = append(args, "-part-size-mb", strconv.Itoa(c.PartSizeMB))
+	}
+	return strings.Join(append(args, dir, c.URL), " ")
+}
+
+// runUpload implements the `upload` command, which uploads an export
+// directory, or resumes its interrupted upload:
+//
+//	upload [flags] <dir> s3://bucket/prefix
+func runUpload(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	var cfg UploadConfig
+	fs.StringVar(&cfg.Endpoint, "endpoint", "", "URL of an S3-compatible store (default: AWS S3)")
+	fs.StringVar(&cfg.Region, "region", "", "region the requests are signed for (default: AWS_REGION or us-east-1)")
+	fs.IntVar(&cfg.PartSizeMB, "part-size-mb", defaultPartSizeMB, "size of the parts of multipart uploads")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatalf("usage: upload [flags] <dir> s3://bucket/prefix")
+	}
+	cfg.URL = fs.Arg(1)
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("invalid arguments: %v", err)
+	}
+	if err := uploadExport(interruptContext(), cfg, fs.Arg(0)); err != nil {
+		log.Fatalf("failed to upload %s: %v", fs.Arg(0), err)
+	}
+}
+
+// uploadExport uploads the files of an export directory under the prefix
+// of the upload's URL, keeping their relative paths. Hidden files, such as
+// the checkpoints and the upload's own state, stay behind, and metadata
+// files go last, so that readers who find the metadata find the files it
+// lists. Files above the part size are uploaded in parts whose progress is
+// saved in uploadStateDir, and an upload that fails resumes from its last
+// uploaded part when run again, as long as the file is unchanged.
+func uploadExport(ctx context.Context, cfg UploadConfig, dir string) error {
+	u, err := newUploader(cfg, dir)
+	if err != nil {
+		return err
+	}
+	files, err := uploadFiles(dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	start := time.Now()
+	for _, rel := range files {
+		n, err := u.uploadFile(ctx, rel)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", rel, err)
+		}
+		total += n
+	}
+	os.RemoveAll(filepath.Join(dir, uploadStateDir))
+	log.Printf("Uploaded %d files, %d MB, to %s in %s", len(files), total>>20, cfg.URL, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// uploadFiles lists the files of an export directory to upload, as slash
+// separated relative paths, with the metadata files last.
+func uploadFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	slices.SortStableFunc(files, func(a, b string) int { return metadataRank(a) - metadataRank(b) })
+	return files, err
+}
+
+// metadataRank orders the metadata files after the others, and the index
+// of split metadata after the tables' files it points at.
+func metadataRank(rel string) int {
+	switch {
+	case rel == metadataPath(metadataSingle) || rel == path.Join(metadataDir, "index.json"):
+		return 2
+	case strings.HasPrefix(rel, metadataDir+"/"):
+		return 1
+	}
+	return 0
+}
+
+// uploadState is the progress of a multipart upload, saved after every
+// part. The file's size and modification time tell whether it changed
+// since.
+type uploadState struct {
+	Key      string         `json:"key"`
+	UploadID string         `json:"upload_id"`
+	Size     int64          `json:"size"`
+	ModTime  time.Time      `json:"mod_time"`
+	PartSize int64          `json:"part_size"`
+	Parts    []uploadedPart `json:"parts"`
+}
+
+// uploadedPart is a part the store has acknowledged, with the MD5 digest
+// it was sent with.
+type uploadedPart struct {
+	Number int    `json:"number" xml:"PartNumber"`
+	ETag   string `json:"etag" xml:"ETag"`
+	MD5    string `json:"md5" xml:"-"`
+}
+
+// uploader uploads the files of a directory to a bucket.
+type uploader struct {
+	client   *s3Client
+	dir      string
+	prefix   string
+	partSize int64
+}
+
+func newUploader(cfg UploadConfig, dir string) (*uploader, error) {
+	bucket, prefix, err := cfg.bucket()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newS3Client(cfg, bucket)
+	if err != nil {
+		return nil, err
+	}
+	partSize := int64(cmp.Or(cfg.PartSizeMB, defaultPartSizeMB)) << 20
+	return &uploader{client: client, dir: dir, prefix: prefix, partSize: partSize}, nil
+}
+
+// uploadFile uploads a file of the directory and returns its size.
+func (u *uploader) uploadFile(ctx context.Context, rel string) (int64, error) {
+	p := filepath.Join(u.dir, filepath.FromSlash(rel))
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	key := path.Join(u.prefix, rel)
+	if info.Size() <= u.partSize {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return 0, err
+		}
+		sum := md5.Sum(b)
+		etag, err := u.client.putObject(ctx, key, b, sum)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkETag(etag, hex.EncodeToString(sum[:])); err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	return info.Size(), u.uploadParts(ctx, p, rel, key, info)
+}
+
+// uploadParts uploads a file in parts, resuming the upload of its state
+// file if the file is unchanged and the store still has the upload, and
+// checks the object the store assembled.
+func (u *uploader) uploadParts(ctx context.Context, p, rel, key string, info fs.FileInfo) error {
+	partSize := u.partSize
+	// Files above 10,000 parts take bigger ones.
+	for (info.Size()+partSize-1)/partSize > maxParts {
+		partSize *= 2
+	}
+	statePath := filepath.Join(u.dir, uploadStateDir, filepath.FromSlash(rel)+".json")
+	state, err := u.resume(ctx, statePath, key, info, partSize)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		id, err := u.client.createMultipartUpload(ctx, key)
+		if err != nil {
+			return err
+		}
+		state = &uploadState{Key: key, UploadID: id, Size: info.Size(), ModTime: info.ModTime(), PartSize: partSize}
+		if err := saveUploadState(statePath, state); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Resuming the upload of %s after %d of its parts", rel, len(state.Parts))
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	done := make(map[int]bool)
+	for _, part := range state.Parts {
+		done[part.Number] = true
+	}
+	parts := int((state.Size + partSize - 1) / partSize)
+	buf := make([]byte, partSize)
+	for n := 1; n <= parts; n++ {
+		if done[n] {
+			continue
+		}
+		b := buf[:min(partSize, state.Size-int64(n-1)*partSize)]
+		if _, err := f.ReadAt(b, int64(n-1)*partSize); err != nil {
+			return err
+		}
+		sum := md5.Sum(b)
+		etag, err := u.client.uploadPart(ctx, key, state.UploadID, n, b, sum)
+		if err != nil {
+			return fmt.Errorf("part %d of %d: %w", n, parts, err)
+		}
+		md5Hex := hex.EncodeToString(sum[:])
+		if err := checkETag(etag, md5Hex); err != nil {
+			return fmt.Errorf("part %d of %d: %w", n, parts, err)
+		}
+		state.Parts = append(state.Parts, uploadedPart{Number: n, ETag: etag, MD5: md5Hex})
+		if err := saveUploadState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	slices.SortFunc(state.Parts, func(a, b uploadedPart) int { return a.Number - b.Number })
+	etag, err := u.client.completeMultipartUpload(ctx, key, state.UploadID, state.Parts)
+	if err != nil {
+		return err
+	}
+	if err := checkETag(etag, multipartETag(state.Parts)); err != nil {
+		return err
+	}
+	size, err := u.client.objectSize(ctx, key)
+	if err != nil {
+		return err
+	}
+	if size != state.Size {
+		return fmt.Errorf("uploaded object %s has %d bytes, the file %d", key, size, state.Size)
+	}
+	return os.Remove(statePath)
+}
+
+// resume returns the saved state of a file's upload, with the parts the
+// store still has. It returns nil, aborting the saved upload, if the file
+// changed since, and nil if there is no saved upload or the store no
+// longer has it.
+func (u *uploader) resume(ctx context.Context, statePath, key string, info fs.FileInfo, partSize int64) (*uploadState, error) {
+	b, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", statePath, err)
+	}
+	if state.Key != key || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) || state.PartSize != partSize {
+		log.Printf("%s changed since its upload started, uploading it again", key)
+		if err := u.client.abortMultipartUpload(ctx, state.Key, state.UploadID); err != nil {
+			log.Printf("failed to abort the earlier upload of %s: %v", state.Key, err)
+		}
+		return nil, nil
+	}
+	stored, err := u.client.listParts(ctx, key, state.UploadID)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.Code == "NoSuchUpload" {
+		log.Printf("The store no longer has the upload of %s, uploading it again", key)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	kept := state.Parts[:0]
+	for _, part := range state.Parts {
+		if strings.Trim(stored[part.Number], `"`) == strings.Trim(part.ETag, `"`) {
+			kept = append(kept, part)
+		}
+	}
+	state.Parts = kept
+	return &state, nil
+}
+
+func saveUploadState(p string, state *uploadState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// checkETag compares the ETag the store returned with the one expected of
+// the MD5 digests sent. Stores that don't make ETags of MD5 digests, as S3
+// with KMS encryption, have checked the digests sent with the parts
+// instead.
+func checkETag(etag, want string) error {
+	etag = strings.Trim(etag, `"`)
+	digest, _, _ := strings.Cut(etag, "-")
+	if len(digest) != 2*md5.Size || strings.Trim(strings.ToLower(digest), "0123456789abcdef") != "" {
+		return nil
+	}
+	if !strings.EqualFold(etag, want) {
+		return fmt.Errorf("the store has ETag %s, expected %s: the data was corrupted in transit", etag, want)
+	}
+	return nil
+}
+
+// multipartETag returns the ETag S3 gives an object uploaded in parts: the
+// MD5 digest of the parts' digests, and their number.
+func multipartETag(parts []uploadedPart) string {
+	h := md5.New()
+	for _, part := range parts {
+		b, _ := hex.DecodeString(part.MD5)
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(parts))
+}
+
+// s3Client sends the requests of the S3 API an upload needs, signed with
+// Signature Version 4, retrying those that fail on the network or on the
+// store's side.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	http      *http.Client
+	// backoff is multiplied by the attempt number between retries.
+	backoff time.Duration
+}
+
+func newS3Client(cfg UploadConfig, bucket string) (*s3Client, error) {
+	c := &s3Client{
+		bucket:    bucket,
+		region:    cfg.Region,
+		accessKey: os.Getenv(envAccessKeyID),
+		secretKey: os.Getenv(envSecretAccessKey),
+		token:     os.Getenv(envSessionToken),
+		http:      &http.Client{Timeout: uploadTimeout},
+		backoff:   uploadBackoff,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("uploading needs %s and %s", envAccessKeyID, envSecretAccessKey)
+	}
+	if c.region == "" {
+		c.region = os.Getenv(envRegion)
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+	} else {
+		c.pathStyle = true
+	}
+	var err error
+	if c.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid upload endpoint %q: %w", endpoint, err)
+	}
+	return c, nil
+}
+
+// s3Error is an error response of the store.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// retryable reports whether a request that failed this way may succeed
+// when sent again.
+func (e *s3Error) retryable() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Code == "InternalError" || e.Code == "SlowDown" || e.Code == "RequestTimeout"
+}
+
+func (c *s3Client) putObject(ctx context.Context, key string, body []byte, sum [md5.Size]byte) (string, error) {
+	resp, _, err := c.do(ctx, http.MethodPut, key, nil, body, &sum)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *s3Client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	_, b, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(b, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("unexpected response to starting the upload of %s: %.200s", key, b)
+	}
+	return result.UploadID, nil
+}
+
+func (c *s3Client) uploadPart(ctx context.Context, key, uploadID string, n int, body []byte, sum [md5.Size]byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	resp, _, err := c.do(ctx, http.MethodPut, key, query, body, &sum)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// listParts returns the ETags of the parts of an upload by number.
+func (c *s3Client) listParts(ctx context.Context, key, uploadID string) (map[int]string, error) {
+	parts := make(map[int]string)
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {uploadID}, "part-number-marker": {strconv.Itoa(marker)}}
+		_, b, err := c.do(ctx, http.MethodGet, key, query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated          bool           `xml:"IsTruncated"`
+			NextPartNumberMarker int            `xml:"NextPartNumberMarker"`
+			Parts                []uploadedPart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return nil, fmt.Errorf("parsing the parts of %s: %w", key, err)
+		}
+		for _, part := range result.Parts {
+			parts[part.Number] = part.ETag
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// completeMultipartUpload assembles the object from its parts and returns
+// its ETag.
+func (c *s3Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []uploadedPart) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []uploadedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	_, b, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := xml.Unmarshal(b, &result); err != nil {
+		return "", fmt.Errorf("parsing the completed upload of %s: %w", key, err)
+	}
+	return result.ETag, nil
+}
+
+func (c *s3Client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, _, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
+
+func (c *s3Client) objectSize(ctx context.Context, key string) (int64, error) {
+	resp, _, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return resp.ContentLength, nil
+}
+
+// do sends a request for an object of the bucket, with the MD5 digest of
+// its body if given, and returns the response with its body read. Requests
+// are retried up to uploadAttempts times on network errors and on errors
+// of the store, including those S3 reports with a 200 status, as it may
+// when completing an upload.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, sum *[md5.Size]byte) (*http.Response, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		resp, b, err := c.send(ctx, method, key, query, body, sum)
+		var s3Err *s3Error
+		if err == nil || ctx.Err() != nil || attempt == uploadAttempts || errors.As(err, &s3Err) && !s3Err.retryable() {
+			return resp, b, err
+		}
+		log.Printf("%s %s failed (attempt %d of %d), retrying: %v", method, key, attempt, uploadAttempts, err)
+		if err := sleepContext(ctx, time.Duration(attempt)*c.backoff); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (c *s3Client) send(ctx context.Context, method, key string, query url.Values, body []byte, sum *[md5.Size]byte) (*http.Response, []byte, error) {
+	u := *c.endpoint
+	p := "/" + key
+	if c.pathStyle {
+		p = "/" + c.bucket + p
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + p
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if sum != nil {
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	payload := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(payload[:]), time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 300 || bytes.Contains(b[:min(len(b), 256)], []byte("<Error>")) {
+		s3Err := &s3Error{Status: resp.StatusCode}
+		if xml.Unmarshal(b, s3Err) != nil || s3Err.Code == "" {
+			s3Err.Code, s3Err.Message = http.StatusText(resp.StatusCode), strings.TrimSpace(string(b[:min(len(b), 200)]))
+		}
+		if resp.StatusCode < 300 {
+			// An error in the body of a 200 response.
+			s3Err.Status = http.StatusInternalServerError
+		}
+		return nil, nil, s3Err
+	}
+	return resp, b, nil
+}
+
+// sign adds the Signature Version 4 authorization of a request, signing
+// all of its headers and its payload's SHA-256 hash.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	signed := strings.Join(names, ";")
+
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+
+	scope := date[:8] + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date[:8], c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		c.accessKey, scope, signed, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string as Signature Version 4 signs it:
+// sorted by name, with every character but the unreserved ones escaped.
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, v := range query[name] {
+			pairs = append(pairs, awsEscape(name, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte of s but the unreserved characters
+// of RFC 3986, and slashes if keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~', b == '/' && keepSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TableUsage records the bytes moved while exporting a single table.
+type TableUsage struct {
+	Table               string `json:"table"`
+	Rows                int    `json:"rows"`
+	SourceBytes         int64  `json:"source_bytes"`
+	NetworkBytesRead    int64  `json:"network_bytes_read"`
+	NetworkBytesWritten int64  `json:"network_bytes_written"`
+	TempBytes           int64  `json:"temp_bytes"`
+	// RejectedRows are the rows -quarantine left out; Rows doesn't count
+	// them.
+	RejectedRows int `json:"rejected_rows,omitempty"`
+	// NullDroppedRows are the rows drop_row null policies left out; Rows
+	// doesn't count them.
+	NullDroppedRows int     `json:"null_dropped_rows,omitempty"`
+	ArtifactBytes   int64   `json:"artifact_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// RunReport summarizes an export run and is written as run_report.json.
+type RunReport struct {
+	ToolVersion string       `json:"tool_version"`
+	StartedAt   time.Time    `json:"started_at"`
+	FinishedAt  time.Time    `json:"finished_at"`
+	Tables      []TableUsage `json:"tables"`
+	Totals      TableUsage   `json:"totals"`
+	// Skipped lists the tables that failed every export attempt.
+	Skipped []SkippedTable `json:"skipped,omitempty"`
+	// Checks are the results of the configured checks.
+	Checks []CheckResult `json:"checks,omitempty"`
+	// Health is the verdict of the health gate, with health configured.
+	Health *HealthReport `json:"health,omitempty"`
+}
+
+// SkippedTable is a table left out of a run after failing to export.
+type SkippedTable struct {
+	Table    string `json:"table"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// netCounter counts the bytes exchanged with the database server over
+// every connection opened through countingDialer.
+var netCounter struct {
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+// countingDialer is a pq.Dialer whose connections update netCounter.
+type countingDialer struct {
+	net.Dialer
+}
+
+func (d countingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d countingDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	d.Timeout = timeout
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	netCounter.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	netCounter.written.Add(int64(n))
+	return n, err
+}
+
+// usageMeter measures a table export from start to finish.
+type usageMeter struct {
+	usage   TableUsage
+	start   time.Time
+	read    int64
+	written int64
+}
+
+func startUsageMeter(table string) *usageMeter {
+	return &usageMeter{
+		usage:   TableUsage{Table: table},
+		start:   time.Now(),
+		read:    netCounter.read.Load(),
+		written: netCounter.written.Load(),
+	}
+}
+
+// addRows counts a batch of rows read from the source.
+func (m *usageMeter) addRows(rows []TableRow) {
+	m.usage.Rows += len(rows)
+	for _, row := range rows {
+		for _, value := range row {
+			m.usage.SourceBytes += valueSize(value)
+		}
+	}
+}
+
+// finish completes the measurement once the table's artifact has been written.
+func (m *usageMeter) finish(artifactPath string) TableUsage {
+	m.usage.NetworkBytesRead = netCounter.read.Load() - m.read
+	m.usage.NetworkBytesWritten = netCounter.written.Load() - m.written
+	m.usage.DurationSeconds = time.Since(m.start).Seconds()
+	if info, err := os.Stat(artifactPath); err == nil {
+		m.usage.ArtifactBytes = info.Size()
+	}
+	return m.usage
+}
+
+// valueSize approximates the in-database size of a scanned value.
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case bool:
+		return 1
+	case time.Time:
+		return 8
+	default:
+		return 8
+	}
+}
+
+// add accumulates the usage of a table into the run totals.
+func (r *RunReport) add(u TableUsage) {
+	r.Tables = append(r.Tables, u)
+	r.Totals.Table = "*"
+	r.Totals.Rows += u.Rows
+	r.Totals.SourceBytes += u.SourceBytes
+	r.Totals.NetworkBytesRead += u.NetworkBytesRead
+	r.Totals.NetworkBytesWritten += u.NetworkBytesWritten
+	r.Totals.TempBytes += u.TempBytes
+	r.Totals.RejectedRows += u.RejectedRows
+	r.Totals.NullDroppedRows += u.NullDroppedRows
+	r.Totals.ArtifactBytes += u.ArtifactBytes
+	r.Totals.DurationSeconds += u.DurationSeconds
+}
+
+// saveRunReport writes run_report.json and a Prometheus textfile-collector
+// compatible metrics.prom to outDir.
+func saveRunReport(outDir string, report RunReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := saveFile(filepath.Join(outDir, "run_report.json"), b); err != nil {
+		return err
+	}
+
+	metrics := []struct {
+		name, help string
+		value      func(TableUsage) float64
+	}{
+		{"npz_export_rows", "Rows exported per table.", func(u TableUsage) float64 { return float64(u.Rows) }},
+		{"npz_export_source_bytes", "Approximate bytes read from the source per table.", func(u TableUsage) float64 { return float64(u.SourceBytes) }},
+		{"npz_export_network_read_bytes", "Bytes received from the database per table.", func(u TableUsage) float64 { return float64(u.NetworkBytesRead) }},
+		{"npz_export_network_written_bytes", "Bytes sent to the database per table.", func(u TableUsage) float64 { return float64(u.NetworkBytesWritten) }},
+		{"npz_export_rejected_rows", "Rows left out per table for values that failed to convert.", func(u TableUsage) float64 { return float64(u.RejectedRows) }},
+		{"npz_export_null_dropped_rows", "Rows left out per table for nulls their null policy drops.", func(u TableUsage) float64 { return float64(u.NullDroppedRows) }},
+		{"npz_export_temp_bytes", "Local temporary disk used per table.", func(u TableUsage) float64 { return float64(u.TempBytes) }},
+		{"npz_export_artifact_bytes", "Size of the written artifact per table.", func(u TableUsage) float64 { return float64(u.ArtifactBytes) }},
+		{"npz_export_duration_seconds", "Export duration per table.", func(u TableUsage) float64 { return u.DurationSeconds }},
+	}
+
+	tables := append([]TableUsage(nil), report.Tables...)
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Table < tables[j].Table })
+
+	var sb strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, u := range tables {
+			fmt.Fprintf(&sb, "%s{table=%q} %g\n", m.name, u.Table, m.value(u))
+		}
+	}
+	fmt.Fprintf(&sb, "# HELP npz_export_skipped_tables Tables skipped after failing every attempt.\n# TYPE npz_export_skipped_tables gauge\nnpz_export_skipped_tables %d\n", len(report.Skipped))
+	if report.Health != nil {
+		fmt.Fprintf(&sb, "# HELP npz_export_health_score Percentage of the health criteria the export passed.\n# TYPE npz_export_health_score gauge\nnpz_export_health_score %d\n", report.Health.Score)
+	}
+	return saveFile(filepath.Join(outDir, "metrics.prom"), []byte(sb.String()))
+}
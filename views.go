@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+)
+
+// ViewConfig is a helper view that queries and other views can select
+// from. It is created as a temporary view, so it lives only as long as the
+// run's database sessions and is never exported itself.
+type ViewConfig struct {
+	Name string `yaml:"name" toml:"name"`
+	SQL  string `yaml:"sql" toml:"sql"`
+}
+
+// createStatement returns the statement creating the view.
+func (v ViewConfig) createStatement() string {
+	return fmt.Sprintf("CREATE TEMP VIEW %s AS %s", quoteIdent(v.Name), v.SQL)
+}
+
+// viewConnector creates the configured views on every connection it opens,
+// since a temporary view only exists in the session that created it. Views
+// are created in order, so a view can select from the ones before it.
+type viewConnector struct {
+	driver.Connector
+	views []ViewConfig
+}
+
+func (c viewConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range c.views {
+		if err := execConn(ctx, conn, v.createStatement()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("creating view %s: %w", v.Name, err)
+		}
+	}
+	return conn, nil
+}
+
+// dsnConnector is the connector of drivers that only open connections
+// from a connection string.
+type dsnConnector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.drv.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+// execConn runs a statement without parameters on a driver connection.
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return fmt.Errorf("the database driver can't run statements")
+	}
+	_, err := execer.ExecContext(ctx, query, nil)
+	return err
+}